@@ -16,8 +16,11 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/client-go/informers"
 	"k8s.io/klog"
 
@@ -66,7 +69,7 @@ func run(o *Options) error {
 
 	ovsBridgeClient := ovsconfig.NewOVSBridge(o.config.OVSBridge, o.config.OVSDatapathType, ovsdbConnection)
 
-	ofClient := openflow.NewClient(o.config.OVSBridge)
+	ofClient := openflow.NewClient(o.config.OVSBridge, o.config.ConntrackZone)
 
 	// Create an ifaceStore that caches network interfaces managed by this node.
 	ifaceStore := interfacestore.NewInterfaceStore()
@@ -138,7 +141,27 @@ func run(o *Options) error {
 
 	go agentMonitor.Run(stopCh)
 
+	if o.config.MetricsBindAddress != "" {
+		prometheus.MustRegister(openflow.NewFlowCountCollector(ofClient))
+		go serveMetrics(o.config.MetricsBindAddress, stopCh)
+	}
+
 	<-stopCh
 	klog.Info("Stopping Antrea agent")
 	return nil
 }
+
+// serveMetrics serves the Prometheus metrics of the agent at the /metrics path of address until stopCh is closed.
+func serveMetrics(address string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+	klog.Infof("Serving metrics at %s", address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("Failed to serve metrics at %s: %v", address, err)
+	}
+}
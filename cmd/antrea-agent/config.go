@@ -64,4 +64,12 @@ type AgentConfig struct {
 	// Antrea Agent through an environment variable: ANTREA_IPSEC_PSK.
 	// Defaults to false.
 	EnableIPSecTunnel bool `yaml:"enableIPSecTunnel,omitempty"`
+	// The OVS conntrack zone Pod traffic is tracked in. Nodes running on the same host, e.g. isolated
+	// tenants with overlapping Pod CIDRs, must use distinct zones. Zone 0 is the host's default zone and
+	// can't be used.
+	// Defaults to 65520 (0xfff0).
+	ConntrackZone uint16 `yaml:"conntrackZone,omitempty"`
+	// The address at which antrea-agent serves Prometheus metrics under the /metrics path, e.g. ":10349".
+	// Metrics are not served if it's empty, which is the default.
+	MetricsBindAddress string `yaml:"metricsBindAddress,omitempty"`
 }
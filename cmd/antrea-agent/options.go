@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"net"
 
+	"github.com/vmware-tanzu/antrea/pkg/agent/openflow"
 	"github.com/vmware-tanzu/antrea/pkg/cni"
 	"github.com/vmware-tanzu/antrea/pkg/ovs/ovsconfig"
 
@@ -124,6 +125,9 @@ func (o *Options) setDefaults() {
 	if o.config.ServiceCIDR == "" {
 		o.config.ServiceCIDR = defaultServiceCIDR
 	}
+	if o.config.ConntrackZone == 0 {
+		o.config.ConntrackZone = openflow.DefaultCTZone
+	}
 	if o.config.DefaultMTU == 0 {
 		if o.config.TunnelType == ovsconfig.VXLANTunnel {
 			o.config.DefaultMTU = defaultMTUVXLAN
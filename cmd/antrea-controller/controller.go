@@ -17,8 +17,10 @@ package main
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	genericoptions "k8s.io/apiserver/pkg/server/options"
 	"k8s.io/client-go/informers"
@@ -26,6 +28,7 @@ import (
 
 	"github.com/vmware-tanzu/antrea/pkg/apiserver"
 	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram"
 	"github.com/vmware-tanzu/antrea/pkg/controller/networkpolicy"
 	"github.com/vmware-tanzu/antrea/pkg/controller/networkpolicy/store"
 	"github.com/vmware-tanzu/antrea/pkg/k8s"
@@ -52,10 +55,17 @@ func run(o *Options) error {
 	networkPolicyInformer := informerFactory.Networking().V1().NetworkPolicies()
 	nodeInformer := informerFactory.Core().V1().Nodes()
 
+	ram.SetWatcherTerminationLogLevel(klog.Level(o.watcherLogVerbosity))
+	if err := ram.SetWatchInitRateLimit(o.watchInitQPS, o.watchInitBurst); err != nil {
+		return fmt.Errorf("error setting watch initialization rate limit: %v", err)
+	}
 	// Create Antrea object storage.
 	addressGroupStore := store.NewAddressGroupStore()
 	appliedToGroupStore := store.NewAppliedToGroupStore()
 	networkPolicyStore := store.NewNetworkPolicyStore()
+	if err := ram.RegisterMetrics(prometheus.DefaultRegisterer, addressGroupStore, appliedToGroupStore, networkPolicyStore); err != nil {
+		return fmt.Errorf("error registering storage metrics: %v", err)
+	}
 
 	networkPolicyController := networkpolicy.NewNetworkPolicyController(client,
 		podInformer,
@@ -68,7 +78,8 @@ func run(o *Options) error {
 	apiServerConfig, err := createAPIServerConfig(o.config.ClientConnection.Kubeconfig,
 		addressGroupStore,
 		appliedToGroupStore,
-		networkPolicyStore)
+		networkPolicyStore,
+		o.enableWatchCompression)
 	if err != nil {
 		return fmt.Errorf("error creating API server config: %v", err)
 	}
@@ -99,7 +110,8 @@ func run(o *Options) error {
 func createAPIServerConfig(kubeconfig string,
 	addressGroupStore storage.Interface,
 	appliedToGroupStore storage.Interface,
-	networkPolicyStore storage.Interface) (*apiserver.Config, error) {
+	networkPolicyStore storage.Interface,
+	enableWatchCompression bool) (*apiserver.Config, error) {
 	// TODO:
 	// 1. Support user-provided certificate.
 	// 2. Support configurable https port.
@@ -130,6 +142,13 @@ func createAPIServerConfig(kubeconfig string,
 	if err := authorization.ApplyTo(&serverConfig.Authorization); err != nil {
 		return nil, err
 	}
+	serverConfig.BuildHandlerChainFunc = func(handler http.Handler, c *genericapiserver.Config) http.Handler {
+		handler = apiserver.WithEventVersion(handler)
+		if enableWatchCompression {
+			handler = apiserver.WithWatchCompression(handler)
+		}
+		return genericapiserver.DefaultBuildHandlerChain(handler, c)
+	}
 
 	return &apiserver.Config{
 		GenericConfig: serverConfig,
@@ -23,22 +23,41 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	defaultWatcherLogVerbosity = 4
+	defaultWatchInitBurst      = 100
+)
+
 type Options struct {
 	// The path of configuration file.
 	configFile string
 	// The configuration object
 	config *ControllerConfig
+	// The log verbosity at which the termination of each watcher of the Antrea API is logged.
+	watcherLogVerbosity int32
+	// Whether to compress the responses of watch requests for clients accepting it.
+	enableWatchCompression bool
+	// The number of watches that may list objects per second, 0 for no limit.
+	watchInitQPS float64
+	// The number of watches that may list objects at once.
+	watchInitBurst int
 }
 
 func newOptions() *Options {
 	return &Options{
-		config: new(ControllerConfig),
+		config:              new(ControllerConfig),
+		watcherLogVerbosity: defaultWatcherLogVerbosity,
+		watchInitBurst:      defaultWatchInitBurst,
 	}
 }
 
 // addFlags adds flags to fs and binds them to options.
 func (o *Options) addFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&o.configFile, "config", o.configFile, "The path to the configuration file")
+	fs.Int32Var(&o.watcherLogVerbosity, "watcher-log-verbosity", o.watcherLogVerbosity, "The log verbosity at which the termination of each watcher of the Antrea API is logged, a summary is logged every minute regardless of it")
+	fs.BoolVar(&o.enableWatchCompression, "enable-watch-compression", o.enableWatchCompression, "Compress the responses of watch requests of the Antrea API with gzip or deflate when accepted by the client, trading CPU for bandwidth")
+	fs.Float64Var(&o.watchInitQPS, "watch-init-qps", o.watchInitQPS, "The number of watches of the Antrea API that may list objects per second, the others wait for their turn, 0 for no limit")
+	fs.IntVar(&o.watchInitBurst, "watch-init-burst", o.watchInitBurst, "The number of watches of the Antrea API that may list objects at once when watch-init-qps is set")
 }
 
 // complete completes all the required options.
@@ -58,6 +77,15 @@ func (o *Options) validate(args []string) error {
 	if len(args) != 0 {
 		return errors.New("No arguments are supported")
 	}
+	if o.watcherLogVerbosity < 0 {
+		return errors.New("watcher-log-verbosity must not be negative")
+	}
+	if o.watchInitQPS < 0 {
+		return errors.New("watch-init-qps must not be negative")
+	}
+	if o.watchInitQPS > 0 && o.watchInitBurst <= 0 {
+		return errors.New("watch-init-burst must be positive")
+	}
 	return nil
 }
 
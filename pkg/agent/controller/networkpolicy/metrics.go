@@ -0,0 +1,37 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networkpolicy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// ruleRealizationLatency observes the duration from the time a rule became dirty, which happens as soon as the
+	// watch event changing it is received, to the time its flows are installed successfully.
+	ruleRealizationLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "antrea",
+			Subsystem: "agent",
+			Name:      "networkpolicy_realization_seconds",
+			Help:      "Duration from receiving the change of a NetworkPolicy rule to realizing it in OVS.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ruleRealizationLatency)
+}
@@ -15,6 +15,7 @@
 package networkpolicy
 
 import (
+	"sync"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -69,6 +70,11 @@ type Controller struct {
 	appliedToGroupWatcherConnected bool
 	// addressGroupWatcherConnected maintains the connection status between addressGroupWatcherConnected and Controller.
 	addressGroupWatcherConnected bool
+	// dirtyTimesLock protects dirtyTimes.
+	dirtyTimesLock sync.Mutex
+	// dirtyTimes maps the ID of a rule that hasn't been realized to the time it first became dirty, which is
+	// used to measure the realization latency of rules.
+	dirtyTimes map[string]time.Time
 }
 
 // NewNetworkPolicyController returns a new *Controller.
@@ -82,6 +88,7 @@ func NewNetworkPolicyController(antreaClient versioned.Interface,
 		nodeName:     nodeName,
 		queue:        workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(minRetryDelay, maxRetryDelay), "networkpolicyrule"),
 		reconciler:   newReconciler(ofClient, ifaceStore),
+		dirtyTimes:   map[string]time.Time{},
 	}
 	c.ruleCache = newRuleCache(c.enqueueRule, podUpdates)
 	c.networkPolicyWatcherConnected = true
@@ -125,9 +132,25 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 }
 
 func (c *Controller) enqueueRule(ruleID string) {
+	c.dirtyTimesLock.Lock()
+	// Keep the earliest time if the rule changes again before it's realized.
+	if _, exists := c.dirtyTimes[ruleID]; !exists {
+		c.dirtyTimes[ruleID] = time.Now()
+	}
+	c.dirtyTimesLock.Unlock()
 	c.queue.Add(ruleID)
 }
 
+// observeRealization observes the realization latency of the rule, if it has been dirty.
+func (c *Controller) observeRealization(ruleID string) {
+	c.dirtyTimesLock.Lock()
+	defer c.dirtyTimesLock.Unlock()
+	if dirtyTime, exists := c.dirtyTimes[ruleID]; exists {
+		ruleRealizationLatency.Observe(time.Since(dirtyTime).Seconds())
+		delete(c.dirtyTimes, ruleID)
+	}
+}
+
 // worker runs a worker thread that just dequeues items, processes them, and
 // marks them done. You may run as many of these in parallel as you wish; the
 // workqueue guarantees that they will not end up processing the same rule at
@@ -162,10 +185,12 @@ func (c *Controller) syncRule(key string) error {
 		if err := c.reconciler.Forget(key); err != nil {
 			return err
 		}
+		c.observeRealization(key)
 		return nil
 	}
 	// If the rule is not complete, we can simply skip it as it will be marked as dirty
-	// and queued again when we receive the missing group it missed.
+	// and queued again when we receive the missing group it missed. Its realization
+	// latency includes the time waiting for the missing group.
 	if !completed {
 		klog.V(2).Infof("Rule %v was not complete, skipping", key)
 		return nil
@@ -173,6 +198,7 @@ func (c *Controller) syncRule(key string) error {
 	if err := c.reconciler.Reconcile(rule); err != nil {
 		return err
 	}
+	c.observeRealization(key)
 	return nil
 }
 
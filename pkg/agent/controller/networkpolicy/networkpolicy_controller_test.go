@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -396,3 +397,31 @@ func TestAddNetworkPolicyWithMultipleRules(t *testing.T) {
 	assert.Equal(t, 2, controller.GetAddressGroupNum())
 	assert.Equal(t, 1, controller.GetAppliedToGroupNum())
 }
+
+func realizationSampleCount(t *testing.T) uint64 {
+	metric := &dto.Metric{}
+	if err := ruleRealizationLatency.Write(metric); err != nil {
+		t.Fatalf("Failed to read realization latency: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestRuleRealizationLatency(t *testing.T) {
+	controller, _, _ := newTestController()
+
+	controller.enqueueRule("rule1")
+	firstDirtyTime := controller.dirtyTimes["rule1"]
+	// A rule changed again before being realized keeps the time it first became dirty.
+	time.Sleep(time.Millisecond)
+	controller.enqueueRule("rule1")
+	assert.Equal(t, firstDirtyTime, controller.dirtyTimes["rule1"])
+
+	countBefore := realizationSampleCount(t)
+	controller.observeRealization("rule1")
+	assert.Equal(t, countBefore+1, realizationSampleCount(t))
+	assert.NotContains(t, controller.dirtyTimes, "rule1")
+
+	// A rule that hasn't become dirty since its last realization is not observed again.
+	controller.observeRealization("rule1")
+	assert.Equal(t, countBefore+1, realizationSampleCount(t))
+}
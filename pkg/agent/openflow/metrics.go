@@ -0,0 +1,62 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openflow
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	flowCountDesc = prometheus.NewDesc(
+		"antrea_agent_ovs_flow_count",
+		"Number of flows in each OVS flow table.",
+		[]string{"table"}, nil,
+	)
+	totalFlowCountDesc = prometheus.NewDesc(
+		"antrea_agent_ovs_total_flow_count",
+		"Number of flows in all OVS flow tables.",
+		nil, nil,
+	)
+)
+
+// flowCountCollector collects the number of flows in each flow table from the Client when metrics are scraped,
+// so that operators can tell how close the bridge gets to the limits of OVS, e.g. as NetworkPolicies grow.
+type flowCountCollector struct {
+	client Client
+}
+
+// NewFlowCountCollector creates a prometheus.Collector reporting the number of flows installed by the provided
+// Client, per table and in total. It must be registered by the caller.
+func NewFlowCountCollector(client Client) prometheus.Collector {
+	return &flowCountCollector{client: client}
+}
+
+// Describe implements prometheus.Collector.
+func (c *flowCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- flowCountDesc
+	ch <- totalFlowCountDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *flowCountCollector) Collect(ch chan<- prometheus.Metric) {
+	var total uint
+	for _, status := range c.client.GetFlowTableStatus() {
+		total += status.FlowCount
+		ch <- prometheus.MustNewConstMetric(flowCountDesc, prometheus.GaugeValue, float64(status.FlowCount), strconv.Itoa(int(status.ID)))
+	}
+	ch <- prometheus.MustNewConstMetric(totalFlowCountDesc, prometheus.GaugeValue, float64(total))
+}
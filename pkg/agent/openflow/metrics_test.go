@@ -0,0 +1,50 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	oftest "github.com/vmware-tanzu/antrea/pkg/agent/openflow/testing"
+	binding "github.com/vmware-tanzu/antrea/pkg/ovs/openflow"
+)
+
+func TestFlowCountCollector(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ofClient := oftest.NewMockClient(ctrl)
+	ofClient.EXPECT().GetFlowTableStatus().Return([]binding.TableStatus{
+		{ID: uint(classifierTable), FlowCount: 3},
+		{ID: uint(ingressRuleTable), FlowCount: 120},
+		{ID: uint(ingressDefaultTable), FlowCount: 0},
+	})
+
+	expected := `
+# HELP antrea_agent_ovs_flow_count Number of flows in each OVS flow table.
+# TYPE antrea_agent_ovs_flow_count gauge
+antrea_agent_ovs_flow_count{table="0"} 3
+antrea_agent_ovs_flow_count{table="90"} 120
+antrea_agent_ovs_flow_count{table="100"} 0
+# HELP antrea_agent_ovs_total_flow_count Number of flows in all OVS flow tables.
+# TYPE antrea_agent_ovs_total_flow_count gauge
+antrea_agent_ovs_total_flow_count 123
+`
+	assert.NoError(t, testutil.CollectAndCompare(NewFlowCountCollector(ofClient), strings.NewReader(expected)))
+}
@@ -82,7 +82,8 @@ const (
 	marksReg     regType = 0
 	portCacheReg regType = 1
 
-	ctZone = 0xfff0
+	// DefaultCTZone is the default conntrack zone of Pod traffic.
+	DefaultCTZone = 0xfff0
 
 	portFoundMark = 0x1
 	gatewayCTMark = 0x20
@@ -124,6 +125,8 @@ type client struct {
 	globalConjMatchFlowCache map[string]*conjMatchFlowContext
 	// replayMutex provides exclusive access to the OFSwitch to the ReplayFlows method.
 	replayMutex sync.RWMutex
+	// ctZone is the conntrack zone Pod traffic is tracked in.
+	ctZone uint16
 }
 
 func (c *client) Add(flow binding.Flow) error {
@@ -192,7 +195,7 @@ func (c *client) podClassifierFlow(podOFPort uint32, category cookie.Category) b
 }
 
 // connectionTrackFlows generates flows that redirect traffic to ct_zone and handle traffic according to ct_state:
-// 1) commit new connections to ct_zone(0xfff0) in the conntrackCommitTable.
+// 1) commit new connections to the configured ct_zone in the conntrackCommitTable.
 // 2) Add ct_mark on the packet if it is sent to the switch from the host gateway.
 // 3) Allow traffic if it hits ct_mark and is sent from the host gateway.
 // 4) Drop all invalid traffic.
@@ -203,7 +206,7 @@ func (c *client) connectionTrackFlows(category cookie.Category) (flows []binding
 	connectionTrackCommitTable := c.pipeline[conntrackCommitTable]
 	flows = []binding.Flow{
 		connectionTrackTable.BuildFlow(priorityNormal).MatchProtocol(binding.ProtocolIP).
-			Action().CT(false, connectionTrackTable.GetNext(), ctZone).CTDone().
+			Action().CT(false, connectionTrackTable.GetNext(), int(c.ctZone)).CTDone().
 			Cookie(c.cookieAllocator.Request(category).Raw()).
 			Done(),
 		connectionTrackStateTable.BuildFlow(priorityHigh).MatchProtocol(binding.ProtocolIP).
@@ -221,12 +224,12 @@ func (c *client) connectionTrackFlows(category cookie.Category) (flows []binding
 		connectionTrackCommitTable.BuildFlow(priorityNormal).MatchProtocol(binding.ProtocolIP).
 			MatchRegRange(int(marksReg), markTrafficFromGateway, binding.Range{0, 15}).
 			MatchCTStateNew(true).MatchCTStateTrk(true).
-			Action().CT(true, connectionTrackCommitTable.GetNext(), ctZone).LoadToMark(gatewayCTMark).CTDone().
+			Action().CT(true, connectionTrackCommitTable.GetNext(), int(c.ctZone)).LoadToMark(gatewayCTMark).CTDone().
 			Cookie(c.cookieAllocator.Request(category).Raw()).
 			Done(),
 		connectionTrackCommitTable.BuildFlow(priorityLow).MatchProtocol(binding.ProtocolIP).
 			MatchCTStateNew(true).MatchCTStateTrk(true).
-			Action().CT(true, connectionTrackCommitTable.GetNext(), ctZone).CTDone().
+			Action().CT(true, connectionTrackCommitTable.GetNext(), int(c.ctZone)).CTDone().
 			Cookie(c.cookieAllocator.Request(category).Raw()).
 			Done(),
 	}
@@ -515,7 +518,8 @@ func (c *client) localProbeFlow(localGatewayIP net.IP, category cookie.Category)
 }
 
 // NewClient is the constructor of the Client interface.
-func NewClient(bridgeName string) Client {
+// ctZone is the conntrack zone Pod traffic is tracked in.
+func NewClient(bridgeName string, ctZone uint16) Client {
 	bridge := binding.NewOFBridge(bridgeName)
 	c := &client{
 		bridge: bridge,
@@ -539,6 +543,7 @@ func NewClient(bridgeName string) Client {
 		podFlowCache:             newFlowCategoryCache(),
 		policyCache:              sync.Map{},
 		globalConjMatchFlowCache: map[string]*conjMatchFlowContext{},
+		ctZone:                   ctZone,
 	}
 	c.flowOperations = c
 	return c
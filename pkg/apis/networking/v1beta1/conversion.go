@@ -26,7 +26,7 @@ func init() {
 
 // addConversionFuncs adds non-generated conversion functions to the given scheme.
 func addConversionFuncs(scheme *runtime.Scheme) error {
-	for _, kind := range []string{"AppliedToGroup", "AddressGroup", "NetworkPolicy"} {
+	for _, kind := range []string{"AppliedToGroup", "AddressGroup"} {
 		err := scheme.AddFieldLabelConversionFunc(SchemeGroupVersion.WithKind(kind),
 			func(label, value string) (string, string, error) {
 				switch label {
@@ -42,5 +42,15 @@ func addConversionFuncs(scheme *runtime.Scheme) error {
 			return err
 		}
 	}
-	return nil
+	// NetworkPolicies are namespaced, they can be selected by namespace in addition.
+	return scheme.AddFieldLabelConversionFunc(SchemeGroupVersion.WithKind("NetworkPolicy"),
+		func(label, value string) (string, string, error) {
+			switch label {
+			case "metadata.name", "metadata.namespace", "nodeName":
+				return label, value, nil
+			default:
+				return "", "", fmt.Errorf("field label not supported: %s", label)
+			}
+		},
+	)
 }
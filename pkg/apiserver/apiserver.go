@@ -15,12 +15,17 @@
 package apiserver
 
 import (
+	"fmt"
+	"net/http"
+	"time"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apiserver/pkg/registry/rest"
 	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/client-go/informers"
 
 	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
@@ -31,6 +36,10 @@ import (
 	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
 )
 
+// maxDispatchLatency is the 99th percentile of the duration of dispatching an event to all watchers above which
+// the apiserver is considered unhealthy, which usually means some watchers are blocked and slowing the dispatching.
+const maxDispatchLatency = 500 * time.Millisecond
+
 var (
 	// Scheme defines methods for serializing and deserializing API objects.
 	Scheme = runtime.NewScheme()
@@ -94,5 +103,29 @@ func (c completedConfig) New() (*APIServer, error) {
 		return nil, err
 	}
 
+	stores := map[string]storage.Interface{
+		"addressgroups":   c.ExtraConfig.AddressGroupStore,
+		"appliedtogroups": c.ExtraConfig.AppliedToGroupStore,
+		"networkpolicies": c.ExtraConfig.NetworkPolicyStore,
+	}
+	if err := s.GenericAPIServer.AddHealthzChecks(dispatchLatencyCheck(stores, maxDispatchLatency)); err != nil {
+		return nil, err
+	}
+	s.GenericAPIServer.Handler.NonGoRestfulMux.HandleFunc(watchersPath, watchersHandler(stores))
+	s.GenericAPIServer.Handler.NonGoRestfulMux.HandleFunc(watchDiffPath, watchDiffHandler(stores))
+
 	return s, nil
 }
+
+// dispatchLatencyCheck returns a HealthzChecker which fails if the dispatch latency of any of the provided stores
+// exceeds maxLatency.
+func dispatchLatencyCheck(stores map[string]storage.Interface, maxLatency time.Duration) healthz.HealthzChecker {
+	return healthz.NamedCheck("watch-dispatch-latency", func(_ *http.Request) error {
+		for resource, store := range stores {
+			if latency := store.DispatchLatencyP99(); latency > maxLatency {
+				return fmt.Errorf("dispatch latency of %s is %v, exceeding %v", resource, latency, maxLatency)
+			}
+		}
+		return nil
+	})
+}
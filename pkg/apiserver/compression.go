@@ -0,0 +1,134 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/util/wsstream"
+	"k8s.io/klog"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// WithWatchCompression wraps the handler of API requests to compress the responses of watch requests with gzip or
+// deflate, if the client advertises either of them in its Accept-Encoding header. The generic apiserver never
+// compresses watches, while the full objects streamed to agents take significant bandwidth at scale. Each event is
+// flushed as soon as it's written, so compression doesn't delay it. It must be called with the innermost handler,
+// as it relies on the RequestInfo of the request.
+func WithWatchCompression(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := watchEncoding(req)
+		if encoding == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		var compressor compressor
+		if encoding == encodingGzip {
+			compressor = gzip.NewWriter(w)
+		} else {
+			compressor = zlib.NewWriter(w)
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Del("Content-Length")
+		cw := &compressedResponseWriter{ResponseWriter: w, compressor: compressor}
+		handler.ServeHTTP(cw, req)
+		if err := compressor.Close(); err != nil {
+			klog.V(2).Infof("Failed to close compressed watch stream: %v", err)
+		}
+	})
+}
+
+// watchEncoding returns the encoding the response of the request should be compressed with, the one of gzip and
+// deflate with the highest quality value in the Accept-Encoding header, in the order the client lists them if they
+// have the same quality, or an empty string if it's not a watch request or the client accepts neither of them.
+func watchEncoding(req *http.Request) string {
+	info, ok := request.RequestInfoFrom(req.Context())
+	if !ok || !info.IsResourceRequest || info.Verb != "watch" || wsstream.IsWebSocketRequest(req) {
+		return ""
+	}
+	var encoding string
+	var quality float64
+	for _, token := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, q := parseAcceptEncoding(token)
+		if (coding == encodingGzip || coding == encodingDeflate) && q > quality {
+			encoding, quality = coding, q
+		}
+	}
+	return encoding
+}
+
+// parseAcceptEncoding parses a token of the Accept-Encoding header, e.g. "gzip;q=0.5", into its content coding and
+// quality value. The quality value is 1 if it's not specified, and 0, meaning not acceptable, if it's invalid.
+func parseAcceptEncoding(token string) (string, float64) {
+	params := strings.Split(token, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+	quality := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") && !strings.HasPrefix(param, "Q=") {
+			continue
+		}
+		q, err := strconv.ParseFloat(param[2:], 64)
+		if err != nil || q < 0 || q > 1 {
+			return coding, 0
+		}
+		quality = q
+	}
+	return coding, quality
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressedResponseWriter compresses the data written to the underlying http.ResponseWriter. Unlike the
+// compression of the generic apiserver, Flush also flushes the underlying http.ResponseWriter, so that each watch
+// event reaches the client immediately.
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	compressor compressor
+}
+
+func (w *compressedResponseWriter) Write(p []byte) (int, error) {
+	return w.compressor.Write(p)
+}
+
+// Flush implements http.Flusher, which is required by the watch handler.
+func (w *compressedResponseWriter) Flush() {
+	if err := w.compressor.Flush(); err != nil {
+		klog.V(2).Infof("Failed to flush compressed watch stream: %v", err)
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier, which is required by the watch handler.
+func (w *compressedResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	restwatch "k8s.io/client-go/rest/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apis/networking/v1beta1"
+)
+
+func newAddressGroup(name string, ips int) *v1beta1.AddressGroup {
+	group := &v1beta1.AddressGroup{
+		TypeMeta:   metav1.TypeMeta{Kind: "AddressGroup", APIVersion: v1beta1.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: "1"},
+	}
+	for i := 0; i < ips; i++ {
+		group.IPAddresses = append(group.IPAddresses, v1beta1.IPAddress(net.IPv4(10, 0, byte(i/256), byte(i%256)).To4()))
+	}
+	return group
+}
+
+func protobufSerializer(t testing.TB) runtime.SerializerInfo {
+	info, ok := runtime.SerializerInfoForMediaType(Codecs.SupportedMediaTypes(), runtime.ContentTypeProtobuf)
+	if !ok || info.StreamSerializer == nil {
+		t.Fatalf("No protobuf stream serializer")
+	}
+	return info
+}
+
+// encodeWatchEvent encodes the event the way the watch handler of the generic apiserver does.
+func encodeWatchEvent(t testing.TB, info runtime.SerializerInfo, encoder streaming.Encoder, event watch.Event) {
+	embedded := Codecs.EncoderForVersion(info.Serializer, v1beta1.SchemeGroupVersion)
+	raw, err := runtime.Encode(embedded, event.Object)
+	if err != nil {
+		t.Fatalf("Failed to encode object: %v", err)
+	}
+	if err := encoder.Encode(&metav1.WatchEvent{Type: string(event.Type), Object: runtime.RawExtension{Raw: raw}}); err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+}
+
+// newWatchServer returns a server streaming the events to watch requests, flushing each of them and waiting for
+// next to receive before sending the following one.
+func newWatchServer(t *testing.T, info runtime.SerializerInfo, events []watch.Event, next <-chan struct{}) *httptest.Server {
+	handler := WithWatchCompression(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", info.MediaType)
+		w.WriteHeader(http.StatusOK)
+		encoder := streaming.NewEncoder(info.StreamSerializer.Framer.NewFrameWriter(w), info.StreamSerializer.Serializer)
+		for i, event := range events {
+			if i > 0 {
+				select {
+				case <-next:
+				case <-req.Context().Done():
+					return
+				}
+			}
+			encodeWatchEvent(t, info, encoder, event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		verb := "watch"
+		if req.URL.Query().Get("watch") == "" {
+			verb = "list"
+		}
+		ctx := request.WithRequestInfo(req.Context(), &request.RequestInfo{IsResourceRequest: true, Verb: verb})
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	}))
+}
+
+func decodeWithTimeout(decoder *restwatch.Decoder) (watch.EventType, runtime.Object, error) {
+	type result struct {
+		eventType watch.EventType
+		obj       runtime.Object
+		err       error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		eventType, obj, err := decoder.Decode()
+		resultCh <- result{eventType, obj, err}
+	}()
+	select {
+	case r := <-resultCh:
+		return r.eventType, r.obj, r.err
+	case <-time.After(wait.ForeverTestTimeout):
+		return "", nil, fmt.Errorf("timed out waiting for event")
+	}
+}
+
+func TestWithWatchCompression(t *testing.T) {
+	info := protobufSerializer(t)
+	events := []watch.Event{
+		{Type: watch.Added, Object: newAddressGroup("foo", 100)},
+		{Type: watch.Modified, Object: newAddressGroup("foo", 50)},
+		{Type: watch.Deleted, Object: newAddressGroup("foo", 0)},
+	}
+	tests := []struct {
+		name             string
+		query            string
+		acceptEncoding   string
+		expectedEncoding string
+	}{
+		{"gzip", "?watch=1", "gzip", "gzip"},
+		{"deflate", "?watch=1", "deflate", "deflate"},
+		{"first accepted encoding", "?watch=1", "deflate, gzip", "deflate"},
+		{"no accepted encoding", "?watch=1", "", ""},
+		{"identity", "?watch=1", "identity", ""},
+		{"refused encoding", "?watch=1", "gzip;q=0, deflate", "deflate"},
+		{"all refused", "?watch=1", "gzip;q=0, deflate; q=0", ""},
+		{"higher quality", "?watch=1", "gzip;q=0.5, deflate;q=0.8", "deflate"},
+		{"encoding within another token", "?watch=1", "x-gzip-custom", ""},
+		{"unsupported encoding", "?watch=1", "br", ""},
+		{"not a watch", "", "gzip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := make(chan struct{})
+			server := newWatchServer(t, info, events, next)
+			defer server.Close()
+
+			req, _ := http.NewRequest("GET", server.URL+tt.query, nil)
+			// Setting the header explicitly disables the transparent decompression of the transport.
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			defer resp.Body.Close()
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != tt.expectedEncoding {
+				t.Fatalf("Expected Content-Encoding %q, got %q", tt.expectedEncoding, encoding)
+			}
+
+			var body io.Reader = resp.Body
+			switch tt.expectedEncoding {
+			case "gzip":
+				body, err = gzip.NewReader(body)
+			case "deflate":
+				body, err = zlib.NewReader(body)
+			}
+			if err != nil {
+				t.Fatalf("Failed to create decompressor: %v", err)
+			}
+			frameReader := info.StreamSerializer.Framer.NewFrameReader(struct {
+				io.Reader
+				io.Closer
+			}{body, resp.Body})
+			decoder := restwatch.NewDecoder(streaming.NewDecoder(frameReader, info.StreamSerializer.Serializer), Codecs.UniversalDeserializer())
+			for i, expected := range events {
+				if i > 0 {
+					// The server doesn't send the next event until the previous one is received, which
+					// requires each event to be flushed through the compressor.
+					next <- struct{}{}
+				}
+				eventType, obj, err := decodeWithTimeout(decoder)
+				if err != nil {
+					t.Fatalf("Failed to decode event %d: %v", i, err)
+				}
+				if eventType != expected.Type || !apiequality.Semantic.DeepEqual(obj, expected.Object) {
+					t.Errorf("Expected event %d to be %v %v, got %v %v", i, expected.Type, expected.Object, eventType, obj)
+				}
+			}
+		})
+	}
+}
+
+func TestWithWatchCompressionDefaultTransport(t *testing.T) {
+	info := protobufSerializer(t)
+	events := []watch.Event{{Type: watch.Added, Object: newAddressGroup("foo", 10)}}
+	server := newWatchServer(t, info, events, nil)
+	defer server.Close()
+
+	// The transport requests gzip and decompresses the response transparently.
+	resp, err := http.Get(server.URL + "?watch=1")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	if !resp.Uncompressed {
+		t.Errorf("Expected the response to be compressed")
+	}
+	frameReader := info.StreamSerializer.Framer.NewFrameReader(resp.Body)
+	decoder := restwatch.NewDecoder(streaming.NewDecoder(frameReader, info.StreamSerializer.Serializer), Codecs.UniversalDeserializer())
+	eventType, obj, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if eventType != events[0].Type || !apiequality.Semantic.DeepEqual(obj, events[0].Object) {
+		t.Errorf("Expected event to be %v %v, got %v %v", events[0].Type, events[0].Object, eventType, obj)
+	}
+}
+
+func BenchmarkWatchCompression(b *testing.B) {
+	info, _ := runtime.SerializerInfoForMediaType(Codecs.SupportedMediaTypes(), runtime.ContentTypeProtobuf)
+	for _, ips := range []int{10, 100, 1000} {
+		// Distinct events with random Pod IPs, as identical events would be compressed unrealistically well.
+		events := make([]watch.Event, 100)
+		for i := range events {
+			group := newAddressGroup(fmt.Sprintf("group-%d", i), 0)
+			for j := 0; j < ips; j++ {
+				group.IPAddresses = append(group.IPAddresses, v1beta1.IPAddress(net.IPv4(10, 10, byte(rand.Intn(256)), byte(rand.Intn(256))).To4()))
+			}
+			events[i] = watch.Event{Type: watch.Modified, Object: group}
+		}
+		for _, encoding := range []string{"identity", "gzip", "deflate"} {
+			b.Run(fmt.Sprintf("%s-%d", encoding, ips), func(b *testing.B) {
+				var buf bytes.Buffer
+				var w io.Writer = &buf
+				var c compressor
+				switch encoding {
+				case "gzip":
+					c = gzip.NewWriter(&buf)
+					w = c
+				case "deflate":
+					c = zlib.NewWriter(&buf)
+					w = c
+				}
+				encoder := streaming.NewEncoder(info.StreamSerializer.Framer.NewFrameWriter(w), info.StreamSerializer.Serializer)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					encodeWatchEvent(b, info, encoder, events[i%len(events)])
+					if c != nil {
+						c.Flush()
+					}
+				}
+				b.ReportMetric(float64(buf.Len())/float64(b.N), "bytes/event")
+			})
+		}
+	}
+}
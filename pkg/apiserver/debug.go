@@ -0,0 +1,200 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+const (
+	// watchersPath is the path of the debug endpoint listing the active watchers.
+	watchersPath = "/debug/watchers"
+	// watchDiffPath is the path of the debug endpoint showing the objects changed between two resourceVersions.
+	watchDiffPath = "/debug/watch-diff"
+	// watchDiffTimeout is the maximum duration of replaying the events of a watch-diff request.
+	watchDiffTimeout = 30 * time.Second
+)
+
+// watchersHandler returns a http.HandlerFunc which responds with the active watchers of the provided stores
+// in JSON, sorted by resource name.
+func watchersHandler(stores map[string]storage.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resources := make([]string, 0, len(stores))
+		for resource := range stores {
+			resources = append(resources, resource)
+		}
+		sort.Strings(resources)
+		watchers := []storage.WatcherInfo{}
+		for _, resource := range resources {
+			watchers = append(watchers, stores[resource].ListWatchers()...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(watchers); err != nil {
+			klog.Errorf("Failed to encode watchers: %v", err)
+		}
+	}
+}
+
+// watchDiff is the response of the watch-diff debug endpoint.
+type watchDiff struct {
+	Resource string            `json:"resource"`
+	From     uint64            `json:"from"`
+	To       uint64            `json:"to"`
+	Objects  []watchDiffObject `json:"objects"`
+}
+
+// watchDiffObject is an object changed between the two resourceVersions of a watchDiff.
+type watchDiffObject struct {
+	Name string `json:"name"`
+	// Change is the net change of the object: ADDED if it didn't exist at the first resourceVersion, DELETED if
+	// it doesn't exist at the second one, MODIFIED otherwise.
+	Change watch.EventType `json:"change"`
+	// Events is the number of events of the object between the two resourceVersions.
+	Events int `json:"events"`
+	// Object is the object of the last event, which may be a patch.
+	Object runtime.Object `json:"object"`
+}
+
+// watchDiffHandler returns a http.HandlerFunc which responds with the objects of a store changed between two
+// resourceVersions in JSON, sorted by name. The resource and the resourceVersions are given by the resource, from
+// and to query parameters. The events are replayed from the store's history, which must still retain the ones
+// following from, and to must not be newer than the store's current resourceVersion.
+func watchDiffHandler(stores map[string]storage.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		resource := query.Get("resource")
+		store, ok := stores[resource]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown resource %q", resource), http.StatusNotFound)
+			return
+		}
+		from, err := strconv.ParseUint(query.Get("from"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from resourceVersion %q: %v", query.Get("from"), err), http.StatusBadRequest)
+			return
+		}
+		to, err := strconv.ParseUint(query.Get("to"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to resourceVersion %q: %v", query.Get("to"), err), http.StatusBadRequest)
+			return
+		}
+		if _, current := store.ResourceVersionRange(); from >= to || to > current {
+			http.Error(w, fmt.Sprintf("resourceVersions must satisfy from < to <= %d", current), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), watchDiffTimeout)
+		defer cancel()
+		objects, err := diffWatch(ctx, store, from, to)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if status, ok := err.(errors.APIStatus); ok {
+				code = int(status.Status().Code)
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		diff := watchDiff{Resource: resource, From: from, To: to, Objects: objects}
+		if err := json.NewEncoder(w).Encode(diff); err != nil {
+			klog.Errorf("Failed to encode watch diff: %v", err)
+		}
+	}
+}
+
+// diffWatch replays the events of the store after from up to to, and returns the net change of each object
+// sorted by name. Objects created and deleted in the meantime are omitted.
+func diffWatch(ctx context.Context, store storage.Interface, from, to uint64) ([]watchDiffObject, error) {
+	selectors := &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), ResourceVersionCeiling: to}
+	watcher, err := store.Watch(ctx, strconv.FormatUint(from, 10), selectors)
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+	changes := map[string]*watchDiffObject{}
+	for {
+		var event watch.Event
+		select {
+		case <-ctx.Done():
+			return nil, errors.NewTimeoutError(fmt.Sprintf("replaying events up to resourceVersion %d: %v", to, ctx.Err()), 0)
+		case e, ok := <-watcher.ResultChan():
+			if !ok {
+				return sortWatchDiffObjects(changes), nil
+			}
+			event = e
+		}
+		switch event.Type {
+		case watch.Error:
+			if status, ok := event.Object.(*metav1.Status); ok {
+				return nil, errors.FromObject(status)
+			}
+			return nil, fmt.Errorf("unexpected error event: %v", event.Object)
+		case watch.Bookmark:
+			continue
+		}
+		accessor, err := meta.Accessor(event.Object)
+		if err != nil {
+			return nil, err
+		}
+		name := accessor.GetName()
+		if namespace := accessor.GetNamespace(); namespace != "" {
+			name = namespace + "/" + name
+		}
+		change, ok := changes[name]
+		if !ok {
+			changes[name] = &watchDiffObject{Name: name, Change: event.Type, Events: 1, Object: event.Object}
+			continue
+		}
+		change.Events++
+		change.Object = event.Object
+		switch {
+		case change.Change == watch.Added && event.Type == watch.Deleted:
+			// The object didn't exist at either resourceVersion.
+			delete(changes, name)
+		case change.Change == watch.Added:
+		case change.Change == watch.Deleted && event.Type == watch.Added:
+			change.Change = watch.Modified
+		default:
+			change.Change = event.Type
+		}
+	}
+}
+
+func sortWatchDiffObjects(changes map[string]*watchDiffObject) []watchDiffObject {
+	objects := make([]watchDiffObject, 0, len(changes))
+	for _, change := range changes {
+		objects = append(objects, *change)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+	"github.com/vmware-tanzu/antrea/pkg/controller/networkpolicy/store"
+	"github.com/vmware-tanzu/antrea/pkg/controller/types"
+)
+
+func TestWatchDiffHandler(t *testing.T) {
+	addressGroupStore := store.NewAddressGroupStore()
+	group := func(name string, addresses ...string) *types.AddressGroup {
+		return &types.AddressGroup{Name: name, Addresses: sets.NewString(addresses...)}
+	}
+	// Seed the store so that the resourceVersion of each change is its position in the list.
+	require.NoError(t, addressGroupStore.Create(group("a", "1.1.1.1")))
+	require.NoError(t, addressGroupStore.Create(group("b", "2.2.2.2")))
+	require.NoError(t, addressGroupStore.Create(group("c", "3.3.3.3")))
+	require.NoError(t, addressGroupStore.Update(group("a", "1.1.1.1", "4.4.4.4")))
+	require.NoError(t, addressGroupStore.Delete("c"))
+	require.NoError(t, addressGroupStore.Delete("b"))
+	require.NoError(t, addressGroupStore.Create(group("d", "5.5.5.5")))
+	handler := watchDiffHandler(map[string]storage.Interface{"addressgroups": addressGroupStore})
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedCode    int
+		expectedChanges map[string]watch.EventType
+	}{
+		{
+			name:            "created and deleted object omitted",
+			query:           "resource=addressgroups&from=1&to=5",
+			expectedCode:    http.StatusOK,
+			expectedChanges: map[string]watch.EventType{"a": watch.Modified, "b": watch.Added},
+		},
+		{
+			name:            "up to current resourceVersion",
+			query:           "resource=addressgroups&from=3&to=7",
+			expectedCode:    http.StatusOK,
+			expectedChanges: map[string]watch.EventType{"a": watch.Modified, "b": watch.Deleted, "c": watch.Deleted, "d": watch.Added},
+		},
+		{
+			name:         "unknown resource",
+			query:        "resource=pods&from=1&to=5",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "invalid resourceVersion",
+			query:        "resource=addressgroups&from=x&to=5",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "reversed resourceVersions",
+			query:        "resource=addressgroups&from=5&to=1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "future resourceVersion",
+			query:        "resource=addressgroups&from=1&to=8",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(http.MethodGet, watchDiffPath+"?"+tt.query, nil))
+			require.Equal(t, tt.expectedCode, recorder.Code, recorder.Body.String())
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			var diff struct {
+				Objects []struct {
+					Name   string
+					Change watch.EventType
+				}
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &diff))
+			changes := map[string]watch.EventType{}
+			var names []string
+			for _, object := range diff.Objects {
+				changes[object.Name] = object.Change
+				names = append(names, object.Name)
+			}
+			assert.Equal(t, tt.expectedChanges, changes)
+			assert.Equal(t, sets.NewString(names...).List(), names, "Objects should be sorted by name without duplicates")
+		})
+	}
+}
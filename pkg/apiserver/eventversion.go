@@ -0,0 +1,43 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver
+
+import (
+	"net/http"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/registry/networkpolicy"
+)
+
+// WithEventVersion wraps the handler of API requests to record the event version a client announces in
+// networkpolicy.EventVersionHeader or networkpolicy.EventVersionParam in the context of its request, so that its
+// watches only receive events in formats it can interpret. Requests announcing an invalid version are rejected.
+func WithEventVersion(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		value := req.Header.Get(networkpolicy.EventVersionHeader)
+		if value == "" {
+			value = req.URL.Query().Get(networkpolicy.EventVersionParam)
+		}
+		if value == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		version, err := networkpolicy.ParseEventVersion(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, req.WithContext(networkpolicy.WithEventVersion(req.Context(), version)))
+	})
+}
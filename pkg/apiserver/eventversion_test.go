@@ -0,0 +1,84 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/registry/networkpolicy"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func TestWithEventVersion(t *testing.T) {
+	tests := []struct {
+		name            string
+		url             string
+		header          string
+		expectedCode    int
+		expectedVersion storage.EventVersion
+	}{
+		{
+			name:         "not announced",
+			url:          "/apis/networking.antrea.tanzu.vmware.com/v1beta1/appliedtogroups?watch=true",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:            "header",
+			url:             "/apis/networking.antrea.tanzu.vmware.com/v1beta1/appliedtogroups?watch=true",
+			header:          "1",
+			expectedCode:    http.StatusOK,
+			expectedVersion: storage.EventVersionFull,
+		},
+		{
+			name:            "query parameter",
+			url:             "/apis/networking.antrea.tanzu.vmware.com/v1beta1/appliedtogroups?watch=true&eventVersion=1",
+			expectedCode:    http.StatusOK,
+			expectedVersion: storage.EventVersionFull,
+		},
+		{
+			name:            "header over query parameter",
+			url:             "/apis/networking.antrea.tanzu.vmware.com/v1beta1/appliedtogroups?watch=true&eventVersion=1",
+			header:          "2",
+			expectedCode:    http.StatusOK,
+			expectedVersion: storage.EventVersionDelta,
+		},
+		{
+			name:         "invalid",
+			url:          "/apis/networking.antrea.tanzu.vmware.com/v1beta1/appliedtogroups?watch=true",
+			header:       "delta",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var version storage.EventVersion
+			handler := WithEventVersion(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				version, _ = networkpolicy.EventVersionFrom(req.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.header != "" {
+				req.Header.Set(networkpolicy.EventVersionHeader, tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			assert.Equal(t, tt.expectedCode, recorder.Code)
+			assert.Equal(t, tt.expectedVersion, version)
+		})
+	}
+}
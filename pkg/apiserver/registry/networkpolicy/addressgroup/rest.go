@@ -71,12 +71,17 @@ func (r *REST) Get(ctx context.Context, name string, options *v1.GetOptions) (ru
 }
 
 func (r *REST) List(ctx context.Context, options *internalversion.ListOptions) (runtime.Object, error) {
-	addressGroups := r.addressGroupStore.List()
+	limit, continueToken := networkpolicy.GetPagination(options)
+	addressGroups, continueToken, err := r.addressGroupStore.ListPage(limit, continueToken)
+	if err != nil {
+		return nil, err
+	}
 	list := new(networking.AddressGroupList)
 	list.Items = make([]networking.AddressGroup, len(addressGroups))
 	for i := range addressGroups {
 		store.ToAddressGroupMsg(addressGroups[i].(*types.AddressGroup), &list.Items[i], true)
 	}
+	list.Continue = continueToken
 	return list, nil
 }
 
@@ -85,6 +90,6 @@ func (r *REST) NamespaceScoped() bool {
 }
 
 func (r *REST) Watch(ctx context.Context, options *internalversion.ListOptions) (watch.Interface, error) {
-	key, label, field := networkpolicy.GetSelectors(options)
-	return r.addressGroupStore.Watch(ctx, key, label, field)
+	selectors := networkpolicy.GetSelectors(ctx, options)
+	return networkpolicy.Watch(ctx, r.addressGroupStore, options, selectors)
 }
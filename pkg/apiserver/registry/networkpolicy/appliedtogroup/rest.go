@@ -71,12 +71,17 @@ func (r *REST) Get(ctx context.Context, name string, options *v1.GetOptions) (ru
 }
 
 func (r *REST) List(ctx context.Context, options *internalversion.ListOptions) (runtime.Object, error) {
-	appliedToGroups := r.appliedToGroupStore.List()
+	limit, continueToken := networkpolicy.GetPagination(options)
+	appliedToGroups, continueToken, err := r.appliedToGroupStore.ListPage(limit, continueToken)
+	if err != nil {
+		return nil, err
+	}
 	list := new(networking.AppliedToGroupList)
 	list.Items = make([]networking.AppliedToGroup, len(appliedToGroups))
 	for i := range appliedToGroups {
 		store.ToAppliedToGroupMsg(appliedToGroups[i].(*types.AppliedToGroup), &list.Items[i], true, nil)
 	}
+	list.Continue = continueToken
 	return list, nil
 }
 
@@ -85,6 +90,6 @@ func (r *REST) NamespaceScoped() bool {
 }
 
 func (r *REST) Watch(ctx context.Context, options *internalversion.ListOptions) (watch.Interface, error) {
-	key, label, field := networkpolicy.GetSelectors(options)
-	return r.appliedToGroupStore.Watch(ctx, key, label, field)
+	selectors := networkpolicy.GetSelectors(ctx, options)
+	return networkpolicy.Watch(ctx, r.appliedToGroupStore, options, selectors)
 }
@@ -78,12 +78,17 @@ func (r *REST) Get(ctx context.Context, name string, options *v1.GetOptions) (ru
 }
 
 func (r *REST) List(ctx context.Context, options *internalversion.ListOptions) (runtime.Object, error) {
-	networkPolicies := r.networkPolicyStore.List()
+	limit, continueToken := networkpolicy.GetPagination(options)
+	networkPolicies, continueToken, err := r.networkPolicyStore.ListPage(limit, continueToken)
+	if err != nil {
+		return nil, err
+	}
 	list := new(networking.NetworkPolicyList)
 	list.Items = make([]networking.NetworkPolicy, len(networkPolicies))
 	for i := range networkPolicies {
 		store.ToNetworkPolicyMsg(networkPolicies[i].(*types.NetworkPolicy), &list.Items[i], true)
 	}
+	list.Continue = continueToken
 	return list, nil
 }
 
@@ -92,13 +97,13 @@ func (r *REST) NamespaceScoped() bool {
 }
 
 func (r *REST) Watch(ctx context.Context, options *internalversion.ListOptions) (watch.Interface, error) {
-	key, label, field := networkpolicy.GetSelectors(options)
-	if len(key) > 0 {
+	selectors := networkpolicy.GetSelectors(ctx, options)
+	if len(selectors.Key) > 0 {
 		ns, ok := request.NamespaceFrom(ctx)
 		if !ok || len(ns) == 0 {
 			return nil, errors.NewBadRequest("Namespace parameter required.")
 		}
-		key = k8s.NamespacedName(ns, key)
+		selectors.Key = k8s.NamespacedName(ns, selectors.Key)
 	}
-	return r.networkPolicyStore.Watch(ctx, key, label, field)
+	return networkpolicy.Watch(ctx, r.networkPolicyStore, options, selectors)
 }
@@ -15,13 +15,55 @@
 package networkpolicy
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
 	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+const (
+	// EventVersionHeader is the header with which watch clients announce the newest format of events they can
+	// interpret, e.g. "1" for clients that expect every Modified event to carry the whole object.
+	EventVersionHeader = "X-Antrea-Event-Version"
+	// EventVersionParam is the query parameter equivalent to EventVersionHeader, for clients that can't set headers.
+	// The header takes precedence if both are set.
+	EventVersionParam = "eventVersion"
 )
 
-// GetSelectors extracts label selector, field selector, and key selector from the provided options.
-func GetSelectors(options *internalversion.ListOptions) (string, labels.Selector, fields.Selector) {
+type eventVersionKey struct{}
+
+// WithEventVersion returns a copy of ctx carrying the event version negotiated with the client of the request.
+func WithEventVersion(ctx context.Context, version storage.EventVersion) context.Context {
+	return context.WithValue(ctx, eventVersionKey{}, version)
+}
+
+// EventVersionFrom returns the event version negotiated with the client of the request, if any.
+func EventVersionFrom(ctx context.Context) (storage.EventVersion, bool) {
+	version, ok := ctx.Value(eventVersionKey{}).(storage.EventVersion)
+	return version, ok
+}
+
+// ParseEventVersion parses the event version announced by a client in EventVersionHeader or EventVersionParam.
+func ParseEventVersion(value string) (storage.EventVersion, error) {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < int(storage.EventVersionFull) {
+		return 0, fmt.Errorf("invalid event version %q", value)
+	}
+	return storage.EventVersion(version), nil
+}
+
+// GetSelectors extracts label selector, field selector, key selector, and whether bookmarks are allowed
+// from the provided options, and the event version negotiated with the client from ctx. If the client didn't
+// announce one, the latest event version is negotiated, as existing clients of the API expect Modified events of
+// groups to carry patches.
+func GetSelectors(ctx context.Context, options *internalversion.ListOptions) *storage.Selectors {
 	label := labels.Everything()
 	if options != nil && options.LabelSelector != nil {
 		label = options.LabelSelector
@@ -31,5 +73,67 @@ func GetSelectors(options *internalversion.ListOptions) (string, labels.Selector
 		field = options.FieldSelector
 	}
 	key, _ := field.RequiresExactMatch("metadata.name")
-	return key, label, field
+	eventVersion, ok := EventVersionFrom(ctx)
+	if !ok {
+		eventVersion = storage.LatestEventVersion
+	}
+	return &storage.Selectors{
+		Key:                 key,
+		Label:               label,
+		Field:               field,
+		AllowWatchBookmarks: options != nil && options.AllowWatchBookmarks,
+		EventVersion:        eventVersion,
+	}
+}
+
+// GetResourceVersion extracts the resourceVersion from the provided options.
+func GetResourceVersion(options *internalversion.ListOptions) string {
+	if options == nil {
+		return ""
+	}
+	return options.ResourceVersion
+}
+
+// Watch starts watching the store with the provided selectors from the resourceVersion in the provided options.
+// If TimeoutSeconds is set in the options, the watch ends normally once it elapses, without an Error event, so
+// that clients reconnect and their connections can be rebalanced.
+func Watch(ctx context.Context, store storage.Interface, options *internalversion.ListOptions, selectors *storage.Selectors) (watch.Interface, error) {
+	if options == nil || options.TimeoutSeconds == nil || *options.TimeoutSeconds <= 0 {
+		return store.Watch(ctx, GetResourceVersion(options), selectors)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*options.TimeoutSeconds)*time.Second)
+	w, err := store.Watch(ctx, GetResourceVersion(options), selectors)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelOnStopWatcher{Interface: w, cancel: cancel}, nil
+}
+
+// cancelOnStopWatcher cancels the context of the watch once it's stopped, releasing the resources of the context
+// before its deadline.
+type cancelOnStopWatcher struct {
+	watch.Interface
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnStopWatcher) Stop() {
+	w.Interface.Stop()
+	w.cancel()
+}
+
+// Err implements storage.ErrWatcher if the wrapped watcher does.
+func (w *cancelOnStopWatcher) Err() error {
+	if errWatcher, ok := w.Interface.(storage.ErrWatcher); ok {
+		return errWatcher.Err()
+	}
+	return nil
+}
+
+// GetPagination extracts the limit and the continue token of a paginated list from the provided options.
+func GetPagination(options *internalversion.ListOptions) (int64, string) {
+	if options == nil {
+		return 0, ""
+	}
+	return options.Limit, options.Continue
 }
@@ -0,0 +1,163 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networkpolicy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram/ramtest"
+	"github.com/vmware-tanzu/antrea/pkg/controller/networkpolicy/store"
+	"github.com/vmware-tanzu/antrea/pkg/controller/types"
+)
+
+func TestWatchTimeout(t *testing.T) {
+	store := ramtest.NewFakeStore("Pod", func() runtime.Object { return new(v1.Pod) })
+	timeoutSeconds := int64(1)
+	options := &internalversion.ListOptions{TimeoutSeconds: &timeoutSeconds}
+	start := time.Now()
+	w, err := Watch(context.Background(), store, options, GetSelectors(context.Background(), options))
+	require.NoError(t, err)
+	defer w.Stop()
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}
+	require.NoError(t, store.Create(pod))
+	assert.Equal(t, watch.Event{Type: watch.Added, Object: pod}, <-w.ResultChan())
+
+	// The watch ends at the deadline without an Error event.
+	select {
+	case event, ok := <-w.ResultChan():
+		assert.False(t, ok, "Unexpected event %v", event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch didn't end at the deadline")
+	}
+	assert.True(t, time.Since(start) >= time.Second, "Watch ended before the deadline")
+	assert.Equal(t, context.DeadlineExceeded, w.(storage.ErrWatcher).Err())
+}
+
+func TestWatchWithoutTimeout(t *testing.T) {
+	store := ramtest.NewFakeStore("Pod", func() runtime.Object { return new(v1.Pod) })
+	w, err := Watch(context.Background(), store, nil, GetSelectors(context.Background(), nil))
+	require.NoError(t, err)
+
+	select {
+	case event, ok := <-w.ResultChan():
+		t.Fatalf("Unexpected event %v, channel open: %t", event, ok)
+	case <-time.After(100 * time.Millisecond):
+	}
+	w.Stop()
+	_, ok := <-w.ResultChan()
+	assert.False(t, ok)
+	assert.Equal(t, storage.ErrWatcherStopped, w.(storage.ErrWatcher).Err())
+}
+
+func TestGetSelectorsEventVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		expected storage.EventVersion
+	}{
+		{
+			name:     "not announced",
+			ctx:      context.Background(),
+			expected: storage.LatestEventVersion,
+		},
+		{
+			name:     "full",
+			ctx:      WithEventVersion(context.Background(), storage.EventVersionFull),
+			expected: storage.EventVersionFull,
+		},
+		{
+			name:     "delta",
+			ctx:      WithEventVersion(context.Background(), storage.EventVersionDelta),
+			expected: storage.EventVersionDelta,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, GetSelectors(tt.ctx, nil).EventVersion)
+		})
+	}
+}
+
+func TestParseEventVersion(t *testing.T) {
+	version, err := ParseEventVersion("1")
+	require.NoError(t, err)
+	assert.Equal(t, storage.EventVersionFull, version)
+	for _, value := range []string{"", "0", "-1", "delta"} {
+		_, err := ParseEventVersion(value)
+		assert.Error(t, err, "Expected error for event version %q", value)
+	}
+}
+
+func TestWatchNegotiatedEventVersion(t *testing.T) {
+	pod1 := networking.PodReference{Name: "pod1", Namespace: "default"}
+	pod2 := networking.PodReference{Name: "pod2", Namespace: "default"}
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		expected runtime.Object
+	}{
+		{
+			name: "v1 client",
+			ctx:  WithEventVersion(context.Background(), storage.EventVersionFull),
+			expected: &networking.AppliedToGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+				Pods:       []networking.PodReference{pod1, pod2},
+			},
+		},
+		{
+			name: "client not announcing its version",
+			ctx:  context.Background(),
+			expected: &networking.AppliedToGroupPatch{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+				AddedPods:  []networking.PodReference{pod2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appliedToGroupStore := store.NewAppliedToGroupStore()
+			w, err := Watch(tt.ctx, appliedToGroupStore, nil, GetSelectors(tt.ctx, nil))
+			require.NoError(t, err)
+			defer w.Stop()
+
+			require.NoError(t, appliedToGroupStore.Create(&types.AppliedToGroup{
+				Name:       "foo",
+				SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1")},
+				PodsByNode: map[string]types.PodSet{"node1": {pod1: sets.Empty{}}},
+			}))
+			require.NoError(t, appliedToGroupStore.Update(&types.AppliedToGroup{
+				Name:       "foo",
+				SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1")},
+				PodsByNode: map[string]types.PodSet{"node1": {pod1: sets.Empty{}, pod2: sets.Empty{}}},
+			}))
+			assert.Equal(t, watch.Added, (<-w.ResultChan()).Type)
+			assert.Equal(t, watch.Event{Type: watch.Modified, Object: tt.expected}, <-w.ResultChan())
+		})
+	}
+}
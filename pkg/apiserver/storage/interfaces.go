@@ -16,9 +16,18 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
@@ -26,6 +35,87 @@ import (
 // It indicates watch.Event contains an incremental update, not the object itself.
 const Patched watch.EventType = "PATCHED"
 
+// Batched is an EventType in addition to EventTypes defined in k8s.io/apimachinery/pkg/watch/watch.go.
+// It indicates watch.Event carries an EventBatch of consecutive events, see Selectors.MaxBatchSize.
+const Batched watch.EventType = "BATCHED"
+
+// InitialEventsAnnotationKey is the annotation set on the Bookmark event that marks the end of the initial
+// events sent to a watcher that requested SendInitialEvents.
+const InitialEventsAnnotationKey = "k8s.io/initial-events-end"
+
+// SyncCompleteAnnotationKey is the annotation set on the Bookmark event that marks the end of the events preceding
+// the live changes sent to a watcher that requested SendSyncMarker.
+const SyncCompleteAnnotationKey = "antrea.io/sync-complete"
+
+// CompactionWarningAnnotationKey is the annotation set on a Bookmark event when few events can still be recorded
+// before its resourceVersion can no longer be resumed from. Its value is the number of such events. Clients are
+// expected to reconnect from the Bookmark's resourceVersion before it gets compacted, instead of relisting later.
+const CompactionWarningAnnotationKey = "antrea.io/compaction-warning"
+
+// BackpressurePolicy decides how a new event is handled when a watcher's buffer is full.
+type BackpressurePolicy int
+
+const (
+	// BlockUntilTimeout blocks the dispatching of the new event until the watcher's buffer becomes available
+	// or a timeout expires, in which case the watcher is terminated. This is the default policy.
+	BlockUntilTimeout BackpressurePolicy = iota
+	// DropOldest doesn't block the dispatching: the new event is discarded and the watcher is terminated with
+	// ErrWatcherResyncRequired right away, as its client would otherwise resume from a later resourceVersion
+	// without having seen the event.
+	DropOldest
+	// DropNewest behaves like DropOldest: a watcher can't skip an event without its client having to relist.
+	DropNewest
+)
+
+// ResourceVersionMatch decides how the resourceVersion requested by a watcher is applied.
+type ResourceVersionMatch string
+
+const (
+	// ResourceVersionMatchNotOlderThan requires the initial state sent to the watcher to be at least as new as the
+	// requested resourceVersion. If the store is older, the watch creation is blocked until it catches up or a
+	// timeout expires.
+	ResourceVersionMatchNotOlderThan ResourceVersionMatch = "NotOlderThan"
+)
+
+var (
+	// ErrWatcherStopped indicates the watcher has been stopped by its consumer or the server.
+	ErrWatcherStopped = errors.New("watcher stopped")
+	// ErrWatcherTooSlow indicates the watcher has been stopped as it didn't receive events in time.
+	ErrWatcherTooSlow = errors.New("watcher stopped as it didn't receive events in time")
+	// ErrWatcherResyncRequired indicates the watcher has been stopped as it had to discard a Delete event.
+	ErrWatcherResyncRequired = errors.New("watcher stopped as it discarded a Delete event, it must resync")
+)
+
+// ErrWatcher is a watch.Interface that can tell why it has been terminated.
+type ErrWatcher interface {
+	watch.Interface
+	// Err returns the cause of the termination of the watcher, or nil if it's still running. It's meant to be
+	// called after the result channel has been closed, to decide whether to retry. The cause is one of the
+	// ErrWatcher* errors, the error of the watch context, or a StatusError if the requested resourceVersion
+	// has been compacted.
+	Err() error
+}
+
+// WaitableWatcher is a watch.Interface whose termination can be waited for, e.g. by tests asserting that the
+// goroutines serving a watcher don't outlive it.
+type WaitableWatcher interface {
+	watch.Interface
+	// WaitStopped blocks until the goroutines serving the watcher have returned and its result channel has been
+	// closed, or until the timeout expires. It returns whether they have returned.
+	WaitStopped(timeout time.Duration) bool
+}
+
+// PausableWatcher is a watch.Interface whose delivery of events can be paused without disconnecting, e.g. by a
+// client doing bulk processing.
+type PausableWatcher interface {
+	watch.Interface
+	// Pause stops sending events to the result channel until Resume is called. The events keep being buffered in
+	// the meantime, up to the limits of the watcher's buffer.
+	Pause()
+	// Resume resumes sending events to the result channel, starting with the ones buffered while paused.
+	Resume()
+}
+
 // Selectors represent a watcher's conditions to select objects.
 type Selectors struct {
 	// Key is the identifier of the object the watcher monitors. It can be empty.
@@ -34,6 +124,258 @@ type Selectors struct {
 	Label labels.Selector
 	// Field filters objects based on the value of the resource fields.
 	Field fields.Selector
+	// AllowWatchBookmarks indicates whether the watcher should receive periodic Bookmark events
+	// carrying the latest resourceVersion it has observed.
+	AllowWatchBookmarks bool
+	// BackpressurePolicy decides how new events are handled when the watcher's buffer is full.
+	BackpressurePolicy BackpressurePolicy
+	// SendInitialEvents indicates whether the watcher should receive ADDED events of all existing objects
+	// first, followed by a Bookmark event annotated with InitialEventsAnnotationKey, regardless of the
+	// requested resourceVersion, which must not be newer than the store. It requires AllowWatchBookmarks.
+	SendInitialEvents bool
+	// SendSyncMarker indicates whether the watcher should receive a Bookmark event annotated with
+	// SyncCompleteAnnotationKey once the initial state, or the events replayed from the requested resourceVersion,
+	// has been sent, so that a list-then-watch client can mark its cache synced before live changes follow. With
+	// SendInitialEvents, a single Bookmark event carries both annotations. It requires AllowWatchBookmarks.
+	SendSyncMarker bool
+	// Kinds are the kinds of objects the watcher monitors through a single watch. It's only interpreted
+	// when watching multiple stores together, in which case the Object of each event is wrapped in a
+	// KindedObject. It's ignored by a single store.
+	Kinds []string
+	// ResourceVersionMatch decides how the requested resourceVersion is applied. If it's empty, the watcher
+	// resumes from the resourceVersion. If it's ResourceVersionMatchNotOlderThan, ADDED events of all existing
+	// objects will be sent first, once the store is at least as new as the resourceVersion.
+	ResourceVersionMatch ResourceVersionMatch
+	// CoalesceModifications indicates whether a Modified event of an object queued in the watcher's buffer can be
+	// replaced in place by a newer Modified event of the same object while the watcher hasn't read it, instead of
+	// queuing both. Other events are never coalesced, neither are the events not implementing TypedInternalEvent.
+	CoalesceModifications bool
+	// SupportsDelta indicates whether the watcher can handle Modified events carrying the incremental update of
+	// an object instead of the whole object, for the kinds of objects that support it. It's equivalent to an
+	// EventVersion of EventVersionDelta and only applies when EventVersion is not set.
+	SupportsDelta bool
+	// EventVersion is the newest format of events the watcher can interpret, negotiated with its client. If it's
+	// zero, the format is decided by SupportsDelta. Events of newer formats are downgraded for the watcher.
+	EventVersion EventVersion
+	// Transform projects the object of each ADDED, MODIFIED and DELETED event sent to the watcher, e.g. to strip
+	// the fields the watcher doesn't need. It's called outside the store's locks, with objects that may be shared
+	// by other watchers, so it must not mutate the provided object. If it's nil, objects are sent as they are.
+	Transform func(runtime.Object) runtime.Object
+	// ResourceVersionCeiling is the resourceVersion up to which the watcher receives events. Once it has observed
+	// the ceiling, it sends no more events and closes its result channel, so that a bounded window of changes can
+	// be replayed together with the requested resourceVersion. Zero means no ceiling.
+	ResourceVersionCeiling uint64
+	// IncludePreviousObject indicates whether the Modified events sent to the watcher should carry the previous
+	// version of the object along with the object of the event, wrapped in an ObjectUpdate, so that the client can
+	// tell what changed without keeping the previous version itself. It only applies to the kinds of objects whose
+	// events implement PreviousObjectEvent.
+	IncludePreviousObject bool
+	// SuppressEqual compares the previous version of the object of each Modified event with the object of the
+	// event, both projected with Transform, and the event is not sent to the watcher if it returns true, e.g.
+	// apiequality.Semantic.DeepEqual, so that the watcher isn't notified of changes it doesn't care about. It only
+	// applies to the kinds of objects whose events implement PreviousObjectEvent. Like Transform, it must not mutate
+	// the provided objects. If it's nil, all Modified events are sent.
+	SuppressEqual func(prevObj, obj runtime.Object) bool
+	// MaxBatchSize, if greater than 1, makes the watcher send the ADDED, MODIFIED and DELETED events it has ready
+	// together, up to MaxBatchSize of them, as a single Batched event carrying an EventBatch, which reduces the
+	// per-event overhead of chatty streams at the cost of some latency. A batch is sent once it's full, once no
+	// more event is ready and BatchWindow has elapsed, or before any other event. A single event is sent as it
+	// is. It's ignored when watching multiple stores together.
+	MaxBatchSize int
+	// BatchWindow is how long the watcher waits for more events before sending a batch that isn't full. Zero
+	// means the batch is sent as soon as no more event is ready. It only applies when MaxBatchSize is set.
+	BatchWindow time.Duration
+}
+
+// NegotiatedEventVersion returns the newest format of events the watcher with the Selectors can interpret, capped
+// at LatestEventVersion.
+func (s *Selectors) NegotiatedEventVersion() EventVersion {
+	switch {
+	case s.EventVersion > LatestEventVersion:
+		return LatestEventVersion
+	case s.EventVersion > 0:
+		return s.EventVersion
+	case s.SupportsDelta:
+		return EventVersionDelta
+	}
+	return EventVersionFull
+}
+
+// Canonical returns a key identifying the events the watcher with the Selectors receives, which is the same for
+// equal Selectors regardless of the order their requirements and kinds were specified in, and different for
+// unequal ones. Transform and SuppressEqual can't be compared, only whether they are set is reflected in the key.
+func (s *Selectors) Canonical() string {
+	kinds := append([]string(nil), s.Kinds...)
+	sort.Strings(kinds)
+	return fmt.Sprintf("key=%q,label=%q,field=%q,bookmarks=%t,backpressure=%d,initialEvents=%t,syncMarker=%t,kinds=%q,match=%q,coalesce=%t,version=%d,transform=%t,ceiling=%d,previous=%t,suppressEqual=%t,batch=%d/%v",
+		s.Key, canonicalLabelSelector(s.Label), canonicalFieldSelector(s.Field), s.AllowWatchBookmarks, s.BackpressurePolicy,
+		s.SendInitialEvents, s.SendSyncMarker, kinds, s.ResourceVersionMatch, s.CoalesceModifications, s.NegotiatedEventVersion(), s.Transform != nil,
+		s.ResourceVersionCeiling, s.IncludePreviousObject, s.SuppressEqual != nil, s.MaxBatchSize, s.BatchWindow)
+}
+
+// canonicalLabelSelector returns the requirements of the selector sorted, "" if it selects everything, including
+// when it's nil, and "!" if it selects nothing.
+func canonicalLabelSelector(selector labels.Selector) string {
+	if selector == nil {
+		return ""
+	}
+	requirements, selectable := selector.Requirements()
+	if !selectable {
+		return "!"
+	}
+	terms := make([]string, 0, len(requirements))
+	for i := range requirements {
+		terms = append(terms, requirements[i].String())
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
+
+// canonicalFieldSelector returns the requirements of the selector sorted, "" if it selects everything, including
+// when it's nil, and "!" if it selects nothing.
+func canonicalFieldSelector(selector fields.Selector) string {
+	if selector == nil || selector.Empty() {
+		return ""
+	}
+	requirements := selector.Requirements()
+	if len(requirements) == 0 {
+		return "!"
+	}
+	terms := make([]string, 0, len(requirements))
+	for _, r := range requirements {
+		operator := r.Operator
+		if operator == selection.DoubleEquals {
+			operator = selection.Equals
+		}
+		terms = append(terms, fmt.Sprintf("%s%s%s", r.Field, operator, fields.EscapeValue(r.Value)))
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
+
+// EventVersion is the version of the format of the watch events converted from InternalEvents. A newer version
+// may use representations that clients interpreting only older versions don't understand.
+type EventVersion int
+
+const (
+	// EventVersionFull is the format in which every event carries the whole object.
+	EventVersionFull EventVersion = 1
+	// EventVersionDelta is the format in which Modified events may carry the incremental update of an object.
+	EventVersionDelta EventVersion = 2
+	// LatestEventVersion is the newest format of events.
+	LatestEventVersion = EventVersionDelta
+)
+
+// KindedObject wraps an object with its kind, so that the events of a watch monitoring multiple kinds of objects
+// can be demultiplexed by the client.
+type KindedObject struct {
+	// Kind is the kind of Object, as specified in Selectors.Kinds.
+	Kind string
+	// Object is the object carried by the original event.
+	Object runtime.Object
+}
+
+// GetObjectKind implements runtime.Object.
+func (o *KindedObject) GetObjectKind() schema.ObjectKind {
+	return schema.EmptyObjectKind
+}
+
+// DeepCopyObject implements runtime.Object.
+func (o *KindedObject) DeepCopyObject() runtime.Object {
+	if o == nil {
+		return nil
+	}
+	out := &KindedObject{Kind: o.Kind}
+	if o.Object != nil {
+		out.Object = o.Object.DeepCopyObject()
+	}
+	return out
+}
+
+// ObjectUpdate wraps the object of a Modified event with the previous version of the object, for the watchers that
+// requested IncludePreviousObject.
+type ObjectUpdate struct {
+	// Object is the object carried by the original event, which may be an incremental update of the object.
+	Object runtime.Object
+	// PrevObject is the whole object before the update.
+	PrevObject runtime.Object
+}
+
+// GetObjectKind implements runtime.Object.
+func (o *ObjectUpdate) GetObjectKind() schema.ObjectKind {
+	return schema.EmptyObjectKind
+}
+
+// DeepCopyObject implements runtime.Object.
+func (o *ObjectUpdate) DeepCopyObject() runtime.Object {
+	if o == nil {
+		return nil
+	}
+	out := &ObjectUpdate{}
+	if o.Object != nil {
+		out.Object = o.Object.DeepCopyObject()
+	}
+	if o.PrevObject != nil {
+		out.PrevObject = o.PrevObject.DeepCopyObject()
+	}
+	return out
+}
+
+// EventBatch is the object of a Batched event, carrying consecutive events in the order they were generated.
+type EventBatch struct {
+	Events []watch.Event
+}
+
+// GetObjectKind implements runtime.Object.
+func (b *EventBatch) GetObjectKind() schema.ObjectKind {
+	return schema.EmptyObjectKind
+}
+
+// DeepCopyObject implements runtime.Object.
+func (b *EventBatch) DeepCopyObject() runtime.Object {
+	if b == nil {
+		return nil
+	}
+	out := &EventBatch{}
+	if b.Events != nil {
+		out.Events = make([]watch.Event, len(b.Events))
+		for i, event := range b.Events {
+			out.Events[i] = watch.Event{Type: event.Type}
+			if event.Object != nil {
+				out.Events[i].Object = event.Object.DeepCopyObject()
+			}
+		}
+	}
+	return out
+}
+
+// Unbatch returns the events carried by the provided event if it's a Batched event, or the event itself otherwise.
+func Unbatch(event watch.Event) []watch.Event {
+	if event.Type == Batched {
+		if batch, ok := event.Object.(*EventBatch); ok {
+			return batch.Events
+		}
+	}
+	return []watch.Event{event}
+}
+
+// WatcherInfo describes an active watcher, for debugging.
+type WatcherInfo struct {
+	// Resource is the name of the watched type.
+	Resource string `json:"resource"`
+	// Selectors is a summary of the watcher's selectors, with the values redacted.
+	Selectors string `json:"selectors"`
+	// BufferDepth is the number of events buffered for the watcher.
+	BufferDepth int `json:"bufferDepth"`
+	// BufferCapacity is the capacity of the watcher's buffer.
+	BufferCapacity int `json:"bufferCapacity"`
+	// Age is how long the watcher has been active.
+	Age metav1.Duration `json:"age"`
+	// LastResourceVersion is the resourceVersion of the last event dispatched to the watcher.
+	LastResourceVersion uint64 `json:"lastResourceVersion"`
+	// SelectorsHash is the bucket the watcher's selectors hash to, which labels the metrics of the cost of
+	// converting events for the watcher. Watchers with equal selectors share it.
+	SelectorsHash string `json:"selectorsHash,omitempty"`
 }
 
 // InternalEvent is an internal event that can be converted to *watch.Event based on watcher's Selectors.
@@ -50,6 +392,35 @@ type InternalEvent interface {
 	GetResourceVersion() uint64
 }
 
+// VersionedInternalEvent is an InternalEvent which can be converted to events of a format newer than
+// EventVersionFull. Its ToWatchEvent must downgrade the event to the full-object form for the watchers whose
+// negotiated version is older than its version, so that mixed-version clients keep working during upgrades.
+type VersionedInternalEvent interface {
+	InternalEvent
+	// GetEventVersion returns the newest format the InternalEvent is converted to.
+	GetEventVersion() EventVersion
+}
+
+// PreviousObjectEvent is an InternalEvent which can tell the previous version of the object it was generated for,
+// see Selectors.IncludePreviousObject.
+type PreviousObjectEvent interface {
+	InternalEvent
+	// ToPreviousObject returns the previous version of the object in the form of the objects of Added events sent
+	// to the watcher with the provided Selectors, or nil if there's no previous version. Like ToWatchEvent, it must
+	// not mutate the event as it may be called for multiple watchers concurrently.
+	ToPreviousObject(selectors *Selectors) runtime.Object
+}
+
+// TypedInternalEvent is an InternalEvent which can tell the type of the event it's converted to for a watcher without
+// converting it, which lets the store decide cheaply whether the event can be coalesced, see
+// Selectors.CoalesceModifications.
+type TypedInternalEvent interface {
+	InternalEvent
+	// GetEventType returns the type of the event ToWatchEvent returns for the provided Selectors, and false if it
+	// returns nil. Like ToWatchEvent, it must not mutate the event.
+	GetEventType(selectors *Selectors) (watch.EventType, bool)
+}
+
 // GenEventFunc generates InternalEvent from the add/update/delete of an object.
 // Only a single InternalEvent will be generated for each add/update/delete, and the InternalEvent itself should be
 // immutable during its conversion to *watch.Event.
@@ -74,12 +445,43 @@ type Interface interface {
 	// List gets a list of all objects.
 	List() []interface{}
 
+	// ListAtLeast gets a list of all objects and the resourceVersion it reflects, which is not older than the
+	// provided resourceVersion. It blocks for a while if the store hasn't caught up with it.
+	ListAtLeast(ctx context.Context, resourceVersion uint64) ([]interface{}, uint64, error)
+
+	// ListPage gets at most limit objects starting after the position encoded in continueToken, and the continue
+	// token of the next page, which is empty if there are no more objects. All pages of a list reflect the same
+	// snapshot of the store. If limit is not positive, all objects are returned.
+	ListPage(limit int64, continueToken string) ([]interface{}, string, error)
+
 	// Delete removes an object that has specified key.
 	Delete(key string) error
 
-	// Watch starts watching with the specified key and selectors. Events will be sent to the returned watch.Interface.
-	Watch(ctx context.Context, key string, labelSelector labels.Selector, fieldSelector fields.Selector) (watch.Interface, error)
+	// Watch starts watching with the specified resourceVersion and selectors. Events will be sent to the returned
+	// watch.Interface. If resourceVersion is empty or "0", or selectors.SendInitialEvents is set, all existing objects
+	// will be sent as ADDED events first.
+	Watch(ctx context.Context, resourceVersion string, selectors *Selectors) (watch.Interface, error)
 
 	// GetWatchersNum gets the number of watchers for the store.
 	GetWatchersNum() int
+
+	// TriggerResync makes all active watchers resend an ADDED event for each object selected by them.
+	TriggerResync() error
+
+	// CountWatchers gets the number of active watchers of the store.
+	CountWatchers() int
+
+	// CountObjects gets the number of objects in the store.
+	CountObjects() int
+
+	// ResourceVersionRange gets the range of resourceVersions watchers can resume from, for debugging. min is the
+	// oldest resourceVersion whose following events are retained, max is the current resourceVersion. Both are 0
+	// if the store has never changed.
+	ResourceVersionRange() (min, max uint64)
+
+	// ListWatchers gets the information of the active watchers of the store, for debugging.
+	ListWatchers() []WatcherInfo
+
+	// DispatchLatencyP99 gets the 99th percentile of the recent durations of dispatching an event to all watchers.
+	DispatchLatencyP99() time.Duration
 }
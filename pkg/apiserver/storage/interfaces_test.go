@@ -0,0 +1,171 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestSelectorsCanonical(t *testing.T) {
+	mustParseLabels := func(s string) labels.Selector {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			t.Fatalf("Failed to parse label selector %q: %v", s, err)
+		}
+		return selector
+	}
+	mustParseFields := func(s string) fields.Selector {
+		selector, err := fields.ParseSelector(s)
+		if err != nil {
+			t.Fatalf("Failed to parse field selector %q: %v", s, err)
+		}
+		return selector
+	}
+	tests := []struct {
+		name  string
+		a     *Selectors
+		b     *Selectors
+		equal bool
+	}{
+		{
+			name:  "label requirements in different order",
+			a:     &Selectors{Label: mustParseLabels("app=foo,tier in (db,web)")},
+			b:     &Selectors{Label: mustParseLabels("tier in (web,db),app=foo")},
+			equal: true,
+		},
+		{
+			name:  "field requirements in different order",
+			a:     &Selectors{Field: mustParseFields("nodeName=node1,metadata.name!=foo")},
+			b:     &Selectors{Field: mustParseFields("metadata.name!=foo,nodeName==node1")},
+			equal: true,
+		},
+		{
+			name:  "kinds in different order",
+			a:     &Selectors{Kinds: []string{"AddressGroup", "NetworkPolicy"}},
+			b:     &Selectors{Kinds: []string{"NetworkPolicy", "AddressGroup"}},
+			equal: true,
+		},
+		{
+			name:  "nil and everything selectors",
+			a:     &Selectors{},
+			b:     &Selectors{Label: labels.Everything(), Field: fields.Everything()},
+			equal: true,
+		},
+		{
+			name:  "delta support and latest event version",
+			a:     &Selectors{SupportsDelta: true},
+			b:     &Selectors{EventVersion: LatestEventVersion},
+			equal: true,
+		},
+		{
+			name: "different label values",
+			a:    &Selectors{Label: mustParseLabels("app=foo")},
+			b:    &Selectors{Label: mustParseLabels("app=bar")},
+		},
+		{
+			name: "everything and nothing label selectors",
+			a:    &Selectors{Label: labels.Everything()},
+			b:    &Selectors{Label: labels.Nothing()},
+		},
+		{
+			name: "everything and nothing field selectors",
+			a:    &Selectors{Field: fields.Everything()},
+			b:    &Selectors{Field: fields.Nothing()},
+		},
+		{
+			name: "different field operators",
+			a:    &Selectors{Field: mustParseFields("nodeName=node1")},
+			b:    &Selectors{Field: mustParseFields("nodeName!=node1")},
+		},
+		{
+			name: "same requirements on labels and fields",
+			a:    &Selectors{Label: mustParseLabels("a=b,c=d")},
+			b:    &Selectors{Field: mustParseFields("a=b,c=d")},
+		},
+		{
+			name: "different keys",
+			a:    &Selectors{Key: "foo"},
+			b:    &Selectors{Key: "bar"},
+		},
+		{
+			name: "different backpressure policies",
+			a:    &Selectors{BackpressurePolicy: BlockUntilTimeout},
+			b:    &Selectors{BackpressurePolicy: DropOldest},
+		},
+		{
+			name: "different bookmarks",
+			a:    &Selectors{AllowWatchBookmarks: true},
+			b:    &Selectors{},
+		},
+		{
+			name: "different event versions",
+			a:    &Selectors{EventVersion: EventVersionFull},
+			b:    &Selectors{EventVersion: EventVersionDelta},
+		},
+		{
+			name: "transform",
+			a:    &Selectors{Transform: func(obj runtime.Object) runtime.Object { return obj }},
+			b:    &Selectors{},
+		},
+		{
+			name: "different batch sizes",
+			a:    &Selectors{MaxBatchSize: 16},
+			b:    &Selectors{MaxBatchSize: 32},
+		},
+		{
+			name: "different batch windows",
+			a:    &Selectors{MaxBatchSize: 16, BatchWindow: time.Millisecond},
+			b:    &Selectors{MaxBatchSize: 16},
+		},
+		{
+			name: "suppress equal",
+			a:    &Selectors{SuppressEqual: func(prevObj, obj runtime.Object) bool { return false }},
+			b:    &Selectors{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.equal {
+				assert.Equal(t, tt.a.Canonical(), tt.b.Canonical())
+			} else {
+				assert.NotEqual(t, tt.a.Canonical(), tt.b.Canonical())
+			}
+		})
+	}
+}
+
+func TestUnbatch(t *testing.T) {
+	pod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}
+	pod2 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}}
+	events := []watch.Event{{Type: watch.Added, Object: pod1}, {Type: watch.Deleted, Object: pod2}}
+	batch := &EventBatch{Events: events}
+
+	assert.Equal(t, events, Unbatch(watch.Event{Type: Batched, Object: batch}))
+	assert.Equal(t, events[:1], Unbatch(events[0]))
+
+	copied := batch.DeepCopyObject().(*EventBatch)
+	assert.Equal(t, batch, copied)
+	copied.Events[0].Object.(*v1.Pod).Name = "pod3"
+	assert.Equal(t, "pod1", pod1.Name, "DeepCopyObject should copy the objects of the events")
+}
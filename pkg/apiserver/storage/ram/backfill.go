@@ -0,0 +1,105 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+
+	"k8s.io/klog"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// tombstone is the Delete event of an object kept for backfilling watchers, along with the key of the object.
+type tombstone struct {
+	antreastorage.InternalEvent
+	key string
+}
+
+// EnableDeleteBackfill makes the store keep the Delete events of the size most recently deleted objects, which are
+// much fewer than all events, so that a watcher resuming from a resourceVersion whose following events have been
+// discarded from history doesn't have to relist. Instead of an expired error, it receives the Delete events of the
+// objects deleted since the resourceVersion and not re-created, followed by ADDED events of all existing objects
+// and a Bookmark event annotated with InitialEventsAnnotationKey, which clients handle the same as a relist with
+// SendInitialEvents. Otherwise a client that missed a Delete event would keep the deleted object forever. Only the
+// watchers selecting everything and allowing bookmarks are backfilled: an object that stopped matching the
+// selectors of others, e.g. a group no longer spanning a Node, is still stored and wouldn't be deleted. Other
+// watchers, and the ones resuming from a resourceVersion older than the oldest Delete event kept, still get an
+// expired error. It must be called before any object is deleted.
+func (s *store) EnableDeleteBackfill(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("number of deleted objects kept for backfilling must be positive, got %d", size)
+	}
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	s.tombstones = newEventRing(size)
+	// The objects deleted before haven't been recorded.
+	s.compactedTombstoneVersion = s.resourceVersion
+	return nil
+}
+
+// recordTombstone records the Delete event generated for the object of the provided key.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) recordTombstone(key string, event antreastorage.InternalEvent) {
+	if s.tombstones == nil {
+		return
+	}
+	if evicted := s.tombstones.add(&tombstone{InternalEvent: event, key: key}); evicted != nil {
+		s.compactedTombstoneVersion = evicted.GetResourceVersion()
+	}
+}
+
+// canBackfill returns whether a watcher with the provided selectors can be backfilled from fromVersion: all the
+// objects deleted after fromVersion are known, the watcher selects every object, so that every object it may know
+// is either deleted or added again, and it allows the Bookmark event marking the end of the backfilled events.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) canBackfill(fromVersion uint64, selectors *antreastorage.Selectors) bool {
+	if s.tombstones == nil || fromVersion < s.compactedTombstoneVersion || !selectors.AllowWatchBookmarks {
+		return false
+	}
+	return selectors.Key == "" && selectors.Label.Empty() && selectors.Field.Empty()
+}
+
+// backfill generates the events bringing a watcher that observed fromVersion up to date when the events after it
+// have been discarded from history: the Delete events of the objects deleted since then which don't exist anymore,
+// followed by ADDED events of all existing objects. The watcher must satisfy canBackfill.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) backfill(fromVersion uint64, selectors *antreastorage.Selectors) ([]antreastorage.InternalEvent, error) {
+	deleted := s.tombstones.since(fromVersion)
+	// An object may have been deleted multiple times, only its last Delete event is sent.
+	lastDeleted := make(map[string]int, len(deleted))
+	for i, event := range deleted {
+		lastDeleted[event.(*tombstone).key] = i
+	}
+	var events []antreastorage.InternalEvent
+	for i, event := range deleted {
+		key := event.(*tombstone).key
+		if lastDeleted[key] != i {
+			continue
+		}
+		if _, exists, _ := s.storage.GetByKey(key); exists {
+			// The object has been re-created, its ADDED event will replace it.
+			continue
+		}
+		events = append(events, event.(*tombstone).InternalEvent)
+	}
+	initEvents, err := s.listInitEvents(selectors)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("Backfilled watch of %s from compacted resourceVersion %d with %d Delete events", s.resource, fromVersion, len(events))
+	return append(events, initEvents...), nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// newBackfillTestStore creates a store keeping 2 events in history, in which pod1, pod2 and pod3 are created at
+// resourceVersions 1 to 3. A client that observed resourceVersion 3 is then disconnected while pod1 is deleted, pod2
+// is updated, pod4 is created, and pod3 is deleted and re-created.
+func newBackfillTestStore(t *testing.T, tombstones int) *store {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.SetHistorySize(2)
+	if tombstones > 0 {
+		require.NoError(t, store.EnableDeleteBackfill(tombstones))
+	}
+	for _, name := range []string{"pod1", "pod2", "pod3"} {
+		require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}))
+	}
+	require.NoError(t, store.Delete("pod1"))
+	require.NoError(t, store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "web"}}}))
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod4"}}))
+	require.NoError(t, store.Delete("pod3"))
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}}))
+	return store
+}
+
+func receiveEvents(t *testing.T, w watch.Interface, n int) []watch.Event {
+	var events []watch.Event
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-w.ResultChan():
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+	select {
+	case event, ok := <-w.ResultChan():
+		if ok {
+			t.Errorf("Unexpected excess event: %#v", event)
+		}
+	case <-time.After(10 * time.Millisecond):
+	}
+	return events
+}
+
+func TestRamStoreWatchBackfillDeletes(t *testing.T) {
+	store := newBackfillTestStore(t, 10)
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true}
+	w, err := store.Watch(context.Background(), "3", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+
+	// The client learns pod1 is gone, followed by the current state, whose end is marked so that the client can
+	// drop any object it knows that hasn't been added again.
+	events := receiveEvents(t, w, 5)
+	assert.Equal(t, watch.Event{Type: watch.Deleted, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}}, events[0])
+	assert.ElementsMatch(t, []watch.Event{
+		{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "web"}}}},
+		{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}}},
+		{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod4"}}},
+	}, events[1:4])
+	assert.Equal(t, watch.Bookmark, events[4].Type)
+	assert.Equal(t, "true", events[4].Object.(*v1.Pod).Annotations[antreastorage.InitialEventsAnnotationKey])
+
+	// Live events follow.
+	require.NoError(t, store.Delete("pod4"))
+	assert.Equal(t, []watch.Event{{Type: watch.Deleted, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod4"}}}}, receiveEvents(t, w, 1))
+}
+
+func TestRamStoreWatchBackfillExpired(t *testing.T) {
+	everything := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true}
+	testCases := []struct {
+		name       string
+		tombstones int
+		selectors  *antreastorage.Selectors
+	}{
+		{"backfill disabled", 0, everything},
+		// pod1's Delete event has been discarded to keep pod3's.
+		{"tombstones compacted", 1, everything},
+		// The end of the backfilled events can't be marked.
+		{"bookmarks not allowed", 10, &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}},
+		// pod2 stopped matching the selectors without being deleted, it would be kept by the client.
+		{"selected objects", 10, &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "db"}), Field: fields.Everything(), AllowWatchBookmarks: true}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newBackfillTestStore(t, tc.tombstones)
+			w, err := store.Watch(context.Background(), "3", tc.selectors)
+			require.NoError(t, err)
+			defer w.Stop()
+
+			events := receiveEvents(t, w, 1)
+			assert.Equal(t, watch.Error, events[0].Type)
+			assert.True(t, errors.IsResourceExpired(errors.FromObject(events[0].Object)), "Expected an expired error, got %v", events[0].Object)
+		})
+	}
+}
+
+func TestRamStoreEnableDeleteBackfill(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Error(t, store.EnableDeleteBackfill(0))
+	store.SetHistorySize(1)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	store.Delete("pod1")
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+	require.NoError(t, store.EnableDeleteBackfill(10))
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true}
+	assert.False(t, store.canBackfill(1, selectors), "Deletions before backfilling was enabled are unknown")
+	assert.True(t, store.canBackfill(3, selectors))
+}
+
+func TestRamStoreWatchBackfillGroupLeavingNode(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.SetHistorySize(1)
+	require.NoError(t, store.EnableDeleteBackfill(10))
+	group := func(name, node string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"node": node}}}
+	}
+	require.NoError(t, store.Create(group("group1", "node1")))
+	require.NoError(t, store.Create(group("group2", "node1")))
+
+	// The client watching the groups of node1 is disconnected at resourceVersion 2, while group1 leaves node1 and
+	// group2 is deleted. The events are discarded from history, but group1 is still stored.
+	require.NoError(t, store.Update(group("group1", "node2")))
+	require.NoError(t, store.Delete("group2"))
+	require.NoError(t, store.Create(group("group3", "node2")))
+
+	// Backfilling only group2's Delete event and the groups of node1 would leave group1 as a phantom.
+	selectors := &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"node": "node1"}), Field: fields.Everything(), AllowWatchBookmarks: true}
+	w, err := store.Watch(context.Background(), "2", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+	events := receiveEvents(t, w, 1)
+	assert.Equal(t, watch.Error, events[0].Type)
+	assert.True(t, errors.IsResourceExpired(errors.FromObject(events[0].Object)), "Expected an expired error, got %v", events[0].Object)
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// SetTTL makes the store delete the object of the provided key once the ttl elapses, generating a Delete event for
+// the watchers as if Delete was called, which saves ephemeral objects from needing an external cleaner. Calling it
+// again reschedules the deletion, a non-positive ttl cancels it. Updating the object keeps its expiry, deleting it
+// cancels it.
+func (s *store) SetTTL(key string, ttl time.Duration) error {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	if _, exists, _ := s.storage.GetByKey(key); !exists {
+		return fmt.Errorf("object %+v not found in storage", key)
+	}
+	if ttl <= 0 {
+		delete(s.expiries, key)
+		return nil
+	}
+	s.expiries[key] = time.Now().Add(ttl)
+	s.reaperOnce.Do(func() {
+		go s.runReaper(s.done)
+	})
+	select {
+	case s.expiryCh <- struct{}{}:
+	default:
+		// The reaper has a pending wakeup, which will make it see the new expiry.
+	}
+	return nil
+}
+
+// runReaper deletes the objects whose TTL has elapsed, sleeping until the earliest expiry in between. It returns
+// once stopCh is closed.
+func (s *store) runReaper(stopCh <-chan struct{}) {
+	for {
+		var timerCh <-chan time.Time
+		var timer *time.Timer
+		if next, ok := s.reapExpired(time.Now()); ok {
+			timer = time.NewTimer(time.Until(next))
+			timerCh = timer.C
+		}
+		select {
+		case <-s.expiryCh:
+		case <-timerCh:
+		case <-stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// reapExpired deletes the objects that have expired at the provided time. It returns the earliest expiry of the
+// remaining objects and whether there is any.
+func (s *store) reapExpired(now time.Time) (time.Time, bool) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	var next time.Time
+	for key, expireAt := range s.expiries {
+		if !expireAt.After(now) {
+			klog.V(2).Infof("Deleting %s %s as its TTL has elapsed", s.resource, key)
+			if err := s.delete(key); err != nil {
+				klog.Errorf("Failed to delete expired %s %s: %v", s.resource, key, err)
+				delete(s.expiries, key)
+			}
+			continue
+		}
+		if next.IsZero() || expireAt.Before(next) {
+			next = expireAt
+		}
+	}
+	return next, !next.IsZero()
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func TestRamStoreSetTTL(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Error(t, store.SetTTL("pod1", time.Second), "TTL can't be set on a missing object")
+
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}))
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}}))
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	defer w.Stop()
+	for i := 0; i < 2; i++ {
+		<-w.ResultChan()
+	}
+
+	ttl := 200 * time.Millisecond
+	start := time.Now()
+	require.NoError(t, store.SetTTL("pod1", ttl))
+	// Updating the object keeps its expiry.
+	require.NoError(t, store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "web"}}}))
+	event := <-w.ResultChan()
+	assert.Equal(t, watch.Modified, event.Type)
+
+	select {
+	case event := <-w.ResultChan():
+		assert.Equal(t, watch.Deleted, event.Type)
+		assert.Equal(t, "pod1", event.Object.(*v1.Pod).Name)
+		assert.True(t, time.Since(start) >= ttl, "Object was deleted before its TTL elapsed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the Delete event of the expired object")
+	}
+	_, exists, _ := store.Get("pod1")
+	assert.False(t, exists)
+	_, exists, _ = store.Get("pod2")
+	assert.True(t, exists, "Objects without TTL should never expire")
+	assert.Empty(t, store.expiries)
+}
+
+func TestRamStoreSetTTLReschedule(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	for _, name := range []string{"pod1", "pod2", "pod3"} {
+		require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}))
+	}
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	defer w.Stop()
+	for i := 0; i < 3; i++ {
+		<-w.ResultChan()
+	}
+
+	require.NoError(t, store.SetTTL("pod1", 300*time.Millisecond))
+	require.NoError(t, store.SetTTL("pod2", time.Minute))
+	require.NoError(t, store.SetTTL("pod3", time.Minute))
+	// An earlier expiry wakes the reaper up. A non-positive TTL cancels the expiry, so does deleting the object.
+	require.NoError(t, store.SetTTL("pod2", 100*time.Millisecond))
+	require.NoError(t, store.SetTTL("pod1", 0))
+	require.NoError(t, store.Delete("pod3"))
+	event := <-w.ResultChan()
+	assert.Equal(t, watch.Deleted, event.Type)
+	assert.Equal(t, "pod3", event.Object.(*v1.Pod).Name)
+
+	select {
+	case event := <-w.ResultChan():
+		assert.Equal(t, watch.Deleted, event.Type)
+		assert.Equal(t, "pod2", event.Object.(*v1.Pod).Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the Delete event of the expired object")
+	}
+	select {
+	case event := <-w.ResultChan():
+		t.Fatalf("Unexpected event %v after the TTL was canceled", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	_, exists, _ := store.Get("pod1")
+	assert.True(t, exists)
+	assert.Empty(t, store.expiries)
+}
+
+func TestRamStoreStopReaper(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}))
+
+	stopCh := make(chan struct{})
+	reaperDone := make(chan struct{})
+	go func() {
+		defer close(reaperDone)
+		store.runReaper(stopCh)
+	}()
+	close(stopCh)
+	select {
+	case <-reaperDone:
+	case <-time.After(time.Second):
+		t.Fatal("Reaper didn't return after its stop channel was closed")
+	}
+
+	// Once the store is stopped, expired objects are no longer deleted.
+	ttl := 100 * time.Millisecond
+	require.NoError(t, store.SetTTL("pod1", ttl))
+	store.Stop()
+	store.Stop()
+	time.Sleep(2 * ttl)
+	_, exists, _ := store.Get("pod1")
+	assert.True(t, exists, "Object was deleted after the store was stopped")
+	// Events generated after the store is stopped don't block even if nothing dispatches them.
+	for i := 0; i < 200; i++ {
+		require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i+2)}}))
+	}
+	assert.Error(t, store.SetDispatchShards(2))
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"sort"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// eventRing is a fixed-size ring buffer of events in ascending order of resourceVersion. Once it's full,
+// adding an event overwrites the oldest one. It is not thread safe.
+type eventRing struct {
+	// events is the underlying buffer, its length is the capacity of the ring.
+	events []storage.InternalEvent
+	// start is the index of the oldest event in events.
+	start int
+	// size is the number of events in the ring.
+	size int
+}
+
+func newEventRing(capacity int) *eventRing {
+	return &eventRing{events: make([]storage.InternalEvent, capacity)}
+}
+
+// len returns the number of events in the ring.
+func (r *eventRing) len() int {
+	return r.size
+}
+
+// at returns the i-th oldest event in the ring.
+func (r *eventRing) at(i int) storage.InternalEvent {
+	return r.events[(r.start+i)%len(r.events)]
+}
+
+// add appends the event to the ring, which must be newer than all events in it. It returns the event
+// that was overwritten to make room for it, or nil if the ring was not full.
+func (r *eventRing) add(event storage.InternalEvent) storage.InternalEvent {
+	if len(r.events) == 0 {
+		return event
+	}
+	if r.size < len(r.events) {
+		r.events[(r.start+r.size)%len(r.events)] = event
+		r.size++
+		return nil
+	}
+	evicted := r.events[r.start]
+	r.events[r.start] = event
+	r.start = (r.start + 1) % len(r.events)
+	return evicted
+}
+
+// capacity returns the maximum number of events the ring can hold.
+func (r *eventRing) capacity() int {
+	return len(r.events)
+}
+
+// countSince returns the number of events in the ring whose resourceVersion is greater than resourceVersion.
+func (r *eventRing) countSince(resourceVersion uint64) int {
+	return r.size - r.search(resourceVersion)
+}
+
+// search returns the index of the oldest event in the ring whose resourceVersion is greater than
+// resourceVersion, or the size of the ring if there is none.
+func (r *eventRing) search(resourceVersion uint64) int {
+	// Events are sorted by resourceVersion.
+	return sort.Search(r.size, func(i int) bool {
+		return r.at(i).GetResourceVersion() > resourceVersion
+	})
+}
+
+// since returns a copy of the events in the ring whose resourceVersion is greater than resourceVersion, in
+// ascending order of resourceVersion.
+func (r *eventRing) since(resourceVersion uint64) []storage.InternalEvent {
+	i := r.search(resourceVersion)
+	events := make([]storage.InternalEvent, r.size-i)
+	for j := range events {
+		events[j] = r.at(i + j)
+	}
+	return events
+}
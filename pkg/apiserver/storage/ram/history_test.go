@@ -0,0 +1,112 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func resourceVersions(events []storage.InternalEvent) []uint64 {
+	versions := []uint64{}
+	for _, event := range events {
+		versions = append(versions, event.GetResourceVersion())
+	}
+	return versions
+}
+
+func TestEventRingWraparound(t *testing.T) {
+	r := newEventRing(3)
+	for i := uint64(1); i <= 3; i++ {
+		assert.Nil(t, r.add(&emptyInternalEvent{ResourceVersion: i}), "Expected no eviction before the ring is full")
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, resourceVersions(r.since(0)))
+
+	// Wrap around more than once, the oldest event should be evicted each time.
+	for i := uint64(4); i <= 8; i++ {
+		evicted := r.add(&emptyInternalEvent{ResourceVersion: i})
+		if assert.NotNil(t, evicted) {
+			assert.Equal(t, i-3, evicted.GetResourceVersion())
+		}
+	}
+	assert.Equal(t, 3, r.len())
+	assert.Equal(t, []uint64{6, 7, 8}, resourceVersions(r.since(0)))
+	assert.Equal(t, []uint64{7, 8}, resourceVersions(r.since(6)))
+	assert.Equal(t, []uint64{}, resourceVersions(r.since(8)))
+}
+
+func TestEventRingZeroCapacity(t *testing.T) {
+	r := newEventRing(0)
+	event := &emptyInternalEvent{ResourceVersion: 1}
+	assert.Equal(t, event, r.add(event), "Expected the event itself to be evicted")
+	assert.Equal(t, 0, r.len())
+	assert.Empty(t, r.since(0))
+}
+
+func TestSetHistorySize(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	for i := 0; i < 5; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	store.SetHistorySize(10)
+	events, err := store.Replay(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, resourceVersions(events))
+
+	// Shrinking the history discards the oldest events.
+	store.SetHistorySize(2)
+	assert.Equal(t, uint64(3), store.compactedResourceVersion)
+	events, err = store.Replay(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4, 5}, resourceVersions(events))
+	_, err = store.Replay(2)
+	assert.Error(t, err)
+}
+
+func BenchmarkEventRingSince(b *testing.B) {
+	for _, size := range []int{1000, 10000} {
+		r := newEventRing(size)
+		// Fill the ring twice so that it has wrapped around.
+		for i := 1; i <= size*2; i++ {
+			r.add(&emptyInternalEvent{ResourceVersion: uint64(i)})
+		}
+		for _, missed := range []int{1, 100} {
+			b.Run(fmt.Sprintf("size=%d/missed=%d", size, missed), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					r.since(uint64(size*2 - missed))
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkEventRingAdd(b *testing.B) {
+	r := newEventRing(eventHistorySize)
+	events := make([]storage.InternalEvent, b.N)
+	for i := range events {
+		events[i] = &emptyInternalEvent{ResourceVersion: uint64(i + 1)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.add(events[i])
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// initObjects holds the objects a watcher must receive ADDED events of when it starts, whose events are generated
+// page by page as they are sent, see EnableChunkedInitEvents. The objects are immutable once stored, so they can be
+// converted after the store has changed. It's only accessed by the watcher's process.
+type initObjects struct {
+	objs []interface{}
+	// resourceVersion is the resourceVersion of the store when the objects were listed, which the events carry.
+	resourceVersion uint64
+	pageSize        int
+	keyFunc         cache.KeyFunc
+	genEventFunc    storage.GenEventFunc
+}
+
+// nextPage generates the events of the next page of objects, and releases the objects. It returns nil once all
+// the objects have been converted.
+func (o *initObjects) nextPage() ([]storage.InternalEvent, error) {
+	n := o.pageSize
+	if n > len(o.objs) {
+		n = len(o.objs)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	events := make([]storage.InternalEvent, n)
+	for i, obj := range o.objs[:n] {
+		// Objects retrieved from storage have been verified with keyFunc when they are inserted.
+		key, _ := o.keyFunc(obj)
+		event, err := o.genEventFunc(key, nil, obj, o.resourceVersion)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = event
+		o.objs[i] = nil
+	}
+	o.objs = o.objs[n:]
+	return events, nil
+}
+
+// EnableChunkedInitEvents makes the watchers listing the existing objects generate their ADDED events in pages of
+// pageSize objects, as they send them, instead of generating all of them when they are created. The events of a
+// large store are then not all held in memory at once by each watcher, nor generated while holding the store's
+// lock, and a watcher whose client has gone stops generating them. Watchers sharing initial events or backfilled
+// still get them generated up front. It must be called before any watcher is created.
+func (s *store) EnableChunkedInitEvents(pageSize int) error {
+	if pageSize <= 0 {
+		return fmt.Errorf("page size of initial events must be positive, got %d", pageSize)
+	}
+	s.initEventsPageSize = pageSize
+	return nil
+}
+
+// listInit returns the ADDED events carrying the current resourceVersion of the existing objects that may match the
+// provided selectors, or the objects to generate them from if the initial events are chunked.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) listInit(selectors *storage.Selectors) ([]storage.InternalEvent, *initObjects, error) {
+	if s.initEventsPageSize > 0 {
+		return nil, s.listInitObjects(selectors), nil
+	}
+	initEvents, err := s.listInitEvents(selectors)
+	return initEvents, nil, err
+}
+
+// listInitObjects returns the existing objects that may match the provided selectors, whose ADDED events carrying
+// the current resourceVersion are generated by the watcher in pages.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) listInitObjects(selectors *storage.Selectors) *initObjects {
+	return &initObjects{
+		objs:            s.listCandidates(selectors),
+		resourceVersion: s.resourceVersion,
+		pageSize:        s.initEventsPageSize,
+		keyFunc:         s.keyFunc,
+		genEventFunc:    s.genEventFunc,
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// countingGenEvent wraps testGenEvent, counting the events it generates and failing once fail is set.
+type countingGenEvent struct {
+	generated int64
+	fail      int32
+}
+
+func (g *countingGenEvent) genEvent(key string, prevObj, obj interface{}, resourceVersion uint64) (antreastorage.InternalEvent, error) {
+	if atomic.LoadInt32(&g.fail) != 0 {
+		return nil, fmt.Errorf("failed to generate event of %s", key)
+	}
+	atomic.AddInt64(&g.generated, 1)
+	return testGenEvent(key, prevObj, obj, resourceVersion)
+}
+
+func TestEnableChunkedInitEvents(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Error(t, store.EnableChunkedInitEvents(0))
+	assert.NoError(t, store.EnableChunkedInitEvents(3))
+}
+
+func TestChunkedInitEvents(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	require.NoError(t, store.EnableChunkedInitEvents(3))
+	expectedNames := sets.NewString()
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("pod%d", i)
+		require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}))
+		expectedNames.Insert(name)
+	}
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true, SendInitialEvents: true})
+	require.NoError(t, err)
+	defer w.Stop()
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod10"}}))
+
+	// The objects listed when the watch was created are sent in pages, followed by the Bookmark event marking their
+	// end and the live events.
+	events := receiveEvents(t, w, 12)
+	names := sets.NewString()
+	for _, event := range events[:10] {
+		assert.Equal(t, watch.Added, event.Type)
+		names.Insert(event.Object.(*v1.Pod).Name)
+	}
+	assert.Equal(t, expectedNames, names)
+	assert.Equal(t, watch.Bookmark, events[10].Type)
+	assert.Equal(t, "10", events[10].Object.(*v1.Pod).ResourceVersion)
+	assert.Equal(t, watch.Event{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod10"}}}, events[11])
+}
+
+func TestChunkedInitEventsFailure(t *testing.T) {
+	gen := &countingGenEvent{}
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, gen.genEvent, newPod)
+	require.NoError(t, store.EnableChunkedInitEvents(3))
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}))
+	atomic.StoreInt32(&gen.fail, 1)
+
+	// The watch is created as the events are generated afterwards, the watcher is terminated with the error.
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	select {
+	case event, ok := <-w.ResultChan():
+		assert.False(t, ok, "Unexpected event %v", event)
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the watcher to be terminated")
+	}
+	assert.EqualError(t, w.(antreastorage.ErrWatcher).Err(), "failed to generate event of pod1")
+}
+
+func TestChunkedInitEventsBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test creating 100k objects in short mode")
+	}
+	const (
+		numObjects = 100000
+		pageSize   = 100
+		resultSize = 10
+	)
+	gen := &countingGenEvent{}
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, gen.genEvent, newPod)
+	require.NoError(t, store.EnableChunkedInitEvents(pageSize))
+	require.NoError(t, store.SetWatcherChanSizes(resultSize, resultSize))
+	for i := 0; i < numObjects; i++ {
+		require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), Labels: map[string]string{"app": "web"}}}))
+	}
+	atomic.StoreInt64(&gen.generated, 0)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := store.Watch(ctx, "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	defer w.Stop()
+	// The client doesn't receive events, the watcher stalls once its result channel is full.
+	for i := 0; i < 100 && len(w.ResultChan()) < resultSize; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, resultSize, len(w.ResultChan()))
+	time.Sleep(50 * time.Millisecond)
+
+	// At most the page being sent has been generated besides the events in the result channel.
+	generated := atomic.LoadInt64(&gen.generated)
+	assert.True(t, generated <= resultSize+pageSize, "Expected at most %d events generated, got %d", resultSize+pageSize, generated)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// Generating the events of all objects would take tens of megabytes, while the watcher only holds the list of
+	// the objects besides a page of events.
+	growth := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	assert.True(t, growth < 8<<20, "Expected heap to grow by less than 8MiB, got %d bytes", growth)
+
+	// Once the client has gone, the remaining events are never generated.
+	cancel()
+	for range w.ResultChan() {
+	}
+	assert.Equal(t, context.Canceled, w.(antreastorage.ErrWatcher).Err())
+	assert.True(t, atomic.LoadInt64(&gen.generated) < numObjects)
+}
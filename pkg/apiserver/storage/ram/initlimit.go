@@ -0,0 +1,98 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+)
+
+// defaultWatchInitMaxWait is the default maximum duration a watch waits for its turn to compute its initial events,
+// beyond which it's rejected, see SetWatchInitRateLimit.
+const defaultWatchInitMaxWait = 10 * time.Second
+
+var (
+	// watchInitMutex protects watchInitLimiter and watchInitMaxWait.
+	watchInitMutex sync.RWMutex
+	// watchInitLimiter paces the watches computing their initial events across all stores. It's nil if they're
+	// not paced.
+	watchInitLimiter *rate.Limiter
+	// watchInitMaxWait is the maximum duration a watch waits for its turn to compute its initial events.
+	watchInitMaxWait = defaultWatchInitMaxWait
+)
+
+// SetWatchInitRateLimit limits the number of watches computing their initial events to qps per second across all
+// stores, allowing bursts of burst watches, so that the clients reconnecting all at once, e.g. after the controller
+// restarts, don't cause CPU and lock contention spikes. Watches beyond the rate wait for their turn, up to 10
+// seconds, after which they're rejected with a TooManyRequests error telling the client when to retry. Watches
+// resuming from a resourceVersion are not limited as they only replay recent events. A non-positive qps, the
+// default, removes the limit.
+func SetWatchInitRateLimit(qps float64, burst int) error {
+	if qps > 0 && burst <= 0 {
+		return fmt.Errorf("burst of watch initializations must be positive, got %d", burst)
+	}
+	watchInitMutex.Lock()
+	defer watchInitMutex.Unlock()
+
+	if qps <= 0 {
+		watchInitLimiter = nil
+		return nil
+	}
+	watchInitLimiter = rate.NewLimiter(rate.Limit(qps), burst)
+	return nil
+}
+
+// waitForWatchInit blocks until the watch of the provided resource is allowed to compute its initial events. It
+// returns a TooManyRequests error if it would have to wait longer than watchInitMaxWait, or the context's error if
+// the context is canceled in the meantime.
+func waitForWatchInit(ctx context.Context, resource string) error {
+	watchInitMutex.RLock()
+	limiter, maxWait := watchInitLimiter, watchInitMaxWait
+	watchInitMutex.RUnlock()
+	if limiter == nil {
+		return nil
+	}
+
+	reservation := limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if delay > maxWait {
+		reservation.Cancel()
+		recordWatchInitThrottled(resource, throttleResultRejected)
+		klog.V(2).Infof("Rejected watch of %s as too many watches are being initialized", resource)
+		return errors.NewTooManyRequests(fmt.Sprintf("too many watches of %s being initialized, please retry later", resource),
+			int(math.Ceil(delay.Seconds())))
+	}
+	recordWatchInitThrottled(resource, throttleResultDelayed)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the turn back to the watches queued after this one.
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// setWatchInitRateLimit sets the rate limit of watch initializations and the maximum wait for a test, it returns a
+// function restoring the defaults.
+func setWatchInitRateLimit(t *testing.T, qps float64, burst int, maxWait time.Duration) func() {
+	require.NoError(t, SetWatchInitRateLimit(qps, burst))
+	watchInitMutex.Lock()
+	watchInitMaxWait = maxWait
+	watchInitMutex.Unlock()
+	return func() {
+		SetWatchInitRateLimit(0, 0)
+		watchInitMutex.Lock()
+		watchInitMaxWait = defaultWatchInitMaxWait
+		watchInitMutex.Unlock()
+	}
+}
+
+func TestSetWatchInitRateLimit(t *testing.T) {
+	assert.Error(t, SetWatchInitRateLimit(10, 0))
+	assert.NoError(t, SetWatchInitRateLimit(10, 1))
+	assert.NotNil(t, watchInitLimiter)
+	assert.NoError(t, SetWatchInitRateLimit(0, 0))
+	assert.Nil(t, watchInitLimiter)
+}
+
+func TestWatchInitRateLimitBurst(t *testing.T) {
+	defer setWatchInitRateLimit(t, 10, 2, time.Second)()
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+
+	// A burst of watches is initialized at the configured pace instead of all at once.
+	start := time.Now()
+	durations := make(chan time.Duration, 6)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer w.Stop()
+			<-w.ResultChan()
+			durations <- time.Since(start)
+		}()
+	}
+	wg.Wait()
+	close(durations)
+	var immediate int
+	var last time.Duration
+	for d := range durations {
+		if d < 50*time.Millisecond {
+			immediate++
+		}
+		if d > last {
+			last = d
+		}
+	}
+	assert.Equal(t, 2, immediate, "Only the burst should be initialized immediately")
+	assert.True(t, last >= 350*time.Millisecond, "The watches beyond the burst should be paced at 10 per second, the last one was initialized after %v", last)
+}
+
+func TestWatchInitRateLimitReject(t *testing.T) {
+	defer setWatchInitRateLimit(t, 1, 1, 500*time.Millisecond)()
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	rejected := testutil.ToFloat64(watchInitsThrottled.WithLabelValues(store.resource, throttleResultRejected))
+
+	w, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+	// The next turn is about a second away, beyond the maximum wait.
+	_, err = store.Watch(context.Background(), "", selectors)
+	assert.True(t, errors.IsTooManyRequests(err), "Expected TooManyRequests error, got %v", err)
+	delay, ok := errors.SuggestsClientDelay(err)
+	assert.True(t, ok && delay > 0, "The error should tell the client when to retry")
+	assert.Equal(t, rejected+1, testutil.ToFloat64(watchInitsThrottled.WithLabelValues(store.resource, throttleResultRejected)))
+
+	// Watches resuming from a resourceVersion are not paced.
+	w, err = store.Watch(context.Background(), "1", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+}
+
+func TestWatchInitRateLimitCanceled(t *testing.T) {
+	defer setWatchInitRateLimit(t, 1, 1, 5*time.Second)()
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+
+	w, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = store.Watch(ctx, "", selectors)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, store.CountWatchers())
+}
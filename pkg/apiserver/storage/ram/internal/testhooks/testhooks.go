@@ -0,0 +1,26 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testhooks exposes seams of the ram store to the test helpers in package ramtest, without exporting them
+// from the store to production code.
+package testhooks
+
+import (
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// InjectEvent dispatches an event generated by genEvent to the watchers of store, which must have been created by
+// ram.NewStore, without changing the stored objects. genEvent is called with the next resourceVersion. It's set by
+// package ram when it's initialized.
+var InjectEvent func(store storage.Interface, genEvent func(resourceVersion uint64) (storage.InternalEvent, error)) error
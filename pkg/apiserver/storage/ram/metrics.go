@@ -0,0 +1,290 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+const (
+	metricNamespace = "antrea"
+	metricSubsystem = "apiserver"
+	// selectorsHashBuckets is the number of values the "selectors_hash" label can take, which bounds the
+	// cardinality of the metrics labeled by watchers' selectors.
+	selectorsHashBuckets = 64
+)
+
+// The reasons why events are dropped for a watcher, used as the "reason" label of watcherEventsDropped.
+const (
+	// dropReasonBufferFull means the watcher's buffer was full: the event was discarded according to the
+	// watcher's BackpressurePolicy, or the watcher was terminated as its buffer didn't become available in time.
+	dropReasonBufferFull = "buffer_full"
+	// dropReasonSendTimeout means the client didn't receive the event in time and the watcher was terminated.
+	dropReasonSendTimeout = "send_timeout"
+	// dropReasonClientGone means the client went away before the event could be sent to it.
+	dropReasonClientGone = "client_gone"
+	// dropReasonCompaction means the events the watcher requested had been discarded from history.
+	dropReasonCompaction = "compaction"
+	// dropReasonDispatchBreaker means the watcher was terminated as the slowest one when dispatching an event
+	// took too long.
+	dropReasonDispatchBreaker = "dispatch_breaker"
+)
+
+// The results of throttling the initialization of a watch, used as the "result" label of watchInitsThrottled.
+const (
+	// throttleResultDelayed means the watch waited for its turn to compute its initial events.
+	throttleResultDelayed = "delayed"
+	// throttleResultRejected means the watch was rejected as its turn was too far away.
+	throttleResultRejected = "rejected"
+)
+
+var (
+	watcherEventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watcher_events_dropped_total",
+			Help:      "Number of events dropped for watchers, either discarded or lost with the terminated watcher, by reason.",
+		},
+		[]string{"resource", "reason"},
+	)
+	watcherConversionErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watcher_event_conversion_errors_total",
+			Help:      "Number of events skipped for watchers because converting them panicked.",
+		},
+		[]string{"resource"},
+	)
+	watcherConversionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watcher_event_conversion_duration_seconds",
+			Help:      "Duration of converting an event for a watcher, including selecting and transforming its object, by hash of the watcher's selectors.",
+			Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10),
+		},
+		[]string{"resource", "selectors_hash"},
+	)
+	watcherEventsDowngraded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watcher_events_downgraded_total",
+			Help:      "Number of events converted to an older format for watchers which don't support their version.",
+		},
+		[]string{"resource"},
+	)
+	watchInitsThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watch_inits_throttled_total",
+			Help:      "Number of watches delayed or rejected as too many watches were computing their initial events, by result.",
+		},
+		[]string{"resource", "result"},
+	)
+	watchEventsOutOfOrder = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watch_out_of_order_total",
+			Help:      "Number of events received by watchers after an event of a higher resourceVersion, which indicates a dispatching bug.",
+		},
+		[]string{"resource"},
+	)
+	watchersCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watchers_created_total",
+			Help:      "Number of watchers created.",
+		},
+		[]string{"resource"},
+	)
+	watchersStopped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watchers_stopped_total",
+			Help:      "Number of watchers stopped.",
+		},
+		[]string{"resource"},
+	)
+	watchersActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Subsystem: metricSubsystem,
+			Name:      "watchers_active",
+			Help:      "Number of watchers created but not stopped yet.",
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(watcherEventsDropped, watcherConversionErrors, watcherConversionDuration, watcherEventsDowngraded, watchInitsThrottled, watchEventsOutOfOrder, watchersCreated, watchersStopped, watchersActive)
+}
+
+// recordWatcherCreated updates the lifecycle metrics of watchers when a watcher of the resource is created.
+func recordWatcherCreated(resource string) {
+	watchersCreated.WithLabelValues(resource).Inc()
+	watchersActive.WithLabelValues(resource).Inc()
+}
+
+// recordEventDropped counts an event of the resource dropped for a watcher for the provided reason.
+func recordEventDropped(resource, reason string) {
+	watcherEventsDropped.WithLabelValues(resource, reason).Inc()
+}
+
+// recordConversionError counts an event of the resource skipped for a watcher as converting it panicked.
+func recordConversionError(resource string) {
+	watcherConversionErrors.WithLabelValues(resource).Inc()
+}
+
+// recordConversionDuration observes the duration of converting an event of the resource for a watcher whose
+// selectors hash to the provided bucket.
+func recordConversionDuration(resource, selectorsHash string, duration time.Duration) {
+	watcherConversionDuration.WithLabelValues(resource, selectorsHash).Observe(duration.Seconds())
+}
+
+// hashSelectors returns the bucket the provided selectors hash to, among selectorsHashBuckets. Equal selectors hash
+// to the same bucket regardless of the order their requirements were specified in.
+func hashSelectors(selectors *storage.Selectors) string {
+	h := fnv.New32a()
+	h.Write([]byte(selectors.Canonical()))
+	return fmt.Sprintf("%02x", h.Sum32()%selectorsHashBuckets)
+}
+
+// recordEventDowngraded counts an event of the resource converted to an older format for a watcher.
+func recordEventDowngraded(resource string) {
+	watcherEventsDowngraded.WithLabelValues(resource).Inc()
+}
+
+// recordWatchInitThrottled counts a watch of the resource delayed or rejected as too many watches were computing
+// their initial events.
+func recordWatchInitThrottled(resource, result string) {
+	watchInitsThrottled.WithLabelValues(resource, result).Inc()
+}
+
+// recordEventOutOfOrder counts an event of the resource received by a watcher after an event of a higher
+// resourceVersion.
+func recordEventOutOfOrder(resource string) {
+	watchEventsOutOfOrder.WithLabelValues(resource).Inc()
+}
+
+// recordWatcherStopped updates the lifecycle metrics of watchers when a watcher of the resource is stopped.
+// It must be called exactly once for each created watcher.
+func recordWatcherStopped(resource string) {
+	watchersStopped.WithLabelValues(resource).Inc()
+	watchersActive.WithLabelValues(resource).Dec()
+}
+
+// watchersCollector implements prometheus.Collector. It reports the buffer depth and capacity of
+// the input channels of the active watchers of a store, including the clients of shared sources, when
+// metrics are scraped, aggregated per store as watchers come and go, along with the duration of
+// dispatching events to the watchers.
+type watchersCollector struct {
+	store        *store
+	depthDesc    *prometheus.Desc
+	maxDepthDesc *prometheus.Desc
+	capacityDesc *prometheus.Desc
+}
+
+func newWatchersCollector(s *store) *watchersCollector {
+	constLabels := prometheus.Labels{"resource": s.resource}
+	return &watchersCollector{
+		store: s,
+		depthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricNamespace, metricSubsystem, "watcher_input_buffer_depth"),
+			"Number of events buffered in the input channels of all watchers.",
+			nil,
+			constLabels,
+		),
+		maxDepthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricNamespace, metricSubsystem, "watcher_input_buffer_depth_max"),
+			"Maximum number of events buffered in the input channel of a watcher.",
+			nil,
+			constLabels,
+		),
+		capacityDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricNamespace, metricSubsystem, "watcher_input_buffer_capacity"),
+			"Capacity of the input channels of all watchers.",
+			nil,
+			constLabels,
+		),
+	}
+}
+
+// RegisterMetrics registers the collectors reporting the watchers and the dispatch latency of the provided stores,
+// which must have been created by NewStore, with registerer. It fails if the collector of a store of the same
+// resource has been registered with it already.
+func RegisterMetrics(registerer prometheus.Registerer, stores ...storage.Interface) error {
+	for _, st := range stores {
+		s, ok := st.(*store)
+		if !ok {
+			return fmt.Errorf("store %T was not created by NewStore", st)
+		}
+		if err := registerer.Register(newWatchersCollector(s)); err != nil {
+			return fmt.Errorf("error registering the metrics of %s store: %v", s.resource, err)
+		}
+	}
+	return nil
+}
+
+func (c *watchersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depthDesc
+	ch <- c.maxDepthDesc
+	ch <- c.capacityDesc
+	c.store.dispatchLatency.Describe(ch)
+}
+
+func (c *watchersCollector) Collect(ch chan<- prometheus.Metric) {
+	c.store.dispatchLatency.Collect(ch)
+
+	var depth, maxDepth, capacity int
+	observe := func(w *storeWatcher) {
+		watcherDepth := len(w.input)
+		depth += watcherDepth
+		if watcherDepth > maxDepth {
+			maxDepth = watcherDepth
+		}
+		capacity += cap(w.input)
+	}
+	c.store.watcherMutex.RLock()
+	for _, w := range c.store.watchers {
+		observe(w)
+		// The clients of a shared source have their own buffer, fed by the source's.
+		if w.source != nil {
+			w.source.mutex.RLock()
+			for client := range w.source.clients {
+				observe(client)
+			}
+			w.source.mutex.RUnlock()
+		}
+	}
+	c.store.watcherMutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(c.depthDesc, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(c.maxDepthDesc, prometheus.GaugeValue, float64(maxDepth))
+	ch <- prometheus.MustNewConstMetric(c.capacityDesc, prometheus.GaugeValue, float64(capacity))
+}
@@ -0,0 +1,399 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func TestWatchersCollector(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	// Add watchers without running their process goroutine so that events stay in the input channel.
+	s.watchers[0] = newStoreWatcher(10, 10, &storage.Selectors{}, func() {}, newPod)
+	s.watchers[1] = newStoreWatcher(5, 5, &storage.Selectors{}, func() {}, newPod)
+	s.watchers[0].nonBlockingAdd("", &emptyInternalEvent{ResourceVersion: 1})
+	s.watchers[0].nonBlockingAdd("", &emptyInternalEvent{ResourceVersion: 2})
+	s.watchers[1].nonBlockingAdd("", &emptyInternalEvent{ResourceVersion: 2})
+
+	expected := `
+# HELP antrea_apiserver_watcher_input_buffer_capacity Capacity of the input channels of all watchers.
+# TYPE antrea_apiserver_watcher_input_buffer_capacity gauge
+antrea_apiserver_watcher_input_buffer_capacity{resource="Pod"} 15
+# HELP antrea_apiserver_watcher_input_buffer_depth Number of events buffered in the input channels of all watchers.
+# TYPE antrea_apiserver_watcher_input_buffer_depth gauge
+antrea_apiserver_watcher_input_buffer_depth{resource="Pod"} 3
+# HELP antrea_apiserver_watcher_input_buffer_depth_max Maximum number of events buffered in the input channel of a watcher.
+# TYPE antrea_apiserver_watcher_input_buffer_depth_max gauge
+antrea_apiserver_watcher_input_buffer_depth_max{resource="Pod"} 2
+`
+	if err := testutil.CollectAndCompare(newWatchersCollector(s), strings.NewReader(expected),
+		"antrea_apiserver_watcher_input_buffer_capacity", "antrea_apiserver_watcher_input_buffer_depth",
+		"antrea_apiserver_watcher_input_buffer_depth_max"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	capacity := func() float64 {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "antrea_apiserver_watcher_input_buffer_capacity" {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatalf("No buffer capacity reported")
+		return 0
+	}
+	s1 := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	s1.watchers[0] = newStoreWatcher(10, 10, &storage.Selectors{}, func() {}, newPod)
+	require.NoError(t, RegisterMetrics(registry, s1))
+	assert.Equal(t, float64(10), capacity())
+
+	// A second store of the same resource is rejected, the first one is still reported.
+	s2 := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	s2.watchers[0] = newStoreWatcher(5, 5, &storage.Selectors{}, func() {}, newPod)
+	assert.Error(t, RegisterMetrics(registry, s2))
+	assert.Equal(t, float64(10), capacity())
+
+	assert.Error(t, RegisterMetrics(registry, &foreignStore{}), "Stores not created by NewStore can't be registered")
+}
+
+// foreignStore is a storage.Interface not created by NewStore.
+type foreignStore struct {
+	storage.Interface
+}
+
+func TestWatcherLifecycleMetrics(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	createdBefore := testutil.ToFloat64(watchersCreated.WithLabelValues("Pod"))
+	stoppedBefore := testutil.ToFloat64(watchersStopped.WithLabelValues("Pod"))
+	activeBefore := testutil.ToFloat64(watchersActive.WithLabelValues("Pod"))
+	assertMetrics := func(created, stopped, active float64) {
+		assert.Equal(t, createdBefore+created, testutil.ToFloat64(watchersCreated.WithLabelValues("Pod")), "Unexpected created watchers number")
+		assert.Equal(t, stoppedBefore+stopped, testutil.ToFloat64(watchersStopped.WithLabelValues("Pod")), "Unexpected stopped watchers number")
+		assert.Equal(t, activeBefore+active, testutil.ToFloat64(watchersActive.WithLabelValues("Pod")), "Unexpected active watchers number")
+	}
+
+	w1, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	w2, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	assertMetrics(2, 0, 2)
+
+	// Concurrent calls of Stop should only be counted once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w1.Stop()
+		}()
+	}
+	wg.Wait()
+	assertMetrics(2, 1, 1)
+
+	w2.(*storeWatcher).StopWithDrain(0)
+	w2.Stop()
+	assertMetrics(2, 2, 0)
+
+	// An expired watcher is stopped once it has sent the error, even if the client doesn't call Stop.
+	s.SetHistorySize(1)
+	for i := 0; i < 3; i++ {
+		s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	w3, err := s.Watch(context.Background(), "1", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	assert.Equal(t, watch.Error, (<-w3.ResultChan()).Type)
+	<-w3.(*storeWatcher).stopped
+	assertMetrics(3, 3, 0)
+	w3.Stop()
+	assertMetrics(3, 3, 0)
+}
+
+func TestWatcherEventsDroppedReasons(t *testing.T) {
+	selectors := &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	tests := []struct {
+		name   string
+		reason string
+		drop   func(t *testing.T)
+	}{
+		{
+			name:   "buffer full",
+			reason: dropReasonBufferFull,
+			drop: func(t *testing.T) {
+				s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+				require.NoError(t, s.SetWatcherChanSizes(1, 1))
+				w, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), BackpressurePolicy: storage.DropNewest})
+				require.NoError(t, err)
+				// The client doesn't receive, the first event that finds the buffer full is dropped and the
+				// watcher is stopped.
+				for i := 0; i < 10; i++ {
+					s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+					time.Sleep(5 * time.Millisecond)
+				}
+				<-w.(*storeWatcher).done
+			},
+		},
+		{
+			name:   "send timeout",
+			reason: dropReasonSendTimeout,
+			drop: func(t *testing.T) {
+				w := newStoreWatcher(1, 1, selectors, nil, newPod)
+				w.resource = "Pod"
+				w.sendTimeout = 10 * time.Millisecond
+				w.send(&watch.Event{Type: watch.Added, Object: &v1.Pod{}})
+				// The second event times out as the client doesn't receive the first one.
+				w.send(&watch.Event{Type: watch.Added, Object: &v1.Pod{}})
+			},
+		},
+		{
+			name:   "client gone",
+			reason: dropReasonClientGone,
+			drop: func(t *testing.T) {
+				w := newStoreWatcher(1, 1, selectors, nil, newPod)
+				w.resource = "Pod"
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				w.ctxDone = ctx.Done()
+				w.send(&watch.Event{Type: watch.Added, Object: &v1.Pod{}})
+			},
+		},
+		{
+			name:   "compaction",
+			reason: dropReasonCompaction,
+			drop: func(t *testing.T) {
+				s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+				s.SetHistorySize(1)
+				for i := 0; i < 3; i++ {
+					s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+				}
+				w, err := s.Watch(context.Background(), "1", selectors)
+				require.NoError(t, err)
+				for range w.ResultChan() {
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]float64{}
+			for _, reason := range []string{dropReasonBufferFull, dropReasonSendTimeout, dropReasonClientGone, dropReasonCompaction, dropReasonDispatchBreaker} {
+				before[reason] = testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", reason))
+			}
+			tt.drop(t)
+			for reason, count := range before {
+				expected := count
+				if reason == tt.reason {
+					expected++
+				}
+				assert.Equal(t, expected, testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", reason)), "Unexpected dropped events number with reason %s", reason)
+			}
+		})
+	}
+}
+
+// versionedInternalEvent is a simpleInternalEvent of the provided version.
+type versionedInternalEvent struct {
+	simpleInternalEvent
+	Version storage.EventVersion
+}
+
+func (e *versionedInternalEvent) GetEventVersion() storage.EventVersion {
+	return e.Version
+}
+
+func TestWatcherEventsDowngraded(t *testing.T) {
+	tests := []struct {
+		name       string
+		selectors  *storage.Selectors
+		event      storage.InternalEvent
+		downgraded bool
+	}{
+		{
+			name:       "v1 watcher",
+			selectors:  &storage.Selectors{EventVersion: storage.EventVersionFull},
+			event:      &versionedInternalEvent{simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}}, storage.EventVersionDelta},
+			downgraded: true,
+		},
+		{
+			name:       "watcher not supporting delta",
+			selectors:  &storage.Selectors{},
+			event:      &versionedInternalEvent{simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}}, storage.EventVersionDelta},
+			downgraded: true,
+		},
+		{
+			name:      "watcher supporting delta",
+			selectors: &storage.Selectors{SupportsDelta: true},
+			event:     &versionedInternalEvent{simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}}, storage.EventVersionDelta},
+		},
+		{
+			name:      "watcher newer than store",
+			selectors: &storage.Selectors{EventVersion: storage.LatestEventVersion + 1},
+			event:     &versionedInternalEvent{simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}}, storage.EventVersionDelta},
+		},
+		{
+			name:      "v1 event",
+			selectors: &storage.Selectors{EventVersion: storage.EventVersionFull},
+			event:     &versionedInternalEvent{simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}}, storage.EventVersionFull},
+		},
+		{
+			name:      "added event",
+			selectors: &storage.Selectors{EventVersion: storage.EventVersionFull},
+			event:     &versionedInternalEvent{simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{}}, storage.EventVersionDelta},
+		},
+		{
+			name:      "unversioned event",
+			selectors: &storage.Selectors{EventVersion: storage.EventVersionFull},
+			event:     &simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			defer s.Stop()
+			tt.selectors.Label = labels.Everything()
+			tt.selectors.Field = fields.Everything()
+			w, err := s.Watch(context.Background(), "", tt.selectors)
+			require.NoError(t, err)
+			defer w.Stop()
+
+			before := testutil.ToFloat64(watcherEventsDowngraded.WithLabelValues("Pod"))
+			require.NoError(t, s.injectEvent(func(resourceVersion uint64) (storage.InternalEvent, error) {
+				switch event := tt.event.(type) {
+				case *versionedInternalEvent:
+					event.ResourceVersion = resourceVersion
+				case *simpleInternalEvent:
+					event.ResourceVersion = resourceVersion
+				}
+				return tt.event, nil
+			}))
+			select {
+			case <-w.ResultChan():
+			case <-time.After(time.Second):
+				t.Fatal("Timeout waiting for the event")
+			}
+			expected := before
+			if tt.downgraded {
+				expected++
+			}
+			assert.Equal(t, expected, testutil.ToFloat64(watcherEventsDowngraded.WithLabelValues("Pod")))
+		})
+	}
+}
+
+func TestWatcherEventsDowngradedCoalesced(t *testing.T) {
+	genDeltaEvent := func(key string, prevObj, obj interface{}, rv uint64) (storage.InternalEvent, error) {
+		eventType := watch.Added
+		if prevObj != nil {
+			eventType = watch.Modified
+		}
+		return &versionedInternalEvent{simpleInternalEvent{Type: eventType, Object: obj.(runtime.Object), ResourceVersion: rv}, storage.EventVersionDelta}, nil
+	}
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, genDeltaEvent, newPod)
+	defer s.Stop()
+	w, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), CoalesceModifications: true})
+	require.NoError(t, err)
+	defer w.Stop()
+
+	before := testutil.ToFloat64(watcherEventsDowngraded.WithLabelValues("Pod"))
+	w.(storage.PausableWatcher).Pause()
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}
+	require.NoError(t, s.Create(pod))
+	for i := 0; i < 5; i++ {
+		pod = pod.DeepCopy()
+		pod.Labels = map[string]string{"version": fmt.Sprint(i)}
+		require.NoError(t, s.Update(pod))
+	}
+	w.(storage.PausableWatcher).Resume()
+
+	// Each Modified event the client receives is counted once, however many modifications it coalesced.
+	modified := 0
+	for done := false; !done; {
+		select {
+		case event := <-w.ResultChan():
+			if event.Type == watch.Modified {
+				modified++
+			}
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	require.NotZero(t, modified)
+	assert.Equal(t, before+float64(modified), testutil.ToFloat64(watcherEventsDowngraded.WithLabelValues("Pod")))
+}
+
+func TestHashSelectors(t *testing.T) {
+	a := &storage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "web", "tier": "front"})}
+	b := &storage.Selectors{Label: labels.SelectorFromSet(labels.Set{"tier": "front", "app": "web"})}
+	assert.Equal(t, hashSelectors(a), hashSelectors(b), "Equal selectors should hash to the same bucket")
+	buckets := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		buckets[hashSelectors(&storage.Selectors{Key: fmt.Sprintf("pod%d", i)})] = true
+	}
+	assert.True(t, len(buckets) <= selectorsHashBuckets, "Expected at most %d buckets, got %d", selectorsHashBuckets, len(buckets))
+}
+
+func TestWatcherConversionDuration(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	slowSelectors := &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), Transform: func(obj runtime.Object) runtime.Object {
+		time.Sleep(10 * time.Millisecond)
+		return obj
+	}}
+	hash := hashSelectors(slowSelectors)
+	histogram := func() *dto.Histogram {
+		metric := &dto.Metric{}
+		require.NoError(t, watcherConversionDuration.WithLabelValues("Pod", hash).(prometheus.Metric).Write(metric))
+		return metric.Histogram
+	}
+	before := histogram()
+	w, err := store.Watch(context.Background(), "", slowSelectors)
+	require.NoError(t, err)
+	defer w.Stop()
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	<-w.ResultChan()
+
+	after := histogram()
+	assert.Equal(t, before.GetSampleCount()+1, after.GetSampleCount())
+	assert.True(t, after.GetSampleSum()-before.GetSampleSum() >= 0.01, "Expected the slow transform to be recorded, got %v seconds", after.GetSampleSum()-before.GetSampleSum())
+	watchers := store.ListWatchers()
+	require.Len(t, watchers, 1)
+	assert.Equal(t, hash, watchers[0].SelectorsHash)
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// multiWatcher implements watch.Interface and storage.WaitableWatcher. It fans in the events of the watchers of multiple stores into a
+// single result channel, wrapping the object of each event in a storage.KindedObject.
+//
+// Each store has its own resourceVersion sequence, so there is no ordering across kinds: the events of a kind
+// are delivered in ascending order of that kind's resourceVersion, but they may be interleaved arbitrarily with
+// the events of other kinds. A client resuming such a watch must track the latest resourceVersion per kind.
+type multiWatcher struct {
+	kinds    []string
+	watchers []watch.Interface
+	result   chan watch.Event
+	done     chan struct{}
+	// stopped is closed when the result channel has been closed.
+	stopped  chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// WatchKinds starts watching the stores of selectors.Kinds through a single watch. stores is a mapping from the
+// kind to its store, and resourceVersions is a mapping from the kind to the resourceVersion to watch from, with
+// the same semantics as storage.Interface.Watch. If the watcher of any kind stops, the whole watch is stopped so
+// that the client can restart it without missing events of that kind.
+func WatchKinds(ctx context.Context, stores map[string]storage.Interface, resourceVersions map[string]string, selectors *storage.Selectors) (watch.Interface, error) {
+	if len(selectors.Kinds) == 0 {
+		return nil, errors.NewBadRequest("at least one kind must be specified")
+	}
+	w := &multiWatcher{
+		result:  make(chan watch.Event, watcherChanSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, kind := range selectors.Kinds {
+		s, ok := stores[kind]
+		if !ok {
+			w.stopWatchers()
+			return nil, errors.NewBadRequest(fmt.Sprintf("unknown kind %q", kind))
+		}
+		kindSelectors := *selectors
+		kindSelectors.Kinds = nil
+		kindSelectors.MaxBatchSize, kindSelectors.BatchWindow = 0, 0
+		kindWatcher, err := s.Watch(ctx, resourceVersions[kind], &kindSelectors)
+		if err != nil {
+			w.stopWatchers()
+			return nil, err
+		}
+		w.kinds = append(w.kinds, kind)
+		w.watchers = append(w.watchers, kindWatcher)
+	}
+
+	for i := range w.watchers {
+		w.wg.Add(1)
+		go w.forward(w.kinds[i], w.watchers[i])
+	}
+	go func() {
+		w.wg.Wait()
+		close(w.result)
+		close(w.stopped)
+	}()
+	return w, nil
+}
+
+// forward sends the events of the provided watcher to result channel until the watcher or w is stopped.
+func (w *multiWatcher) forward(kind string, kindWatcher watch.Interface) {
+	defer w.wg.Done()
+	// Stop the whole watch if the watcher of a kind stops, otherwise the client would miss its events silently.
+	defer w.Stop()
+
+	for event := range kindWatcher.ResultChan() {
+		event.Object = &storage.KindedObject{Kind: kind, Object: event.Object}
+		select {
+		case w.result <- event:
+		case <-w.done:
+			return
+		}
+	}
+	klog.V(2).Infof("The watcher of kind %s had been stopped, stopping the multi-kind watch", kind)
+}
+
+// ResultChan returns the channel for outgoing events to the client.
+func (w *multiWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// WaitStopped implements storage.WaitableWatcher. It returns whether the result channel has been closed and the
+// watchers of all kinds have returned.
+func (w *multiWatcher) WaitStopped(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.stopped:
+	case <-timer.C:
+		return false
+	}
+	for _, kindWatcher := range w.watchers {
+		if waitable, ok := kindWatcher.(storage.WaitableWatcher); ok && !waitable.WaitStopped(time.Until(deadline)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop stops the watchers of all kinds. It's idempotent and thread safe.
+func (w *multiWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.stopWatchers()
+	})
+}
+
+func (w *multiWatcher) stopWatchers() {
+	for _, kindWatcher := range w.watchers {
+		kindWatcher.Stop()
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func newMultiWatchStores() (*store, *store, map[string]storage.Interface) {
+	storeA := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	storeB := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	return storeA, storeB, map[string]storage.Interface{"A": storeA, "B": storeB}
+}
+
+func TestWatchKinds(t *testing.T) {
+	storeA, storeB, stores := newMultiWatchStores()
+	storeA.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a0"}})
+
+	w, err := WatchKinds(context.Background(), stores, nil, &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), Kinds: []string{"A", "B"}})
+	if err != nil {
+		t.Fatalf("Failed to watch kinds: %v", err)
+	}
+	defer w.Stop()
+	for i := 1; i < 4; i++ {
+		storeA.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("a%d", i)}})
+		storeB.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("b%d", i)}})
+	}
+
+	// Events of each kind must be tagged and delivered in order, regardless of how they are interleaved.
+	received := map[string][]string{}
+	for i := 0; i < 7; i++ {
+		select {
+		case event := <-w.ResultChan():
+			assert.Equal(t, watch.Added, event.Type)
+			obj, ok := event.Object.(*storage.KindedObject)
+			if !ok {
+				t.Fatalf("Expected *storage.KindedObject, got %T", event.Object)
+			}
+			received[obj.Kind] = append(received[obj.Kind], obj.Object.(*v1.Pod).Name)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+	assert.Equal(t, []string{"a0", "a1", "a2", "a3"}, received["A"])
+	assert.Equal(t, []string{"b1", "b2", "b3"}, received["B"])
+}
+
+func TestWatchKindsStop(t *testing.T) {
+	storeA, storeB, stores := newMultiWatchStores()
+	w, err := WatchKinds(context.Background(), stores, nil, &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), Kinds: []string{"A", "B"}})
+	if err != nil {
+		t.Fatalf("Failed to watch kinds: %v", err)
+	}
+	assert.Equal(t, 1, storeA.GetWatchersNum())
+	assert.Equal(t, 1, storeB.GetWatchersNum())
+
+	// Stopping the watcher of one kind should stop the whole watch.
+	w.(*multiWatcher).watchers[0].Stop()
+	select {
+	case _, ok := <-w.ResultChan():
+		assert.False(t, ok, "Expected result channel to be closed")
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for result channel to be closed")
+	}
+	assert.Equal(t, 0, storeA.GetWatchersNum())
+	assert.Equal(t, 0, storeB.GetWatchersNum())
+	w.Stop()
+	assert.True(t, w.(storage.WaitableWatcher).WaitStopped(time.Second), "The watchers of all kinds should have returned")
+}
+
+func TestWatchKindsInvalid(t *testing.T) {
+	storeA, _, stores := newMultiWatchStores()
+	_, err := WatchKinds(context.Background(), stores, nil, &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	assert.True(t, errors.IsBadRequest(err), "Expected BadRequest error without kinds, got %v", err)
+
+	_, err = WatchKinds(context.Background(), stores, nil, &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), Kinds: []string{"A", "C"}})
+	assert.True(t, errors.IsBadRequest(err), "Expected BadRequest error for unknown kind, got %v", err)
+	// The watcher created for the known kind must be cleaned up.
+	assert.Equal(t, 0, storeA.GetWatchersNum())
+}
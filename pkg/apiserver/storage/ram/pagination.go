@@ -0,0 +1,153 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// listSnapshotTTL is the default duration a snapshot of the store is kept for paginated lists after its last use.
+const listSnapshotTTL = time.Minute
+
+// listContinueToken is decoded from and encoded to the opaque continue token of paginated lists.
+type listContinueToken struct {
+	// ResourceVersion is the resourceVersion of the snapshot the list is paging through.
+	ResourceVersion uint64 `json:"rv"`
+	// StartAfter is the key of the last object returned.
+	StartAfter string `json:"start"`
+}
+
+func (t *listContinueToken) encode() (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeContinueToken(token string) (*listContinueToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.NewBadRequest("continue key is not valid: " + err.Error())
+	}
+	t := new(listContinueToken)
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, errors.NewBadRequest("continue key is not valid: " + err.Error())
+	}
+	return t, nil
+}
+
+// listSnapshot is the state of the store at a resourceVersion, kept for the pages after the first one.
+type listSnapshot struct {
+	// keys are the sorted keys of objects.
+	keys    []string
+	objects map[string]interface{}
+	// expireAt is the time after which the snapshot is discarded.
+	expireAt time.Time
+}
+
+// ListPage returns at most limit objects in the order of their keys, starting after the position encoded in
+// continueToken, and a continue token for the next page which is empty if there are no more objects. The pages
+// of a list are taken from the same snapshot of the store, so that objects changed in between are returned as
+// they were when the first page was listed. The snapshot is discarded if it's not used for a while, after which
+// its tokens get a ResourceExpired error. If limit is not positive, all objects are returned.
+func (s *store) ListPage(limit int64, continueToken string) ([]interface{}, string, error) {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	now := time.Now()
+	for rv, snapshot := range s.snapshots {
+		if now.After(snapshot.expireAt) {
+			delete(s.snapshots, rv)
+		}
+	}
+
+	var snapshot *listSnapshot
+	var resourceVersion uint64
+	startIdx := 0
+	if continueToken == "" {
+		snapshot, resourceVersion = s.takeSnapshot()
+		if limit <= 0 || int64(len(snapshot.keys)) <= limit {
+			return snapshot.list(0, len(snapshot.keys)), "", nil
+		}
+		s.snapshots[resourceVersion] = snapshot
+	} else {
+		token, err := decodeContinueToken(continueToken)
+		if err != nil {
+			return nil, "", err
+		}
+		var ok bool
+		if snapshot, ok = s.snapshots[token.ResourceVersion]; !ok {
+			return nil, "", errors.NewResourceExpired("the provided continue parameter is too old, please restart the list")
+		}
+		resourceVersion = token.ResourceVersion
+		startIdx = sort.Search(len(snapshot.keys), func(i int) bool {
+			return snapshot.keys[i] > token.StartAfter
+		})
+	}
+	snapshot.expireAt = now.Add(s.snapshotTTL)
+
+	endIdx := len(snapshot.keys)
+	if limit > 0 && int64(endIdx-startIdx) > limit {
+		endIdx = startIdx + int(limit)
+	}
+	objs := snapshot.list(startIdx, endIdx)
+	if endIdx == len(snapshot.keys) {
+		return objs, "", nil
+	}
+	next, err := (&listContinueToken{ResourceVersion: resourceVersion, StartAfter: snapshot.keys[endIdx-1]}).encode()
+	if err != nil {
+		return nil, "", err
+	}
+	return objs, next, nil
+}
+
+// takeSnapshot returns a snapshot of the store and its resourceVersion. If a snapshot of the same
+// resourceVersion has been taken, it's reused.
+func (s *store) takeSnapshot() (*listSnapshot, uint64) {
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	if snapshot, ok := s.snapshots[s.resourceVersion]; ok {
+		return snapshot, s.resourceVersion
+	}
+	objs := s.storage.List()
+	snapshot := &listSnapshot{
+		keys:    make([]string, 0, len(objs)),
+		objects: make(map[string]interface{}, len(objs)),
+	}
+	for _, obj := range objs {
+		// Objects retrieved from storage have been verified with keyFunc when they are inserted.
+		key, _ := s.keyFunc(obj)
+		snapshot.keys = append(snapshot.keys, key)
+		snapshot.objects[key] = obj
+	}
+	sort.Strings(snapshot.keys)
+	return snapshot, s.resourceVersion
+}
+
+// list returns the objects whose keys are in [startIdx, endIdx).
+func (s *listSnapshot) list(startIdx, endIdx int) []interface{} {
+	objs := make([]interface{}, 0, endIdx-startIdx)
+	for _, key := range s.keys[startIdx:endIdx] {
+		objs = append(objs, s.objects[key])
+	}
+	return objs
+}
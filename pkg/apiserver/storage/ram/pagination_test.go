@@ -0,0 +1,120 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func podNames(objs []interface{}) []string {
+	names := make([]string, len(objs))
+	for i, obj := range objs {
+		names[i] = obj.(*v1.Pod).Name
+	}
+	return names
+}
+
+func newPaginationTestStore(numPods int) *store {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	for i := 0; i < numPods; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	return store
+}
+
+func TestListPage(t *testing.T) {
+	store := newPaginationTestStore(5)
+
+	objs, token, err := store.ListPage(0, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod0", "pod1", "pod2", "pod3", "pod4"}, podNames(objs))
+	assert.Empty(t, token, "Expected no continue token without limit")
+
+	objs, token, err = store.ListPage(5, "")
+	require.NoError(t, err)
+	assert.Len(t, objs, 5)
+	assert.Empty(t, token, "Expected no continue token when all objects fit in a page")
+
+	var pages [][]string
+	token = ""
+	for {
+		objs, token, err = store.ListPage(2, token)
+		require.NoError(t, err)
+		pages = append(pages, podNames(objs))
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, [][]string{{"pod0", "pod1"}, {"pod2", "pod3"}, {"pod4"}}, pages)
+}
+
+func TestListPageStableSnapshot(t *testing.T) {
+	store := newPaginationTestStore(5)
+
+	objs, token, err := store.ListPage(2, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod0", "pod1"}, podNames(objs))
+
+	// Objects changed in the middle of the list don't affect the remaining pages.
+	require.NoError(t, store.Delete("pod3"))
+	require.NoError(t, store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod5"}}))
+	require.NoError(t, store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "web"}}}))
+
+	objs, token, err = store.ListPage(2, token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod2", "pod3"}, podNames(objs))
+	assert.Empty(t, objs[0].(*v1.Pod).Labels, "Expected the object as it was in the snapshot")
+	objs, token, err = store.ListPage(2, token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod4"}, podNames(objs))
+	assert.Empty(t, token)
+
+	// A new list reflects the changes.
+	objs, _, err = store.ListPage(0, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod0", "pod1", "pod2", "pod4", "pod5"}, podNames(objs))
+}
+
+func TestListPageTokenExpired(t *testing.T) {
+	store := newPaginationTestStore(5)
+	store.snapshotTTL = 10 * time.Millisecond
+
+	_, token, err := store.ListPage(2, "")
+	require.NoError(t, err)
+	// Using the token extends the lifetime of the snapshot.
+	time.Sleep(5 * time.Millisecond)
+	_, token, err = store.ListPage(2, token)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, _, err = store.ListPage(2, token)
+	assert.True(t, errors.IsResourceExpired(err), "Expected ResourceExpired error, got %v", err)
+	assert.Empty(t, store.snapshots, "Expected expired snapshots to be discarded")
+}
+
+func TestListPageInvalidToken(t *testing.T) {
+	store := newPaginationTestStore(5)
+
+	_, _, err := store.ListPage(2, "invalid token")
+	assert.True(t, errors.IsBadRequest(err), "Expected BadRequest error, got %v", err)
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ramtest provides a fake storage.Interface backed by the ram store, for the unit tests of its consumers,
+// and a harness replaying recorded changes of objects into a store to check the events its watchers receive.
+package ramtest
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram/internal/testhooks"
+)
+
+// FakeEvent implements storage.TypedInternalEvent. It carries the previous and current versions of an object as
+// they are, and selects them by the key, the labels, and the "metadata.name" and "metadata.namespace" fields.
+type FakeEvent struct {
+	Key             string
+	PrevObject      runtime.Object
+	Object          runtime.Object
+	ResourceVersion uint64
+}
+
+// ToWatchEvent implements storage.InternalEvent.
+func (e *FakeEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	eventType, ok := e.GetEventType(selectors)
+	if !ok {
+		return nil
+	}
+	if eventType == watch.Deleted {
+		return &watch.Event{Type: watch.Deleted, Object: e.PrevObject.DeepCopyObject()}
+	}
+	return &watch.Event{Type: eventType, Object: e.Object.DeepCopyObject()}
+}
+
+// GetEventType implements storage.TypedInternalEvent.
+func (e *FakeEvent) GetEventType(selectors *storage.Selectors) (watch.EventType, bool) {
+	currSelected := e.Object != nil && selected(selectors, e.Key, e.Object)
+	prevSelected := e.PrevObject != nil && selected(selectors, e.Key, e.PrevObject)
+	switch {
+	case currSelected && !prevSelected:
+		return watch.Added, true
+	case currSelected && prevSelected:
+		return watch.Modified, true
+	case !currSelected && prevSelected:
+		return watch.Deleted, true
+	}
+	return "", false
+}
+
+// GetResourceVersion implements storage.InternalEvent.
+func (e *FakeEvent) GetResourceVersion() uint64 {
+	return e.ResourceVersion
+}
+
+func selected(selectors *storage.Selectors, key string, obj runtime.Object) bool {
+	if selectors.Key != "" && selectors.Key != key {
+		return false
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	if selectors.Label != nil && !selectors.Label.Matches(labels.Set(accessor.GetLabels())) {
+		return false
+	}
+	objFields := fields.Set{"metadata.name": accessor.GetName(), "metadata.namespace": accessor.GetNamespace()}
+	return selectors.Field == nil || selectors.Field.Matches(objFields)
+}
+
+// GenFakeEvent is a storage.GenEventFunc which generates *FakeEvent.
+func GenFakeEvent(key string, prevObj, obj interface{}, resourceVersion uint64) (storage.InternalEvent, error) {
+	event := &FakeEvent{Key: key, ResourceVersion: resourceVersion}
+	if prevObj != nil {
+		event.PrevObject = prevObj.(runtime.Object)
+	}
+	if obj != nil {
+		event.Object = obj.(runtime.Object)
+	}
+	return event, nil
+}
+
+// FakeStore is a storage.Interface for objects implementing metav1.Object, keyed by their namespace and name.
+// It's backed by the ram store so that watchers behave as in production, including the filtering by selectors
+// and resourceVersion, and additionally allows tests to push events to watchers directly.
+type FakeStore struct {
+	storage.Interface
+}
+
+// NewFakeStore creates a FakeStore of the provided resource, whose name labels the store's metrics. newFunc creates
+// an empty object of the stored type.
+func NewFakeStore(resource string, newFunc func() runtime.Object) *FakeStore {
+	return &FakeStore{Interface: ram.NewStore(resource, cache.MetaNamespaceKeyFunc, cache.Indexers{}, GenFakeEvent, newFunc)}
+}
+
+// PushEvent dispatches a FakeEvent carrying the provided versions of an object to the watchers, without changing
+// the stored objects. prevObj is nil for an addition and obj is nil for a deletion.
+func (f *FakeStore) PushEvent(prevObj, obj runtime.Object) error {
+	keyObj := obj
+	if keyObj == nil {
+		keyObj = prevObj
+	}
+	key, err := cache.MetaNamespaceKeyFunc(keyObj)
+	if err != nil {
+		return err
+	}
+	return testhooks.InjectEvent(f.Interface, func(resourceVersion uint64) (storage.InternalEvent, error) {
+		return &FakeEvent{Key: key, PrevObject: prevObj, Object: obj, ResourceVersion: resourceVersion}, nil
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ramtest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram/ramtest"
+)
+
+func newPod() runtime.Object {
+	return new(v1.Pod)
+}
+
+func ExampleFakeStore_PushEvent() {
+	store := ramtest.NewFakeStore("Pod", newPod)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1"}})
+
+	w, _ := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	defer w.Stop()
+	// Synthesize an update of pod1 without changing the stored object.
+	store.PushEvent(
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1", Labels: map[string]string{"app": "web"}}},
+	)
+
+	for i := 0; i < 2; i++ {
+		event := <-w.ResultChan()
+		pod := event.Object.(*v1.Pod)
+		fmt.Println(event.Type, pod.Name, pod.Labels)
+	}
+	// Output:
+	// ADDED pod1 map[]
+	// MODIFIED pod1 map[app:web]
+}
+
+func TestFakeStoreSelectors(t *testing.T) {
+	store := ramtest.NewFakeStore("Pod", newPod)
+	w, err := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "web"}), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer w.Stop()
+
+	// pod1 starts being selected, then stops being selected.
+	pod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1"}}
+	webPod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1", Labels: map[string]string{"app": "web"}}}
+	assert.NoError(t, store.PushEvent(nil, pod1))
+	assert.NoError(t, store.PushEvent(pod1, webPod1))
+	assert.NoError(t, store.PushEvent(webPod1, pod1))
+
+	expected := []watch.Event{
+		{Type: watch.Added, Object: webPod1},
+		{Type: watch.Deleted, Object: webPod1},
+	}
+	for i, expectedEvent := range expected {
+		select {
+		case actualEvent := <-w.ResultChan():
+			assert.Equal(t, expectedEvent, actualEvent, "Unexpected event %d", i)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+	select {
+	case event := <-w.ResultChan():
+		t.Errorf("Unexpected excess event: %#v", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Watchers resuming from a resourceVersion only receive the events after it.
+	w2, err := store.Watch(context.Background(), "2", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer w2.Stop()
+	assert.Equal(t, watch.Event{Type: watch.Modified, Object: pod1}, <-w2.ResultChan())
+}
+
+func TestReplayExampleRecording(t *testing.T) {
+	recording, err := ramtest.LoadRecordingFile("testdata/example.json")
+	require.NoError(t, err)
+	results, err := ramtest.Replay(ramtest.NewFakeStore("Pod", newPod), recording, newPod, 1, 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, results, len(recording.Watchers))
+	for _, result := range results {
+		assert.True(t, result.Matches(), result.String())
+		assert.False(t, result.Terminated, result.String())
+	}
+}
+
+func TestReplaySlowConsumer(t *testing.T) {
+	recording := &ramtest.Recording{
+		Watchers: []ramtest.RecordedWatcher{
+			{Name: "fast"},
+			{Name: "slow", ReceiveDelay: metav1.Duration{Duration: 200 * time.Millisecond}},
+		},
+	}
+	// A burst of events at the same time.
+	for i := 0; i < 10; i++ {
+		recording.Events = append(recording.Events, ramtest.RecordedEvent{
+			Type:   watch.Added,
+			Object: []byte(fmt.Sprintf(`{"metadata": {"namespace": "default", "name": "pod%d"}}`, i)),
+		})
+		for j := range recording.Watchers {
+			recording.Watchers[j].Expected = append(recording.Watchers[j].Expected, ramtest.ReplayedEvent{Type: watch.Added, Key: fmt.Sprintf("default/pod%d", i)})
+		}
+	}
+	store := ram.NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, ramtest.GenFakeEvent, newPod)
+	// The buffers of the slow consumer can't absorb the burst.
+	require.NoError(t, store.SetWatcherChanSizes(1, 1))
+
+	results, err := ramtest.Replay(store, recording, newPod, 1, 5*time.Second)
+	require.NoError(t, err)
+	assert.True(t, results[0].Matches(), results[0].String())
+	assert.False(t, results[0].Terminated, results[0].String())
+	assert.True(t, results[1].Terminated, results[1].String())
+	assert.False(t, results[1].Matches(), "The slow consumer should have missed events")
+}
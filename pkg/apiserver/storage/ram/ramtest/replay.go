@@ -0,0 +1,306 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ramtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// replaySettleDuration is how long watchers keep receiving after they have received as many events as expected,
+// so that unexpected excess events are caught.
+const replaySettleDuration = 50 * time.Millisecond
+
+// Recording is a recorded sequence of changes of objects along with the watchers observing them and the events
+// each watcher is expected to receive, e.g. reproducing a reported dispatching bug.
+type Recording struct {
+	Events   []RecordedEvent   `json:"events"`
+	Watchers []RecordedWatcher `json:"watchers"`
+}
+
+// RecordedEvent is a change of an object at a point of a Recording.
+type RecordedEvent struct {
+	// Offset is the time of the change since the start of the Recording.
+	Offset metav1.Duration `json:"offset"`
+	// Type is ADDED, MODIFIED or DELETED.
+	Type watch.EventType `json:"type"`
+	// Object is the object after the change, or before it for a deletion.
+	Object json.RawMessage `json:"object"`
+}
+
+// RecordedWatcher is a watcher observing the changes of a Recording.
+type RecordedWatcher struct {
+	Name          string `json:"name"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// StartAfter is the number of events replayed before the watcher is created.
+	StartAfter int `json:"startAfter,omitempty"`
+	// ReceiveDelay is how long the watcher waits before receiving each event, to simulate a slow consumer.
+	ReceiveDelay metav1.Duration `json:"receiveDelay,omitempty"`
+	// Expected are the events the watcher is expected to receive, in order.
+	Expected []ReplayedEvent `json:"expected"`
+}
+
+// ReplayedEvent is an event received by a watcher, identified by its type and the key of its object.
+type ReplayedEvent struct {
+	Type watch.EventType `json:"type"`
+	Key  string          `json:"key,omitempty"`
+}
+
+// WatcherResult is the outcome of a RecordedWatcher.
+type WatcherResult struct {
+	Name     string
+	Expected []ReplayedEvent
+	Received []ReplayedEvent
+	// Terminated is true if the store terminated the watcher, e.g. because it was too slow.
+	Terminated bool
+}
+
+// Matches returns whether the watcher received exactly the expected events.
+func (r *WatcherResult) Matches() bool {
+	if len(r.Received) != len(r.Expected) {
+		return false
+	}
+	for i := range r.Received {
+		if r.Received[i] != r.Expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the expected and received events of the watcher.
+func (r *WatcherResult) String() string {
+	format := func(events []ReplayedEvent) string {
+		s := make([]string, 0, len(events))
+		for _, e := range events {
+			s = append(s, fmt.Sprintf("%s %s", e.Type, e.Key))
+		}
+		return "[" + strings.Join(s, ", ") + "]"
+	}
+	return fmt.Sprintf("watcher %s expected %s, received %s (terminated: %t)", r.Name, format(r.Expected), format(r.Received), r.Terminated)
+}
+
+// LoadRecording reads a Recording in JSON.
+func LoadRecording(r io.Reader) (*Recording, error) {
+	recording := new(Recording)
+	if err := json.NewDecoder(r).Decode(recording); err != nil {
+		return nil, fmt.Errorf("error decoding recording: %v", err)
+	}
+	return recording, nil
+}
+
+// LoadRecordingFile reads a Recording in JSON from the file of the provided path.
+func LoadRecordingFile(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadRecording(f)
+}
+
+// Replay applies the changes of the recording to the store, which is expected to be empty and to key objects
+// by their namespace and name, at the recorded timing scaled by speed, e.g. 2 replays twice as fast. The
+// recording's watchers are created when their StartAfter events have been replayed. Once all changes are
+// replayed, Replay waits up to timeout for every watcher to receive as many events as expected, and returns what
+// each of them received. newFunc creates an empty object to decode the recorded objects into.
+func Replay(store storage.Interface, recording *Recording, newFunc func() runtime.Object, speed float64, timeout time.Duration) ([]*WatcherResult, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("speed must be positive, got %v", speed)
+	}
+	objects := make([]runtime.Object, len(recording.Events))
+	for i, event := range recording.Events {
+		obj := newFunc()
+		if err := json.Unmarshal(event.Object, obj); err != nil {
+			return nil, fmt.Errorf("error decoding object of event %d: %v", i, err)
+		}
+		objects[i] = obj
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replayers := make([]*watcherReplayer, len(recording.Watchers))
+	for i := range recording.Watchers {
+		replayers[i] = &watcherReplayer{recorded: &recording.Watchers[i], received: make(chan struct{}, 1)}
+	}
+	var wg sync.WaitGroup
+	startWatchers := func(replayed int) error {
+		for _, r := range replayers {
+			if r.recorded.StartAfter != replayed {
+				continue
+			}
+			if err := r.start(ctx, store, &wg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer func() {
+		cancel()
+		for _, r := range replayers {
+			if r.watcher != nil {
+				r.watcher.Stop()
+			}
+		}
+		wg.Wait()
+	}()
+
+	start := time.Now()
+	for i, event := range recording.Events {
+		if err := startWatchers(i); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Until(start.Add(time.Duration(float64(event.Offset.Duration) / speed))))
+		if err := apply(store, event.Type, objects[i]); err != nil {
+			return nil, fmt.Errorf("error replaying event %d: %v", i, err)
+		}
+	}
+	if err := startWatchers(len(recording.Events)); err != nil {
+		return nil, err
+	}
+
+	deadline := time.After(timeout)
+	for _, r := range replayers {
+		if r.watcher == nil {
+			return nil, fmt.Errorf("watcher %s starts after %d events but the recording has %d", r.recorded.Name, r.recorded.StartAfter, len(recording.Events))
+		}
+		for !r.done(len(r.recorded.Expected)) {
+			select {
+			case <-r.received:
+			case <-deadline:
+				return nil, fmt.Errorf("timed out waiting for watchers to receive the expected events, %s", r.result())
+			}
+		}
+	}
+	time.Sleep(replaySettleDuration)
+
+	results := make([]*WatcherResult, len(replayers))
+	for i, r := range replayers {
+		results[i] = r.result()
+	}
+	return results, nil
+}
+
+func apply(store storage.Interface, eventType watch.EventType, obj runtime.Object) error {
+	switch eventType {
+	case watch.Added:
+		return store.Create(obj)
+	case watch.Modified:
+		return store.Update(obj)
+	case watch.Deleted:
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return err
+		}
+		return store.Delete(key)
+	}
+	return fmt.Errorf("unsupported event type %q", eventType)
+}
+
+// watcherReplayer receives the events of a RecordedWatcher.
+type watcherReplayer struct {
+	recorded *RecordedWatcher
+	watcher  watch.Interface
+	// received is notified whenever an event is received or the watcher is terminated.
+	received chan struct{}
+
+	mutex      sync.Mutex
+	events     []ReplayedEvent
+	terminated bool
+}
+
+func (r *watcherReplayer) start(ctx context.Context, store storage.Interface, wg *sync.WaitGroup) error {
+	label, err := labels.Parse(r.recorded.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("invalid label selector of watcher %s: %v", r.recorded.Name, err)
+	}
+	field, err := fields.ParseSelector(r.recorded.FieldSelector)
+	if err != nil {
+		return fmt.Errorf("invalid field selector of watcher %s: %v", r.recorded.Name, err)
+	}
+	r.watcher, err = store.Watch(ctx, "", &storage.Selectors{Label: label, Field: field})
+	if err != nil {
+		return fmt.Errorf("error creating watcher %s: %v", r.recorded.Name, err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.receive(ctx)
+	}()
+	return nil
+}
+
+func (r *watcherReplayer) receive(ctx context.Context) {
+	for {
+		if delay := r.recorded.ReceiveDelay.Duration; delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+		event, ok := <-r.watcher.ResultChan()
+		r.mutex.Lock()
+		if !ok {
+			// The channel is also closed when Replay stops the watcher, in which case ctx is done.
+			r.terminated = ctx.Err() == nil
+		} else if event.Type != watch.Bookmark {
+			key, _ := cache.MetaNamespaceKeyFunc(event.Object)
+			r.events = append(r.events, ReplayedEvent{Type: event.Type, Key: key})
+		}
+		r.mutex.Unlock()
+		select {
+		case r.received <- struct{}{}:
+		default:
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// done returns whether the watcher has received the provided number of events or has been terminated.
+func (r *watcherReplayer) done(expected int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.terminated || len(r.events) >= expected
+}
+
+func (r *watcherReplayer) result() *WatcherResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &WatcherResult{
+		Name:       r.recorded.Name,
+		Expected:   r.recorded.Expected,
+		Received:   append([]ReplayedEvent(nil), r.events...),
+		Terminated: r.terminated,
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/klog"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// dispatchShard dispatches events to a subset of the watchers of a store from its own goroutine, so that the
+// delivery of events to different subsets happens in parallel. Each watcher is assigned to a single shard, which
+// receives all events in the order of their resourceVersion, so the order of events is preserved for every
+// watcher.
+type dispatchShard struct {
+	store *store
+	// mutex protects watchers from concurrent access during watcher insertion and deletion. When both are held,
+	// it must be locked after the store's watcherMutex.
+	mutex sync.RWMutex
+	// watchers is a mapping from the index of a watcher to the watcher, for the watchers assigned to the shard.
+	watchers watchersMap
+	// incomingHWM is HighWaterMark for performance debugging.
+	// It records the maximum number of events backed up in incoming channel that have been seen.
+	incomingHWM storage.HighWaterMark
+	// incoming stores the incoming events that should be dispatched to the shard's watchers.
+	incoming chan keyedEvent
+	// timer is used when sending events to watchers. Hold it here to avoid unnecessary
+	// re-allocation for each event.
+	timer *time.Timer
+}
+
+func newDispatchShard(s *store) *dispatchShard {
+	timer := time.NewTimer(time.Duration(0))
+	// Ensure the timer is stopped and drain the channel.
+	if !timer.Stop() {
+		<-timer.C
+	}
+	return &dispatchShard{
+		store:    s,
+		watchers: make(watchersMap),
+		incoming: make(chan keyedEvent, 100),
+		timer:    timer,
+	}
+}
+
+// SetDispatchShards makes the store dispatch events with the provided number of goroutines, each dispatching to
+// a shard of the watchers, which lowers the latency of delivering events to thousands of watchers on multi-core
+// machines. Watchers monitoring a single object, see Selectors.Key, are assigned by the hash of the key, the
+// others in turn. The store has a single shard by default. It must be called before any watcher is created.
+func (s *store) SetDispatchShards(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("number of dispatch shards must be positive, got %d", n)
+	}
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+	s.watcherMutex.Lock()
+	defer s.watcherMutex.Unlock()
+
+	if len(s.watchers) > 0 {
+		return fmt.Errorf("number of dispatch shards can't be changed with %d active watchers", len(s.watchers))
+	}
+	select {
+	case <-s.done:
+		return fmt.Errorf("number of dispatch shards can't be changed as the store is stopped")
+	default:
+	}
+	// The events queued in the previous shards have no watcher to be dispatched to, they can be discarded.
+	close(s.stopCh)
+	s.stopCh = make(chan struct{})
+	s.shards = make([]*dispatchShard, n)
+	for i := range s.shards {
+		s.shards[i] = newDispatchShard(s)
+		go s.shards[i].run(s.stopCh)
+	}
+	return nil
+}
+
+// shardOf returns the shard the watcher of the provided index and selectors is assigned to.
+func (s *store) shardOf(index int, selectors *antreastorage.Selectors) *dispatchShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	if selectors.Key == "" {
+		return s.shards[index%len(s.shards)]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(selectors.Key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// addWatcher registers the watcher of the provided index in the store and its shard.
+// It should be called while holding a lock on watcherMutex.
+func (s *store) addWatcher(index int, watcher *storeWatcher) {
+	s.watchers[index] = watcher
+	shard := s.shardOf(index, watcher.selectors)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.watchers[index] = watcher
+}
+
+// removeWatcher unregisters the watcher of the provided index from the store and its shard.
+// It should be called while holding a lock on watcherMutex.
+func (s *store) removeWatcher(index int) {
+	watcher, ok := s.watchers[index]
+	if !ok {
+		return
+	}
+	delete(s.watchers, index)
+	shard := s.shardOf(index, watcher.selectors)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	delete(shard.watchers, index)
+}
+
+// queueEvent queues the event for dispatching to the shards having watchers. Shards without watchers are skipped,
+// as the watchers created later will start from a newer resourceVersion. Nothing is queued once the store is stopped.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) queueEvent(event keyedEvent) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	for _, shard := range s.shards {
+		if len(s.shards) > 1 && shard.isEmpty() {
+			continue
+		}
+		if curLen := int64(len(shard.incoming)); shard.incomingHWM.Update(curLen) {
+			// Monitor if this gets backed up, and how much.
+			klog.V(1).Infof("%v objects queued in incoming channel", curLen)
+		}
+		shard.incoming <- event
+	}
+}
+
+func (sh *dispatchShard) isEmpty() bool {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	return len(sh.watchers) == 0
+}
+
+func (sh *dispatchShard) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case event, ok := <-sh.incoming:
+			if !ok {
+				return
+			}
+			sh.dispatchEvent(event.key, event.event)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// dispatchEvent dispatches the event generated for the object of the provided key to the shard's watchers.
+// Watchers that only monitor another object, see Selectors.Key, are skipped. An empty key dispatches the event to
+// all watchers.
+func (sh *dispatchShard) dispatchEvent(key string, event antreastorage.InternalEvent) {
+	s := sh.store
+	start := time.Now()
+	var numWatchers, numBlockedWatchers int
+	var failedWatchers []*storeWatcher
+	defer func() {
+		end := time.Now()
+		s.dispatchLatency.Observe(end.Sub(start).Seconds())
+		if t := getTracer(); t != nil {
+			_, span := t.StartSpan(context.Background(), "dispatchEvent", start)
+			span.SetAttribute("resource", s.resource)
+			span.SetAttribute("resourceVersion", event.GetResourceVersion())
+			span.SetAttribute("watchers", numWatchers)
+			span.SetAttribute("blockedWatchers", numBlockedWatchers)
+			stoppedSelectors := make([]string, 0, len(failedWatchers))
+			for _, watcher := range failedWatchers {
+				stoppedSelectors = append(stoppedSelectors, redactSelectors(watcher.selectors))
+			}
+			span.SetAttribute("stoppedWatchers", stoppedSelectors)
+			span.End(end)
+		}
+	}()
+
+	// resizes is a mapping from the index of a watcher to the new size of its buffer.
+	var resizes map[int]int
+
+	s.watcherMutex.RLock()
+	window, minSize, maxSize, step := s.watcherChanSizeWindow, s.minWatcherChanSize, s.maxWatcherChanSize, s.watcherChanSizeStep
+	breakerThreshold := s.breakerThreshold
+	s.watcherMutex.RUnlock()
+
+	func() {
+		sh.mutex.RLock()
+		defer sh.mutex.RUnlock()
+
+		numWatchers = len(sh.watchers)
+
+		// First try to send events without blocking, to avoid setting up a timer
+		// for every event.
+		// blockedWatchers keeps watchers whose buffer are full.
+		var blockedWatchers []*storeWatcher
+		// TODO: Skip the watchers whose label and field selectors can't match the event, only the ones monitoring
+		// another object are skipped so far.
+		for idx, watcher := range sh.watchers {
+			if key != "" && watcher.selectors.Key != "" && watcher.selectors.Key != key {
+				// The event can't concern the watcher, let it know the version it has observed, see process.
+				atomic.StoreUint64(&watcher.lastResourceVersion, event.GetResourceVersion())
+				continue
+			}
+			if size := watcher.sampleFill(window, minSize, maxSize, step); size > 0 {
+				if resizes == nil {
+					resizes = make(map[int]int)
+				}
+				resizes[idx] = size
+			}
+			if !watcher.nonBlockingAdd(key, event) {
+				blockedWatchers = append(blockedWatchers, watcher)
+				continue
+			}
+			atomic.StoreUint64(&watcher.lastResourceVersion, event.GetResourceVersion())
+		}
+		numBlockedWatchers = len(blockedWatchers)
+		if len(blockedWatchers) == 0 {
+			return
+		}
+		klog.V(2).Infof("%d watchers were not available to receive event %+v immediately", len(blockedWatchers), event)
+
+		// Then try to send events to blocked watchers in rounds until watcherAddTimeout expires. In each
+		// round, every blocked watcher gets a time slice of at most watcherAddTimeSlice, so the watchers
+		// at the end of the list are not starved by a slow one ahead of them. If it timeouts, it means
+		// the watcher is too slow to consume the events or the underlying connection is already dead,
+		// terminate the watcher in this case. antrea-agent will start a new watch after it's disconnected.
+		deadline := time.Now().Add(watcherAddTimeout)
+		for len(blockedWatchers) > 0 {
+			var stillBlockedWatchers []*storeWatcher
+			for _, watcher := range blockedWatchers {
+				slice := time.Until(deadline)
+				if slice > watcherAddTimeSlice {
+					slice = watcherAddTimeSlice
+				}
+				// A nil timer lets the watcher know the time is up, it will only try to send without blocking.
+				var timer *time.Timer
+				if slice > 0 {
+					sh.timer.Reset(slice)
+					timer = sh.timer
+				}
+				added := watcher.add(key, event, timer)
+				// Stop the timer and drain its channel if it has fired but add didn't receive from it.
+				if timer != nil && !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				switch {
+				case added:
+					atomic.StoreUint64(&watcher.lastResourceVersion, event.GetResourceVersion())
+				case timer == nil || watcher.resyncRequired:
+					// A watcher that must resync fails without waiting for the next round.
+					failedWatchers = append(failedWatchers, watcher)
+				default:
+					stillBlockedWatchers = append(stillBlockedWatchers, watcher)
+				}
+			}
+			blockedWatchers = stillBlockedWatchers
+		}
+	}()
+
+	if len(resizes) > 0 {
+		sh.resizeWatchers(resizes)
+	}
+
+	var slowestWatcher *storeWatcher
+	if elapsed := time.Since(start); breakerThreshold > 0 && elapsed > breakerThreshold {
+		if watcher := sh.slowestWatcher(); watcher != nil && !containsWatcher(failedWatchers, watcher) {
+			klog.Warningf("Dispatching event %d took %v, forcing stopping the slowest watcher (selectors: %v)", event.GetResourceVersion(), elapsed, watcher.selectors)
+			slowestWatcher = watcher
+			failedWatchers = append(failedWatchers, watcher)
+		}
+	}
+
+	// Terminate unresponsive watchers, this must be executed without watcherMutex as
+	// watcher.Stop will require the lock itself.
+	for _, watcher := range failedWatchers {
+		if watcher == slowestWatcher {
+			recordEventDropped(s.resource, dropReasonDispatchBreaker)
+		} else {
+			recordEventDropped(s.resource, dropReasonBufferFull)
+		}
+		klog.Warningf("Forcing stopping watcher (selectors: %v) due to unresponsiveness", watcher.selectors)
+		if watcher.resyncRequired {
+			watcher.setErr(antreastorage.ErrWatcherResyncRequired)
+		} else {
+			watcher.setErr(antreastorage.ErrWatcherTooSlow)
+		}
+		watcher.Stop()
+	}
+}
+
+// slowestWatcher returns the shard's watcher whose result channel has been full for the longest time, i.e. the one whose
+// client has stopped receiving events the earliest, or nil if no watcher's result channel is full. Watchers that
+// drop events when their buffer is full are not considered as they never block the dispatching.
+func (sh *dispatchShard) slowestWatcher() *storeWatcher {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	var slowest *storeWatcher
+	var slowestSendTime int64
+	for _, watcher := range sh.watchers {
+		if watcher.selectors.BackpressurePolicy != antreastorage.BlockUntilTimeout || len(watcher.result) < cap(watcher.result) {
+			continue
+		}
+		if sendTime := atomic.LoadInt64(&watcher.lastSendTime); slowest == nil || sendTime < slowestSendTime {
+			slowest, slowestSendTime = watcher, sendTime
+		}
+	}
+	return slowest
+}
+
+func containsWatcher(watchers []*storeWatcher, watcher *storeWatcher) bool {
+	for _, w := range watchers {
+		if w == watcher {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeWatchers resizes the buffer of the shard's watchers according to the provided mapping from the index
+// of a watcher to the new size of its buffer. Watchers that have been forgotten are skipped.
+func (sh *dispatchShard) resizeWatchers(resizes map[int]int) {
+	// watcherMutex is required as well since the buffers are read when listing watchers.
+	sh.store.watcherMutex.Lock()
+	defer sh.store.watcherMutex.Unlock()
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	for idx, size := range resizes {
+		watcher, ok := sh.watchers[idx]
+		if !ok {
+			continue
+		}
+		oldSize := cap(watcher.input)
+		if watcher.resizeInput(size) {
+			klog.V(2).Infof("Resized buffer of watcher (selectors: %v) from %d to %d", watcher.selectors, oldSize, size)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func TestRamStoreSetDispatchShards(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Error(t, store.SetDispatchShards(0))
+	require.NoError(t, store.SetDispatchShards(4))
+	assert.Len(t, store.shards, 4)
+
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	assert.Error(t, store.SetDispatchShards(2), "Shards can't be changed with active watchers")
+	w.Stop()
+	assert.NoError(t, store.SetDispatchShards(2))
+}
+
+func TestRamStoreDispatchShards(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	require.NoError(t, store.SetDispatchShards(3))
+
+	var watchers, keyedWatchers []watch.Interface
+	for i := 0; i < 6; i++ {
+		w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+		require.NoError(t, err)
+		defer w.Stop()
+		watchers = append(watchers, w)
+		w, err = store.Watch(context.Background(), "", &antreastorage.Selectors{Key: fmt.Sprintf("pod%d", i), Label: labels.Everything(), Field: fields.Everything()})
+		require.NoError(t, err)
+		defer w.Stop()
+		keyedWatchers = append(keyedWatchers, w)
+	}
+	total := 0
+	for _, shard := range store.shards {
+		assert.NotEmpty(t, shard.watchers, "Watchers should be spread over all shards")
+		total += len(shard.watchers)
+	}
+	assert.Equal(t, 12, total)
+
+	for i := 0; i < 6; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	// Every watcher receives the events of the objects it monitors in order, regardless of its shard.
+	for _, w := range watchers {
+		for i := 0; i < 6; i++ {
+			event := <-w.ResultChan()
+			assert.Equal(t, watch.Added, event.Type)
+			assert.Equal(t, fmt.Sprintf("pod%d", i), event.Object.(*v1.Pod).Name)
+		}
+	}
+	for i, w := range keyedWatchers {
+		event := <-w.ResultChan()
+		assert.Equal(t, watch.Added, event.Type)
+		assert.Equal(t, fmt.Sprintf("pod%d", i), event.Object.(*v1.Pod).Name)
+	}
+
+	// Stopped watchers are removed from their shard.
+	for _, w := range append(watchers, keyedWatchers...) {
+		w.Stop()
+	}
+	for _, shard := range store.shards {
+		assert.True(t, shard.isEmpty())
+	}
+	assert.Equal(t, 0, store.CountWatchers())
+}
+
+func BenchmarkRamStoreDispatchShards(b *testing.B) {
+	const numWatchers = 10000
+	for _, shards := range []int{1, 8} {
+		b.Run(fmt.Sprintf("%d-shards", shards), func(b *testing.B) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			if err := store.SetDispatchShards(shards); err != nil {
+				b.Fatalf("Failed to set dispatch shards: %v", err)
+			}
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod"}})
+			selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+			var received sync.WaitGroup
+			for i := 0; i < numWatchers; i++ {
+				w, err := store.Watch(context.Background(), "", selectors)
+				if err != nil {
+					b.Fatalf("Failed to watch object: %v", err)
+				}
+				defer w.Stop()
+				<-w.ResultChan()
+				go func() {
+					for event := range w.ResultChan() {
+						if event.Type == watch.Modified {
+							received.Done()
+						}
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Measure how long it takes for an event to reach all watchers.
+				received.Add(numWatchers)
+				store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Labels: map[string]string{"i": fmt.Sprint(i)}}})
+				received.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// precomputedEvent carries a watch.Event converted once on behalf of all the watchers sharing a source.
+type precomputedEvent struct {
+	event           *watch.Event
+	resourceVersion uint64
+	// key is the key of the event's object, empty if there's no event.
+	key string
+}
+
+// newPrecomputedEvent converts the event once for all the clients of the source whose watcher is w.
+func newPrecomputedEvent(w *storeWatcher, event storage.InternalEvent) *precomputedEvent {
+	e := &precomputedEvent{event: w.toWatchEvent(event), resourceVersion: event.GetResourceVersion()}
+	if e.event != nil {
+		e.key, _ = cache.MetaNamespaceKeyFunc(e.event.Object)
+	}
+	return e
+}
+
+// ToWatchEvent returns the precomputed event regardless of the selectors, which are the same for all the
+// watchers sharing a source.
+func (e *precomputedEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	return e.event
+}
+
+func (e *precomputedEvent) GetResourceVersion() uint64 {
+	return e.resourceVersion
+}
+
+// GetEventType returns the type of the precomputed event, see storage.TypedInternalEvent.
+func (e *precomputedEvent) GetEventType(selectors *storage.Selectors) (watch.EventType, bool) {
+	if e.event == nil {
+		return "", false
+	}
+	return e.event.Type, true
+}
+
+// sharedSource is a watcher registered in the store on behalf of all the watchers having identical selectors.
+// The store dispatches each event to it once, and it converts the event once and fans it out to its clients.
+// Each client is a storeWatcher with its own buffer and Bookmark events, but is not registered in the store
+// itself.
+type sharedSource struct {
+	key     string
+	watcher *storeWatcher
+	// initEvents are the initial events of the clients at initEventsVersion, computed once for all the clients
+	// attached at the same resourceVersion. They're protected by the store's watcherMutex.
+	initEvents        []storage.InternalEvent
+	initEventsVersion uint64
+	// mutex protects clients. fanOut holds the read lock while sending events to clients, so a client can't
+	// be sent events once it's detached.
+	mutex   sync.RWMutex
+	clients map[*storeWatcher]struct{}
+}
+
+// EnableWatcherSharing makes watchers requesting the most recent state with identical selectors share a single
+// watcher registered in the store, which reduces the number of watchers the store dispatches events to, and the
+// computation of initial events and the conversion of events. Watchers resuming from a resourceVersion or
+// requesting SendInitialEvents, ResourceVersionMatch, Transform, Kinds, ResourceVersionCeiling,
+// IncludePreviousObject, SuppressEqual or MaxBatchSize are never shared. The clients of a shared source are
+// still counted and listed as watchers. It must be called before any watcher is created.
+func (s *store) EnableWatcherSharing() {
+	s.shareWatchers = true
+}
+
+// sharingKey returns the key identifying the source the watcher with the provided fromVersion and selectors
+// can share, and false if it can't share one.
+func (s *store) sharingKey(fromVersion uint64, selectors *storage.Selectors) (string, bool) {
+	if !s.shareWatchers || fromVersion != 0 || selectors.SendInitialEvents || selectors.ResourceVersionMatch != "" ||
+		selectors.Transform != nil || len(selectors.Kinds) > 0 || selectors.ResourceVersionCeiling > 0 ||
+		selectors.IncludePreviousObject || selectors.SuppressEqual != nil || selectors.MaxBatchSize > 1 {
+		return "", false
+	}
+	return selectors.Canonical(), true
+}
+
+// attachSharedWatcher creates a watcher attached to the source identified by key, which is created if it
+// doesn't exist, and returns it with its initial events. eventMutex must be held by the caller.
+func (s *store) attachSharedWatcher(key string, selectors *storage.Selectors) (*storeWatcher, []storage.InternalEvent, error) {
+	s.watcherMutex.Lock()
+	defer s.watcherMutex.Unlock()
+
+	if err := s.checkWatcherLimit(); err != nil {
+		return nil, nil, err
+	}
+
+	source, exists := s.sharedSources[key]
+	if !exists || source.initEventsVersion != s.resourceVersion {
+		initEvents, err := s.listInitEvents(selectors)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			source = &sharedSource{key: key, clients: map[*storeWatcher]struct{}{}}
+		}
+		source.initEvents = initEvents
+		source.initEventsVersion = s.resourceVersion
+	}
+	if !exists {
+		index := s.watcherIdx
+		source.watcher = s.buildWatcher(selectors, forgetSharedSource(s, index, source))
+		source.watcher.source = source
+		s.addWatcher(index, source.watcher)
+		s.watcherIdx++
+		s.sharedSources[key] = source
+		go source.fanOut()
+	}
+
+	var client *storeWatcher
+	client = s.newWatcher(selectors, func() {
+		s.detachSharedWatcher(source, client)
+	})
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.clients[client] = struct{}{}
+	s.activeWatchers++
+	// Each client gets its own copy as process sorts the events in place.
+	initEvents := append([]storage.InternalEvent(nil), source.initEvents...)
+	return client, initEvents, nil
+}
+
+// clientInfos returns the information of the source's clients, ordered by creation time. It should be called while
+// holding a read lock on the store's watcherMutex.
+func (src *sharedSource) clientInfos() []storage.WatcherInfo {
+	src.mutex.RLock()
+	defer src.mutex.RUnlock()
+
+	clients := make([]*storeWatcher, 0, len(src.clients))
+	for client := range src.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].createdAt.Before(clients[j].createdAt)
+	})
+	infos := make([]storage.WatcherInfo, 0, len(clients))
+	for _, client := range clients {
+		infos = append(infos, client.info())
+	}
+	return infos
+}
+
+// countClients returns the number of the source's clients.
+func (src *sharedSource) countClients() int {
+	src.mutex.RLock()
+	defer src.mutex.RUnlock()
+
+	return len(src.clients)
+}
+
+// detachSharedWatcher detaches the client from the source, and stops the source if it was the last client.
+func (s *store) detachSharedWatcher(source *sharedSource, client *storeWatcher) {
+	last := func() bool {
+		s.watcherMutex.Lock()
+		defer s.watcherMutex.Unlock()
+		source.mutex.Lock()
+		defer source.mutex.Unlock()
+
+		delete(source.clients, client)
+		s.activeWatchers--
+		if len(source.clients) > 0 {
+			return false
+		}
+		// New watchers with the same selectors will create a new source from now on.
+		if s.sharedSources[source.key] == source {
+			delete(s.sharedSources, source.key)
+		}
+		return true
+	}()
+	// Stop must be called without watcherMutex as it requires the lock itself.
+	if last {
+		source.watcher.Stop()
+	}
+}
+
+func forgetSharedSource(s *store, index int, source *sharedSource) func() {
+	return func() {
+		s.watcherMutex.Lock()
+		defer s.watcherMutex.Unlock()
+
+		s.removeWatcher(index)
+		if s.sharedSources[source.key] == source {
+			delete(s.sharedSources, source.key)
+		}
+	}
+}
+
+// fanOut converts each event got from the source's input channel once and sends it to all the clients. A
+// client that can't receive an event in watcherAddTimeout is stopped. When the source is stopped, e.g.
+// because it couldn't receive events from the store in time, all the clients are stopped.
+func (src *sharedSource) fanOut() {
+	defer close(src.watcher.stopped)
+	input := <-src.watcher.inputs
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer src.stopClients()
+	for {
+		event, ok := <-input
+		if !ok {
+			// The channel was closed because it has been resized, continue with the new one.
+			select {
+			case input = <-src.watcher.inputs:
+				continue
+			default:
+			}
+			return
+		}
+		// A resyncEvent is handled by each client itself.
+		var key string
+		if _, isResync := event.(*resyncEvent); !isResync {
+			precomputed := newPrecomputedEvent(src.watcher, event)
+			event, key = precomputed, precomputed.key
+		}
+		// Stop must be called without the lock as it requires the lock itself.
+		for _, client := range src.send(key, event, timer) {
+			client.Stop()
+		}
+	}
+}
+
+// send sends the event of the object of the provided key to all the clients and returns the ones that failed to
+// receive it. Like the store's dispatcher, it gives the blocked clients watcherAddTimeout in total to receive the
+// event, in rounds where each gets a time slice of at most watcherAddTimeSlice, so that slow clients can't hold
+// the others back longer than that.
+func (src *sharedSource) send(key string, event storage.InternalEvent, timer *time.Timer) []*storeWatcher {
+	src.mutex.RLock()
+	defer src.mutex.RUnlock()
+
+	var blockedClients []*storeWatcher
+	for client := range src.clients {
+		if !client.nonBlockingAdd(key, event) {
+			blockedClients = append(blockedClients, client)
+		}
+	}
+
+	var failedClients []*storeWatcher
+	deadline := time.Now().Add(watcherAddTimeout)
+	for len(blockedClients) > 0 {
+		var stillBlockedClients []*storeWatcher
+		for _, client := range blockedClients {
+			slice := time.Until(deadline)
+			if slice > watcherAddTimeSlice {
+				slice = watcherAddTimeSlice
+			}
+			// A nil timer lets the client know the time is up, it will only try to send without blocking.
+			var clientTimer *time.Timer
+			if slice > 0 {
+				timer.Reset(slice)
+				clientTimer = timer
+			}
+			added := client.add(key, event, clientTimer)
+			if clientTimer != nil && !clientTimer.Stop() {
+				select {
+				case <-clientTimer.C:
+				default:
+				}
+			}
+			switch {
+			case added:
+			case clientTimer == nil || client.resyncRequired:
+				failedClients = append(failedClients, client)
+			default:
+				stillBlockedClients = append(stillBlockedClients, client)
+			}
+		}
+		blockedClients = stillBlockedClients
+	}
+
+	for _, client := range failedClients {
+		client.recordDropped(dropReasonBufferFull)
+		klog.Warningf("Forcing stopping shared watcher (selectors: %v) due to unresponsiveness", client.selectors)
+		if client.resyncRequired {
+			client.setErr(storage.ErrWatcherResyncRequired)
+		} else {
+			client.setErr(storage.ErrWatcherTooSlow)
+		}
+	}
+	return failedClients
+}
+
+// stopClients stops all the clients with the error the source was stopped with.
+func (src *sharedSource) stopClients() {
+	src.mutex.RLock()
+	clients := make([]*storeWatcher, 0, len(src.clients))
+	for client := range src.clients {
+		clients = append(clients, client)
+	}
+	src.mutex.RUnlock()
+
+	for _, client := range clients {
+		client.setErr(src.watcher.Err())
+		client.Stop()
+	}
+}
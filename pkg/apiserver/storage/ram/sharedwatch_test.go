@@ -0,0 +1,258 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func receiveEvent(t *testing.T, w watch.Interface) watch.Event {
+	select {
+	case event, ok := <-w.ResultChan():
+		require.True(t, ok, "result channel closed unexpectedly")
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return watch.Event{}
+}
+
+func TestRamStoreSharedWatchers(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableWatcherSharing()
+	pod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx1"}}}
+	pod2 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "nginx2"}}}
+	store.Create(pod1)
+
+	selectors := func() *antreastorage.Selectors {
+		return &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	}
+	w1, err := store.Watch(context.Background(), "", selectors())
+	require.NoError(t, err)
+	w2, err := store.Watch(context.Background(), "0", selectors())
+	require.NoError(t, err)
+	assert.Equal(t, 2, store.GetWatchersNum(), "Watchers sharing a source should be counted")
+	assert.Len(t, store.watchers, 1, "Watchers with identical selectors should share a source")
+	source := store.sharedSources[selectorsKey(t, store, selectors())]
+	require.NotNil(t, source)
+	assert.Len(t, source.clients, 2)
+	assert.Len(t, source.initEvents, 1, "Initial events should be computed once for the shared watchers")
+
+	// Watchers with different selectors or resuming from a resourceVersion don't share the source.
+	w3, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "nginx2"}), Field: fields.Everything()})
+	require.NoError(t, err)
+	w4, err := store.Watch(context.Background(), "1", selectors())
+	require.NoError(t, err)
+	assert.Equal(t, 4, store.GetWatchersNum())
+	assert.Len(t, store.watchers, 3)
+
+	// Each shared watcher gets its own initial events.
+	for _, w := range []watch.Interface{w1, w2} {
+		assert.Equal(t, watch.Event{Type: watch.Added, Object: pod1}, receiveEvent(t, w))
+	}
+
+	store.Create(pod2)
+	for _, w := range []watch.Interface{w1, w2, w3} {
+		assert.Equal(t, watch.Event{Type: watch.Added, Object: pod2}, receiveEvent(t, w))
+	}
+
+	// The source is kept until its last watcher is stopped.
+	w1.Stop()
+	assert.Equal(t, 3, store.GetWatchersNum())
+	assert.Len(t, store.watchers, 3)
+	store.Delete("pod2")
+	assert.Equal(t, watch.Event{Type: watch.Deleted, Object: pod2}, receiveEvent(t, w2))
+	w2.Stop()
+	assert.Equal(t, 2, store.GetWatchersNum())
+	assert.Len(t, store.watchers, 2)
+
+	// A new watcher with the same selectors creates a new source.
+	w5, err := store.Watch(context.Background(), "", selectors())
+	require.NoError(t, err)
+	assert.Equal(t, 3, store.GetWatchersNum())
+	w3.Stop()
+	w4.Stop()
+	w5.Stop()
+	assert.Equal(t, 0, store.GetWatchersNum())
+}
+
+func TestRamStoreSharedWatchersSourceStopped(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableWatcherSharing()
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	w1, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	w2, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+
+	// Stopping the source, e.g. because it's too slow, stops all the watchers sharing it.
+	source := store.sharedSources[selectorsKey(t, store, selectors)]
+	require.NotNil(t, source)
+	source.watcher.setErr(antreastorage.ErrWatcherTooSlow)
+	source.watcher.Stop()
+	for _, w := range []watch.Interface{w1, w2} {
+		for range w.ResultChan() {
+		}
+		assert.Equal(t, antreastorage.ErrWatcherTooSlow, w.(antreastorage.ErrWatcher).Err())
+	}
+	assert.Equal(t, 0, store.GetWatchersNum())
+}
+
+func selectorsKey(t *testing.T, store *store, selectors *antreastorage.Selectors) string {
+	key, ok := store.sharingKey(0, selectors)
+	require.True(t, ok)
+	return key
+}
+
+func TestRamStoreSharedWatchersMaxWatchers(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableWatcherSharing()
+	require.NoError(t, store.SetMaxWatchers(1))
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+
+	w1, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	// Each watcher sharing a source counts.
+	_, err = store.Watch(context.Background(), "", selectors)
+	assert.True(t, errors.IsTooManyRequests(err), "Expected TooManyRequests error, got %v", err)
+
+	w1.Stop()
+	w2, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	w2.Stop()
+}
+
+func TestRamStoreSharedWatchersEqualSelectors(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableWatcherSharing()
+	label1, err := labels.Parse("app=nginx,tier=web")
+	require.NoError(t, err)
+	label2, err := labels.Parse("tier=web,app=nginx")
+	require.NoError(t, err)
+	field1, err := fields.ParseSelector("metadata.namespace=default,metadata.name!=pod1")
+	require.NoError(t, err)
+	field2, err := fields.ParseSelector("metadata.name!=pod1,metadata.namespace=default")
+	require.NoError(t, err)
+
+	w1, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: label1, Field: field1})
+	require.NoError(t, err)
+	defer w1.Stop()
+	w2, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: label2, Field: field2})
+	require.NoError(t, err)
+	defer w2.Stop()
+	assert.Len(t, store.watchers, 1, "Watchers with equal selectors specified in different orders should share a source")
+}
+
+func TestRamStoreSharedWatchersListed(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableWatcherSharing()
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	w1, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer w1.Stop()
+	w2, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer w2.Stop()
+	require.Len(t, store.watchers, 1)
+
+	// The clients are counted and listed in place of their source, as they are against the watcher limit.
+	assert.Equal(t, 2, store.CountWatchers())
+	assert.Equal(t, store.activeWatchers, store.CountWatchers())
+	infos := store.ListWatchers()
+	require.Len(t, infos, 2)
+	for _, info := range infos {
+		assert.Equal(t, "Pod", info.Resource)
+		assert.Equal(t, hashSelectors(selectors), info.SelectorsHash)
+		assert.Equal(t, watcherChanSize, info.BufferCapacity)
+	}
+	// The buffers of the source and of both clients are reported.
+	expected := fmt.Sprintf(`
+# HELP antrea_apiserver_watcher_input_buffer_capacity Capacity of the input channels of all watchers.
+# TYPE antrea_apiserver_watcher_input_buffer_capacity gauge
+antrea_apiserver_watcher_input_buffer_capacity{resource="Pod"} %d
+`, 3*watcherChanSize)
+	assert.NoError(t, testutil.CollectAndCompare(newWatchersCollector(store), strings.NewReader(expected),
+		"antrea_apiserver_watcher_input_buffer_capacity"))
+}
+
+func TestRamStoreSharedWatchersMetrics(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableWatcherSharing()
+	createdBefore := testutil.ToFloat64(watchersCreated.WithLabelValues("Pod"))
+	stoppedBefore := testutil.ToFloat64(watchersStopped.WithLabelValues("Pod"))
+	activeBefore := testutil.ToFloat64(watchersActive.WithLabelValues("Pod"))
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	w1, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	w2, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+
+	// The clients are recorded as watchers, not their source.
+	assert.Equal(t, createdBefore+2, testutil.ToFloat64(watchersCreated.WithLabelValues("Pod")))
+	assert.Equal(t, activeBefore+2, testutil.ToFloat64(watchersActive.WithLabelValues("Pod")))
+	w1.Stop()
+	w2.Stop()
+	<-w1.(*storeWatcher).done
+	<-w2.(*storeWatcher).done
+	assert.Equal(t, stoppedBefore+2, testutil.ToFloat64(watchersStopped.WithLabelValues("Pod")))
+	assert.Equal(t, activeBefore, testutil.ToFloat64(watchersActive.WithLabelValues("Pod")))
+}
+
+func TestSharedSourceSendDeadline(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	source := &sharedSource{clients: map[*storeWatcher]struct{}{}}
+	numClients := 5
+	for i := 0; i < numClients; i++ {
+		// process is not running so that the clients' buffers stay full.
+		client := store.newWatcher(selectors, func() {})
+		for len(client.input) < cap(client.input) {
+			client.input <- &emptyInternalEvent{ResourceVersion: 1}
+		}
+		source.clients[client] = struct{}{}
+	}
+	droppedBefore := testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonBufferFull))
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	start := time.Now()
+	failed := source.send("", &emptyInternalEvent{ResourceVersion: 2}, timer)
+	elapsed := time.Since(start)
+
+	// The blocked clients share a single watcherAddTimeout instead of getting one each.
+	assert.Len(t, failed, numClients)
+	assert.True(t, elapsed < 3*watcherAddTimeout, "Sending the event took %v", elapsed)
+	assert.Equal(t, droppedBefore+float64(numClients), testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonBufferFull)))
+	for _, client := range failed {
+		assert.Equal(t, antreastorage.ErrWatcherTooSlow, client.Err())
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+const (
+	// snapshotMagic identifies the encoding of snapshots of the store.
+	snapshotMagic = "ARSS"
+	// snapshotVersion is the version of the encoding of snapshots, which must be bumped whenever the encoding
+	// changes.
+	snapshotVersion uint8 = 1
+	// snapshotHeaderLen is the length of the magic, the version and the resourceVersion.
+	snapshotHeaderLen = len(snapshotMagic) + 1 + 8
+	// snapshotChecksumLen is the length of the CRC-32 checksum ending a snapshot.
+	snapshotChecksumLen = 4
+)
+
+// ObjectEncodeFunc encodes an object of the store for a snapshot.
+type ObjectEncodeFunc func(obj interface{}) ([]byte, error)
+
+// ObjectDecodeFunc decodes an object encoded by the corresponding ObjectEncodeFunc.
+type ObjectDecodeFunc func(data []byte) (interface{}, error)
+
+// EnableSnapshot enables Snapshot and Restore of the store, with the functions encoding and decoding the
+// objects of the store.
+func (s *store) EnableSnapshot(encodeFunc ObjectEncodeFunc, decodeFunc ObjectDecodeFunc) {
+	s.encodeFunc = encodeFunc
+	s.decodeFunc = decodeFunc
+}
+
+// Snapshot encodes all the objects of the store and returns them with the resourceVersion they are at.
+// A snapshot starts with the magic "ARSS", the version of the encoding (uint8), the resourceVersion (uint64)
+// and the number of objects (uvarint), followed by the length (uvarint) and the encoding of each object in the
+// order of their keys, and ends with the CRC-32 (IEEE) checksum of all the preceding bytes (uint32). Integers of
+// fixed size are big-endian.
+func (s *store) Snapshot() ([]byte, uint64, error) {
+	if s.encodeFunc == nil {
+		return nil, 0, fmt.Errorf("snapshot is not enabled")
+	}
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	keys := s.storage.ListKeys()
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	writeUint64(&buf, s.resourceVersion)
+	writeUvarint(&buf, uint64(len(keys)))
+	for _, key := range keys {
+		obj, _, _ := s.storage.GetByKey(key)
+		data, err := s.encodeFunc(obj)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error encoding object %s: %v", key, err)
+		}
+		writeUvarint(&buf, uint64(len(data)))
+		buf.Write(data)
+	}
+	checksum := make([]byte, snapshotChecksumLen)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(checksum)
+	return buf.Bytes(), s.resourceVersion, nil
+}
+
+// Restore restores the objects and the resourceVersion of a snapshot generated by Snapshot. It can only be
+// called on a store that has never had an object, before any watcher is created. Watchers can then resume
+// from the resourceVersion of the snapshot, while older resourceVersions are considered expired.
+func (s *store) Restore(data []byte) error {
+	if s.decodeFunc == nil {
+		return fmt.Errorf("snapshot is not enabled")
+	}
+	resourceVersion, objs, err := s.decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+	if s.resourceVersion != 0 {
+		return fmt.Errorf("can't restore a snapshot to a store at resourceVersion %d", s.resourceVersion)
+	}
+	keys := make(map[string]struct{}, len(objs))
+	for _, obj := range objs {
+		key, err := s.keyFunc(obj)
+		if err != nil {
+			return fmt.Errorf("couldn't get key for object %+v: %v", obj, err)
+		}
+		if _, exists := keys[key]; exists {
+			return fmt.Errorf("invalid snapshot: duplicate object %s", key)
+		}
+		keys[key] = struct{}{}
+	}
+	if err := s.storage.Replace(objs, fmt.Sprint(resourceVersion)); err != nil {
+		return err
+	}
+	s.resourceVersion = resourceVersion
+	s.compactedResourceVersion = resourceVersion
+	return nil
+}
+
+// decodeSnapshot verifies the snapshot and decodes its resourceVersion and objects.
+func (s *store) decodeSnapshot(data []byte) (uint64, []interface{}, error) {
+	if len(data) < snapshotHeaderLen+snapshotChecksumLen {
+		return 0, nil, fmt.Errorf("invalid snapshot: too short")
+	}
+	if string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, nil, fmt.Errorf("invalid snapshot: unknown format")
+	}
+	if version := data[len(snapshotMagic)]; version != snapshotVersion {
+		return 0, nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	payload, checksum := data[:len(data)-snapshotChecksumLen], data[len(data)-snapshotChecksumLen:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(checksum) {
+		return 0, nil, fmt.Errorf("invalid snapshot: checksum mismatch")
+	}
+
+	resourceVersion := binary.BigEndian.Uint64(payload[len(snapshotMagic)+1 : snapshotHeaderLen])
+	reader := bytes.NewReader(payload[snapshotHeaderLen:])
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	// Each object takes at least one byte for its length.
+	if count > uint64(reader.Len()) {
+		return 0, nil, fmt.Errorf("invalid snapshot: %d objects in %d bytes", count, reader.Len())
+	}
+	objs := make([]interface{}, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid snapshot: %v", err)
+		}
+		if length > uint64(reader.Len()) {
+			return 0, nil, fmt.Errorf("invalid snapshot: object %d exceeds the snapshot", i)
+		}
+		objData := make([]byte, length)
+		reader.Read(objData)
+		obj, err := s.decodeFunc(objData)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error decoding object %d: %v", i, err)
+		}
+		objs = append(objs, obj)
+	}
+	if reader.Len() != 0 {
+		return 0, nil, fmt.Errorf("invalid snapshot: %d trailing bytes", reader.Len())
+	}
+	return resourceVersion, objs, nil
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	buf.Write(b)
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+	buf.Write(b[:n])
+}
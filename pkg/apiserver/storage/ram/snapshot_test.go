@@ -0,0 +1,147 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func encodePod(obj interface{}) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func decodePod(data []byte) (interface{}, error) {
+	pod := new(v1.Pod)
+	if err := json.Unmarshal(data, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+func newSnapshotStore() *store {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.EnableSnapshot(encodePod, decodePod)
+	return store
+}
+
+func TestRamStoreSnapshotRestore(t *testing.T) {
+	pod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns1", Labels: map[string]string{"app": "nginx1"}}}
+	pod2 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "ns2", Labels: map[string]string{"app": "nginx2"}}}
+	pod3 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3", Namespace: "ns1"}}
+	store := newSnapshotStore()
+	store.Create(pod1)
+	store.Create(pod2)
+	store.Create(pod3)
+	store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "ns2"}})
+	store.Delete("ns1/pod3")
+	pod2 = &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "ns2"}}
+
+	data, resourceVersion, err := store.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), resourceVersion)
+	// Snapshots of the same state are identical.
+	data2, _, err := store.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, data, data2)
+
+	restored := newSnapshotStore()
+	require.NoError(t, restored.Restore(data))
+	assert.Equal(t, resourceVersion, restored.resourceVersion)
+	assert.ElementsMatch(t, []interface{}{pod1, pod2}, restored.List())
+
+	// Watchers can resume from the resourceVersion of the snapshot but not from an older one.
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	w, err := restored.Watch(context.Background(), "5", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+	expiredWatcher, err := restored.Watch(context.Background(), "4", selectors)
+	require.NoError(t, err)
+	assert.Equal(t, watch.Error, (<-expiredWatcher.ResultChan()).Type)
+	restored.Delete("ns1/pod1")
+	select {
+	case event := <-w.ResultChan():
+		assert.Equal(t, watch.Event{Type: watch.Deleted, Object: pod1}, event)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	// An empty store can be restored too.
+	data, resourceVersion, err = newSnapshotStore().Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), resourceVersion)
+	restored = newSnapshotStore()
+	require.NoError(t, restored.Restore(data))
+	assert.Empty(t, restored.List())
+}
+
+func TestRamStoreRestoreInvalid(t *testing.T) {
+	store := newSnapshotStore()
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+	data, _, err := store.Snapshot()
+	require.NoError(t, err)
+
+	modify := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte(nil), data...))
+	}
+	testCases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "invalid snapshot: too short"},
+		{"truncated", data[:len(data)-1], "invalid snapshot: checksum mismatch"},
+		{"unknown format", modify(func(d []byte) []byte { d[0] = 'X'; return d }), "invalid snapshot: unknown format"},
+		{"unsupported version", modify(func(d []byte) []byte { d[4] = 2; return d }), "unsupported snapshot version 2"},
+		{"corrupted object", modify(func(d []byte) []byte { d[len(d)/2]++; return d }), "invalid snapshot: checksum mismatch"},
+		{"corrupted checksum", modify(func(d []byte) []byte { d[len(d)-1]++; return d }), "invalid snapshot: checksum mismatch"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			restored := newSnapshotStore()
+			err := restored.Restore(tc.data)
+			assert.EqualError(t, err, tc.err)
+			assert.Empty(t, restored.List())
+			assert.Equal(t, uint64(0), restored.resourceVersion)
+		})
+	}
+}
+
+func TestRamStoreRestoreNotEmpty(t *testing.T) {
+	data, _, err := newSnapshotStore().Snapshot()
+	require.NoError(t, err)
+	store := newSnapshotStore()
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	assert.EqualError(t, store.Restore(data), "can't restore a snapshot to a store at resourceVersion 1")
+
+	store = NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	_, _, err = store.Snapshot()
+	assert.EqualError(t, err, "snapshot is not enabled")
+	assert.EqualError(t, store.Restore(data), "snapshot is not enabled")
+}
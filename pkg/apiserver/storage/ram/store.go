@@ -17,25 +17,68 @@ package ram
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/labels"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/apiserver/pkg/storage"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 
 	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage/ram/internal/testhooks"
 )
 
 const (
-	// watcherChanSize is the buffer size of watchers.
+	// watcherChanSize is the initial buffer size of watchers.
 	watcherChanSize = 1000
+	// maxWatcherChanSize is the default maximum buffer size watchers can grow to.
+	maxWatcherChanSize = 10000
+	// watcherChanSizeStep is the default amount by which the buffer size of watchers is changed.
+	watcherChanSizeStep = 1000
+	// watcherChanSizeWindow is the default number of events over which the fill ratio of a watcher's
+	// buffer is observed before deciding whether to resize it.
+	watcherChanSizeWindow = 100
+	// labelIndex is the name of the index built on the labels of objects, see EnableLabelIndex.
+	labelIndex = "labels"
+	// watcherChanHighFillRatio is the fill ratio at or above which a watcher's buffer is considered
+	// under pressure.
+	watcherChanHighFillRatio = 0.8
+	// watcherChanLowFillRatio is the fill ratio below which a watcher's buffer is considered idle.
+	watcherChanLowFillRatio = 0.2
 	// watcherAddTimeout is the timeout of sending one event to all watchers.
 	// Watchers whose buffer can't be available in it will be terminated.
 	watcherAddTimeout = 50 * time.Millisecond
+	// watcherAddTimeSlice is the maximum duration a blocked watcher can take in each round of sending one
+	// event, so that a slow watcher can't exhaust watcherAddTimeout at the expense of the others.
+	watcherAddTimeSlice = 5 * time.Millisecond
+	// eventHistorySize is the default number of recent events kept by the store.
+	eventHistorySize = 1000
+	// compactionWarningRatio is the fraction of the history size at or below which the number of events that
+	// can still be recorded before a Bookmark's resourceVersion gets compacted is considered low.
+	compactionWarningRatio = 0.1
+	// watcherBookmarkInterval is the default interval after which an idle watcher that allows bookmarks
+	// will receive a Bookmark event.
+	watcherBookmarkInterval = time.Minute
+	// freshnessTimeout is the maximum duration a watch creation is blocked waiting for the store to catch up
+	// with the resourceVersion requested with ResourceVersionMatchNotOlderThan.
+	freshnessTimeout = 3 * time.Second
+	// bookmarkJitterFactor is the maximum factor by which the interval of Bookmark events is jittered.
+	bookmarkJitterFactor = 0.5
+	// dispatchLatencyWindow is the period over which the dispatch latency quantiles are computed. It's short so
+	// that the health check based on them recovers soon after a spike.
+	dispatchLatencyWindow = time.Minute
+	// dispatchLatencyAgeBuckets is the number of buckets dispatchLatencyWindow is divided into, observations
+	// expire one bucket at a time.
+	dispatchLatencyAgeBuckets = 3
 )
 
 type watchersMap map[int]*storeWatcher
@@ -46,11 +89,9 @@ type store struct {
 	watcherMutex sync.RWMutex
 	// eventMutex is used to avoid race condition when generating events.
 	eventMutex sync.RWMutex
-	// incomingHWM is HighWaterMark for performance debugging.
-	// It records the maximum number of events backed up in incoming channel that have been seen.
-	incomingHWM storage.HighWaterMark
-	// incoming stores the incoming events that should be dispatched to watchers.
-	incoming chan antreastorage.InternalEvent
+	// shards dispatch the events to the watchers, each to the watchers assigned to it, see SetDispatchShards.
+	// It's only replaced while no watcher exists, with both eventMutex and watcherMutex held.
+	shards []*dispatchShard
 
 	// storage is the underlying storage.
 	storage cache.Indexer
@@ -58,47 +99,168 @@ type store struct {
 	keyFunc cache.KeyFunc
 	// genEventFunc is used to generate InternalEvent from update of an object.
 	genEventFunc antreastorage.GenEventFunc
+	// newFunc is used to create a new empty object of the stored type, e.g. for Bookmark events.
+	newFunc func() runtime.Object
+	// resource is the name of the stored type, used to label metrics.
+	resource string
+	// labelIndexed indicates whether the underlying storage has an index on the labels of objects.
+	labelIndexed bool
 
 	// resourceVersion up to which the store has generated.
 	resourceVersion uint64
+	// versionMutex protects versionCh.
+	versionMutex sync.Mutex
+	// versionCh is closed when resourceVersion is increased, to notify the watch creations waiting for the store
+	// to catch up with a resourceVersion. It's nil if no one is waiting.
+	versionCh chan struct{}
+	// history keeps the most recent events in ascending order of resourceVersion, so that a watcher
+	// resuming from a recent resourceVersion only receives the events it missed.
+	history *eventRing
+	// compactedResourceVersion is the resourceVersion up to which events have been discarded from history.
+	// Watchers can't resume from a resourceVersion older than it.
+	compactedResourceVersion uint64
+	// tombstones keep the Delete events of the most recently deleted objects for backfilling watchers resuming from
+	// a compacted resourceVersion, see EnableDeleteBackfill. It's nil if backfilling is disabled.
+	tombstones *eventRing
+	// compactedTombstoneVersion is the resourceVersion up to which Delete events have been discarded from tombstones.
+	compactedTombstoneVersion uint64
 	// watcherIdx is the index that will be allocated to next watcher and used as key in watchersMap
 	// so that a watcher can be deleted from the map according to its index later.
 	watcherIdx int
-	// watchers is a mapping from the index of a watcher to the watcher.
+	// watchers is a mapping from the index of a watcher to the watcher, across all shards.
 	watchers watchersMap
 
+	// bookmarkInterval is the interval after which an idle watcher will receive a Bookmark event,
+	// if it allows bookmarks.
+	bookmarkInterval time.Duration
+	// watcherSendTimeout is the duration after which a watcher will be stopped if its client doesn't
+	// receive an event. Zero means no timeout.
+	watcherSendTimeout time.Duration
+	// dispatchLatency observes how long it takes to dispatch an event to all watchers.
+	dispatchLatency prometheus.Summary
+	// breakerThreshold is the duration of dispatching an event to all watchers beyond which the slowest watcher
+	// will be stopped, see SetDispatchBreakerThreshold. Zero, the default, disables it.
+	breakerThreshold time.Duration
+	// freshnessTimeout is the maximum duration a watch or list requiring a resourceVersion not older than a given
+	// one is blocked waiting for the store to catch up.
+	freshnessTimeout time.Duration
+	// initEventsPageSize is the number of ADDED events a watcher listing the existing objects generates at once, see
+	// EnableChunkedInitEvents. Zero means all of them are generated when the watcher is created.
+	initEventsPageSize int
+
+	// minWatcherChanSize, maxWatcherChanSize and watcherChanSizeStep control the buffer size of watchers'
+	// input channel. A watcher starts with minWatcherChanSize. Whenever its buffer has been observed at
+	// least watcherChanHighFillRatio full for most of a window of watcherChanSizeWindow events, the buffer
+	// grows by watcherChanSizeStep up to maxWatcherChanSize; whenever it has stayed below
+	// watcherChanLowFillRatio full for a whole window, it shrinks by watcherChanSizeStep down to
+	// minWatcherChanSize. The result channel, which has been handed to the client, is not resized.
+	minWatcherChanSize  int
+	maxWatcherChanSize  int
+	watcherChanSizeStep int
+	// watcherResultSize is the buffer size of watchers' result channel. It absorbs the bursts a client can't
+	// receive immediately, while the input channel absorbs the bursts of dispatching, so they're sized separately.
+	watcherResultSize int
+	// watcherChanSizeWindow is the number of events over which the fill ratio of a watcher's buffer is
+	// observed before deciding whether to resize it.
+	watcherChanSizeWindow int
+
+	// maxWatchers is the maximum number of active watchers, beyond which new watches are rejected. Zero means no
+	// limit. activeWatchers is the number of watchers created by Watch and not stopped yet, excluding the ones
+	// that only receive an expired error. Both are protected by watcherMutex.
+	maxWatchers    int
+	activeWatchers int
+
+	// shareWatchers indicates whether watchers with identical selectors share a source, see EnableWatcherSharing.
+	shareWatchers bool
+	// sharedSources maps the sharing key of selectors to the source shared by the watchers having them. It's
+	// protected by watcherMutex.
+	sharedSources map[string]*sharedSource
+
+	// encodeFunc and decodeFunc encode and decode objects for Snapshot and Restore, see EnableSnapshot.
+	encodeFunc ObjectEncodeFunc
+	decodeFunc ObjectDecodeFunc
+
+	// snapshotMutex protects snapshots.
+	snapshotMutex sync.Mutex
+	// snapshots are the snapshots of the store kept for paginated lists, keyed by their resourceVersion.
+	snapshots map[uint64]*listSnapshot
+	// snapshotTTL is the duration a snapshot is kept after its last use.
+	snapshotTTL time.Duration
+
+	// expiries maps the keys of the objects that have a TTL to the time they expire, see SetTTL. It's protected by
+	// eventMutex.
+	expiries map[string]time.Time
+	// expiryCh wakes the reaper up when an expiry is set, so that it can reschedule itself.
+	expiryCh chan struct{}
+	// reaperOnce starts the reaper on the first call to SetTTL.
+	reaperOnce sync.Once
+
+	// stopCh stops the current dispatch shards, it's replaced when the shards are.
 	stopCh chan struct{}
-	// timer is used when sending events to watchers. Hold it here to avoid unnecessary
-	// re-allocation for each event.
-	timer *time.Timer
+	// done is closed when the store is stopped, which terminates all its goroutines.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-// NewStore creates a store based on the provided KeyFunc, Indexers, and GenEventFunc.
+// NewStore creates a store of the provided resource based on the provided KeyFunc, Indexers, GenEventFunc, and NewFunc.
+// Resource is the name of the stored type, used to label metrics.
 // KeyFunc decides how to get the key from an object.
 // Indexers decides how to build indices for an object.
 // GenEventFunc decides how to generate InternalEvent for an update of an object.
-func NewStore(keyFunc cache.KeyFunc, indexers cache.Indexers, genEventFunc antreastorage.GenEventFunc) *store {
+// NewFunc decides how to create an empty object of the stored type.
+func NewStore(resource string, keyFunc cache.KeyFunc, indexers cache.Indexers, genEventFunc antreastorage.GenEventFunc, newFunc func() runtime.Object) *store {
 	stopCh := make(chan struct{})
 	storage := cache.NewIndexer(keyFunc, indexers)
-	timer := time.NewTimer(time.Duration(0))
-	// Ensure the timer is stopped and drain the channel.
-	if !timer.Stop() {
-		<-timer.C
-	}
 	s := &store{
-		incoming:     make(chan antreastorage.InternalEvent, 100),
-		storage:      storage,
-		stopCh:       stopCh,
-		watchers:     make(map[int]*storeWatcher),
-		keyFunc:      keyFunc,
-		genEventFunc: genEventFunc,
-		timer:        timer,
+		storage:               storage,
+		stopCh:                stopCh,
+		done:                  make(chan struct{}),
+		watchers:              make(map[int]*storeWatcher),
+		keyFunc:               keyFunc,
+		genEventFunc:          genEventFunc,
+		newFunc:               newFunc,
+		resource:              resource,
+		history:               newEventRing(eventHistorySize),
+		bookmarkInterval:      watcherBookmarkInterval,
+		freshnessTimeout:      freshnessTimeout,
+		minWatcherChanSize:    watcherChanSize,
+		maxWatcherChanSize:    maxWatcherChanSize,
+		watcherChanSizeStep:   watcherChanSizeStep,
+		watcherChanSizeWindow: watcherChanSizeWindow,
+		watcherResultSize:     watcherChanSize,
+		sharedSources:         make(map[string]*sharedSource),
+		snapshots:             make(map[uint64]*listSnapshot),
+		snapshotTTL:           listSnapshotTTL,
+		expiries:              make(map[string]time.Time),
+		expiryCh:              make(chan struct{}, 1),
 	}
-
-	go s.dispatchEvents()
+	s.dispatchLatency = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:   metricNamespace,
+		Subsystem:   metricSubsystem,
+		Name:        "watcher_dispatch_duration_seconds",
+		Help:        "Duration of dispatching an event to all watchers of a dispatch shard.",
+		ConstLabels: prometheus.Labels{"resource": s.resource},
+		Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		MaxAge:      dispatchLatencyWindow,
+		AgeBuckets:  dispatchLatencyAgeBuckets,
+	})
+
+	s.shards = []*dispatchShard{newDispatchShard(s)}
+	go s.shards[0].run(stopCh)
 	return s
 }
 
+// Stop terminates the store's dispatchers and reaper. Events generated afterwards are no longer dispatched to
+// watchers and expired objects are no longer deleted. Calling it more than once is a no-op.
+func (s *store) Stop() {
+	s.stopOnce.Do(func() {
+		s.eventMutex.Lock()
+		defer s.eventMutex.Unlock()
+		close(s.done)
+		close(s.stopCh)
+	})
+}
+
 // nextResourceVersion increments the resourceVersion and returns it.
 // It is not thread safe and should be called while holding a lock on eventMutex.
 func (s *store) nextResourceVersion() uint64 {
@@ -106,12 +268,27 @@ func (s *store) nextResourceVersion() uint64 {
 	return s.resourceVersion
 }
 
-func (s *store) processEvent(event antreastorage.InternalEvent) {
-	if curLen := int64(len(s.incoming)); s.incomingHWM.Update(curLen) {
-		// Monitor if this gets backed up, and how much.
-		klog.V(1).Infof("%v objects queued in incoming channel", curLen)
+// keyedEvent is an event queued for dispatching along with the key of the object it was generated for. The key is
+// empty if the event may concern any object, in which case it's dispatched to all watchers.
+type keyedEvent struct {
+	key   string
+	event antreastorage.InternalEvent
+}
+
+// processEvent records the event generated for the object of the provided key in history and queues it for
+// dispatching.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) processEvent(key string, event antreastorage.InternalEvent) {
+	if evicted := s.history.add(event); evicted != nil {
+		s.compactedResourceVersion = evicted.GetResourceVersion()
 	}
-	s.incoming <- event
+	s.versionMutex.Lock()
+	if s.versionCh != nil {
+		close(s.versionCh)
+		s.versionCh = nil
+	}
+	s.versionMutex.Unlock()
+	s.queueEvent(keyedEvent{key: key, event: event})
 }
 
 // Get returns the object matching the provided key along with a boolean value
@@ -150,7 +327,7 @@ func (s *store) Create(obj interface{}) error {
 	// The object has been verified with keyFunc in the beginning, can never encounter any error.
 	s.storage.Add(obj)
 	if event != nil {
-		s.processEvent(event)
+		s.processEvent(key, event)
 	}
 	return nil
 }
@@ -179,20 +356,97 @@ func (s *store) Update(obj interface{}) error {
 
 	s.storage.Update(obj)
 	if event != nil {
-		s.processEvent(event)
+		s.processEvent(key, event)
 	}
 	return nil
 }
 
+// resyncEvent is dispatched to all watchers by TriggerResync. It carries an ADDED InternalEvent for each
+// object existing at its resourceVersion, which watchers resend regardless of the resourceVersion they
+// have observed.
+type resyncEvent struct {
+	events          []antreastorage.InternalEvent
+	resourceVersion uint64
+}
+
+// ToWatchEvent returns nil as a resyncEvent is never sent to clients itself.
+func (e *resyncEvent) ToWatchEvent(selectors *antreastorage.Selectors) *watch.Event {
+	return nil
+}
+
+func (e *resyncEvent) GetResourceVersion() uint64 {
+	return e.resourceVersion
+}
+
+// TriggerResync makes all active watchers resend an ADDED event for each object selected by them, e.g. after
+// the representation of objects has changed. The events are dispatched in order with the other events, so
+// a watcher never receives an object older than the ones it has received. As the resourceVersion doesn't
+// change, the resync is not recorded in the history and watchers resuming from a resourceVersion won't replay
+// it.
+func (s *store) TriggerResync() error {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	events, err := s.listInitEvents(nil)
+	if err != nil {
+		return fmt.Errorf("error generating resync events: %v", err)
+	}
+	s.queueEvent(keyedEvent{event: &resyncEvent{events: events, resourceVersion: s.resourceVersion}})
+	return nil
+}
+
+func init() {
+	testhooks.InjectEvent = func(s antreastorage.Interface, genEvent func(resourceVersion uint64) (antreastorage.InternalEvent, error)) error {
+		return s.(*store).injectEvent(genEvent)
+	}
+}
+
+// injectEvent dispatches an event generated by genEvent to the watchers without changing the stored objects.
+// genEvent is called with the next resourceVersion. It's meant for tests to synthesize events, which reach it
+// through testhooks.InjectEvent.
+func (s *store) injectEvent(genEvent func(resourceVersion uint64) (antreastorage.InternalEvent, error)) error {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	event, err := genEvent(s.resourceVersion + 1)
+	if err != nil {
+		return fmt.Errorf("error generating event: %v", err)
+	}
+	s.nextResourceVersion()
+	s.processEvent("", event)
+	return nil
+}
+
 // List returns a list of all the objects.
 func (s *store) List() []interface{} {
 	return s.storage.List()
 }
 
+// ListAtLeast returns a list of all the objects along with the resourceVersion it reflects, which is at least the
+// provided one. If the store hasn't caught up with it, ListAtLeast blocks up to freshnessTimeout, after which a
+// Timeout error is returned, or until the context is canceled.
+func (s *store) ListAtLeast(ctx context.Context, resourceVersion uint64) ([]interface{}, uint64, error) {
+	if err := s.waitUntilFresh(ctx, resourceVersion, s.freshnessTimeout); err != nil {
+		return nil, 0, err
+	}
+	// Locks eventMutex for reading so that the list is consistent with the returned resourceVersion.
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	return s.storage.List(), s.resourceVersion, nil
+}
+
 // Delete deletes the object from internal cache storage.
 func (s *store) Delete(key string) error {
 	s.eventMutex.Lock()
 	defer s.eventMutex.Unlock()
+
+	return s.delete(key)
+}
+
+// delete is the implementation of Delete.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) delete(key string) error {
 	prevObj, exists, _ := s.storage.GetByKey(key)
 	if !exists {
 		return fmt.Errorf("object %+v not found in storage", key)
@@ -208,128 +462,507 @@ func (s *store) Delete(key string) error {
 	}
 
 	s.storage.Delete(prevObj)
+	delete(s.expiries, key)
 	if event != nil {
-		s.processEvent(event)
+		s.recordTombstone(key, event)
+		s.processEvent(key, event)
 	}
 	return nil
 }
 
-// Watch creates a watcher based on the key, label selector and field selector.
-func (s *store) Watch(ctx context.Context, key string, labelSelector labels.Selector, fieldSelector fields.Selector) (watch.Interface, error) {
+// Watch creates a watcher based on the resourceVersion and selectors.
+// Following Kubernetes conventions, if resourceVersion is unset, Added events of all existing objects will be
+// sent to the watcher first, followed by the changes after them. If resourceVersion is "0", the client accepts
+// a stale state as well, which is served the same way as the store's state is always the most recent one.
+// If selectors.SendInitialEvents is set, existing objects will be sent first regardless of resourceVersion,
+// followed by a Bookmark event marking the end of them. If selectors.SendSyncMarker is set, the events sent before
+// the live changes are followed by a Bookmark event marking the end of them. If selectors.ResourceVersionMatch is NotOlderThan,
+// existing objects will be sent first as well, once the store is at least as new as resourceVersion. Watch
+// blocks up to freshnessTimeout for the store to catch up, after which a Timeout error is returned.
+// Otherwise, the events that happened after resourceVersion will be sent first, in which case the watcher will
+// receive an Error event and be terminated if the events have been discarded from history, unless the store can
+// backfill them, see EnableDeleteBackfill.
+// If selectors.ResourceVersionCeiling is set, the watcher is closed once it has observed the ceiling.
+func (s *store) Watch(ctx context.Context, resourceVersion string, selectors *antreastorage.Selectors) (watch.Interface, error) {
 	if s.genEventFunc == nil {
 		return nil, fmt.Errorf("genEventFunc must be set to support watching")
 	}
+	fromVersion, err := parseResourceVersion(resourceVersion)
+	if err != nil {
+		return nil, err
+	}
+	if selectors.SendInitialEvents && !selectors.AllowWatchBookmarks {
+		return nil, errors.NewBadRequest("sendInitialEvents requires allowWatchBookmarks")
+	}
+	if selectors.SendSyncMarker && !selectors.AllowWatchBookmarks {
+		return nil, errors.NewBadRequest("sendSyncMarker requires allowWatchBookmarks")
+	}
+	if selectors.ResourceVersionCeiling > 0 && selectors.ResourceVersionCeiling < fromVersion {
+		return nil, errors.NewBadRequest(fmt.Sprintf("resourceVersion ceiling %d is older than resourceVersion %d", selectors.ResourceVersionCeiling, fromVersion))
+	}
+	notOlderThan := selectors.ResourceVersionMatch == antreastorage.ResourceVersionMatchNotOlderThan
+	if notOlderThan {
+		if err := s.waitUntilFresh(ctx, fromVersion, s.freshnessTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if selectors.SendInitialEvents || notOlderThan || fromVersion == 0 {
+		// Reject the watch before listing the objects if the limit is already reached. The limit is checked
+		// again when the watcher is registered as other watchers may be created in the meantime.
+		if err := s.precheckWatcherLimit(); err != nil {
+			return nil, err
+		}
+		// Only the watches listing the objects are paced, resuming ones just replay recent events.
+		if err := waitForWatchInit(ctx, s.resource); err != nil {
+			return nil, err
+		}
+	}
 	// Locks eventMutex for reading so that no new events will be generated in the meantime
 	// while other watchers won't be blocked.
 	s.eventMutex.RLock()
 	defer s.eventMutex.RUnlock()
 
-	allObjects := s.storage.List()
-	initEvents := make([]antreastorage.InternalEvent, len(allObjects))
-	for i, obj := range allObjects {
-		// Objects retrieved from storage have been verified with keyFunc when they are inserted.
-		key, _ := s.keyFunc(obj)
-		event, err := s.genEventFunc(key, nil, obj, s.resourceVersion)
+	if key, ok := s.sharingKey(fromVersion, selectors); ok {
+		watcher, initEvents, err := s.attachSharedWatcher(key, selectors)
 		if err != nil {
 			return nil, err
 		}
-		initEvents[i] = event
+		go watcher.process(ctx, initEvents, s.resourceVersion)
+		return watcher, nil
 	}
 
-	watcher := func() *storeWatcher {
+	var initEvents []antreastorage.InternalEvent
+	var initObjs *initObjects
+	var backfilled bool
+	switch {
+	case selectors.SendInitialEvents || notOlderThan:
+		// The client wants a state not older than resourceVersion followed by the changes after it. With
+		// SendInitialEvents, the end of the state will be marked by a Bookmark event.
+		if fromVersion > s.resourceVersion {
+			return nil, errors.NewBadRequest(fmt.Sprintf("resourceVersion %d is newer than the current resourceVersion %d", fromVersion, s.resourceVersion))
+		}
+		initEvents, initObjs, err = s.listInit(selectors)
+		if err != nil {
+			return nil, err
+		}
+	case fromVersion == 0:
+		// Unset resourceVersion means the client wants the most recent state followed by the changes after it,
+		// while "0" means it accepts any state, even a stale one. The store always serves from its cache, which
+		// is the most recent state, so both are served the same.
+		initEvents, initObjs, err = s.listInit(selectors)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		initEvents, err = s.replay(fromVersion)
+		if errors.IsResourceExpired(err) && s.canBackfill(fromVersion, selectors) {
+			// Unlike an expired watch, a backfilled one creates a watcher, which must be within the limit.
+			if err := s.precheckWatcherLimit(); err != nil {
+				return nil, err
+			}
+			initEvents, err = s.backfill(fromVersion, selectors)
+			backfilled = err == nil
+		}
+		if errors.IsResourceExpired(err) {
+			// The events after fromVersion have been overwritten in history, the client must relist. Clients
+			// that want the full state streamed instead should set SendInitialEvents.
+			// The watcher is not added to the store as it will only receive the Error event.
+			klog.V(2).Infof("Watch of %s from resourceVersion %d expired, watches can only resume from resourceVersions %d to %d",
+				s.resource, fromVersion, s.compactedResourceVersion, s.resourceVersion)
+			watcher := s.newWatcher(selectors, nil)
+			status := err.(errors.APIStatus).Status()
+			go watcher.processExpired(&status)
+			return watcher, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	watcher, err := func() (*storeWatcher, error) {
 		s.watcherMutex.Lock()
 		defer s.watcherMutex.Unlock()
 
-		w := newStoreWatcher(watcherChanSize, &antreastorage.Selectors{key, labelSelector, fieldSelector}, forgetWatcher(s, s.watcherIdx))
-		s.watchers[s.watcherIdx] = w
+		if err := s.checkWatcherLimit(); err != nil {
+			return nil, err
+		}
+		w := s.newWatcher(selectors, forgetWatcher(s, s.watcherIdx))
+		s.addWatcher(s.watcherIdx, w)
 		s.watcherIdx++
-		return w
+		s.activeWatchers++
+		return w, nil
 	}()
+	if err != nil {
+		return nil, err
+	}
 
 	// Specify current resourceVersion so that old events that were currently buffered in incoming channel won't be
 	// delivered to the watcher twice when initEvents already have them.
+	watcher.initObjects = initObjs
+	watcher.backfilled = backfilled
 	go watcher.process(ctx, initEvents, s.resourceVersion)
 	return watcher, nil
 }
 
-// GetWatchersNum gets the number of watchers for the store.
-func (s *store) GetWatchersNum() int {
-	s.watcherMutex.RLock()
-	defer s.watcherMutex.RUnlock()
+// newWatcher creates a watcher configured according to the store and records it in metrics.
+func (s *store) newWatcher(selectors *antreastorage.Selectors, forget func()) *storeWatcher {
+	w := s.buildWatcher(selectors, forget)
+	recordWatcherCreated(s.resource)
+	return w
+}
 
-	return len(s.watchers)
+// buildWatcher creates a watcher configured according to the store without recording it in metrics. It's used
+// directly for the sources of shared watchers, whose clients are recorded instead, see recordStopped.
+func (s *store) buildWatcher(selectors *antreastorage.Selectors, forget func()) *storeWatcher {
+	w := newStoreWatcher(s.minWatcherChanSize, s.watcherResultSize, selectors, forget, s.newFunc)
+	w.resource = s.resource
+	w.bookmarkInterval = s.bookmarkInterval
+	w.sendTimeout = s.watcherSendTimeout
+	w.compactionWarning = s.compactionWarning
+	w.selectorsHash = hashSelectors(selectors)
+	return w
 }
 
-func forgetWatcher(s *store, index int) func() {
-	return func() {
-		s.watcherMutex.Lock()
-		defer s.watcherMutex.Unlock()
+// waitUntilFresh blocks until the store's resourceVersion is at least the provided one. It returns a Timeout
+// error if the store doesn't catch up in the provided timeout, which usually means the resourceVersion was not
+// generated by this store, or an error if the context is canceled.
+func (s *store) waitUntilFresh(ctx context.Context, resourceVersion uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// Get the channel before checking resourceVersion, so that no notification will be missed.
+		s.versionMutex.Lock()
+		if s.versionCh == nil {
+			s.versionCh = make(chan struct{})
+		}
+		versionCh := s.versionCh
+		s.versionMutex.Unlock()
+
+		s.eventMutex.RLock()
+		currentVersion := s.resourceVersion
+		s.eventMutex.RUnlock()
+		if currentVersion >= resourceVersion {
+			return nil
+		}
 
-		delete(s.watchers, index)
+		select {
+		case <-versionCh:
+		case <-timer.C:
+			return errors.NewTimeoutError(fmt.Sprintf("too large resource version: %d, current: %d", resourceVersion, currentVersion), 1)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
-func (s *store) dispatchEvents() {
-	for {
-		select {
-		case event, ok := <-s.incoming:
-			if !ok {
-				return
+// listInitEvents generates Added events carrying the current resourceVersion for the existing objects that may
+// match the provided selectors. It returns nil if there is no such object.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) listInitEvents(selectors *antreastorage.Selectors) ([]antreastorage.InternalEvent, error) {
+	objs := s.listCandidates(selectors)
+	if len(objs) == 0 {
+		return nil, nil
+	}
+	initEvents := make([]antreastorage.InternalEvent, len(objs))
+	for i, obj := range objs {
+		// Objects retrieved from storage have been verified with keyFunc when they are inserted.
+		key, _ := s.keyFunc(obj)
+		event, err := s.genEventFunc(key, nil, obj, s.resourceVersion)
+		if err != nil {
+			return nil, err
+		}
+		initEvents[i] = event
+	}
+	return initEvents, nil
+}
+
+// EnableLabelIndex builds an index on the labels of objects, which is used to generate the initial events
+// of watchers whose label selector has an equality requirement without scanning all objects.
+// It must be called before any object is added to the store.
+func (s *store) EnableLabelIndex() error {
+	if err := s.storage.AddIndexers(cache.Indexers{labelIndex: labelIndexFunc}); err != nil {
+		return err
+	}
+	s.labelIndexed = true
+	return nil
+}
+
+// listCandidates returns the objects that may match the provided selectors. If the selectors have a key, only
+// the object of the key is returned. If the label selector has an equality requirement and the label index is
+// enabled, only the objects having the required label are returned, otherwise all objects are returned. The caller is still responsible for filtering them.
+func (s *store) listCandidates(selectors *antreastorage.Selectors) []interface{} {
+	if selectors != nil && selectors.Key != "" {
+		// The watcher only monitors a single object.
+		obj, exists, _ := s.storage.GetByKey(selectors.Key)
+		if !exists {
+			return nil
+		}
+		return []interface{}{obj}
+	}
+	if !s.labelIndexed || selectors == nil || selectors.Label == nil {
+		return s.storage.List()
+	}
+	requirements, selectable := selectors.Label.Requirements()
+	if !selectable {
+		return s.storage.List()
+	}
+	for _, r := range requirements {
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			values := r.Values()
+			if values.Len() != 1 {
+				continue
 			}
-			s.dispatchEvent(event)
-		case <-s.stopCh:
-			return
+			objs, err := s.storage.ByIndex(labelIndex, labelIndexKey(r.Key(), values.List()[0]))
+			if err != nil {
+				klog.Errorf("Failed to get objects by label index: %v", err)
+				return s.storage.List()
+			}
+			return objs
 		}
 	}
+	return s.storage.List()
 }
 
-func (s *store) dispatchEvent(event antreastorage.InternalEvent) {
-	var failedWatchers []*storeWatcher
+// labelIndexFunc is the IndexFunc of labelIndex, it indexes an object by each of its labels.
+func labelIndexFunc(obj interface{}) ([]string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	objLabels := accessor.GetLabels()
+	keys := make([]string, 0, len(objLabels))
+	for k, v := range objLabels {
+		keys = append(keys, labelIndexKey(k, v))
+	}
+	return keys, nil
+}
 
-	func() {
-		s.watcherMutex.RLock()
-		defer s.watcherMutex.RUnlock()
+func labelIndexKey(key, value string) string {
+	return key + "=" + value
+}
 
-		// First try to send events without blocking, to avoid setting up a timer
-		// for every event.
-		// blockedWatchers keeps watchers whose buffer are full.
-		var blockedWatchers []*storeWatcher
-		// TODO: Optimize this to dispatch the event based on watchers' selector.
-		for _, watcher := range s.watchers {
-			if !watcher.nonBlockingAdd(event) {
-				blockedWatchers = append(blockedWatchers, watcher)
-			}
+// Replay returns the events retained in history whose resourceVersion is greater than fromVersion,
+// in ascending order of resourceVersion. It returns a ResourceExpired error if the events after
+// fromVersion have been discarded, or a BadRequest error if fromVersion is newer than the store.
+func (s *store) Replay(fromVersion uint64) ([]antreastorage.InternalEvent, error) {
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	return s.replay(fromVersion)
+}
+
+// replay is the implementation of Replay.
+// It is not thread safe and should be called while holding a lock on eventMutex.
+func (s *store) replay(fromVersion uint64) ([]antreastorage.InternalEvent, error) {
+	if fromVersion > s.resourceVersion {
+		return nil, errors.NewBadRequest(fmt.Sprintf("resourceVersion %d is newer than the current resourceVersion %d", fromVersion, s.resourceVersion))
+	}
+	if fromVersion < s.compactedResourceVersion {
+		return nil, errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", fromVersion, s.compactedResourceVersion))
+	}
+	return s.history.since(fromVersion), nil
+}
+
+// SetWatcherChanSizes changes the initial buffer size of watchers' input channel and the buffer size of their
+// result channel, which are both watcherChanSize by default. The input channel can still grow up to
+// maxWatcherChanSize, or up to inputSize if it's larger. It only applies to the watchers created afterwards.
+func (s *store) SetWatcherChanSizes(inputSize, resultSize int) error {
+	if inputSize <= 0 || resultSize <= 0 {
+		return fmt.Errorf("buffer sizes of watchers must be positive, got input %d and result %d", inputSize, resultSize)
+	}
+	s.watcherMutex.Lock()
+	defer s.watcherMutex.Unlock()
+
+	s.minWatcherChanSize = inputSize
+	if s.maxWatcherChanSize < inputSize {
+		s.maxWatcherChanSize = inputSize
+	}
+	s.watcherResultSize = resultSize
+	return nil
+}
+
+// SetMaxWatchers sets the maximum number of active watchers. Once it's reached, new watches get a
+// TooManyRequests error until some watchers are stopped. Zero, the default, means no limit. Lowering it doesn't
+// stop the active watchers.
+func (s *store) SetMaxWatchers(max int) error {
+	if max < 0 {
+		return fmt.Errorf("maximum number of watchers must not be negative, got %d", max)
+	}
+	s.watcherMutex.Lock()
+	defer s.watcherMutex.Unlock()
+
+	s.maxWatchers = max
+	return nil
+}
+
+// SetDispatchBreakerThreshold makes the store stop the slowest watcher whenever dispatching an event to all watchers
+// of a dispatch shard takes longer than threshold, so that one slow client can't delay the others for long. Zero, the
+// default, disables it, in which case watchers are only stopped when their buffer can't be available within
+// watcherAddTimeout. A threshold below watcherAddTimeout stops watchers earlier than that budget allows.
+func (s *store) SetDispatchBreakerThreshold(threshold time.Duration) error {
+	if threshold < 0 {
+		return fmt.Errorf("dispatch breaker threshold must not be negative, got %v", threshold)
+	}
+	s.watcherMutex.Lock()
+	defer s.watcherMutex.Unlock()
+
+	s.breakerThreshold = threshold
+	return nil
+}
+
+// SetHistorySize changes the maximum number of recent events kept by the store for watchers to resume from,
+// which is eventHistorySize by default. If it's smaller than the number of events kept, the oldest events are
+// discarded, after which watchers can't resume from them.
+func (s *store) SetHistorySize(size int) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	history := newEventRing(size)
+	for i := 0; i < s.history.len(); i++ {
+		if evicted := history.add(s.history.at(i)); evicted != nil {
+			s.compactedResourceVersion = evicted.GetResourceVersion()
+		}
+	}
+	s.history = history
+}
+
+// compactionWarning returns the number of events that can still be recorded before a watcher resuming from
+// resourceVersion gets an expired error, and whether it's at or below compactionWarningRatio of the history size.
+func (s *store) compactionWarning(resourceVersion uint64) (int, bool) {
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	capacity := s.history.capacity()
+	if capacity == 0 {
+		// Watchers can't resume from any resourceVersion, there is nothing to warn about.
+		return 0, false
+	}
+	if resourceVersion < s.compactedResourceVersion {
+		return 0, true
+	}
+	headroom := capacity - s.history.countSince(resourceVersion)
+	return headroom, float64(headroom) <= float64(capacity)*compactionWarningRatio
+}
+
+// ListWatchers gets the information of the active watchers of the store, in the order they were created, with the
+// clients of a shared source listed together in place of the source.
+func (s *store) ListWatchers() []antreastorage.WatcherInfo {
+	s.watcherMutex.RLock()
+	defer s.watcherMutex.RUnlock()
+
+	indexes := make([]int, 0, len(s.watchers))
+	for idx := range s.watchers {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	infos := make([]antreastorage.WatcherInfo, 0, len(indexes))
+	for _, idx := range indexes {
+		if source := s.watchers[idx].source; source != nil {
+			infos = append(infos, source.clientInfos()...)
+			continue
 		}
-		if len(blockedWatchers) == 0 {
-			return
+		infos = append(infos, s.watchers[idx].info())
+	}
+	return infos
+}
+
+// GetWatchersNum gets the number of watchers for the store.
+func (s *store) GetWatchersNum() int {
+	return s.CountWatchers()
+}
+
+// CountWatchers returns the number of active watchers, counting the clients of shared sources rather than the
+// sources.
+func (s *store) CountWatchers() int {
+	s.watcherMutex.RLock()
+	defer s.watcherMutex.RUnlock()
+
+	count := 0
+	for _, w := range s.watchers {
+		if w.source != nil {
+			count += w.source.countClients()
+		} else {
+			count++
 		}
-		klog.V(2).Infof("%d watchers were not available to receive event %+v immediately", len(blockedWatchers), event)
-
-		// Then try to send events to blocked watchers with a timeout. If it
-		// timeouts, it means the watcher is too slow to consume the events or the
-		// underlying connection is already dead, terminate the watcher in this case.
-		// antrea-agent will start a new watch after it's disconnected.
-		s.timer.Reset(watcherAddTimeout)
-		timer := s.timer
-
-		for _, watcher := range blockedWatchers {
-			if !watcher.add(event, timer) {
-				failedWatchers = append(failedWatchers, watcher)
-				// setting timer to nil to let watcher know know the timer has fired.
-				timer = nil
+	}
+	return count
+}
+
+// CountObjects returns the number of stored objects. It's consistent with the resourceVersion of the store
+// as it's read with eventMutex held.
+func (s *store) CountObjects() int {
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	return len(s.storage.ListKeys())
+}
+
+// ResourceVersionRange returns the range of resourceVersions watchers can resume from. A watcher resuming from a
+// resourceVersion older than min gets an expired error as the events following it have been discarded.
+func (s *store) ResourceVersionRange() (uint64, uint64) {
+	s.eventMutex.RLock()
+	defer s.eventMutex.RUnlock()
+
+	return s.compactedResourceVersion, s.resourceVersion
+}
+
+// DispatchLatencyP99 returns the 99th percentile of the duration of dispatching an event to all watchers,
+// observed in the last dispatchLatencyWindow. It returns 0 if no event has been dispatched in the period.
+func (s *store) DispatchLatencyP99() time.Duration {
+	metric := &dto.Metric{}
+	if err := s.dispatchLatency.Write(metric); err != nil {
+		klog.Errorf("Failed to read dispatch latency of %s: %v", s.resource, err)
+		return 0
+	}
+	for _, q := range metric.GetSummary().GetQuantile() {
+		if q.GetQuantile() == 0.99 {
+			if math.IsNaN(q.GetValue()) {
+				return 0
 			}
+			return time.Duration(q.GetValue() * float64(time.Second))
 		}
+	}
+	return 0
+}
 
-		// Stop the timer and drain its channel if it is not fired.
-		if timer != nil && !timer.Stop() {
-			<-timer.C
-		}
-	}()
+// parseResourceVersion parses the resourceVersion requested by a watcher. Both empty string and "0" mean
+// watching from the current state, 0 will be returned for them. Callers that need to tell them apart should
+// check the original string.
+func parseResourceVersion(resourceVersion string) (uint64, error) {
+	if resourceVersion == "" {
+		return 0, nil
+	}
+	version, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return 0, errors.NewBadRequest(fmt.Sprintf("invalid resourceVersion %q: %v", resourceVersion, err))
+	}
+	return version, nil
+}
 
-	// Terminate unresponsive watchers, this must be executed without watcherMutex as
-	// watcher.Stop will require the lock itself.
-	for _, watcher := range failedWatchers {
-		klog.Warningf("Forcing stopping watcher (selectors: %v) due to unresponsiveness", watcher.selectors)
-		watcher.Stop()
+func forgetWatcher(s *store, index int) func() {
+	return func() {
+		s.watcherMutex.Lock()
+		defer s.watcherMutex.Unlock()
+
+		s.removeWatcher(index)
+		s.activeWatchers--
 	}
 }
+
+// precheckWatcherLimit returns a TooManyRequests error if the number of active watchers has reached maxWatchers. It
+// lets Watch fail before preparing the initial events of a watcher that couldn't be registered anyway.
+func (s *store) precheckWatcherLimit() error {
+	s.watcherMutex.RLock()
+	defer s.watcherMutex.RUnlock()
+	return s.checkWatcherLimit()
+}
+
+// checkWatcherLimit returns a TooManyRequests error if the number of active watchers has reached maxWatchers.
+// It should be called while holding a lock on watcherMutex.
+func (s *store) checkWatcherLimit() error {
+	if s.maxWatchers > 0 && s.activeWatchers >= s.maxWatchers {
+		klog.Warningf("Rejected watch of %s as the number of active watchers has reached the limit %d", s.resource, s.maxWatchers)
+		return errors.NewTooManyRequests(fmt.Sprintf("too many active watchers of %s, the limit is %d", s.resource, s.maxWatchers), 1)
+	}
+	return nil
+}
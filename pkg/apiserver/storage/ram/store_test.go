@@ -17,12 +17,19 @@ package ram
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
@@ -48,6 +55,24 @@ type testEvent struct {
 }
 
 func (event *testEvent) ToWatchEvent(selectors *antreastorage.Selectors) *watch.Event {
+	eventType, ok := event.GetEventType(selectors)
+	if !ok {
+		// Watcher is not interested in that object.
+		return nil
+	}
+	switch eventType {
+	case watch.Added:
+		return &watch.Event{Type: watch.Added, Object: event.Object.DeepCopyObject()}
+	case watch.Modified:
+		return &watch.Event{Type: watch.Modified, Object: event.Object.DeepCopyObject()}
+	default:
+		// return a delete event with the previous object content
+		return &watch.Event{Type: watch.Deleted, Object: event.PrevObject.DeepCopyObject()}
+	}
+}
+
+// GetEventType implements storage.TypedInternalEvent.
+func (event *testEvent) GetEventType(selectors *antreastorage.Selectors) (watch.EventType, bool) {
 	filter := func(s *antreastorage.Selectors, key string, labels labels.Set, fields fields.Set) bool {
 		if s.Key != "" && key != s.Key {
 			return false
@@ -66,27 +91,29 @@ func (event *testEvent) ToWatchEvent(selectors *antreastorage.Selectors) *watch.
 	if event.PrevObject != nil {
 		oldObjPasses = filter(selectors, event.Key, event.PrevObjLabels, event.PrevObjFields)
 	}
-	if !curObjPasses && !oldObjPasses {
-		// Watcher is not interested in that object.
-		return nil
-	}
-
 	switch {
 	case curObjPasses && !oldObjPasses:
-		return &watch.Event{Type: watch.Added, Object: event.Object.DeepCopyObject()}
+		return watch.Added, true
 	case curObjPasses && oldObjPasses:
-		return &watch.Event{Type: watch.Modified, Object: event.Object.DeepCopyObject()}
+		return watch.Modified, true
 	case !curObjPasses && oldObjPasses:
-		// return a delete event with the previous object content
-		return &watch.Event{Type: watch.Deleted, Object: event.PrevObject.DeepCopyObject()}
+		return watch.Deleted, true
 	}
-	return nil
+	return "", false
 }
 
 func (event *testEvent) GetResourceVersion() uint64 {
 	return event.ResourceVersion
 }
 
+// ToPreviousObject implements storage.PreviousObjectEvent.
+func (event *testEvent) ToPreviousObject(selectors *antreastorage.Selectors) runtime.Object {
+	if event.PrevObject == nil {
+		return nil
+	}
+	return event.PrevObject.DeepCopyObject()
+}
+
 // testGenEvent generates *testEvent
 func testGenEvent(key string, prevObj, obj interface{}, resourceVersion uint64) (antreastorage.InternalEvent, error) {
 	if reflect.DeepEqual(prevObj, obj) {
@@ -121,6 +148,10 @@ func testGenEvent(key string, prevObj, obj interface{}, resourceVersion uint64)
 	return event, nil
 }
 
+func newPod() runtime.Object {
+	return new(v1.Pod)
+}
+
 func TestRamStoreCRUD(t *testing.T) {
 	key := "pod1"
 	testCases := []struct {
@@ -152,7 +183,7 @@ func TestRamStoreCRUD(t *testing.T) {
 		},
 	}
 	for i, testCase := range testCases {
-		store := NewStore(cache.MetaNamespaceKeyFunc, cache.Indexers{}, nil)
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, nil, newPod)
 
 		testCase.operations(store)
 		obj, _, err := store.Get(key)
@@ -218,7 +249,7 @@ func TestRamStoreGetByIndex(t *testing.T) {
 		},
 	}
 	for i, testCase := range testCases {
-		store := NewStore(cache.MetaNamespaceKeyFunc, indexers, testGenEvent)
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, indexers, testGenEvent, newPod)
 
 		testCase.operations(store)
 		objs, err := store.GetByIndex(indexName, indexKey)
@@ -262,7 +293,7 @@ func TestRamStoreList(t *testing.T) {
 		},
 	}
 	for i, testCase := range testCases {
-		store := NewStore(cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent)
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
 
 		testCase.operations(store)
 		objs := store.List()
@@ -304,8 +335,8 @@ func TestRamStoreWatchAll(t *testing.T) {
 		},
 	}
 	for i, testCase := range testCases {
-		store := NewStore(cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent)
-		w, err := store.Watch(context.Background(), "", labels.Everything(), fields.Everything())
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+		w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
 		if err != nil {
 			t.Errorf("%d: failed to watch object: %v", i, err)
 		}
@@ -367,10 +398,10 @@ func TestRamStoreWatchWithInitOperations(t *testing.T) {
 		},
 	}
 	for i, testCase := range testCases {
-		store := NewStore(cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent)
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
 		// Init the storage before watching
 		testCase.initOperations(store)
-		w, err := store.Watch(context.Background(), "", labels.Everything(), fields.Everything())
+		w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
 		if err != nil {
 			t.Errorf("%d: failed to watch object: %v", i, err)
 		}
@@ -435,8 +466,8 @@ func TestRamStoreWatchWithSelector(t *testing.T) {
 		},
 	}
 	for i, testCase := range testCases {
-		store := NewStore(cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent)
-		w, err := store.Watch(context.Background(), "", testCase.labelSelector, fields.Everything())
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+		w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: testCase.labelSelector, Field: fields.Everything()})
 		if err != nil {
 			t.Errorf("%d: failed to watch object: %v", i, err)
 		}
@@ -456,13 +487,419 @@ func TestRamStoreWatchWithSelector(t *testing.T) {
 	}
 }
 
+func TestRamStoreWatchFromCurrentState(t *testing.T) {
+	testCases := []struct {
+		name            string
+		resourceVersion string
+		// The Pods existing before watching
+		existingPods []string
+	}{
+		{"unset resourceVersion", "", []string{"pod1", "pod2"}},
+		{"resourceVersion 0", "0", []string{"pod1", "pod2"}},
+		{"unset resourceVersion with empty store", "", nil},
+		{"resourceVersion 0 with empty store", "0", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			for _, name := range tc.existingPods {
+				store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			}
+			selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+
+			initEvents, err := store.listInitEvents(selectors)
+			assert.NoError(t, err)
+			if len(tc.existingPods) == 0 {
+				assert.Nil(t, initEvents, "Expected nil initEvents for empty store")
+			} else {
+				assert.Equal(t, len(tc.existingPods), len(initEvents))
+			}
+
+			w, err := store.Watch(context.Background(), tc.resourceVersion, selectors)
+			if err != nil {
+				t.Fatalf("Failed to watch object: %v", err)
+			}
+			defer w.Stop()
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}})
+
+			// All existing objects are sent first, followed by the changes after watching.
+			ch := w.ResultChan()
+			var actualPods []string
+			for range tc.existingPods {
+				event := <-ch
+				assert.Equal(t, watch.Added, event.Type)
+				actualPods = append(actualPods, event.Object.(*v1.Pod).Name)
+			}
+			assert.ElementsMatch(t, tc.existingPods, actualPods)
+			expectedEvent := watch.Event{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}}}
+			if actualEvent := <-ch; !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("Unexpected event, got %#v, expected %#v", actualEvent, expectedEvent)
+			}
+			select {
+			case obj, ok := <-ch:
+				t.Errorf("Unexpected excess event: %#v %t", obj, ok)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRamStoreWatchSendInitialEvents(t *testing.T) {
+	testCases := []struct {
+		name            string
+		resourceVersion string
+		// The Pods existing before watching
+		existingPods []string
+	}{
+		{"unset resourceVersion", "", []string{"pod1", "pod2"}},
+		{"older resourceVersion", "1", []string{"pod1", "pod2"}},
+		{"current resourceVersion", "2", []string{"pod1", "pod2"}},
+		{"empty store", "", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			for _, name := range tc.existingPods {
+				store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			}
+			w, err := store.Watch(context.Background(), tc.resourceVersion, &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true, SendInitialEvents: true})
+			if err != nil {
+				t.Fatalf("Failed to watch object: %v", err)
+			}
+			defer w.Stop()
+
+			// All existing objects are sent first, followed by a Bookmark marking the end of them.
+			ch := w.ResultChan()
+			var actualPods []string
+			for range tc.existingPods {
+				event := <-ch
+				assert.Equal(t, watch.Added, event.Type)
+				actualPods = append(actualPods, event.Object.(*v1.Pod).Name)
+			}
+			assert.ElementsMatch(t, tc.existingPods, actualPods)
+			expectedEvent := watch.Event{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				ResourceVersion: fmt.Sprintf("%d", len(tc.existingPods)),
+				Annotations:     map[string]string{antreastorage.InitialEventsAnnotationKey: "true"},
+			}}}
+			if actualEvent := <-ch; !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("Unexpected event, got %#v, expected %#v", actualEvent, expectedEvent)
+			}
+			select {
+			case obj, ok := <-ch:
+				t.Errorf("Unexpected excess event: %#v %t", obj, ok)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRamStoreWatchSendInitialEventsInvalid(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+
+	_, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), SendInitialEvents: true})
+	assert.True(t, errors.IsBadRequest(err), "Expected BadRequest error without AllowWatchBookmarks, got %v", err)
+	_, err = store.Watch(context.Background(), "2", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true, SendInitialEvents: true})
+	assert.True(t, errors.IsBadRequest(err), "Expected BadRequest error for future resourceVersion, got %v", err)
+	assert.Equal(t, 0, store.GetWatchersNum(), "Unexpected watchers number")
+}
+
+func TestRamStoreWatchSendSyncMarker(t *testing.T) {
+	testCases := []struct {
+		name              string
+		resourceVersion   string
+		sendInitialEvents bool
+		// The Pods expected to be sent before the marker
+		expectedPods []string
+		// The annotations expected on the marker
+		expectedAnnotations map[string]string
+	}{
+		{"unset resourceVersion", "", false, []string{"pod1", "pod2"}, map[string]string{antreastorage.SyncCompleteAnnotationKey: "true"}},
+		{"resume resourceVersion", "1", false, []string{"pod2"}, map[string]string{antreastorage.SyncCompleteAnnotationKey: "true"}},
+		{"current resourceVersion", "2", false, nil, map[string]string{antreastorage.SyncCompleteAnnotationKey: "true"}},
+		{"send initial events", "", true, []string{"pod1", "pod2"}, map[string]string{
+			antreastorage.SyncCompleteAnnotationKey:  "true",
+			antreastorage.InitialEventsAnnotationKey: "true",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+			w, err := store.Watch(context.Background(), tc.resourceVersion, &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(),
+				AllowWatchBookmarks: true, SendSyncMarker: true, SendInitialEvents: tc.sendInitialEvents})
+			require.NoError(t, err)
+			defer w.Stop()
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}})
+
+			// Exactly one marker is sent between the initial events and the live events.
+			ch := w.ResultChan()
+			var actualPods []string
+			for range tc.expectedPods {
+				event := <-ch
+				assert.Equal(t, watch.Added, event.Type)
+				actualPods = append(actualPods, event.Object.(*v1.Pod).Name)
+			}
+			assert.ElementsMatch(t, tc.expectedPods, actualPods)
+			expectedEvent := watch.Event{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				ResourceVersion: "2",
+				Annotations:     tc.expectedAnnotations,
+			}}}
+			assert.Equal(t, expectedEvent, <-ch)
+			assert.Equal(t, watch.Event{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}}}, <-ch)
+			select {
+			case obj, ok := <-ch:
+				t.Errorf("Unexpected excess event: %#v %t", obj, ok)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	}
+
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	_, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), SendSyncMarker: true})
+	assert.True(t, errors.IsBadRequest(err), "Expected BadRequest error without AllowWatchBookmarks, got %v", err)
+}
+
+func TestRamStoreWatchNotOlderThan(t *testing.T) {
+	testCases := []struct {
+		name            string
+		resourceVersion string
+		// The Pods created after watching
+		laterPods    []string
+		expectedPods []string
+	}{
+		{"older resourceVersion", "1", nil, []string{"pod1", "pod2"}},
+		{"unset resourceVersion", "", nil, []string{"pod1", "pod2"}},
+		{"newer resourceVersion", "3", []string{"pod3"}, []string{"pod1", "pod2", "pod3"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+			go func(laterPods []string) {
+				// The watch creation should be blocked until the store catches up.
+				time.Sleep(20 * time.Millisecond)
+				for _, name := range laterPods {
+					store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
+				}
+			}(tc.laterPods)
+
+			w, err := store.Watch(context.Background(), tc.resourceVersion, &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), ResourceVersionMatch: antreastorage.ResourceVersionMatchNotOlderThan})
+			if err != nil {
+				t.Fatalf("Failed to watch object: %v", err)
+			}
+			defer w.Stop()
+			ch := w.ResultChan()
+			var actualPods []string
+			for range tc.expectedPods {
+				event := <-ch
+				assert.Equal(t, watch.Added, event.Type)
+				actualPods = append(actualPods, event.Object.(*v1.Pod).Name)
+			}
+			assert.ElementsMatch(t, tc.expectedPods, actualPods)
+			select {
+			case obj, ok := <-ch:
+				t.Errorf("Unexpected excess event: %#v %t", obj, ok)
+			case <-time.After(30 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRamStoreWaitUntilFresh(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+
+	assert.NoError(t, store.waitUntilFresh(context.Background(), 1, 10*time.Millisecond))
+	err := store.waitUntilFresh(context.Background(), 10, 10*time.Millisecond)
+	assert.True(t, errors.IsTimeout(err), "Expected Timeout error, got %v", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, store.waitUntilFresh(ctx, 10, time.Second))
+}
+
+func TestRamStoreListAtLeast(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.freshnessTimeout = 100 * time.Millisecond
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+
+	// The store is already ahead.
+	objs, resourceVersion, err := store.ListAtLeast(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Len(t, objs, 2)
+	assert.Equal(t, uint64(2), resourceVersion)
+
+	// The store catches up in time.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}})
+	}()
+	objs, resourceVersion, err = store.ListAtLeast(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Len(t, objs, 3)
+	assert.Equal(t, uint64(3), resourceVersion)
+
+	// The store doesn't catch up in time.
+	_, _, err = store.ListAtLeast(context.Background(), 10)
+	assert.True(t, errors.IsTimeout(err), "Expected Timeout error, got %v", err)
+}
+
+func TestRamStoreWatchWithLabelIndex(t *testing.T) {
+	testCases := []struct {
+		name string
+		// The label Selector that will be set when watching
+		labelSelector labels.Selector
+		// The number of candidates expected to be scanned for initEvents
+		expectedCandidates int
+		// The names of the Pods expected to see in initEvents
+		expectedPods []string
+	}{
+		{
+			name:               "equality",
+			labelSelector:      labels.SelectorFromSet(labels.Set{"app": "nginx1"}),
+			expectedCandidates: 2,
+			expectedPods:       []string{"pod1", "pod3"},
+		},
+		{
+			name:               "equality and other requirements",
+			labelSelector:      labels.SelectorFromSet(labels.Set{"app": "nginx1", "tier": "web"}),
+			expectedCandidates: 2,
+			expectedPods:       []string{"pod3"},
+		},
+		{
+			name:               "no equality",
+			labelSelector:      labels.SelectorFromSet(labels.Set{}),
+			expectedCandidates: 3,
+			expectedPods:       []string{"pod1", "pod2", "pod3"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			if err := store.EnableLabelIndex(); err != nil {
+				t.Fatalf("Failed to enable label index: %v", err)
+			}
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx1"}}})
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "nginx2"}}})
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3", Labels: map[string]string{"app": "nginx1", "tier": "web"}}})
+
+			selectors := &antreastorage.Selectors{Label: tc.labelSelector, Field: fields.Everything()}
+			assert.Equal(t, tc.expectedCandidates, len(store.listCandidates(selectors)), "Unexpected number of candidates")
+
+			w, err := store.Watch(context.Background(), "", selectors)
+			if err != nil {
+				t.Fatalf("Failed to watch object: %v", err)
+			}
+			defer w.Stop()
+			ch := w.ResultChan()
+			var actualPods []string
+			for range tc.expectedPods {
+				event := <-ch
+				actualPods = append(actualPods, event.Object.(*v1.Pod).Name)
+			}
+			assert.ElementsMatch(t, tc.expectedPods, actualPods)
+			select {
+			case obj, ok := <-ch:
+				t.Errorf("Unexpected excess event: %#v %t", obj, ok)
+			default:
+			}
+		})
+	}
+}
+
+func TestRamStoreEnableLabelIndexNotEmpty(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	assert.Error(t, store.EnableLabelIndex(), "Expected error when enabling label index on non-empty store")
+	assert.False(t, store.labelIndexed)
+}
+
+func TestRamStoreWatchByKey(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.bookmarkInterval = 50 * time.Millisecond
+	for i := 1; i <= 3; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Key: "pod2", Label: labels.Everything(), Field: fields.Everything(), AllowWatchBookmarks: true})
+	require.NoError(t, err)
+	defer w.Stop()
+
+	// Only the object of the key is listed.
+	ch := w.ResultChan()
+	event := <-ch
+	assert.Equal(t, watch.Added, event.Type)
+	assert.Equal(t, "pod2", event.Object.(*v1.Pod).Name)
+
+	// The events of other objects are not dispatched to the watcher, but their versions are recorded.
+	store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "foo"}}})
+	store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "foo"}}})
+	store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3", Labels: map[string]string{"app": "foo"}}})
+	event = <-ch
+	assert.Equal(t, watch.Modified, event.Type)
+	assert.Equal(t, "pod2", event.Object.(*v1.Pod).Name)
+
+	// The Bookmark carries the version of the last skipped event, so that the client can resume from it.
+	event = <-ch
+	assert.Equal(t, watch.Bookmark, event.Type)
+	assert.Equal(t, "6", event.Object.(*v1.Pod).ResourceVersion)
+}
+
+func TestRamStoreDispatchSkipsOtherKeys(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	w := newStoreWatcher(10, 10, &antreastorage.Selectors{Key: "pod2"}, nil, newPod)
+	store.addWatcher(store.watcherIdx, w)
+	store.watcherIdx++
+
+	store.shards[0].dispatchEvent("pod1", &emptyInternalEvent{ResourceVersion: 1})
+	assert.Equal(t, 0, len(w.input), "The event of another key should not be dispatched")
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&w.lastResourceVersion))
+	store.shards[0].dispatchEvent("pod2", &emptyInternalEvent{ResourceVersion: 2})
+	assert.Equal(t, 1, len(w.input))
+	// An event without key is dispatched to all watchers.
+	store.shards[0].dispatchEvent("", &emptyInternalEvent{ResourceVersion: 3})
+	assert.Equal(t, 2, len(w.input))
+}
+
+func BenchmarkRamStoreWatchWithLabelSelector(b *testing.B) {
+	for _, indexed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("indexed=%t", indexed), func(b *testing.B) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			if indexed {
+				if err := store.EnableLabelIndex(); err != nil {
+					b.Fatalf("Failed to enable label index: %v", err)
+				}
+			}
+			// 50k Pods, each 1000 of which share the same label.
+			for i := 0; i < 50000; i++ {
+				store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), Labels: map[string]string{"app": fmt.Sprintf("app%d", i%50)}}})
+			}
+			selectors := &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "app0"}), Field: fields.Everything()}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w, err := store.Watch(context.Background(), "", selectors)
+				if err != nil {
+					b.Fatalf("Failed to watch object: %v", err)
+				}
+				w.Stop()
+			}
+		})
+	}
+}
+
 func TestRamStoreWatchTimeout(t *testing.T) {
-	store := NewStore(cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent)
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	// Disable growing of watchers' buffer to make the number of events that can be buffered predictable.
+	store.maxWatcherChanSize = watcherChanSize
 	// watcherChanSize*2+1 events can fill a watcher's buffer: input channel buffer + result channel buffer + 1 in-flight.
 	maxBuffered := watcherChanSize*2 + 1
 
 	// w1 has consumer for its result chan.
-	w1, err := store.Watch(context.Background(), "", labels.SelectorFromSet(labels.Set{"app": "nginx"}), fields.Everything())
+	w1, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "nginx"}), Field: fields.Everything()})
 	if err != nil {
 		t.Errorf("Failed to watch object: %v", err)
 	}
@@ -483,7 +920,7 @@ func TestRamStoreWatchTimeout(t *testing.T) {
 	}()
 
 	// w2 has no consumer for its result chan.
-	w2, err := store.Watch(context.Background(), "", labels.SelectorFromSet(labels.Set{"app": "nginx"}), fields.Everything())
+	w2, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "nginx"}), Field: fields.Everything()})
 	if err != nil {
 		t.Errorf("Failed to watch object: %v", err)
 	}
@@ -500,6 +937,7 @@ func TestRamStoreWatchTimeout(t *testing.T) {
 	case <-time.After(watcherAddTimeout + time.Millisecond*10):
 	}
 
+	droppedBefore := testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonBufferFull))
 	// w2 can't take one more event as it's buffer has been full, it should be terminated.
 	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", maxBuffered), Labels: map[string]string{"app": "nginx"}}})
 
@@ -508,5 +946,973 @@ func TestRamStoreWatchTimeout(t *testing.T) {
 	case <-time.After(watcherAddTimeout + time.Millisecond*10):
 		t.Error("w2 was not stopped, expected stopped")
 	}
+	assert.Equal(t, antreastorage.ErrWatcherTooSlow, w2.(antreastorage.ErrWatcher).Err())
 	assert.Equal(t, 1, store.GetWatchersNum(), "Unexpected watchers number")
+	assert.Equal(t, droppedBefore+1, testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonBufferFull)), "Unexpected dropped events number")
+}
+
+func TestRamStoreWatchWithResourceVersion(t *testing.T) {
+	testCases := []struct {
+		// The resourceVersion that will be set when watching
+		resourceVersion string
+		// The events expected to see before the events generated after watching
+		expectedInitEvents []watch.Event
+		// Whether watching is expected to fail
+		expectedErr bool
+	}{
+		{
+			resourceVersion: "",
+			expectedInitEvents: []watch.Event{
+				{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx2"}}}},
+			},
+		},
+		{
+			// The client should only see the events it missed.
+			resourceVersion: "1",
+			expectedInitEvents: []watch.Event{
+				{Type: watch.Modified, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx2"}}}},
+			},
+		},
+		{
+			// The client is up to date, it should only see subsequent events.
+			resourceVersion:    "2",
+			expectedInitEvents: nil,
+		},
+		{
+			resourceVersion: "3",
+			expectedErr:     true,
+		},
+		{
+			resourceVersion: "foo",
+			expectedErr:     true,
+		},
+	}
+	for i, testCase := range testCases {
+		store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx1"}}})
+		store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx2"}}})
+		w, err := store.Watch(context.Background(), testCase.resourceVersion, &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+		if testCase.expectedErr {
+			if err == nil {
+				t.Errorf("%d: expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: failed to watch object: %v", i, err)
+			continue
+		}
+		store.Delete("pod1")
+		expected := append(testCase.expectedInitEvents, watch.Event{Type: watch.Deleted, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "nginx2"}}}})
+		ch := w.ResultChan()
+		for j, expectedEvent := range expected {
+			actualEvent := <-ch
+			if !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("%d: unexpected event %d: %#v", i, j, actualEvent)
+			}
+		}
+		select {
+		case obj, ok := <-ch:
+			t.Errorf("%d: unexpected excess event: %#v %t", i, obj, ok)
+		default:
+		}
+	}
+}
+
+func TestRamStoreWatchWithResourceVersionCeiling(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	for i := 1; i <= 5; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	selectors := func(ceiling uint64) *antreastorage.Selectors {
+		return &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), ResourceVersionCeiling: ceiling}
+	}
+	receiveAll := func(w watch.Interface) []string {
+		var names []string
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event, ok := <-w.ResultChan():
+				if !ok {
+					return names
+				}
+				names = append(names, event.Object.(*v1.Pod).Name)
+			case <-timeout:
+				t.Fatalf("Timeout waiting for the result channel to be closed, received %v", names)
+			}
+		}
+	}
+
+	_, err := store.Watch(context.Background(), "3", selectors(2))
+	assert.True(t, errors.IsBadRequest(err), "A ceiling older than resourceVersion should be rejected")
+
+	// The stream is bounded between the two versions, excluding the floor and including the ceiling.
+	w, err := store.Watch(context.Background(), "2", selectors(4))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pod3", "pod4"}, receiveAll(w))
+	w.Stop()
+
+	// The initial state is sent as it's not newer than the ceiling.
+	w, err = store.Watch(context.Background(), "", selectors(5))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"pod1", "pod2", "pod3", "pod4", "pod5"}, receiveAll(w))
+	w.Stop()
+
+	// Live events are sent until the ceiling is reached.
+	w, err = store.Watch(context.Background(), "5", selectors(7))
+	require.NoError(t, err)
+	for i := 6; i <= 8; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	assert.Equal(t, []string{"pod6", "pod7"}, receiveAll(w))
+	w.Stop()
+
+	// A watcher monitoring a single object is closed by the first event beyond the ceiling it receives.
+	w, err = store.Watch(context.Background(), "8", &antreastorage.Selectors{Key: "pod1", Label: labels.Everything(), Field: fields.Everything(), ResourceVersionCeiling: 9})
+	require.NoError(t, err)
+	store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "web"}}})
+	store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "web"}}})
+	assert.Empty(t, receiveAll(w))
+	w.Stop()
+}
+
+func TestRamStoreWatchIncludePreviousObject(t *testing.T) {
+	pod := func(version int) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"version": fmt.Sprint(version)}}}
+	}
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(pod(0))
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), IncludePreviousObject: true})
+	require.NoError(t, err)
+	defer w.Stop()
+	for i := 1; i <= 3; i++ {
+		store.Update(pod(i))
+	}
+	store.Delete("pod1")
+
+	assert.Equal(t, watch.Event{Type: watch.Added, Object: pod(0)}, <-w.ResultChan())
+	// Each Modified event carries the version preceding it.
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, watch.Event{Type: watch.Modified, Object: &antreastorage.ObjectUpdate{Object: pod(i), PrevObject: pod(i - 1)}}, <-w.ResultChan())
+	}
+	assert.Equal(t, watch.Event{Type: watch.Deleted, Object: pod(3)}, <-w.ResultChan())
+}
+
+func TestRamStoreWatchSuppressEqual(t *testing.T) {
+	pod := func(version int, nodeName string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"version": fmt.Sprint(version)}},
+			Spec:       v1.PodSpec{NodeName: nodeName},
+		}
+	}
+	// The watcher only cares about the Node of the Pod.
+	project := func(obj runtime.Object) runtime.Object {
+		p := obj.(*v1.Pod)
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: p.Name}, Spec: v1.PodSpec{NodeName: p.Spec.NodeName}}
+	}
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.Create(pod(0, "node1"))
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{
+		Label:     labels.Everything(),
+		Field:     fields.Everything(),
+		Transform: project,
+		SuppressEqual: func(prevObj, obj runtime.Object) bool {
+			return apiequality.Semantic.DeepEqual(prevObj, obj)
+		},
+	})
+	require.NoError(t, err)
+	defer w.Stop()
+	// Only the second and the fourth updates change the Node.
+	store.Update(pod(1, "node1"))
+	store.Update(pod(2, "node2"))
+	store.Update(pod(3, "node2"))
+	store.Update(pod(4, "node1"))
+	store.Delete("pod1")
+
+	assert.Equal(t, watch.Event{Type: watch.Added, Object: project(pod(0, "node1"))}, <-w.ResultChan())
+	assert.Equal(t, watch.Event{Type: watch.Modified, Object: project(pod(2, "node2"))}, <-w.ResultChan())
+	assert.Equal(t, watch.Event{Type: watch.Modified, Object: project(pod(4, "node1"))}, <-w.ResultChan())
+	assert.Equal(t, watch.Event{Type: watch.Deleted, Object: project(pod(4, "node1"))}, <-w.ResultChan())
+}
+
+func TestRamStoreWatchDropRequiresResync(t *testing.T) {
+	for _, policy := range []antreastorage.BackpressurePolicy{antreastorage.DropOldest, antreastorage.DropNewest} {
+		t.Run(fmt.Sprintf("policy %d", policy), func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			require.NoError(t, store.SetWatcherChanSizes(2, 1))
+			// w has no consumer for its result chan, an Added event must be dropped once its buffer is full.
+			w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), BackpressurePolicy: policy})
+			require.NoError(t, err)
+			sw := w.(*storeWatcher)
+			numPods := 10
+			for i := 0; i < numPods; i++ {
+				store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			select {
+			case <-sw.done:
+			case <-time.After(time.Second):
+				t.Fatal("w was not stopped, expected stopped")
+			}
+			assert.Equal(t, antreastorage.ErrWatcherResyncRequired, sw.Err(), "The client should be told to relist")
+			// The watcher mustn't be resumed from the dropped event or a later one.
+			lastResourceVersion := atomic.LoadUint64(&sw.lastResourceVersion)
+			assert.True(t, lastResourceVersion < uint64(numPods), "The resourceVersion advanced past the dropped event: %d", lastResourceVersion)
+			for event := range w.ResultChan() {
+				if event.Type == watch.Error {
+					continue
+				}
+				var i uint64
+				fmt.Sscanf(event.Object.(*v1.Pod).Name, "pod%d", &i)
+				assert.True(t, i+1 <= lastResourceVersion, "Received event %d after the last resourceVersion %d", i+1, lastResourceVersion)
+			}
+			assert.Equal(t, 0, store.GetWatchersNum(), "Unexpected watchers number")
+		})
+	}
+}
+
+func TestRamStoreWatchAdaptiveChanSize(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.minWatcherChanSize = 4
+	store.watcherResultSize = 4
+	store.maxWatcherChanSize = 8
+	store.watcherChanSizeStep = 4
+	store.watcherChanSizeWindow = 4
+	inputCap := func(w *storeWatcher) int {
+		store.watcherMutex.RLock()
+		defer store.watcherMutex.RUnlock()
+		return cap(w.input)
+	}
+
+	// w's client receives slower than events are generated at first, its buffer fills up.
+	var delay int64 = int64(5 * time.Millisecond)
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	go func() {
+		for range w.ResultChan() {
+			time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		}
+	}()
+	sw := w.(*storeWatcher)
+	i := 0
+	for ; i < 100 && inputCap(sw) < store.maxWatcherChanSize; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, store.maxWatcherChanSize, inputCap(sw), "Buffer didn't grow to the maximum size under pressure")
+
+	// Once the client catches up, the buffer should shrink back to the minimum size.
+	atomic.StoreInt64(&delay, 0)
+	for j := 0; j < 1000 && inputCap(sw) > store.minWatcherChanSize; j++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i+j)}})
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, store.minWatcherChanSize, inputCap(sw), "Buffer didn't shrink to the minimum size when idle")
+	assert.Equal(t, 1, store.GetWatchersNum(), "Unexpected watchers number")
+	w.Stop()
+}
+
+func TestRamStoreWatchNeverDropDelete(t *testing.T) {
+	testCases := []struct {
+		name               string
+		backpressurePolicy antreastorage.BackpressurePolicy
+		// Whether the client starts receiving events right after the Delete is issued
+		consume bool
+		// The operations that will be executed on the storage after watching
+		operations func(*store)
+	}{
+		{
+			// The Delete event is buffered when the buffer is full, the watcher can't keep later events.
+			name:               "DropOldest",
+			backpressurePolicy: antreastorage.DropOldest,
+			operations: func(store *store) {
+				for i := 0; i < 3; i++ {
+					store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+					time.Sleep(5 * time.Millisecond)
+				}
+				store.Delete("pod0")
+				for i := 0; i < 10; i++ {
+					store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"v": fmt.Sprintf("%d", i)}}})
+				}
+			},
+		},
+		{
+			// The Delete event comes when the buffer is full.
+			name:               "DropNewest",
+			backpressurePolicy: antreastorage.DropNewest,
+			operations: func(store *store) {
+				store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod0"}})
+				for i := 0; i < 10; i++ {
+					// Give process a chance to move events forward so that the buffer is saturated.
+					time.Sleep(5 * time.Millisecond)
+					store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod0", Labels: map[string]string{"v": fmt.Sprintf("%d", i)}}})
+				}
+				store.Delete("pod0")
+			},
+		},
+		{
+			// The buffer gets full before the Delete event comes, the client can't catch up on the dropped events.
+			name:               "DropNewest with consumer",
+			backpressurePolicy: antreastorage.DropNewest,
+			consume:            true,
+			operations: func(store *store) {
+				store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod0"}})
+				for i := 0; i < 10; i++ {
+					// Give process a chance to move events forward so that the buffer is saturated.
+					time.Sleep(5 * time.Millisecond)
+					store.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod0", Labels: map[string]string{"v": fmt.Sprintf("%d", i)}}})
+				}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			store.minWatcherChanSize = 2
+			store.watcherResultSize = 2
+			store.maxWatcherChanSize = 2
+			w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), BackpressurePolicy: tc.backpressurePolicy})
+			if err != nil {
+				t.Fatalf("Failed to watch object: %v", err)
+			}
+			tc.operations(store)
+
+			if !tc.consume {
+				// The watcher can't receive the Delete event, it must be stopped so that the client resyncs.
+				select {
+				case <-w.(*storeWatcher).done:
+				case <-time.After(time.Second):
+					t.Fatal("Watcher was not stopped, expected stopped")
+				}
+				assert.Equal(t, 0, store.GetWatchersNum(), "Unexpected watchers number")
+				return
+			}
+
+			deleted := make(chan struct{})
+			go func() {
+				for event := range w.ResultChan() {
+					if event.Type == watch.Deleted {
+						close(deleted)
+						return
+					}
+				}
+			}()
+			store.Delete("pod0")
+			select {
+			case <-deleted:
+			case <-w.(*storeWatcher).done:
+				// Stopping the watcher is acceptable as well.
+			case <-time.After(time.Second):
+				t.Fatal("Delete event was neither observed nor the watcher was stopped")
+			}
+			w.Stop()
+		})
+	}
+}
+
+func TestRamStoreCounts(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	numObjects, numWatchers := 100, 20
+
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	// Read the counts continuously while objects and watchers are being added and removed.
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			assert.True(t, store.CountObjects() <= numObjects)
+			assert.True(t, store.CountWatchers() <= numWatchers*2)
+		}
+	}()
+	for i := 0; i < numObjects; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+		}(i)
+	}
+	watchers := make(chan watch.Interface, numWatchers*2)
+	for i := 0; i < numWatchers*2; i++ {
+		wg.Add(1)
+		go func(stop bool) {
+			defer wg.Done()
+			w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+			if err != nil {
+				t.Errorf("Failed to watch object: %v", err)
+				return
+			}
+			if stop {
+				w.Stop()
+				return
+			}
+			watchers <- w
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	close(stopCh)
+	<-readerDone
+	close(watchers)
+
+	assert.Equal(t, numObjects, store.CountObjects())
+	assert.Equal(t, numWatchers, store.CountWatchers())
+	for w := range watchers {
+		w.Stop()
+	}
+	assert.Equal(t, 0, store.CountWatchers())
+}
+
+func TestRamStoreTriggerResync(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	webPod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "web"}}}
+	dbPod2 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Labels: map[string]string{"app": "db"}}}
+	webPod3 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3", Labels: map[string]string{"app": "web"}}}
+	store.Create(webPod1)
+	store.Create(dbPod2)
+
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.SelectorFromSet(labels.Set{"app": "web"}), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer w.Stop()
+	assert.Equal(t, watch.Event{Type: watch.Added, Object: webPod1}, <-w.ResultChan())
+
+	// Trigger the resync between two updates, the watcher should resend the selected objects in order.
+	webPod1Updated := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"app": "web", "tier": "frontend"}}}
+	store.Update(webPod1Updated)
+	assert.NoError(t, store.TriggerResync())
+	store.Create(webPod3)
+
+	expected := []watch.Event{
+		{Type: watch.Modified, Object: webPod1Updated},
+		{Type: watch.Added, Object: webPod1Updated},
+		{Type: watch.Added, Object: webPod3},
+	}
+	for i, expectedEvent := range expected {
+		select {
+		case actualEvent := <-w.ResultChan():
+			assert.Equal(t, expectedEvent, actualEvent, "Unexpected event %d", i)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+	select {
+	case event := <-w.ResultChan():
+		t.Errorf("Unexpected excess event: %#v", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRamStoreListWatchers(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	w1, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer w1.Stop()
+	w2, err := store.Watch(context.Background(), "", &antreastorage.Selectors{
+		Key:   "secret-pod",
+		Label: labels.SelectorFromSet(labels.Set{"app": "secret-app"}),
+		Field: fields.SelectorFromSet(fields.Set{"nodeName": "secret-node"}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	for i := 0; i < 3; i++ {
+		<-w1.ResultChan()
+	}
+
+	watchers := store.ListWatchers()
+	if !assert.Len(t, watchers, 2) {
+		return
+	}
+	for _, watcher := range watchers {
+		assert.Equal(t, "Pod", watcher.Resource)
+		assert.Equal(t, uint64(3), watcher.LastResourceVersion)
+		assert.Equal(t, watcherChanSize, watcher.BufferCapacity)
+	}
+	assert.Equal(t, "", watchers[0].Selectors)
+	assert.Equal(t, "key=*,label:app = *,field:nodeName = *", watchers[1].Selectors)
+	assert.NotContains(t, watchers[1].Selectors, "secret", "Selector values should be redacted")
+
+	w2.Stop()
+	assert.Len(t, store.ListWatchers(), 1)
+}
+
+func TestRamStoreDispatchLatency(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.minWatcherChanSize = 1
+	store.watcherResultSize = 1
+	store.maxWatcherChanSize = 1
+	assert.Equal(t, time.Duration(0), store.DispatchLatencyP99(), "Expected zero latency before any dispatching")
+
+	// w has no consumer for its result chan, it can buffer 3 events: 1 in input, 1 in result, and 1 in-flight.
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, store.DispatchLatencyP99() < watcherAddTimeout, "Expected low latency when no watcher is blocked")
+
+	// The blocked watcher slows the dispatching of next event until it's terminated.
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3"}})
+	select {
+	case <-w.(*storeWatcher).done:
+	case <-time.After(time.Second):
+		t.Fatal("w was not stopped, expected stopped")
+	}
+	for i := 0; i < 100 && store.DispatchLatencyP99() < watcherAddTimeout; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, store.DispatchLatencyP99() >= watcherAddTimeout, "Expected latency to climb when a watcher is blocked, got %v", store.DispatchLatencyP99())
+}
+
+func TestRamStoreDispatchFairness(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	// Fill the buffer of every watcher, slow watchers never consume their buffer while fast watchers
+	// consume it shortly after the dispatching starts.
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}
+	fullEvent := &simpleInternalEvent{Type: watch.Added, Object: pod, ResourceVersion: 1}
+	newWatcher := func() *storeWatcher {
+		w := newStoreWatcher(1, 1, &antreastorage.Selectors{}, nil, newPod)
+		w.input <- fullEvent
+		return w
+	}
+	var slowWatchers, fastWatchers []*storeWatcher
+	for i := 0; i < 4; i++ {
+		w := newWatcher()
+		slowWatchers = append(slowWatchers, w)
+		store.addWatcher(store.watcherIdx, w)
+		store.watcherIdx++
+	}
+	for i := 0; i < 2; i++ {
+		w := newWatcher()
+		fastWatchers = append(fastWatchers, w)
+		store.addWatcher(store.watcherIdx, w)
+		store.watcherIdx++
+	}
+
+	event := &simpleInternalEvent{Type: watch.Modified, Object: pod, ResourceVersion: 2}
+	start := time.Now()
+	latencies := make(chan time.Duration, len(fastWatchers))
+	for _, w := range fastWatchers {
+		go func(w *storeWatcher) {
+			time.Sleep(5 * time.Millisecond)
+			<-w.input
+			<-w.input
+			latencies <- time.Since(start)
+		}(w)
+	}
+	store.shards[0].dispatchEvent("", event)
+	elapsed := time.Since(start)
+
+	// The slow watchers must not delay the fast watchers until they time out.
+	for range fastWatchers {
+		latency := <-latencies
+		assert.True(t, latency < watcherAddTimeout, "Expected fast watchers to receive the event before slow watchers time out, got %v", latency)
+	}
+	// The blocking per event is bounded regardless of the number of blocked watchers.
+	assert.True(t, elapsed < watcherAddTimeout+2*watcherAddTimeSlice, "Expected dispatching to be bounded, took %v", elapsed)
+	for _, w := range slowWatchers {
+		select {
+		case <-w.done:
+		default:
+			t.Error("Expected slow watcher to be stopped")
+		}
+	}
+	for _, w := range fastWatchers {
+		select {
+		case <-w.done:
+			t.Error("Expected fast watcher not to be stopped")
+		default:
+		}
+	}
+}
+
+func TestRamStoreWatchCompacted(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.SetHistorySize(2)
+	for i := 0; i < 4; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	// Events up to resourceVersion 2 have been discarded from history.
+	assert.Equal(t, uint64(2), store.compactedResourceVersion)
+
+	w, err := store.Watch(context.Background(), "1", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	ch := w.ResultChan()
+	event, ok := <-ch
+	if !ok {
+		t.Fatal("Result channel was closed, expected an Error event")
+	}
+	assert.Equal(t, watch.Error, event.Type)
+	status, ok := event.Object.(*metav1.Status)
+	if !ok {
+		t.Fatalf("Expected *metav1.Status, got %T", event.Object)
+	}
+	assert.Equal(t, int32(http.StatusGone), status.Code)
+	assert.Equal(t, metav1.StatusReasonExpired, status.Reason)
+	if event, ok := <-ch; ok {
+		t.Errorf("Unexpected excess event: %#v", event)
+	}
+	assert.Equal(t, 0, store.GetWatchersNum(), "Unexpected watchers number")
+
+	// Resuming from the compacted resourceVersion should still work.
+	w, err = store.Watch(context.Background(), "2", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	ch = w.ResultChan()
+	for i := 2; i < 4; i++ {
+		expectedEvent := watch.Event{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}}}
+		if actualEvent := <-ch; !reflect.DeepEqual(actualEvent, expectedEvent) {
+			t.Errorf("Unexpected event %#v, expected %#v", actualEvent, expectedEvent)
+		}
+	}
+	w.Stop()
+}
+
+func TestRamStoreReplay(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.SetHistorySize(3)
+	for i := 1; i <= 5; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	// History keeps the events of resourceVersion 3, 4, 5.
+	testCases := map[string]struct {
+		fromVersion uint64
+		// The resourceVersions of the events expected to be replayed.
+		expectedVersions []uint64
+		expectedErr      func(error) bool
+	}{
+		"below-floor": {
+			fromVersion: 1,
+			expectedErr: errors.IsResourceExpired,
+		},
+		"at-floor": {
+			fromVersion:      2,
+			expectedVersions: []uint64{3, 4, 5},
+		},
+		"in-the-middle": {
+			fromVersion:      4,
+			expectedVersions: []uint64{5},
+		},
+		"at-head": {
+			fromVersion:      5,
+			expectedVersions: []uint64{},
+		},
+		"above-head": {
+			fromVersion: 6,
+			expectedErr: errors.IsBadRequest,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events, err := store.Replay(tc.fromVersion)
+			if tc.expectedErr != nil {
+				if !tc.expectedErr(err) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to replay events: %v", err)
+			}
+			versions := make([]uint64, len(events))
+			for i := range events {
+				versions[i] = events[i].GetResourceVersion()
+			}
+			assert.Equal(t, tc.expectedVersions, versions)
+		})
+	}
+}
+
+func TestRamStoreResourceVersionRange(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.SetHistorySize(3)
+	assertRange := func(expectedMin, expectedMax uint64) {
+		min, max := store.ResourceVersionRange()
+		assert.Equal(t, expectedMin, min, "Unexpected min resourceVersion")
+		assert.Equal(t, expectedMax, max, "Unexpected max resourceVersion")
+	}
+	assertRange(0, 0)
+
+	for i := 0; i < 3; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	assertRange(0, 3)
+
+	// The oldest events are discarded from history once it's full.
+	store.Delete("pod0")
+	store.Delete("pod1")
+	assertRange(2, 5)
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	w, err := store.Watch(context.Background(), "1", selectors)
+	assert.NoError(t, err)
+	assert.Equal(t, watch.Error, (<-w.ResultChan()).Type)
+	w, err = store.Watch(context.Background(), "2", selectors)
+	assert.NoError(t, err)
+	w.Stop()
+}
+
+func TestRamStoreDispatchBreakerDisabledByDefault(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Zero(t, store.breakerThreshold, "The dispatch breaker should be opt-in")
+	assert.Error(t, store.SetDispatchBreakerThreshold(-time.Millisecond))
+
+	store.minWatcherChanSize = 2
+	store.watcherResultSize = 2
+	store.maxWatcherChanSize = 2
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	droppedBefore := testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonDispatchBreaker))
+	// slow receives an event only once in a while, keeping its buffers full between them.
+	slow, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer slow.Stop()
+	for i := 0; i < 10; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	// Each dispatch blocked on slow takes about half of watcherAddTimeout, longer than the breaker used to allow.
+	for i := 0; i < 10; i++ {
+		time.Sleep(watcherAddTimeout / 2)
+		select {
+		case event := <-slow.ResultChan():
+			require.Equal(t, fmt.Sprintf("pod%d", i), event.Object.(*v1.Pod).Name)
+		case <-time.After(time.Second):
+			t.Fatalf("Slow watcher didn't receive event %d", i)
+		}
+	}
+	select {
+	case <-slow.(*storeWatcher).done:
+		t.Fatalf("A watcher receiving events within watcherAddTimeout shouldn't be stopped")
+	default:
+	}
+	assert.Equal(t, droppedBefore, testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonDispatchBreaker)))
+}
+
+func TestRamStoreDispatchBreaker(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.minWatcherChanSize = 2
+	store.watcherResultSize = 2
+	store.maxWatcherChanSize = 2
+	// Every dispatch exceeds the threshold, only watchers whose result channel is full can be stopped.
+	require.NoError(t, store.SetDispatchBreakerThreshold(time.Nanosecond))
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	droppedBefore := testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonDispatchBreaker))
+
+	// wedged never receives events.
+	wedged, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	var healthy []watch.Interface
+	for i := 0; i < 2; i++ {
+		w, err := store.Watch(context.Background(), "", selectors)
+		require.NoError(t, err)
+		defer w.Stop()
+		healthy = append(healthy, w)
+	}
+
+	for i := 0; i < 5; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+		// The healthy watchers receive each event before the next one is dispatched.
+		for _, w := range healthy {
+			select {
+			case event := <-w.ResultChan():
+				assert.Equal(t, fmt.Sprintf("pod%d", i), event.Object.(*v1.Pod).Name)
+			case <-time.After(time.Second):
+				t.Fatalf("Healthy watcher didn't receive event %d", i)
+			}
+		}
+	}
+
+	// The wedged watcher is stopped once its result channel is full, before its input channel gets full.
+	select {
+	case <-wedged.(*storeWatcher).done:
+	case <-time.After(time.Second):
+		t.Fatal("Wedged watcher was not stopped")
+	}
+	assert.Equal(t, antreastorage.ErrWatcherTooSlow, wedged.(*storeWatcher).Err())
+	assert.Equal(t, 2, store.GetWatchersNum())
+	assert.Equal(t, droppedBefore+1, testutil.ToFloat64(watcherEventsDropped.WithLabelValues("Pod", dropReasonDispatchBreaker)), "Unexpected dropped events number")
+}
+
+func TestRamStoreSlowestWatcher(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.minWatcherChanSize = 1
+	store.watcherResultSize = 1
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	assert.Nil(t, store.shards[0].slowestWatcher())
+
+	var watchers []*storeWatcher
+	for i := 0; i < 3; i++ {
+		w, err := store.Watch(context.Background(), "", selectors)
+		require.NoError(t, err)
+		defer w.Stop()
+		watchers = append(watchers, w.(*storeWatcher))
+	}
+	assert.Nil(t, store.shards[0].slowestWatcher(), "No watcher's result channel is full")
+
+	// A watcher dropping events is never the slowest.
+	dropping, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything(), BackpressurePolicy: antreastorage.DropOldest})
+	require.NoError(t, err)
+	defer dropping.Stop()
+	dropping.(*storeWatcher).result <- watch.Event{}
+	assert.Nil(t, store.shards[0].slowestWatcher())
+
+	// Fill the result channels of the last two watchers, the one that sent its last event earlier is the slowest.
+	now := time.Now()
+	for i, w := range watchers[1:] {
+		w.result <- watch.Event{}
+		atomic.StoreInt64(&w.lastSendTime, now.Add(-time.Duration(i)*time.Second).UnixNano())
+	}
+	assert.Equal(t, watchers[2], store.shards[0].slowestWatcher())
+}
+
+func TestRamStoreSetWatcherChanSizes(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Error(t, store.SetWatcherChanSizes(0, 10))
+	assert.Error(t, store.SetWatcherChanSizes(10, -1))
+
+	require.NoError(t, store.SetWatcherChanSizes(20000, 10))
+	assert.Equal(t, 20000, store.maxWatcherChanSize, "The maximum input size should be raised to the initial one")
+	w, err := store.Watch(context.Background(), "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+	defer w.Stop()
+	assert.Equal(t, 20000, cap(w.(*storeWatcher).input))
+	assert.Equal(t, 10, cap(w.(*storeWatcher).result))
+}
+
+func TestRamStoreMaxWatchers(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	assert.Error(t, store.SetMaxWatchers(-1))
+	require.NoError(t, store.SetMaxWatchers(2))
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+
+	var watchers []watch.Interface
+	for i := 0; i < 2; i++ {
+		w, err := store.Watch(context.Background(), "", selectors)
+		require.NoError(t, err)
+		defer w.Stop()
+		watchers = append(watchers, w)
+	}
+	_, err := store.Watch(context.Background(), "", selectors)
+	assert.True(t, errors.IsTooManyRequests(err), "Expected TooManyRequests error, got %v", err)
+	assert.Equal(t, 2, store.GetWatchersNum(), "The rejected watch should not leave a watcher")
+
+	// A watch from a compacted resourceVersion only gets an Error event, it's not limited.
+	store.SetHistorySize(1)
+	for i := 0; i < 3; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	w, err := store.Watch(context.Background(), "1", selectors)
+	require.NoError(t, err)
+	assert.Equal(t, watch.Error, (<-w.ResultChan()).Type)
+
+	// Stopping a watcher makes room for a new one.
+	watchers[0].Stop()
+	w, err = store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+}
+
+func TestRamStoreMaxWatchersBeforeInit(t *testing.T) {
+	var numGenerated int32
+	genEvent := func(key string, prevObj, obj interface{}, resourceVersion uint64) (antreastorage.InternalEvent, error) {
+		atomic.AddInt32(&numGenerated, 1)
+		return testGenEvent(key, prevObj, obj, resourceVersion)
+	}
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, genEvent, newPod)
+	require.NoError(t, store.SetMaxWatchers(1))
+	for i := 0; i < 3; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()}
+	w, err := store.Watch(context.Background(), "", selectors)
+	require.NoError(t, err)
+	defer w.Stop()
+
+	// The rejected watch mustn't generate the initial events of the objects.
+	before := atomic.LoadInt32(&numGenerated)
+	_, err = store.Watch(context.Background(), "", selectors)
+	assert.True(t, errors.IsTooManyRequests(err), "Expected TooManyRequests error, got %v", err)
+	assert.Equal(t, before, atomic.LoadInt32(&numGenerated), "Initial events were generated for a rejected watch")
+}
+
+func TestRamStoreCompactionWarning(t *testing.T) {
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.SetHistorySize(10)
+	headroom, low := store.compactionWarning(0)
+	assert.Equal(t, 10, headroom)
+	assert.False(t, low)
+
+	// Resuming from resourceVersion 0 gets closer to expiring as the ring fills.
+	for i := 1; i <= 10; i++ {
+		store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+		headroom, low = store.compactionWarning(0)
+		assert.Equal(t, 10-i, headroom)
+		assert.Equal(t, i >= 9, low, "Unexpected warning after %d events", i)
+	}
+	// The latest resourceVersion has the whole history ahead of it.
+	headroom, low = store.compactionWarning(10)
+	assert.Equal(t, 10, headroom)
+	assert.False(t, low)
+
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod11"}})
+	headroom, low = store.compactionWarning(0)
+	assert.Equal(t, 0, headroom)
+	assert.True(t, low, "Expected a warning for a compacted resourceVersion")
+
+	// Without history there is nothing to resume from.
+	store.SetHistorySize(0)
+	_, low = store.compactionWarning(11)
+	assert.False(t, low)
+}
+
+func BenchmarkRamStoreDispatchWithKey(b *testing.B) {
+	for _, keyed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("keyed=%t", keyed), func(b *testing.B) {
+			store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			var events []*testEvent
+			for i := 0; i < 10000; i++ {
+				pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}}
+				store.Create(pod)
+				event, _ := testGenEvent(pod.Name, pod, &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Labels: map[string]string{"app": "foo"}}}, 0)
+				events = append(events, event.(*testEvent))
+			}
+			// A single watcher monitors pod0, with a key or only a field selector on the name.
+			selectors := &antreastorage.Selectors{Label: labels.Everything(), Field: fields.OneTermEqualSelector("metadata.name", "pod0")}
+			if keyed {
+				selectors.Key = "pod0"
+			}
+			w, err := store.Watch(context.Background(), "", selectors)
+			if err != nil {
+				b.Fatalf("Failed to watch object: %v", err)
+			}
+			defer w.Stop()
+			<-w.ResultChan()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Dispatch the events of the other objects.
+				event := events[1+i%(len(events)-1)]
+				event.ResourceVersion = uint64(10000 + i + 1)
+				store.shards[0].dispatchEvent(event.Key, event)
+			}
+		})
+	}
 }
@@ -0,0 +1,100 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+const (
+	// defaultWatcherTerminationLogLevel is the default verbosity of the log of each watcher termination.
+	defaultWatcherTerminationLogLevel klog.Level = 4
+	// watcherTerminationSummaryInterval is the minimum interval between two summaries of watcher terminations.
+	watcherTerminationSummaryInterval = time.Minute
+)
+
+const (
+	terminationInputClosed      = "input closed"
+	terminationContextCanceled  = "context canceled"
+	terminationCeilingReached   = "resourceVersion ceiling reached"
+	terminationInitEventsFailed = "initial events failed"
+)
+
+// watcherTerminationLogLevel is the verbosity at which the termination of each watcher is logged. It must be
+// accessed atomically.
+var watcherTerminationLogLevel = int32(defaultWatcherTerminationLogLevel)
+
+// SetWatcherTerminationLogLevel sets the verbosity at which the termination of each watcher is logged. A summary
+// counting the terminations is logged at most once every minute regardless of the verbosity.
+func SetWatcherTerminationLogLevel(level klog.Level) {
+	atomic.StoreInt32(&watcherTerminationLogLevel, int32(level))
+}
+
+var terminations = newTerminationLogger(watcherTerminationSummaryInterval, klog.Infof)
+
+// terminationLogger aggregates watcher terminations by reason, so that a mass disconnect, e.g. a rolling restart
+// of agents, doesn't flood the logs with one message per watcher.
+type terminationLogger struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	// logf logs the summary, it's klog.Infof except in tests.
+	logf func(format string, args ...interface{})
+	// lastSummaryTime is the time the last summary was logged.
+	lastSummaryTime time.Time
+	// counts is the number of terminations by reason since the last summary.
+	counts map[string]int
+}
+
+func newTerminationLogger(interval time.Duration, logf func(format string, args ...interface{})) *terminationLogger {
+	return &terminationLogger{
+		interval: interval,
+		logf:     logf,
+		counts:   map[string]int{},
+	}
+}
+
+// record logs the termination of a watcher at the configured verbosity and counts it. If the last summary
+// was logged more than interval ago, it logs the counts since then and resets them. The counts are only
+// reported when a watcher terminates, so the first termination is always reported immediately.
+func (l *terminationLogger) record(reason string, selectors *storage.Selectors) {
+	if klog.V(klog.Level(atomic.LoadInt32(&watcherTerminationLogLevel))) {
+		klog.Infof("Stopping process of watcher (selectors: %v) as its %s", selectors, reason)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.counts[reason]++
+	now := time.Now()
+	if now.Sub(l.lastSummaryTime) < l.interval {
+		return
+	}
+	reasons := make([]string, 0, len(l.counts))
+	for r, count := range l.counts {
+		reasons = append(reasons, fmt.Sprintf("%d with %s", count, r))
+	}
+	sort.Strings(reasons)
+	l.logf("Watchers stopped since the last summary: %s", strings.Join(reasons, ", "))
+	l.lastSummaryTime = now
+	l.counts = map[string]int{}
+}
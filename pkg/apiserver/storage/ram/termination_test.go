@@ -0,0 +1,53 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func TestTerminationLogger(t *testing.T) {
+	var summaries []string
+	logf := func(format string, args ...interface{}) {
+		summaries = append(summaries, fmt.Sprintf(format, args...))
+	}
+	l := newTerminationLogger(50*time.Millisecond, logf)
+	selectors := &storage.Selectors{}
+
+	// The first termination is reported immediately.
+	l.record(terminationInputClosed, selectors)
+	assert.Equal(t, []string{"Watchers stopped since the last summary: 1 with input closed"}, summaries)
+
+	// A burst of terminations is aggregated until the interval elapses.
+	for i := 0; i < 100; i++ {
+		l.record(terminationContextCanceled, selectors)
+	}
+	for i := 0; i < 20; i++ {
+		l.record(terminationInputClosed, selectors)
+	}
+	assert.Len(t, summaries, 1)
+	time.Sleep(50 * time.Millisecond)
+	l.record(terminationInputClosed, selectors)
+	assert.Equal(t, []string{
+		"Watchers stopped since the last summary: 1 with input closed",
+		"Watchers stopped since the last summary: 100 with context canceled, 21 with input closed",
+	}, summaries)
+}
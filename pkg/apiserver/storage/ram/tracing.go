@@ -0,0 +1,64 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// slowSendThreshold is the duration beyond which sending an event to a watcher's client is traced.
+const slowSendThreshold = 100 * time.Millisecond
+
+// Tracer creates the spans of the watch path of stores, e.g. by delegating to an OpenTelemetry tracer.
+type Tracer interface {
+	// StartSpan starts a span with the provided name at the provided time. The span is a child of the span
+	// carried by ctx, if any, e.g. the span of the API request that created the watch. It returns a context
+	// carrying the new span.
+	StartSpan(ctx context.Context, name string, start time.Time) (context.Context, Span)
+}
+
+// Span is a span created by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span.
+	SetAttribute(key string, value interface{})
+	// End ends the span at the provided time.
+	End(end time.Time)
+}
+
+// tracerHolder allows storing a nil Tracer in an atomic.Value.
+type tracerHolder struct {
+	tracer Tracer
+}
+
+// tracer is the Tracer of all stores, it holds a tracerHolder.
+var tracer atomic.Value
+
+// SetTracer sets the Tracer of all stores. When set, a span is created for the dispatching of each event to all
+// watchers, for the lifetime of each watcher, and for each event that takes its client longer than
+// slowSendThreshold to receive, as a child of the watcher's span. Tracing is disabled if it's nil, which is the
+// default. It only applies to the watchers created afterwards.
+func SetTracer(t Tracer) {
+	tracer.Store(tracerHolder{tracer: t})
+}
+
+// getTracer returns the Tracer of all stores, or nil if tracing is disabled.
+func getTracer() Tracer {
+	if holder, ok := tracer.Load().(tracerHolder); ok {
+		return holder.tracer
+	}
+	return nil
+}
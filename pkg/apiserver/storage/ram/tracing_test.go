@@ -0,0 +1,124 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ram
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	antreastorage "github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+type fakeSpanKey struct{}
+
+type fakeSpan struct {
+	tracer     *fakeTracer
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	start      time.Time
+	end        time.Time
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *fakeSpan) End(end time.Time) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.end = end
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+// fakeTracer records the ended spans.
+type fakeTracer struct {
+	mutex sync.Mutex
+	ended []*fakeSpan
+}
+
+func (t *fakeTracer) StartSpan(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	span := &fakeSpan{tracer: t, name: name, attributes: map[string]interface{}{}, start: start}
+	if parent, ok := ctx.Value(fakeSpanKey{}).(*fakeSpan); ok {
+		span.parent = parent.name
+	}
+	return context.WithValue(ctx, fakeSpanKey{}, span), span
+}
+
+// endedSpans returns the ended spans with the provided name.
+func (t *fakeTracer) endedSpans(name string) []*fakeSpan {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var spans []*fakeSpan
+	for _, span := range t.ended {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	assert.Nil(t, getTracer(), "Tracing should be disabled by default")
+	tracer := &fakeTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	store := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	store.watcherResultSize = 1
+	// The span of the API request creating the watch.
+	ctx := context.WithValue(context.Background(), fakeSpanKey{}, &fakeSpan{name: "request"})
+	w, err := store.Watch(ctx, "", &antreastorage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	require.NoError(t, err)
+
+	// The client receives the second event late as the first one fills its result channel.
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	store.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+	time.Sleep(slowSendThreshold + 50*time.Millisecond)
+	<-w.ResultChan()
+	<-w.ResultChan()
+	w.Stop()
+	<-w.(*storeWatcher).stopped
+
+	dispatchSpans := tracer.endedSpans("dispatchEvent")
+	require.Len(t, dispatchSpans, 2)
+	for i, span := range dispatchSpans {
+		assert.Equal(t, "", span.parent)
+		assert.Equal(t, uint64(i+1), span.attributes["resourceVersion"])
+		assert.Equal(t, 1, span.attributes["watchers"])
+		assert.Equal(t, "Pod", span.attributes["resource"])
+	}
+	watchSpans := tracer.endedSpans("watch")
+	require.Len(t, watchSpans, 1)
+	assert.Equal(t, "request", watchSpans[0].parent)
+	assert.Equal(t, antreastorage.ErrWatcherStopped.Error(), watchSpans[0].attributes["error"])
+	sendSpans := tracer.endedSpans("sendWatchEvent")
+	require.Len(t, sendSpans, 1, "Only the slow send should be traced")
+	assert.Equal(t, "watch", sendSpans[0].parent)
+	assert.Equal(t, uint64(2), sendSpans[0].attributes["resourceVersion"])
+	assert.True(t, sendSpans[0].end.Sub(sendSpans[0].start) > slowSendThreshold)
+}
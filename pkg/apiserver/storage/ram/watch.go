@@ -16,132 +16,1000 @@ package ram
 
 import (
 	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/klog"
 
 	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
 )
 
-// storeWatcher implements watch.Interface
+// storeWatcher implements watch.Interface, storage.ErrWatcher, storage.WaitableWatcher and storage.PausableWatcher
 type storeWatcher struct {
+	// lastResourceVersion is the resourceVersion of the last event dispatched to the watcher, or skipped by the
+	// dispatcher as it can't concern the watcher. It must be
+	// accessed atomically as it's read when listing watchers. It's the first field to guarantee 64-bit
+	// alignment on 32-bit platforms.
+	lastResourceVersion uint64
+	// lastSendTime is the time in nanoseconds the last event was sent to channel result, or the creation time
+	// of the watcher if none has been sent. It must be accessed atomically as it's read by the store's
+	// dispatcher. It follows lastResourceVersion to guarantee 64-bit alignment on 32-bit platforms.
+	lastSendTime int64
 	// input represents the channel for incoming internal events that should be processed.
+	// It may be replaced with a channel of different capacity by the store, see resizeInput.
 	input chan storage.InternalEvent
+	// inputs hands over the channel process should receive events from. It holds the initial
+	// input channel until process starts, and the new one whenever channel input is resized.
+	inputs chan chan storage.InternalEvent
 	// result represents the channel for outgoing events that will be sent to the client.
 	result chan watch.Event
 	done   chan struct{}
+	// stopped is closed when process returns.
+	stopped chan struct{}
 	// selectors represent a watcher's conditions to select objects.
 	selectors *storage.Selectors
-	// forget is used to cleanup the watcher.
+	// forget is used to cleanup the watcher. It can be nil if the watcher needs no cleanup.
 	forget func()
 	// stopOnce guarantees Stop function will perform exactly once.
 	stopOnce sync.Once
+	// abortDrain is closed by Stop to cut short the drain started by StopWithDrain, if any. abortOnce guarantees
+	// it's closed exactly once.
+	abortDrain chan struct{}
+	abortOnce  sync.Once
+	// stoppedRecordOnce guarantees the watcher's stop is recorded in metrics exactly once, whether it's stopped
+	// by the client or terminated as expired.
+	stoppedRecordOnce sync.Once
+	// resource is the name of the watched type, used to label metrics. It's empty if the watcher is
+	// not created by a store, in which case no metrics will be recorded.
+	resource string
+	// selectorsHash is the bucket the watcher's selectors hash to, used to label the metrics of the cost of
+	// converting events. It's empty if the watcher is not created by a store.
+	selectorsHash string
+	// source is the shared source the watcher is registered in the store on behalf of, or nil if the watcher
+	// is not a shared source's, see EnableWatcherSharing.
+	source *sharedSource
+	// newFunc is used to create the object carried by Bookmark events.
+	newFunc func() runtime.Object
+	// bookmarkInterval is the duration after which a Bookmark event will be sent if no
+	// event has been received from channel input, when bookmarks are allowed. The actual
+	// duration is jittered by up to bookmarkJitterFactor of it, see nextBookmarkInterval.
+	bookmarkInterval time.Duration
+	// sendTimeout is the duration after which the watcher will stop itself if the client
+	// doesn't receive an event. Zero means no timeout.
+	sendTimeout time.Duration
+	// compactionWarning returns the number of events that can still be recorded before resourceVersion gets
+	// compacted and whether it's low, in which case Bookmark events are annotated with
+	// CompactionWarningAnnotationKey. It's nil if the watcher is not created by a store.
+	compactionWarning func(resourceVersion uint64) (int, bool)
+
+	// fillSamples is the number of times the fill ratio of channel input has been observed in
+	// the current window, highFillSamples and lowFillSamples are the number of times it was
+	// observed high and low respectively. They are only accessed by the store's dispatcher.
+	fillSamples     int
+	highFillSamples int
+	lowFillSamples  int
+	// errMutex protects err.
+	errMutex sync.Mutex
+	// err is the cause of the termination of the watcher, it's set once by the first termination path.
+	err error
+	// pauseMutex protects resumeCh.
+	pauseMutex sync.Mutex
+	// resumeCh is closed when the watcher is resumed. It's nil if the watcher is not paused.
+	resumeCh chan struct{}
+	// ctxDone is the Done channel of the context process runs with, if any. It's only accessed by process.
+	ctxDone <-chan struct{}
+	// initObjects are the listed objects whose initial events haven't been generated yet, if the store chunks
+	// initial events. It's only accessed by process once it has started.
+	initObjects *initObjects
+	// backfilled indicates whether the initial events were backfilled, see EnableDeleteBackfill. Their end is
+	// marked like the end of the initial events requested with SendInitialEvents, as the objects the client knows
+	// but which haven't been added again may no longer match its selectors.
+	backfilled bool
+	// batch holds the events waiting to be sent together when the watcher batches events. It's only accessed by
+	// process.
+	batch []watch.Event
+	// tracer and traceCtx are the Tracer and the context carrying the watcher's span if tracing is enabled. They're
+	// only accessed by process.
+	tracer   Tracer
+	traceCtx context.Context
+	// createdAt is the time the watcher was created.
+	createdAt time.Time
+	// resyncRequired is set when an event had to be discarded as channel input is full, in which case
+	// the watcher must be stopped so that the client resyncs. It's only accessed by the store's dispatcher.
+	resyncRequired bool
+	// coalescible maps the key of an object to the last Modified event of it queued in channel input, if
+	// there's no other event of the object queued after it. It's only used when the watcher coalesces
+	// modifications and only accessed by the store's dispatcher.
+	coalescible map[string]*coalescedEvent
+}
+
+// coalescedEvent wraps a Modified event queued in channel input so that it can be replaced by a newer Modified
+// event of the same object until process takes it. It keeps the resourceVersion of the original event, which
+// is the position of the event in the sequence of events sent to the watcher.
+type coalescedEvent struct {
+	resourceVersion uint64
+	// first is the original event, whose previous object is the one before all the coalesced modifications.
+	first storage.InternalEvent
+	// mutex protects event and taken, which are accessed by both the store's dispatcher and process.
+	mutex sync.Mutex
+	event storage.InternalEvent
+	// taken is set once the event is taken by process or discarded, after which it can't be replaced.
+	taken bool
+}
+
+// ToWatchEvent converts the latest event and marks the coalescedEvent taken.
+func (e *coalescedEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.taken = true
+	return e.event.ToWatchEvent(selectors)
+}
+
+func (e *coalescedEvent) GetResourceVersion() uint64 {
+	return e.resourceVersion
+}
+
+// ToPreviousObject returns the previous object of the original event, if it has one.
+func (e *coalescedEvent) ToPreviousObject(selectors *storage.Selectors) runtime.Object {
+	if first, ok := e.first.(storage.PreviousObjectEvent); ok {
+		return first.ToPreviousObject(selectors)
+	}
+	return nil
+}
+
+// replace replaces the event if it hasn't been taken. It returns whether it's replaced.
+func (e *coalescedEvent) replace(event storage.InternalEvent) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.taken {
+		return false
+	}
+	e.event = event
+	return true
 }
 
-func newStoreWatcher(chanSize int, selectors *storage.Selectors, forget func()) *storeWatcher {
+// current returns the event that replaced the others, the original one if none has.
+func (e *coalescedEvent) current() storage.InternalEvent {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.event
+}
+
+// isTaken returns whether the event has been taken.
+func (e *coalescedEvent) isTaken() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.taken
+}
+
+// newStoreWatcher creates a watcher whose input channel and result channel have the provided buffer sizes.
+func newStoreWatcher(inputSize, resultSize int, selectors *storage.Selectors, forget func(), newFunc func() runtime.Object) *storeWatcher {
+	input := make(chan storage.InternalEvent, inputSize)
+	inputs := make(chan chan storage.InternalEvent, 1)
+	inputs <- input
+	now := time.Now()
 	return &storeWatcher{
-		input:     make(chan storage.InternalEvent, chanSize),
-		result:    make(chan watch.Event, chanSize),
-		done:      make(chan struct{}),
-		selectors: selectors,
-		forget:    forget,
+		lastSendTime:     now.UnixNano(),
+		input:            input,
+		inputs:           inputs,
+		result:           make(chan watch.Event, resultSize),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		abortDrain:       make(chan struct{}),
+		selectors:        selectors,
+		forget:           forget,
+		newFunc:          newFunc,
+		bookmarkInterval: watcherBookmarkInterval,
+		createdAt:        now,
 	}
 }
 
 // nonBlockingAdd tries to send event to channel input without blocking.
-// It returns true if successful, otherwise false.
-func (w *storeWatcher) nonBlockingAdd(event storage.InternalEvent) bool {
+// If channel input is full and the watcher's BackpressurePolicy drops events, the
+// event is not handled and the watcher is marked resyncRequired, as its client would
+// miss an event and keep a stale state otherwise.
+// If the watcher coalesces modifications, a Modified event replaces the queued Modified
+// event of the same object if process hasn't taken it. key is the key of the object the
+// event was generated for, empty if the event isn't specific to one object.
+// It returns true if the event has been handled, otherwise false.
+func (w *storeWatcher) nonBlockingAdd(key string, event storage.InternalEvent) bool {
+	if w.resyncRequired {
+		return false
+	}
+	if !w.selectors.CoalesceModifications {
+		return w.tryAdd(event)
+	}
+	key, modified := w.coalescingKey(key, event)
+	if modified {
+		if queued, exists := w.coalescible[key]; exists && queued.replace(event) {
+			return true
+		}
+		event = &coalescedEvent{resourceVersion: event.GetResourceVersion(), first: event, event: event}
+	}
+	if !w.tryAdd(event) {
+		return false
+	}
+	w.trackQueued(key, modified, event)
+	return true
+}
+
+// tryAdd tries to send event to channel input without blocking, see nonBlockingAdd.
+func (w *storeWatcher) tryAdd(event storage.InternalEvent) bool {
 	select {
 	case w.input <- event:
 		return true
 	default:
+	}
+
+	if w.selectors.BackpressurePolicy == storage.DropOldest || w.selectors.BackpressurePolicy == storage.DropNewest {
+		// Whichever event is discarded, the client would never see it, and a Bookmark carrying a later
+		// resourceVersion would let it resume without it. The watcher must be stopped for the client to relist.
+		klog.V(2).Infof("Watcher (selectors: %v) had to discard event %d as its buffer is full, it must resync", w.selectors, event.GetResourceVersion())
+		w.resyncRequired = true
+	}
+	return false
+}
+
+// coalescingKey returns the key of the object of the event if the watcher is interested in it, and whether it's
+// a Modified event. key is the one the event was generated for and the type is told by the event itself, see
+// storage.TypedInternalEvent, so that the event isn't converted on the dispatching path. An event that can't tell
+// its type is returned with its key, so that it's never coalesced nor reordered with the events of the same object.
+// A resyncEvent resets all the coalescible events as they can't be reordered with it.
+func (w *storeWatcher) coalescingKey(key string, event storage.InternalEvent) (string, bool) {
+	if _, ok := event.(*resyncEvent); ok {
+		w.coalescible = nil
+		return "", false
+	}
+	typed, ok := event.(storage.TypedInternalEvent)
+	if !ok {
+		return key, false
+	}
+	eventType, ok := typed.GetEventType(w.selectors)
+	if !ok {
+		return "", false
+	}
+	return key, eventType == watch.Modified
+}
+
+// trackQueued records the event queued for the object of the provided key. A Modified event becomes the one the
+// next Modified event of the object can replace, while other events prevent the events queued before them from
+// being replaced, which would reorder them. The events taken by process are purged once there are as many
+// tracked events as channel input can hold.
+func (w *storeWatcher) trackQueued(key string, modified bool, event storage.InternalEvent) {
+	if key == "" {
+		return
+	}
+	if !modified {
+		delete(w.coalescible, key)
+		return
+	}
+	if w.coalescible == nil {
+		w.coalescible = map[string]*coalescedEvent{}
+	}
+	if len(w.coalescible) >= cap(w.input) {
+		for k, e := range w.coalescible {
+			if e.isTaken() {
+				delete(w.coalescible, k)
+			}
+		}
+	}
+	w.coalescible[key] = event.(*coalescedEvent)
+}
+
+// info returns the information of the watcher. It should be called while holding a read lock on the
+// store's watcherMutex, as channel input may be replaced otherwise.
+func (w *storeWatcher) info() storage.WatcherInfo {
+	return storage.WatcherInfo{
+		Resource:            w.resource,
+		Selectors:           redactSelectors(w.selectors),
+		BufferDepth:         len(w.input),
+		BufferCapacity:      cap(w.input),
+		Age:                 metav1.Duration{Duration: time.Since(w.createdAt).Round(time.Second)},
+		LastResourceVersion: atomic.LoadUint64(&w.lastResourceVersion),
+		SelectorsHash:       w.selectorsHash,
+	}
+}
+
+// redactSelectors summarizes the provided selectors without their values, which may be sensitive.
+func redactSelectors(selectors *storage.Selectors) string {
+	var terms []string
+	if selectors.Key != "" {
+		terms = append(terms, "key=*")
+	}
+	if selectors.Label != nil {
+		if requirements, selectable := selectors.Label.Requirements(); selectable {
+			for _, r := range requirements {
+				if r.Values().Len() > 0 {
+					terms = append(terms, fmt.Sprintf("label:%s %s *", r.Key(), r.Operator()))
+				} else {
+					terms = append(terms, fmt.Sprintf("label:%s %s", r.Key(), r.Operator()))
+				}
+			}
+		}
+	}
+	if selectors.Field != nil {
+		for _, r := range selectors.Field.Requirements() {
+			terms = append(terms, fmt.Sprintf("field:%s %s *", r.Field, r.Operator))
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// sampleFill records the current fill ratio of channel input. Once the window is complete, it
+// returns the capacity channel input should be resized to based on the observations, or 0 if
+// it should be kept, and starts a new window.
+// It should only be called by the store's dispatcher while holding a read lock on watcherMutex.
+func (w *storeWatcher) sampleFill(window, minSize, maxSize, step int) int {
+	ratio := float64(len(w.input)) / float64(cap(w.input))
+	w.fillSamples++
+	if ratio >= watcherChanHighFillRatio {
+		w.highFillSamples++
+	} else if ratio < watcherChanLowFillRatio {
+		w.lowFillSamples++
+	}
+	if w.fillSamples < window {
+		return 0
+	}
+
+	newSize := 0
+	curSize := cap(w.input)
+	if w.highFillSamples*2 > w.fillSamples && curSize < maxSize {
+		// Under sustained pressure, grow the buffer to absorb bursts.
+		newSize = curSize + step
+		if newSize > maxSize {
+			newSize = maxSize
+		}
+	} else if w.lowFillSamples == w.fillSamples && curSize > minSize {
+		// Idle in the whole window, release the memory.
+		newSize = curSize - step
+		if newSize < minSize {
+			newSize = minSize
+		}
+	}
+	w.fillSamples, w.highFillSamples, w.lowFillSamples = 0, 0, 0
+	return newSize
+}
+
+// resizeInput replaces channel input with a new channel of the provided capacity. The old
+// channel is closed after it's handed over, process will receive the events buffered in it
+// before switching to the new one, so that the order of events is preserved.
+// It returns false if the previous replacement has not been taken over by process yet.
+// It should only be called while holding a lock on the store's watcherMutex, and only if the
+// watcher has not been forgotten, which guarantees nobody else is sending to channel input.
+func (w *storeWatcher) resizeInput(size int) bool {
+	if len(w.inputs) > 0 {
 		return false
 	}
+	input := make(chan storage.InternalEvent, size)
+	w.inputs <- input
+	oldInput := w.input
+	w.input = input
+	close(oldInput)
+	return true
 }
 
 // add tries to send event to channel input. It will first use non blocking
 // way, then block until the provided timer fires, if the timer is not nil.
-// It returns true if successful, otherwise false.
-func (w *storeWatcher) add(event storage.InternalEvent, timer *time.Timer) bool {
+// It returns true if successful, otherwise false. It returns false immediately
+// if the watcher must resync.
+func (w *storeWatcher) add(key string, event storage.InternalEvent, timer *time.Timer) bool {
 	// Try to send the event without blocking regardless of timer is fired or not.
 	// This gives the watcher a chance when other watchers exhaust the time slices.
-	if w.nonBlockingAdd(event) {
+	if w.nonBlockingAdd(key, event) {
 		return true
 	}
 
-	if timer == nil {
+	if timer == nil || w.resyncRequired {
 		return false
 	}
 
+	var modified bool
+	if w.selectors.CoalesceModifications {
+		key, modified = w.coalescingKey(key, event)
+		if modified {
+			event = &coalescedEvent{resourceVersion: event.GetResourceVersion(), first: event, event: event}
+		}
+	}
 	select {
 	case w.input <- event:
+		w.trackQueued(key, modified, event)
 		return true
 	case <-timer.C:
 		return false
 	}
 }
 
-// process first sends initEvents and then keeps sending events got from channel input
-// if they are newer than the specified resourceVersion.
+// process first sends initEvents, if any, in ascending order of resourceVersion, and then keeps sending events got from channel input
+// if they are newer than the specified resourceVersion. If bookmarks are allowed, a
+// Bookmark event carrying the latest resourceVersion will be sent whenever channel input
+// has been idle for a jittered bookmarkInterval. The events carried by a resyncEvent are
+// always sent. An event older than one already got from channel input is skipped and
+// reported, as it can only be caused by a dispatching bug.
 func (w *storeWatcher) process(ctx context.Context, initEvents []storage.InternalEvent, resourceVersion uint64) {
-	for _, event := range initEvents {
-		w.sendWatchEvent(event)
-	}
+	defer close(w.stopped)
 	defer close(w.result)
+	if t := getTracer(); t != nil {
+		var span Span
+		ctx, span = t.StartSpan(ctx, "watch", time.Now())
+		span.SetAttribute("resource", w.resource)
+		span.SetAttribute("selectors", redactSelectors(w.selectors))
+		defer func() {
+			if err := w.Err(); err != nil {
+				span.SetAttribute("error", err.Error())
+			}
+			span.End(time.Now())
+		}()
+		w.tracer, w.traceCtx = t, ctx
+	}
+	w.ctxDone = ctx.Done()
+	// Send the events batched when process stops, e.g. as the ceiling has been reached.
+	defer w.flushBatch()
+	input := <-w.inputs
+	// Clients diffing the initial state rely on initEvents being sent in ascending order of resourceVersion,
+	// regardless of how the caller built them. The order of events having the same resourceVersion is kept.
+	sortEvents(initEvents)
+	ceiling := w.selectors.ResourceVersionCeiling
+	if !w.sendInitEvents(ctx, initEvents) {
+		return
+	}
+	// The events of the listed objects are generated page by page, so that they are never all held at once.
+	for w.initObjects != nil && (ceiling == 0 || w.initObjects.resourceVersion <= ceiling) {
+		page, err := w.initObjects.nextPage()
+		if err != nil {
+			klog.Errorf("Failed to generate initial events for watcher of %s (selectors: %s): %v", w.resource, redactSelectors(w.selectors), err)
+			w.setErr(err)
+			terminations.record(terminationInitEventsFailed, w.selectors)
+			return
+		}
+		if page == nil {
+			break
+		}
+		if !w.sendInitEvents(ctx, page) {
+			return
+		}
+	}
+	w.initObjects = nil
+	w.flushBatch()
+	// Mark the end of initial events even if there is none, so that the client knows it has got the whole state.
+	var annotations map[string]string
+	if w.selectors.SendInitialEvents || w.backfilled {
+		annotations = map[string]string{storage.InitialEventsAnnotationKey: "true"}
+	}
+	if w.selectors.SendSyncMarker {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[storage.SyncCompleteAnnotationKey] = "true"
+	}
+	if annotations != nil {
+		w.sendBookmark(resourceVersion, annotations)
+	}
+	if ceiling > 0 && resourceVersion >= ceiling {
+		terminations.record(terminationCeilingReached, w.selectors)
+		return
+	}
+
+	var bookmarkTimer *time.Timer
+	var bookmarkCh <-chan time.Time
+	if w.selectors.AllowWatchBookmarks {
+		bookmarkTimer = time.NewTimer(w.nextBookmarkInterval())
+		defer bookmarkTimer.Stop()
+		bookmarkCh = bookmarkTimer.C
+	}
+	// dispatchedVersion is the resourceVersion of the last event got from channel input and sent.
+	var dispatchedVersion uint64
+	// batchCh fires when the pending batch has waited for BatchWindow. It's nil if the timer is not running.
+	var batchTimer *time.Timer
+	var batchCh <-chan time.Time
+	if w.selectors.MaxBatchSize > 1 && w.selectors.BatchWindow > 0 {
+		batchTimer = time.NewTimer(w.selectors.BatchWindow)
+		batchTimer.Stop()
+		defer batchTimer.Stop()
+	}
 	for {
 		select {
-		case event, ok := <-w.input:
+		case event, ok := <-input:
 			if !ok {
-				klog.Info("The input channel had been closed, stopping process")
+				// The channel was closed because it has been resized, continue with the new one.
+				select {
+				case input = <-w.inputs:
+					continue
+				default:
+				}
+				terminations.record(terminationInputClosed, w.selectors)
 				return
 			}
-			if event.GetResourceVersion() > resourceVersion {
+			if resync, ok := event.(*resyncEvent); ok {
+				for _, resyncEvent := range resync.events {
+					w.sendWatchEvent(resyncEvent)
+				}
+			} else if event.GetResourceVersion() < dispatchedVersion {
+				w.reportOutOfOrder(event, dispatchedVersion)
+			} else if event.GetResourceVersion() > resourceVersion {
+				if ceiling > 0 && event.GetResourceVersion() > ceiling {
+					// The event of the ceiling didn't concern the watcher and was not dispatched to it.
+					terminations.record(terminationCeilingReached, w.selectors)
+					return
+				}
 				w.sendWatchEvent(event)
+				dispatchedVersion = event.GetResourceVersion()
+				// Record the version even if the watcher is not interested in the event,
+				// so that Bookmark events can tell the latest version it has observed.
+				resourceVersion = event.GetResourceVersion()
+				if resourceVersion == ceiling {
+					terminations.record(terminationCeilingReached, w.selectors)
+					return
+				}
 			}
+			if bookmarkTimer != nil {
+				// Reset the timer as the watcher is not idle.
+				if !bookmarkTimer.Stop() {
+					select {
+					case <-bookmarkTimer.C:
+					default:
+					}
+				}
+				bookmarkTimer.Reset(w.nextBookmarkInterval())
+			}
+			if len(w.batch) > 0 && len(input) == 0 {
+				// No more event is ready, send the batch now or once it has waited for BatchWindow.
+				if batchTimer == nil {
+					w.flushBatch()
+				} else if batchCh == nil {
+					batchTimer.Reset(w.selectors.BatchWindow)
+					batchCh = batchTimer.C
+				}
+			}
+		case <-batchCh:
+			batchCh = nil
+			w.flushBatch()
+		case <-bookmarkCh:
+			resourceVersion = w.observedVersion(input, resourceVersion)
+			if ceiling > 0 && resourceVersion >= ceiling {
+				terminations.record(terminationCeilingReached, w.selectors)
+				return
+			}
+			w.sendBookmark(resourceVersion, nil)
+			bookmarkTimer.Reset(w.nextBookmarkInterval())
 		case <-ctx.Done():
-			klog.Info("The context had been canceled, stopping process")
+			w.setErr(ctx.Err())
+			terminations.record(terminationContextCanceled, w.selectors)
 			return
 		}
 	}
 }
 
+// sendInitEvents sends the provided initial events, up to the watcher's ResourceVersionCeiling. It returns false if
+// the watcher has been stopped or the context process runs with has been canceled in the meantime.
+func (w *storeWatcher) sendInitEvents(ctx context.Context, initEvents []storage.InternalEvent) bool {
+	ceiling := w.selectors.ResourceVersionCeiling
+	for _, event := range initEvents {
+		if ceiling > 0 && event.GetResourceVersion() > ceiling {
+			// Events replayed from history can go beyond the ceiling.
+			break
+		}
+		// The initial set can be large, stop sending it as soon as the client has gone.
+		select {
+		case <-ctx.Done():
+			w.setErr(ctx.Err())
+			terminations.record(terminationContextCanceled, w.selectors)
+			return false
+		case <-w.done:
+			return false
+		default:
+		}
+		w.sendWatchEvent(event)
+	}
+	return true
+}
+
+// observedVersion returns the resourceVersion the watcher has observed, given the one of the last event process
+// got from channel input. The store doesn't dispatch the events that can't concern the watcher, e.g. the ones of
+// other objects when it monitors a single object, but records their version in lastResourceVersion, which is
+// returned if it's newer and there is no event left to process. lastResourceVersion must be read before checking
+// the channels, as the events the dispatcher queued before recording it must have been processed.
+func (w *storeWatcher) observedVersion(input chan storage.InternalEvent, resourceVersion uint64) uint64 {
+	lastResourceVersion := atomic.LoadUint64(&w.lastResourceVersion)
+	if lastResourceVersion <= resourceVersion || len(input) > 0 || len(w.inputs) > 0 {
+		return resourceVersion
+	}
+	return lastResourceVersion
+}
+
+// sortEvents sorts events by ascending resourceVersion in place, keeping the order of events having the same
+// resourceVersion.
+func sortEvents(events []storage.InternalEvent) {
+	less := func(i, j int) bool {
+		return events[i].GetResourceVersion() < events[j].GetResourceVersion()
+	}
+	if sort.SliceIsSorted(events, less) {
+		return
+	}
+	sort.SliceStable(events, less)
+}
+
+// nextBookmarkInterval returns a duration in [bookmarkInterval, bookmarkInterval*(1+bookmarkJitterFactor)).
+// Each watcher schedules its Bookmark events with its own jittered duration instead of a shared ticker, so
+// that watchers created or idle at the same time, e.g. all agents reconnecting after a restart, don't send
+// Bookmark events in the same tick.
+func (w *storeWatcher) nextBookmarkInterval() time.Duration {
+	return wait.Jitter(w.bookmarkInterval, bookmarkJitterFactor)
+}
+
+// processExpired sends an Error event carrying the provided status, which indicates the
+// resourceVersion the watcher requested has been compacted, then closes channel result.
+// The client is expected to relist and start a new watch from the latest state.
+func (w *storeWatcher) processExpired(status *metav1.Status) {
+	defer close(w.stopped)
+	defer close(w.result)
+	// The client may just drop the result channel without calling Stop once it has got the error.
+	defer w.recordStopped()
+	w.setErr(errors.FromObject(status))
+	w.recordDropped(dropReasonCompaction)
+	w.send(&watch.Event{Type: watch.Error, Object: status})
+}
+
 // sendWatchEvent converts an InternalEvent to watch.Event based on the watcher's selectors.
-// It sends the converted event to result channel, if not nil.
+// It sends the converted event to result channel, if not nil, after projecting its object
+// with the watcher's Transform, if any. A Modified event carries the previous object as well
+// if the watcher requested it and the event can tell it, and is not sent if the watcher's
+// SuppressEqual finds the previous and the new objects equal. The duration of the conversion
+// is recorded by hash of the watcher's selectors, to find the watchers that are expensive to
+// serve.
 func (w *storeWatcher) sendWatchEvent(event storage.InternalEvent) {
-	watchEvent := event.ToWatchEvent(w.selectors)
+	convertStart := time.Now()
+	watchEvent := w.convert(event, func() *watch.Event {
+		watchEvent := event.ToWatchEvent(w.selectors)
+		if watchEvent == nil {
+			return nil
+		}
+		var prevObj runtime.Object
+		if (w.selectors.IncludePreviousObject || w.selectors.SuppressEqual != nil) && watchEvent.Type == watch.Modified {
+			if previous, ok := event.(storage.PreviousObjectEvent); ok {
+				prevObj = previous.ToPreviousObject(w.selectors)
+			}
+		}
+		if w.selectors.Transform != nil {
+			// Don't modify the event in place as it may be shared by other watchers.
+			watchEvent = &watch.Event{Type: watchEvent.Type, Object: w.selectors.Transform(watchEvent.Object)}
+			if prevObj != nil {
+				prevObj = w.selectors.Transform(prevObj)
+			}
+		}
+		if prevObj != nil && w.selectors.SuppressEqual != nil && w.selectors.SuppressEqual(prevObj, watchEvent.Object) {
+			return nil
+		}
+		if prevObj != nil && w.selectors.IncludePreviousObject {
+			watchEvent = &watch.Event{Type: watchEvent.Type, Object: &storage.ObjectUpdate{Object: watchEvent.Object, PrevObject: prevObj}}
+		}
+		return watchEvent
+	})
+	if w.selectorsHash != "" {
+		recordConversionDuration(w.resource, w.selectorsHash, time.Since(convertStart))
+	}
 	if watchEvent == nil {
-		// Watcher is not interested in that object.
+		// Watcher is not interested in that object, or it can't be converted.
+		return
+	}
+	w.recordDowngrade(event, watchEvent)
+	if w.tracer == nil {
+		w.sendOrBatch(watchEvent)
+		return
+	}
+	start := time.Now()
+	w.sendOrBatch(watchEvent)
+	if end := time.Now(); end.Sub(start) > slowSendThreshold {
+		_, span := w.tracer.StartSpan(w.traceCtx, "sendWatchEvent", start)
+		span.SetAttribute("type", string(watchEvent.Type))
+		span.SetAttribute("resourceVersion", event.GetResourceVersion())
+		span.End(end)
+	}
+}
+
+// toWatchEvent converts the event to watch.Event based on the watcher's selectors, see convert. Modified events
+// of a newer format than the watcher's negotiated version are counted, as their conversion downgraded them.
+func (w *storeWatcher) toWatchEvent(event storage.InternalEvent) *watch.Event {
+	watchEvent := w.convert(event, func() *watch.Event {
+		return event.ToWatchEvent(w.selectors)
+	})
+	w.recordDowngrade(event, watchEvent)
+	return watchEvent
+}
+
+// recordDowngrade counts watchEvent if it's a Modified event converted from event to a format older than the
+// event's version, as the watcher doesn't support it.
+func (w *storeWatcher) recordDowngrade(event storage.InternalEvent, watchEvent *watch.Event) {
+	if watchEvent == nil || watchEvent.Type != watch.Modified || w.resource == "" {
 		return
 	}
+	if coalesced, ok := event.(*coalescedEvent); ok {
+		event = coalesced.current()
+	}
+	if versioned, ok := event.(storage.VersionedInternalEvent); ok && versioned.GetEventVersion() > w.selectors.NegotiatedEventVersion() {
+		recordEventDowngraded(w.resource)
+	}
+}
 
+// convert returns the result of the provided conversion of the event. If the conversion panics, e.g. because of a
+// malformed object or a buggy Transform, the panic is logged and counted, and nil is returned so that the event is
+// skipped instead of crashing the dispatcher or the watcher.
+func (w *storeWatcher) convert(event storage.InternalEvent, conversion func() *watch.Event) (watchEvent *watch.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Errorf("Skipped event %+v for watcher (selectors: %v) as converting it panicked: %v\n%s", event, w.selectors, r, debug.Stack())
+			if w.resource != "" {
+				recordConversionError(w.resource)
+			}
+			watchEvent = nil
+		}
+	}()
+	return conversion()
+}
+
+// sendBookmark sends a Bookmark event carrying the provided resourceVersion and annotations to result channel.
+// If the resourceVersion is about to be compacted, the event is also annotated with CompactionWarningAnnotationKey.
+func (w *storeWatcher) sendBookmark(resourceVersion uint64, annotations map[string]string) {
+	// The Bookmark event must not overtake the events it follows.
+	w.flushBatch()
+	obj := w.newFunc()
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		klog.Errorf("Failed to create Bookmark event: %v", err)
+		return
+	}
+	accessor.SetResourceVersion(strconv.FormatUint(resourceVersion, 10))
+	if w.compactionWarning != nil {
+		if headroom, low := w.compactionWarning(resourceVersion); low {
+			warned := map[string]string{storage.CompactionWarningAnnotationKey: strconv.Itoa(headroom)}
+			for k, v := range annotations {
+				warned[k] = v
+			}
+			annotations = warned
+		}
+	}
+	if annotations != nil {
+		accessor.SetAnnotations(annotations)
+	}
+	w.send(&watch.Event{Type: watch.Bookmark, Object: obj})
+}
+
+// sendOrBatch sends watchEvent, or appends it to the pending batch if the watcher batches events, in which case
+// the batch is sent once it's full.
+func (w *storeWatcher) sendOrBatch(watchEvent *watch.Event) {
+	if w.selectors.MaxBatchSize <= 1 {
+		w.send(watchEvent)
+		return
+	}
+	w.batch = append(w.batch, *watchEvent)
+	if len(w.batch) >= w.selectors.MaxBatchSize {
+		w.flushBatch()
+	}
+}
+
+// flushBatch sends the pending batch, if any. A batch of a single event is sent as the event itself.
+func (w *storeWatcher) flushBatch() {
+	switch len(w.batch) {
+	case 0:
+		return
+	case 1:
+		w.send(&w.batch[0])
+	default:
+		w.send(&watch.Event{Type: storage.Batched, Object: &storage.EventBatch{Events: w.batch}})
+	}
+	w.batch = nil
+}
+
+// send sends watchEvent to result channel unless the watcher has been stopped or the context
+// process runs with has been canceled. If sendTimeout is set and the client doesn't receive the event in time, the
+// watcher will be stopped, so that a hung client can't hold events forever.
+func (w *storeWatcher) send(watchEvent *watch.Event) {
+	w.waitResumed()
 	select {
 	case <-w.done:
 		return
+	case <-w.ctxDone:
+		w.recordDropped(dropReasonClientGone)
+		return
 	default:
 	}
 
+	if w.sendTimeout == 0 {
+		select {
+		case w.result <- *watchEvent:
+			w.recordSend()
+		case <-w.done:
+		case <-w.ctxDone:
+			w.recordDropped(dropReasonClientGone)
+		}
+		return
+	}
+
+	// Try to send the event without blocking first, to avoid setting up a timer for every event.
 	select {
 	case w.result <- *watchEvent:
+		w.recordSend()
+		return
+	default:
+	}
+	timer := time.NewTimer(w.sendTimeout)
+	defer timer.Stop()
+	select {
+	case w.result <- *watchEvent:
+		w.recordSend()
 	case <-w.done:
+	case <-w.ctxDone:
+		w.recordDropped(dropReasonClientGone)
+	case <-timer.C:
+		klog.Warningf("Stopping watcher (selectors: %v) as the client didn't receive event in %v", w.selectors, w.sendTimeout)
+		w.recordDropped(dropReasonSendTimeout)
+		w.setErr(storage.ErrWatcherTooSlow)
+		w.Stop()
+	}
+}
+
+// reportOutOfOrder logs and counts an event got from channel input after an event of a higher resourceVersion.
+func (w *storeWatcher) reportOutOfOrder(event storage.InternalEvent, dispatchedVersion uint64) {
+	klog.Errorf("Watcher of %s (selectors: %s) got event of resourceVersion %d after dispatching resourceVersion %d, skipping it",
+		w.resource, redactSelectors(w.selectors), event.GetResourceVersion(), dispatchedVersion)
+	if w.resource != "" {
+		recordEventOutOfOrder(w.resource)
+	}
+}
+
+// recordDropped counts an event dropped for the watcher for the provided reason, if the watcher is created by a store.
+func (w *storeWatcher) recordDropped(reason string) {
+	if w.resource != "" {
+		recordEventDropped(w.resource, reason)
+	}
+}
+
+// recordSend records the time an event was sent to channel result.
+func (w *storeWatcher) recordSend() {
+	atomic.StoreInt64(&w.lastSendTime, time.Now().UnixNano())
+}
+
+// setErr sets the cause of the termination of the watcher, unless it has been set.
+func (w *storeWatcher) setErr(err error) {
+	w.errMutex.Lock()
+	defer w.errMutex.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Err implements storage.ErrWatcher.
+func (w *storeWatcher) Err() error {
+	w.errMutex.Lock()
+	defer w.errMutex.Unlock()
+	return w.err
+}
+
+// Pause implements storage.PausableWatcher. While it's paused, process stops receiving events from channel input,
+// which is subject to the watcher's BackpressurePolicy once it's full, like when the client doesn't receive events.
+// It's idempotent.
+func (w *storeWatcher) Pause() {
+	w.pauseMutex.Lock()
+	defer w.pauseMutex.Unlock()
+	if w.resumeCh == nil {
+		w.resumeCh = make(chan struct{})
 	}
 }
 
+// Resume implements storage.PausableWatcher. It's idempotent.
+func (w *storeWatcher) Resume() {
+	w.pauseMutex.Lock()
+	defer w.pauseMutex.Unlock()
+	if w.resumeCh != nil {
+		close(w.resumeCh)
+		w.resumeCh = nil
+	}
+}
+
+// waitResumed blocks while the watcher is paused, until it's resumed or stopped, or the context process runs with is
+// canceled.
+func (w *storeWatcher) waitResumed() {
+	w.pauseMutex.Lock()
+	resumeCh := w.resumeCh
+	w.pauseMutex.Unlock()
+	if resumeCh == nil {
+		return
+	}
+	select {
+	case <-resumeCh:
+	case <-w.done:
+	case <-w.ctxDone:
+	}
+}
+
+// WaitStopped implements storage.WaitableWatcher. It returns whether process has returned.
+func (w *storeWatcher) WaitStopped(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.stopped:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// recordStopped records the stop of the watcher in metrics, if it's created by a store and its stop hasn't
+// been recorded yet.
+func (w *storeWatcher) recordStopped() {
+	// The source of shared watchers is not recorded as a watcher, its clients are.
+	if w.resource == "" || w.source != nil {
+		return
+	}
+	w.stoppedRecordOnce.Do(func() {
+		recordWatcherStopped(w.resource)
+	})
+}
+
 // ResultChan returns the channel for outgoing events to the client.
 func (w *storeWatcher) ResultChan() <-chan watch.Event {
 	return w.result
 }
 
-// Stop stops this watcher.
+// Stop stops this watcher. If it's being drained, see StopWithDrain, the events that haven't been sent yet are
+// discarded.
 // It must be idempotent and thread safe as it could be called by apiserver endpoint handler
 // and dispatchEvent concurrently.
 func (w *storeWatcher) Stop() {
+	w.abortOnce.Do(func() {
+		close(w.abortDrain)
+	})
 	w.stopOnce.Do(func() {
-		w.forget()
+		w.setErr(storage.ErrWatcherStopped)
+		if w.forget != nil {
+			w.forget()
+		}
+		w.recordStopped()
 		close(w.done)
 		// forget removes this watcher from the store's watcher list, there won't
 		// be events sent to its input channel so we are safe to close it.
 		close(w.input)
 	})
 }
+
+// StopWithDrain stops this watcher gracefully. Unlike Stop, it stops receiving new events
+// immediately but keeps sending the events that have been buffered to the client, until all
+// of them have been sent or the provided timeout expires.
+// It doesn't block and is idempotent with Stop, only the first call takes effect, except that Stop cuts an
+// in-progress drain short.
+func (w *storeWatcher) StopWithDrain(timeout time.Duration) {
+	w.stopOnce.Do(func() {
+		w.setErr(storage.ErrWatcherStopped)
+		if w.forget != nil {
+			w.forget()
+		}
+		w.recordStopped()
+		// forget removes this watcher from the store's watcher list, there won't
+		// be events sent to its input channel so we are safe to close it. process
+		// will return after it sends all the buffered events.
+		close(w.input)
+		go func() {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-w.stopped:
+			case <-timer.C:
+				klog.V(2).Infof("Timeout draining watcher (selectors: %v), discarding remaining events", w.selectors)
+			case <-w.abortDrain:
+				klog.V(2).Infof("Watcher (selectors: %v) stopped while draining, discarding remaining events", w.selectors)
+			}
+			close(w.done)
+		}()
+	})
+}
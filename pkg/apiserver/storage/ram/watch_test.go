@@ -16,14 +16,21 @@ package ram
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
 )
@@ -46,16 +53,22 @@ func (e *simpleInternalEvent) GetResourceVersion() uint64 {
 	return e.ResourceVersion
 }
 
+func (e *simpleInternalEvent) GetEventType(selectors *storage.Selectors) (watch.EventType, bool) {
+	return e.Type, true
+}
+
 // emptyInternalEvent always get nil when converting to watch.Event,
 // represents the case that the watcher is not interested in an object.
-type emptyInternalEvent struct{}
+type emptyInternalEvent struct {
+	ResourceVersion uint64
+}
 
 func (e *emptyInternalEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
 	return nil
 }
 
 func (e *emptyInternalEvent) GetResourceVersion() uint64 {
-	return 0
+	return e.ResourceVersion
 }
 
 func TestEvents(t *testing.T) {
@@ -143,11 +156,11 @@ func TestEvents(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		w := newStoreWatcher(10, &storage.Selectors{}, func() {})
+		w := newStoreWatcher(10, 10, &storage.Selectors{}, func() {}, newPod)
 		go w.process(context.Background(), testCase.initEvents, 0)
 
 		for _, event := range testCase.addedEvents {
-			w.nonBlockingAdd(event)
+			w.nonBlockingAdd("", event)
 		}
 		ch := w.ResultChan()
 		for j, expectedEvent := range testCase.expected {
@@ -165,8 +178,78 @@ func TestEvents(t *testing.T) {
 	}
 }
 
+func TestProcessInitEventsCanceled(t *testing.T) {
+	initEvents := make([]storage.InternalEvent, 10000)
+	for i := range initEvents {
+		initEvents[i] = &simpleInternalEvent{
+			Type:   watch.Added,
+			Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+		}
+	}
+	chanSize := 10
+	received := 20
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newStoreWatcher(chanSize, chanSize, &storage.Selectors{}, func() {}, newPod)
+	go w.process(ctx, initEvents, 0)
+	defer w.Stop()
+	for i := 0; i < received; i++ {
+		<-w.ResultChan()
+	}
+	// Wait for process to fill the result channel and block.
+	for len(w.ResultChan()) < chanSize {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	// process should return without trying to send the whole initial set, even if it's blocked on the full
+	// result channel.
+	select {
+	case <-w.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("process didn't return after the context was canceled")
+	}
+	excess := 0
+	for range w.ResultChan() {
+		excess++
+	}
+	if excess > chanSize {
+		t.Errorf("Expected at most %d events after the context was canceled, got %d", chanSize, excess)
+	}
+}
+
+func TestProcessSortsInitEvents(t *testing.T) {
+	versions := []uint64{5, 2, 9, 2, 1, 7}
+	initEvents := make([]storage.InternalEvent, len(versions))
+	for i, version := range versions {
+		initEvents[i] = &simpleInternalEvent{
+			Type:            watch.Added,
+			Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+			ResourceVersion: version,
+		}
+	}
+	// Events having the same resourceVersion keep their order.
+	expectedNames := []string{"pod4", "pod1", "pod3", "pod0", "pod5", "pod2"}
+
+	w := newStoreWatcher(10, 10, &storage.Selectors{}, nil, newPod)
+	go w.process(context.Background(), initEvents, 9)
+	defer w.Stop()
+	// A live event must follow all initEvents.
+	w.nonBlockingAdd("", &simpleInternalEvent{
+		Type:            watch.Added,
+		Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod6"}},
+		ResourceVersion: 10,
+	})
+	for _, expectedName := range append(expectedNames, "pod6") {
+		event := <-w.ResultChan()
+		if name := event.Object.(*v1.Pod).Name; name != expectedName {
+			t.Errorf("Unexpected event order, got %s, expected %s", name, expectedName)
+		}
+	}
+}
+
 func TestAddTimeout(t *testing.T) {
-	w := newStoreWatcher(1, &storage.Selectors{}, func() {})
+	w := newStoreWatcher(1, 1, &storage.Selectors{}, func() {}, newPod)
 	events := []storage.InternalEvent{
 		&simpleInternalEvent{
 			Type:            watch.Added,
@@ -180,12 +263,1055 @@ func TestAddTimeout(t *testing.T) {
 		},
 	}
 	timer := time.NewTimer(watcherAddTimeout)
-	if !w.add(events[0], timer) {
+	if !w.add("", events[0], timer) {
 		t.Error("add() failed, expected success")
 	}
 	// Since channel size is 1 and there's no consumer, the second add should fail.
 	timer = time.NewTimer(watcherAddTimeout)
-	if w.add(events[1], timer) {
+	if w.add("", events[1], timer) {
 		t.Error("add() succeeded, expected failure")
 	}
 }
+
+// panicInternalEvent panics when converting to watch.Event, represents a malformed object.
+type panicInternalEvent struct {
+	ResourceVersion uint64
+}
+
+func (e *panicInternalEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	panic("malformed object")
+}
+
+func (e *panicInternalEvent) GetResourceVersion() uint64 {
+	return e.ResourceVersion
+}
+
+func TestConversionPanic(t *testing.T) {
+	selectors := &storage.Selectors{Transform: func(obj runtime.Object) runtime.Object {
+		if obj.(*v1.Pod).Name == "bad" {
+			panic("buggy transform")
+		}
+		return obj
+	}}
+	w := newStoreWatcher(10, 10, selectors, func() {}, newPod)
+	w.resource = "Pod"
+	errorsBefore := testutil.ToFloat64(watcherConversionErrors.WithLabelValues("Pod"))
+	go w.process(context.Background(), nil, 0)
+	defer w.Stop()
+
+	w.nonBlockingAdd("", &simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}, ResourceVersion: 1})
+	w.nonBlockingAdd("", &simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bad"}}, ResourceVersion: 2})
+	w.nonBlockingAdd("", &panicInternalEvent{ResourceVersion: 3})
+	w.nonBlockingAdd("", &simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}}, ResourceVersion: 4})
+
+	// The events that can't be converted are skipped, the watcher keeps running.
+	for _, expected := range []string{"pod1", "pod2"} {
+		select {
+		case event := <-w.ResultChan():
+			if name := event.Object.(*v1.Pod).Name; name != expected {
+				t.Errorf("Expected event of %s, got %s", expected, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event of %s", expected)
+		}
+	}
+	if count := testutil.ToFloat64(watcherConversionErrors.WithLabelValues("Pod")) - errorsBefore; count != 2 {
+		t.Errorf("Expected 2 conversion errors, got %v", count)
+	}
+}
+
+func TestProcessOutOfOrderEvent(t *testing.T) {
+	w := newStoreWatcher(10, 10, &storage.Selectors{}, func() {}, newPod)
+	w.resource = "Pod"
+	outOfOrderBefore := testutil.ToFloat64(watchEventsOutOfOrder.WithLabelValues("Pod"))
+	go w.process(context.Background(), nil, 0)
+	defer w.Stop()
+
+	for i, resourceVersion := range []uint64{1, 3, 2, 4} {
+		w.nonBlockingAdd("", &simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}}, ResourceVersion: resourceVersion})
+	}
+
+	// The event older than a dispatched one is skipped and counted.
+	for _, expected := range []string{"pod0", "pod1", "pod3"} {
+		select {
+		case event := <-w.ResultChan():
+			if name := event.Object.(*v1.Pod).Name; name != expected {
+				t.Errorf("Expected event of %s, got %s", expected, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event of %s", expected)
+		}
+	}
+	if count := testutil.ToFloat64(watchEventsOutOfOrder.WithLabelValues("Pod")) - outOfOrderBefore; count != 1 {
+		t.Errorf("Expected 1 out-of-order event, got %v", count)
+	}
+}
+
+func TestBookmark(t *testing.T) {
+	w := newStoreWatcher(10, 10, &storage.Selectors{AllowWatchBookmarks: true}, func() {}, newPod)
+	w.bookmarkInterval = 10 * time.Millisecond
+	go w.process(context.Background(), nil, 1)
+	defer w.Stop()
+
+	w.nonBlockingAdd("", &simpleInternalEvent{
+		Type:            watch.Added,
+		Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}},
+		ResourceVersion: 2,
+	})
+	// The watcher is not interested in the event but should still record its version.
+	w.nonBlockingAdd("", &emptyInternalEvent{ResourceVersion: 3})
+
+	ch := w.ResultChan()
+	expectedEvents := []watch.Event{
+		{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}},
+		{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "3"}}},
+		{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "3"}}},
+	}
+	for i, expectedEvent := range expectedEvents {
+		select {
+		case actualEvent := <-ch:
+			if !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("Unexpected event %d: %#v", i, actualEvent)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+}
+
+func TestBookmarkCompactionWarning(t *testing.T) {
+	w := newStoreWatcher(10, 10, &storage.Selectors{AllowWatchBookmarks: true, SendInitialEvents: true}, func() {}, newPod)
+	w.bookmarkInterval = 10 * time.Millisecond
+	// Events after resourceVersion 1 are running out of history, the ones after 2 are not.
+	w.compactionWarning = func(resourceVersion uint64) (int, bool) {
+		if resourceVersion < 2 {
+			return 1, true
+		}
+		return 10, false
+	}
+	go w.process(context.Background(), nil, 1)
+	defer w.Stop()
+
+	ch := w.ResultChan()
+	expectedEvents := []watch.Event{
+		{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1", Annotations: map[string]string{
+			storage.InitialEventsAnnotationKey:     "true",
+			storage.CompactionWarningAnnotationKey: "1",
+		}}}},
+		{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1", Annotations: map[string]string{
+			storage.CompactionWarningAnnotationKey: "1",
+		}}}},
+	}
+	for i, expectedEvent := range expectedEvents {
+		select {
+		case actualEvent := <-ch:
+			if !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("Unexpected event %d: %#v", i, actualEvent)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+
+	w.nonBlockingAdd("", &emptyInternalEvent{ResourceVersion: 2})
+	expectedEvent := watch.Event{Type: watch.Bookmark, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}}}
+	for {
+		select {
+		case actualEvent := <-ch:
+			if actualEvent.Object.(*v1.Pod).ResourceVersion == "1" {
+				// A Bookmark may have been sent before the event was added.
+				continue
+			}
+			if !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("Unexpected event: %#v", actualEvent)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for event")
+		}
+		return
+	}
+}
+
+func TestBookmarkIntervalJitter(t *testing.T) {
+	interval := time.Minute
+	maxInterval := time.Duration(float64(interval) * (1 + bookmarkJitterFactor))
+	// Spread the jittered intervals of watchers into 10 buckets across the window, none of them
+	// should be empty or hold most of the watchers.
+	buckets := make([]int, 10)
+	bucketSize := (maxInterval - interval) / time.Duration(len(buckets))
+	watchers := 5000
+	for i := 0; i < watchers; i++ {
+		w := newStoreWatcher(1, 1, &storage.Selectors{AllowWatchBookmarks: true}, nil, newPod)
+		w.bookmarkInterval = interval
+		d := w.nextBookmarkInterval()
+		if d < interval || d >= maxInterval {
+			t.Fatalf("Jittered interval %v out of bounds [%v, %v)", d, interval, maxInterval)
+		}
+		buckets[(d-interval)/bucketSize]++
+	}
+	for i, n := range buckets {
+		// Each bucket is expected to hold watchers/10 watchers, allow a generous deviation.
+		if n < watchers/20 || n > watchers/5 {
+			t.Errorf("Bucket %d holds %d of %d watchers, jitter is not spread evenly: %v", i, n, watchers, buckets)
+		}
+	}
+}
+
+func TestNoBookmarkIfNotAllowed(t *testing.T) {
+	w := newStoreWatcher(10, 10, &storage.Selectors{}, func() {}, newPod)
+	w.bookmarkInterval = 10 * time.Millisecond
+	go w.process(context.Background(), nil, 0)
+	defer w.Stop()
+
+	select {
+	case event := <-w.ResultChan():
+		t.Errorf("Unexpected event: %#v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStopWithDrain(t *testing.T) {
+	w := newStoreWatcher(10, 10, &storage.Selectors{}, func() {}, newPod)
+	go w.process(context.Background(), nil, 0)
+	var expected []watch.Event
+	for i := 1; i <= 5; i++ {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}}
+		w.nonBlockingAdd("", &simpleInternalEvent{Type: watch.Added, Object: pod, ResourceVersion: uint64(i)})
+		expected = append(expected, watch.Event{Type: watch.Added, Object: pod})
+	}
+	w.StopWithDrain(time.Second)
+	// Calling StopWithDrain again should be no-op.
+	w.StopWithDrain(0)
+
+	var actual []watch.Event
+	for event := range w.ResultChan() {
+		actual = append(actual, event)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected events: %v", actual)
+	}
+}
+
+func TestStopWithDrainTimeout(t *testing.T) {
+	w := newStoreWatcher(1, 1, &storage.Selectors{}, func() {}, newPod)
+	go w.process(context.Background(), nil, 0)
+	for i := 1; i <= 3; i++ {
+		w.add("", &simpleInternalEvent{
+			Type:            watch.Added,
+			Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+			ResourceVersion: uint64(i),
+		}, time.NewTimer(watcherAddTimeout))
+	}
+	// The client never reads, the watcher should give up draining after the timeout.
+	w.StopWithDrain(10 * time.Millisecond)
+
+	select {
+	case <-w.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("process didn't return after draining timed out")
+	}
+	select {
+	case <-w.done:
+	default:
+		t.Error("done channel was not closed")
+	}
+}
+
+func TestStopAbortsDrain(t *testing.T) {
+	w := newStoreWatcher(1, 1, &storage.Selectors{}, func() {}, newPod)
+	go w.process(context.Background(), nil, 0)
+	for i := 1; i <= 3; i++ {
+		w.add("", &simpleInternalEvent{
+			Type:            watch.Added,
+			Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+			ResourceVersion: uint64(i),
+		}, time.NewTimer(watcherAddTimeout))
+	}
+	// The client never reads and gives up before the drain times out.
+	w.StopWithDrain(time.Hour)
+	select {
+	case <-w.done:
+		t.Fatal("done channel was closed before the drain ended")
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.Stop()
+
+	select {
+	case <-w.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("process didn't return after the watcher was stopped while draining")
+	}
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		t.Error("done channel was not closed after the watcher was stopped while draining")
+	}
+}
+
+func TestBackpressurePolicy(t *testing.T) {
+	events := []storage.InternalEvent{
+		&emptyInternalEvent{ResourceVersion: 1},
+		&emptyInternalEvent{ResourceVersion: 2},
+		&emptyInternalEvent{ResourceVersion: 3},
+	}
+	testCases := map[string]struct {
+		policy storage.BackpressurePolicy
+		// The results of adding each event.
+		expectedAdded []bool
+		// The events expected to be buffered in channel input.
+		expectedBuffered []storage.InternalEvent
+		// Whether the watcher is expected to have to resync.
+		expectedResyncRequired bool
+	}{
+		"block-until-timeout": {
+			policy:           storage.BlockUntilTimeout,
+			expectedAdded:    []bool{true, true, false},
+			expectedBuffered: []storage.InternalEvent{events[0], events[1]},
+		},
+		"drop-oldest": {
+			policy:                 storage.DropOldest,
+			expectedAdded:          []bool{true, true, false},
+			expectedBuffered:       []storage.InternalEvent{events[0], events[1]},
+			expectedResyncRequired: true,
+		},
+		"drop-newest": {
+			policy:                 storage.DropNewest,
+			expectedAdded:          []bool{true, true, false},
+			expectedBuffered:       []storage.InternalEvent{events[0], events[1]},
+			expectedResyncRequired: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// process is not running so that the events stay in channel input.
+			w := newStoreWatcher(2, 2, &storage.Selectors{BackpressurePolicy: tc.policy}, func() {}, newPod)
+			for i, event := range events {
+				if added := w.nonBlockingAdd("", event); added != tc.expectedAdded[i] {
+					t.Errorf("Expected nonBlockingAdd to return %t for event %d, got %t", tc.expectedAdded[i], i, added)
+				}
+			}
+			if w.resyncRequired != tc.expectedResyncRequired {
+				t.Errorf("Expected resyncRequired to be %t, got %t", tc.expectedResyncRequired, w.resyncRequired)
+			}
+			w.Stop()
+			var buffered []storage.InternalEvent
+			for event := range w.input {
+				buffered = append(buffered, event)
+			}
+			if !reflect.DeepEqual(buffered, tc.expectedBuffered) {
+				t.Errorf("Unexpected buffered events: %v", buffered)
+			}
+		})
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	forgotten := false
+	w := newStoreWatcher(1, 1, &storage.Selectors{}, func() { forgotten = true }, newPod)
+	w.sendTimeout = 10 * time.Millisecond
+	go w.process(context.Background(), nil, 0)
+	// The first event fills channel result, the second one can't be sent as the client never reads.
+	for i := 1; i <= 2; i++ {
+		w.add("", &simpleInternalEvent{
+			Type:            watch.Added,
+			Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+			ResourceVersion: uint64(i),
+		}, time.NewTimer(watcherAddTimeout))
+	}
+
+	select {
+	case <-w.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("process didn't return after sending timed out")
+	}
+	select {
+	case <-w.done:
+	default:
+		t.Error("done channel was not closed")
+	}
+	if !forgotten {
+		t.Error("Watcher was not forgotten")
+	}
+}
+
+func TestResizeInput(t *testing.T) {
+	w := newStoreWatcher(2, 2, &storage.Selectors{}, func() {}, nil)
+	go w.process(context.Background(), nil, 0)
+	newEvent := func(i int) storage.InternalEvent {
+		return &simpleInternalEvent{
+			Type:            watch.Added,
+			Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+			ResourceVersion: uint64(i),
+		}
+	}
+
+	// Fill the initial channel, then resize it, events buffered in both channels must be received in order.
+	w.input <- newEvent(1)
+	w.input <- newEvent(2)
+	for !w.resizeInput(4) {
+		// process has not taken over the initial channel yet.
+		time.Sleep(time.Millisecond)
+	}
+	if cap(w.input) != 4 {
+		t.Errorf("Unexpected buffer size after resizing: %d", cap(w.input))
+	}
+	w.input <- newEvent(3)
+
+	ch := w.ResultChan()
+	for i := 1; i <= 3; i++ {
+		expectedEvent := watch.Event{Type: watch.Added, Object: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}}}
+		select {
+		case actualEvent := <-ch:
+			if !reflect.DeepEqual(actualEvent, expectedEvent) {
+				t.Errorf("Unexpected event %d, got %#v, expected %#v", i, actualEvent, expectedEvent)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+	w.Stop()
+	if _, ok := <-ch; ok {
+		t.Error("Result channel was not closed after the watcher was stopped")
+	}
+}
+
+func TestSampleFill(t *testing.T) {
+	testCases := []struct {
+		name         string
+		size         int
+		buffered     int
+		expectedSize int
+	}{
+		{"grow under pressure", 10, 9, 15},
+		{"grow up to the maximum", 18, 17, 20},
+		{"keep at the maximum", 20, 20, 0},
+		{"keep when moderately used", 10, 5, 0},
+		{"shrink when idle", 20, 0, 15},
+		{"shrink down to the minimum", 12, 0, 10},
+		{"keep at the minimum", 10, 0, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newStoreWatcher(tc.size, tc.size, &storage.Selectors{}, func() {}, nil)
+			for i := 0; i < tc.buffered; i++ {
+				w.input <- &emptyInternalEvent{}
+			}
+			for i := 0; i < 3; i++ {
+				if size := w.sampleFill(4, 10, 20, 5); size != 0 {
+					t.Errorf("Unexpected size %d before the window is complete", size)
+				}
+			}
+			if size := w.sampleFill(4, 10, 20, 5); size != tc.expectedSize {
+				t.Errorf("Unexpected size, got %d, expected %d", size, tc.expectedSize)
+			}
+		})
+	}
+}
+
+func TestStopWithNilForget(t *testing.T) {
+	for name, stop := range map[string]func(w *storeWatcher){
+		"Stop":          func(w *storeWatcher) { w.Stop() },
+		"StopWithDrain": func(w *storeWatcher) { w.StopWithDrain(time.Second) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := newStoreWatcher(10, 10, &storage.Selectors{}, nil, nil)
+			go w.process(context.Background(), nil, 0)
+			stop(w)
+
+			select {
+			case <-w.stopped:
+			case <-time.After(time.Second):
+				t.Fatal("process didn't return after the watcher was stopped")
+			}
+			select {
+			case <-w.done:
+			case <-time.After(time.Second):
+				t.Error("done was not closed after the watcher was stopped")
+			}
+			if _, ok := <-w.input; ok {
+				t.Error("input was not closed after the watcher was stopped")
+			}
+		})
+	}
+}
+
+func TestWaitStopped(t *testing.T) {
+	for name, stop := range map[string]func(w *storeWatcher){
+		"Stop":          func(w *storeWatcher) { w.Stop() },
+		"StopWithDrain": func(w *storeWatcher) { w.StopWithDrain(100 * time.Millisecond) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			s.SetWatcherChanSizes(1, 1)
+			watcher, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+			if err != nil {
+				t.Fatalf("Failed to watch: %v", err)
+			}
+			w := watcher.(storage.WaitableWatcher)
+			// The client doesn't receive events, so process is blocked sending to the full result channel.
+			for i := 0; i < 2; i++ {
+				s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+			}
+			if w.WaitStopped(50 * time.Millisecond) {
+				t.Fatal("WaitStopped returned true before the watcher was stopped")
+			}
+
+			stop(watcher.(*storeWatcher))
+			if !w.WaitStopped(time.Second) {
+				t.Fatal("process didn't return after the watcher was stopped")
+			}
+			for range w.ResultChan() {
+			}
+			if n := s.CountWatchers(); n != 0 {
+				t.Errorf("Expected no watcher left in the store, got %d", n)
+			}
+		})
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	watcher, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer watcher.Stop()
+	w := watcher.(storage.PausableWatcher)
+
+	w.Pause()
+	w.Pause()
+	for i := 0; i < 5; i++ {
+		s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	select {
+	case event := <-w.ResultChan():
+		t.Fatalf("Unexpected event %v while the watcher is paused", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The events buffered while paused are sent in order once resumed, followed by the live events.
+	w.Resume()
+	w.Resume()
+	s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod5"}})
+	for i := 0; i < 6; i++ {
+		select {
+		case event := <-w.ResultChan():
+			if name := event.Object.(*v1.Pod).Name; name != fmt.Sprintf("pod%d", i) {
+				t.Errorf("Unexpected event %d, got %s", i, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %d", i)
+		}
+	}
+}
+
+func TestPauseBufferLimit(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	s.SetWatcherChanSizes(2, 1)
+	watcher, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), BackpressurePolicy: storage.DropNewest})
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer watcher.Stop()
+	w := watcher.(storage.PausableWatcher)
+
+	w.Pause()
+	for i := 0; i < 10; i++ {
+		s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%02d", i)}})
+	}
+	time.Sleep(50 * time.Millisecond)
+	w.Resume()
+
+	// At most one event held by process and the ones in the full buffer are delivered, the watcher is then
+	// terminated as it couldn't keep the newer ones.
+	var names []string
+	for event := range w.ResultChan() {
+		if event.Type == watch.Error {
+			continue
+		}
+		names = append(names, event.Object.(*v1.Pod).Name)
+	}
+	if len(names) > 3 {
+		t.Errorf("Expected at most 3 events kept while paused, got %v", names)
+	}
+	for i, name := range names {
+		if expected := fmt.Sprintf("pod%02d", i); name != expected {
+			t.Errorf("Expected event %d to be of %s, got %v", i, expected, names)
+		}
+	}
+	if err := watcher.(storage.ErrWatcher).Err(); err != storage.ErrWatcherResyncRequired {
+		t.Errorf("Expected the watcher to fail with %v, got %v", storage.ErrWatcherResyncRequired, err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+		Status:     v1.PodStatus{PodIP: "1.1.1.1"},
+	}
+	stripStatus := func(obj runtime.Object) runtime.Object {
+		projected := obj.(*v1.Pod).DeepCopy()
+		projected.Status = v1.PodStatus{}
+		return projected
+	}
+	testCases := []struct {
+		name      string
+		transform func(runtime.Object) runtime.Object
+		expected  watch.Event
+	}{
+		{
+			name:     "nil transform",
+			expected: watch.Event{Type: watch.Added, Object: pod},
+		},
+		{
+			name:      "strip status",
+			transform: stripStatus,
+			expected: watch.Event{Type: watch.Added, Object: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod1"},
+				Spec:       v1.PodSpec{NodeName: "node1"},
+			}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newStoreWatcher(10, 10, &storage.Selectors{Transform: tc.transform}, nil, newPod)
+			go w.process(context.Background(), []storage.InternalEvent{&simpleInternalEvent{Type: watch.Added, Object: pod}}, 0)
+			defer w.Stop()
+			if actual := <-w.ResultChan(); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Unexpected event, got %#v, expected %#v", actual, tc.expected)
+			}
+			// The stored object must not be changed by the transform.
+			if pod.Status.PodIP != "1.1.1.1" {
+				t.Errorf("The original object was modified by the transform")
+			}
+		})
+	}
+}
+
+func TestWatcherErr(t *testing.T) {
+	expiredStatus := errors.NewResourceExpired("too old resource version: 1 (5)").Status()
+	testCases := []struct {
+		name        string
+		sendTimeout time.Duration
+		terminate   func(w *storeWatcher, cancel context.CancelFunc)
+		expected    error
+	}{
+		{
+			name: "context canceled",
+			terminate: func(w *storeWatcher, cancel context.CancelFunc) {
+				cancel()
+			},
+			expected: context.Canceled,
+		},
+		{
+			name: "stopped",
+			terminate: func(w *storeWatcher, cancel context.CancelFunc) {
+				w.Stop()
+				// Canceling the context after stopping doesn't change the cause.
+				cancel()
+			},
+			expected: storage.ErrWatcherStopped,
+		},
+		{
+			name: "stopped with drain",
+			terminate: func(w *storeWatcher, cancel context.CancelFunc) {
+				w.StopWithDrain(time.Second)
+			},
+			expected: storage.ErrWatcherStopped,
+		},
+		{
+			name:        "send timeout",
+			sendTimeout: 10 * time.Millisecond,
+			terminate: func(w *storeWatcher, cancel context.CancelFunc) {
+				// The result channel can't take the last event as there's no consumer.
+				for i := 0; i <= cap(w.result); i++ {
+					w.input <- &simpleInternalEvent{
+						Type:            watch.Added,
+						Object:          &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}},
+						ResourceVersion: uint64(i + 1),
+					}
+				}
+			},
+			expected: storage.ErrWatcherTooSlow,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := newStoreWatcher(10, 10, &storage.Selectors{}, nil, newPod)
+			w.sendTimeout = tc.sendTimeout
+			if err := w.Err(); err != nil {
+				t.Errorf("Expected no error for a running watcher, got %v", err)
+			}
+			go w.process(ctx, nil, 0)
+			tc.terminate(w, cancel)
+			// The cause is available once process has returned.
+			<-w.stopped
+			if err := w.Err(); err != tc.expected {
+				t.Errorf("Unexpected error, got %v, expected %v", err, tc.expected)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		w := newStoreWatcher(10, 10, &storage.Selectors{}, nil, newPod)
+		go w.processExpired(&expiredStatus)
+		<-w.ResultChan()
+		<-w.stopped
+		if err := w.Err(); !errors.IsResourceExpired(err) {
+			t.Errorf("Expected ResourceExpired error, got %v", err)
+		}
+	})
+}
+
+func TestCoalesceModifications(t *testing.T) {
+	pod := func(name string, version int) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"version": fmt.Sprint(version)}}}
+	}
+	var events []storage.InternalEvent
+	addEvent := func(eventType watch.EventType, obj *v1.Pod) {
+		events = append(events, &simpleInternalEvent{Type: eventType, Object: obj, ResourceVersion: uint64(len(events) + 1)})
+	}
+	addEvent(watch.Added, pod("pod1", 0))
+	// Rapid updates of pod1 are coalesced into the first one.
+	for i := 1; i <= 10; i++ {
+		addEvent(watch.Modified, pod("pod1", i))
+	}
+	addEvent(watch.Added, pod("pod2", 0))
+	addEvent(watch.Modified, pod("pod2", 1))
+	// The Delete event is never coalesced, and the updates after it can't be coalesced into the ones before it.
+	addEvent(watch.Deleted, pod("pod1", 10))
+	addEvent(watch.Added, pod("pod1", 0))
+	addEvent(watch.Modified, pod("pod1", 1))
+	addEvent(watch.Modified, pod("pod2", 2))
+	addEvent(watch.Modified, pod("pod1", 2))
+
+	testCases := map[string]struct {
+		coalesce bool
+		expected []watch.Event
+	}{
+		"coalesce": {
+			coalesce: true,
+			expected: []watch.Event{
+				{Type: watch.Added, Object: pod("pod1", 0)},
+				{Type: watch.Modified, Object: pod("pod1", 10)},
+				{Type: watch.Added, Object: pod("pod2", 0)},
+				{Type: watch.Modified, Object: pod("pod2", 2)},
+				{Type: watch.Deleted, Object: pod("pod1", 10)},
+				{Type: watch.Added, Object: pod("pod1", 0)},
+				{Type: watch.Modified, Object: pod("pod1", 2)},
+			},
+		},
+		"no-coalesce": {
+			coalesce: false,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// process is not running so that the events stay in channel input.
+			w := newStoreWatcher(len(events), len(events), &storage.Selectors{CoalesceModifications: tc.coalesce}, func() {}, newPod)
+			for i, event := range events {
+				if !w.nonBlockingAdd(event.(*simpleInternalEvent).Object.(*v1.Pod).Name, event) {
+					t.Fatalf("Failed to add event %d", i)
+				}
+			}
+			expected := tc.expected
+			if !tc.coalesce {
+				for _, event := range events {
+					expected = append(expected, *event.ToWatchEvent(w.selectors))
+				}
+			}
+			if len(w.input) != len(expected) {
+				t.Errorf("Expected %d buffered events, got %d", len(expected), len(w.input))
+			}
+
+			go w.process(context.Background(), nil, 0)
+			defer w.Stop()
+			for i, expectedEvent := range expected {
+				if actualEvent := <-w.ResultChan(); !reflect.DeepEqual(actualEvent, expectedEvent) {
+					t.Errorf("Unexpected event %d, got %v, expected %v", i, actualEvent, expectedEvent)
+				}
+			}
+
+			// A Modified event taken by process can't be replaced anymore.
+			modified := &simpleInternalEvent{Type: watch.Modified, Object: pod("pod2", 3), ResourceVersion: uint64(len(events) + 1)}
+			if !w.nonBlockingAdd("pod2", modified) {
+				t.Fatal("Failed to add event")
+			}
+			if actualEvent := <-w.ResultChan(); !reflect.DeepEqual(actualEvent, *modified.ToWatchEvent(w.selectors)) {
+				t.Errorf("Unexpected event, got %v", actualEvent)
+			}
+		})
+	}
+}
+
+// countingInternalEvent counts its conversions.
+type countingInternalEvent struct {
+	simpleInternalEvent
+	conversions *int
+}
+
+func (e *countingInternalEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	*e.conversions++
+	return e.simpleInternalEvent.ToWatchEvent(selectors)
+}
+
+// untypedInternalEvent can't tell its type without being converted.
+type untypedInternalEvent struct {
+	event *simpleInternalEvent
+}
+
+func (e *untypedInternalEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	return e.event.ToWatchEvent(selectors)
+}
+
+func (e *untypedInternalEvent) GetResourceVersion() uint64 {
+	return e.event.GetResourceVersion()
+}
+
+func TestCoalesceModificationsWithoutConversion(t *testing.T) {
+	var conversions int
+	// process is not running so that the events stay in channel input.
+	w := newStoreWatcher(10, 10, &storage.Selectors{CoalesceModifications: true}, func() {}, newPod)
+	for i := 1; i <= 3; i++ {
+		event := &countingInternalEvent{simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}, ResourceVersion: uint64(i)}, &conversions}
+		if !w.nonBlockingAdd("pod1", event) {
+			t.Fatalf("Failed to add event %d", i)
+		}
+	}
+	if len(w.input) != 1 {
+		t.Errorf("Expected the Modified events to be coalesced, got %d buffered events", len(w.input))
+	}
+	if conversions != 0 {
+		t.Errorf("Expected no conversion on the dispatching path, got %d", conversions)
+	}
+
+	// Events that can't tell their type are never coalesced.
+	for i := 4; i <= 5; i++ {
+		event := &untypedInternalEvent{&simpleInternalEvent{Type: watch.Modified, Object: &v1.Pod{}, ResourceVersion: uint64(i)}}
+		if !w.nonBlockingAdd("pod1", event) {
+			t.Fatalf("Failed to add event %d", i)
+		}
+	}
+	if len(w.input) != 3 {
+		t.Errorf("Expected the events that can't tell their type not to be coalesced, got %d buffered events", len(w.input))
+	}
+}
+
+func TestCoalesceModificationsIncludePreviousObject(t *testing.T) {
+	pod := func(version int) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Labels: map[string]string{"version": fmt.Sprint(version)}}}
+	}
+	// process is not running so that the events stay in channel input and get coalesced.
+	w := newStoreWatcher(10, 10, &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), CoalesceModifications: true, IncludePreviousObject: true}, func() {}, newPod)
+	for i := 1; i <= 3; i++ {
+		event, err := testGenEvent("pod1", pod(i-1), pod(i), uint64(i))
+		if err != nil {
+			t.Fatalf("Failed to generate event: %v", err)
+		}
+		if !w.nonBlockingAdd("pod1", event) {
+			t.Fatalf("Failed to add event %d", i)
+		}
+	}
+	if len(w.input) != 1 {
+		t.Fatalf("Expected the Modified events to be coalesced, got %d buffered events", len(w.input))
+	}
+
+	go w.process(context.Background(), nil, 0)
+	defer w.Stop()
+	// The coalesced event carries the version preceding all the modifications.
+	expected := watch.Event{Type: watch.Modified, Object: &storage.ObjectUpdate{Object: pod(3), PrevObject: pod(0)}}
+	if actual := <-w.ResultChan(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected event, got %v, expected %v", actual, expected)
+	}
+}
+
+func TestAsymmetricChanSizes(t *testing.T) {
+	w := newStoreWatcher(2, 5, &storage.Selectors{}, func() {}, newPod)
+	if cap(w.input) != 2 || cap(w.result) != 5 {
+		t.Fatalf("Expected input size 2 and result size 5, got %d and %d", cap(w.input), cap(w.result))
+	}
+
+	// The client receives no events, process moves them from channel input to channel result until it's full,
+	// then holds one more while it's blocked.
+	go w.process(context.Background(), nil, 0)
+	defer w.Stop()
+	for i := 1; i <= 8; i++ {
+		select {
+		case w.input <- &simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{}, ResourceVersion: uint64(i)}:
+		case <-time.After(time.Second):
+			t.Fatalf("Failed to add event %d", i)
+		}
+	}
+	if w.nonBlockingAdd("", &simpleInternalEvent{Type: watch.Added, Object: &v1.Pod{}, ResourceVersion: 9}) {
+		t.Error("Expected channel input to be full")
+	}
+	if len(w.result) != 5 {
+		t.Errorf("Expected 5 events buffered in channel result, got %d", len(w.result))
+	}
+}
+
+// receiveUnbatched receives n events from the watcher, unbatching the Batched ones, and returns them with the sizes
+// of the received events.
+func receiveUnbatched(t testing.TB, w watch.Interface, n int) ([]watch.Event, []int) {
+	var events []watch.Event
+	var sizes []int
+	for len(events) < n {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				t.Fatalf("Result channel closed after %d events", len(events))
+			}
+			unbatched := storage.Unbatch(event)
+			events = append(events, unbatched...)
+			sizes = append(sizes, len(unbatched))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for event %d", len(events))
+		}
+	}
+	return events, sizes
+}
+
+func TestBatchEventsOrdering(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	watcher, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), MaxBatchSize: 3})
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer watcher.Stop()
+	w := watcher.(storage.PausableWatcher)
+
+	// Pausing the watcher lets the events pile up so that they are batched.
+	w.Pause()
+	pod := func(i, version int) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), Labels: map[string]string{"version": fmt.Sprint(version)}}}
+	}
+	var expected []watch.Event
+	for version := 0; version < 4; version++ {
+		for i := 0; i < 3; i++ {
+			if version == 0 {
+				s.Create(pod(i, version))
+				expected = append(expected, watch.Event{Type: watch.Added, Object: pod(i, version)})
+			} else {
+				s.Update(pod(i, version))
+				expected = append(expected, watch.Event{Type: watch.Modified, Object: pod(i, version)})
+			}
+		}
+	}
+	s.Delete("pod1")
+	expected = append(expected, watch.Event{Type: watch.Deleted, Object: pod(1, 3)})
+	w.Resume()
+
+	events, sizes := receiveUnbatched(t, w, len(expected))
+	if !reflect.DeepEqual(expected, events) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+	batched := false
+	for _, size := range sizes {
+		if size > 3 {
+			t.Errorf("Expected batches of at most 3 events, got %d", size)
+		}
+		batched = batched || size > 1
+	}
+	if !batched {
+		t.Errorf("Expected events to be batched, got batches of sizes %v", sizes)
+	}
+}
+
+func TestBatchEventsBeforeBookmark(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	for i := 0; i < 5; i++ {
+		s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}})
+	}
+	w, err := s.Watch(context.Background(), "", &storage.Selectors{
+		Label:               labels.Everything(),
+		Field:               fields.Everything(),
+		AllowWatchBookmarks: true,
+		SendInitialEvents:   true,
+		MaxBatchSize:        2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer w.Stop()
+
+	// The initial events are batched up to the size, the rest is sent before the Bookmark event marking their end.
+	expectedSizes := []int{2, 2, 1}
+	events, sizes := receiveUnbatched(t, w, 5)
+	if !reflect.DeepEqual(expectedSizes, sizes) {
+		t.Errorf("Expected batches of sizes %v, got %v", expectedSizes, sizes)
+	}
+	// The order of the initial events is unspecified.
+	names := sets.NewString()
+	for _, event := range events {
+		if event.Type != watch.Added {
+			t.Errorf("Expected Added event, got %s", event.Type)
+		}
+		names.Insert(event.Object.(*v1.Pod).Name)
+	}
+	if expectedNames := sets.NewString("pod0", "pod1", "pod2", "pod3", "pod4"); !expectedNames.Equal(names) {
+		t.Errorf("Expected events of %v, got %v", expectedNames.List(), names.List())
+	}
+	event := <-w.ResultChan()
+	if event.Type != watch.Bookmark {
+		t.Errorf("Expected Bookmark event, got %s", event.Type)
+	}
+}
+
+func TestBatchEventsWindow(t *testing.T) {
+	s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+	w, err := s.Watch(context.Background(), "", &storage.Selectors{
+		Label:        labels.Everything(),
+		Field:        fields.Everything(),
+		MaxBatchSize: 10,
+		BatchWindow:  500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer w.Stop()
+
+	// The events arriving within the window are sent together once it has elapsed.
+	start := time.Now()
+	s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod0"}})
+	time.Sleep(10 * time.Millisecond)
+	s.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	_, sizes := receiveUnbatched(t, w, 2)
+	if !reflect.DeepEqual([]int{2}, sizes) {
+		t.Errorf("Expected a single batch of 2 events, got batches of sizes %v", sizes)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected the batch to be sent after the window, got it after %v", elapsed)
+	}
+}
+
+func BenchmarkWatchBatching(b *testing.B) {
+	const eventsPerIteration = 1000
+	for _, batchSize := range []int{0, 16, 128} {
+		b.Run(fmt.Sprintf("batch-%d", batchSize), func(b *testing.B) {
+			s := NewStore("Pod", cache.MetaNamespaceKeyFunc, cache.Indexers{}, testGenEvent, newPod)
+			w, err := s.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), MaxBatchSize: batchSize})
+			if err != nil {
+				b.Fatalf("Failed to watch: %v", err)
+			}
+			defer w.Stop()
+			pods := make([]*v1.Pod, eventsPerIteration)
+			for i := range pods {
+				pods[i] = &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i)}}
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for _, pod := range pods {
+					s.Create(pod)
+				}
+				for _, pod := range pods {
+					s.Delete(pod.Name)
+				}
+				receiveUnbatched(b, w, 2*eventsPerIteration)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// DecodedEvent is a watch event whose object has been unbatched and unwrapped from KindedObject and ObjectUpdate.
+// Object is guaranteed to be of one of the types expected by the TypedWatcher that decoded it.
+type DecodedEvent struct {
+	Type watch.EventType
+	// Kind is the kind of Object if the event comes from a watch monitoring multiple kinds of objects.
+	Kind   string
+	Object runtime.Object
+	// PrevObject is the whole object before the update if the watcher requested IncludePreviousObject.
+	PrevObject runtime.Object
+}
+
+// TypedSink receives the events decoded by a TypedWatcher, typically to deliver them on a channel of a specific
+// type, so that its consumers don't have to type assert them.
+type TypedSink interface {
+	// Send delivers the event. It must return false once done is closed, without waiting for the event to be
+	// delivered.
+	Send(event DecodedEvent, done <-chan struct{}) bool
+	// Close is called once no more event will be sent.
+	Close()
+}
+
+// TypedWatcher wraps a watch.Interface and passes the events carrying objects of the expected types to a TypedSink.
+// Batched events are unbatched first. Error events and events carrying objects of unexpected types are converted
+// to errors, which never block the events: only the latest one is kept until it's received from Errors.
+type TypedWatcher struct {
+	watcher  watch.Interface
+	objTypes map[reflect.Type]bool
+	sink     TypedSink
+	errors   chan error
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTypedWatcher creates a TypedWatcher on top of the provided watcher, passing the events carrying objects of the
+// same types as expectedObjs, e.g. &networking.AppliedToGroup{} and &networking.AppliedToGroupPatch{}, to sink. It
+// consumes the watcher's ResultChan until the watcher is stopped.
+func NewTypedWatcher(watcher watch.Interface, sink TypedSink, expectedObjs ...runtime.Object) *TypedWatcher {
+	w := &TypedWatcher{
+		watcher:  watcher,
+		objTypes: make(map[reflect.Type]bool, len(expectedObjs)),
+		sink:     sink,
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	for _, obj := range expectedObjs {
+		w.objTypes[reflect.TypeOf(obj)] = true
+	}
+	go w.run()
+	return w
+}
+
+func (w *TypedWatcher) run() {
+	defer close(w.errors)
+	defer w.sink.Close()
+
+	for event := range w.watcher.ResultChan() {
+		kind, event := unwrapKind(event)
+		for _, event := range Unbatch(event) {
+			decoded, err := w.decode(kind, event)
+			if err != nil {
+				w.sendError(err)
+				continue
+			}
+			if !w.sink.Send(decoded, w.done) {
+				return
+			}
+		}
+	}
+}
+
+// sendError makes err available from Errors, replacing the previous error if it hasn't been received yet. run is
+// the only sender, so the buffer can't be filled between draining it and sending.
+func (w *TypedWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+		return
+	default:
+	}
+	select {
+	case <-w.errors:
+	default:
+	}
+	w.errors <- err
+}
+
+// unwrapKind returns the kind of the event's object and the event carrying the unwrapped object, if the object is a
+// KindedObject, or the event itself otherwise.
+func unwrapKind(event watch.Event) (string, watch.Event) {
+	if kinded, ok := event.Object.(*KindedObject); ok {
+		return kinded.Kind, watch.Event{Type: event.Type, Object: kinded.Object}
+	}
+	return "", event
+}
+
+// decode unwraps the object of the event and checks whether it's of one of the expected types.
+func (w *TypedWatcher) decode(kind string, event watch.Event) (DecodedEvent, error) {
+	if eventKind, unwrapped := unwrapKind(event); eventKind != "" {
+		kind, event = eventKind, unwrapped
+	}
+	if event.Type == watch.Error {
+		if status, ok := event.Object.(*metav1.Status); ok {
+			return DecodedEvent{}, errors.FromObject(status)
+		}
+		return DecodedEvent{}, fmt.Errorf("received Error event carrying unexpected object %#v", event.Object)
+	}
+	decoded := DecodedEvent{Type: event.Type, Kind: kind, Object: event.Object}
+	if update, ok := event.Object.(*ObjectUpdate); ok {
+		decoded.Object, decoded.PrevObject = update.Object, update.PrevObject
+	}
+	if objType := reflect.TypeOf(decoded.Object); !w.objTypes[objType] {
+		return DecodedEvent{}, fmt.Errorf("received %s event carrying object of unexpected type %v", event.Type, objType)
+	}
+	return decoded, nil
+}
+
+// Errors returns the channel of errors that occurred when decoding events. It's closed once no more event will be
+// sent to the sink. If an error isn't received before the next one occurs, it's dropped.
+func (w *TypedWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Stop stops the TypedWatcher and the underlying watcher. It's idempotent and thread safe.
+func (w *TypedWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.watcher.Stop()
+	})
+}
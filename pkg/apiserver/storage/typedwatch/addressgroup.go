@@ -0,0 +1,77 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package typedwatch
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// AddressGroupEvent is a watch event of AddressGroups.
+type AddressGroupEvent struct {
+	Type watch.EventType
+	// Object is the AddressGroup carried by the event. It's nil if the event carries a patch.
+	Object *networking.AddressGroup
+	// Patch is the incremental update of the AddressGroup carried by a Modified event, for the watchers that
+	// negotiated storage.EventVersionDelta.
+	Patch *networking.AddressGroupPatch
+	// PrevObject is the whole AddressGroup before the update if the watcher requested IncludePreviousObject.
+	PrevObject *networking.AddressGroup
+}
+
+// AddressGroupWatcher wraps a watch.Interface of AddressGroups and emits AddressGroupEvents.
+type AddressGroupWatcher struct {
+	*storage.TypedWatcher
+	result chan AddressGroupEvent
+}
+
+// NewAddressGroupWatcher creates an AddressGroupWatcher on top of the provided watcher.
+func NewAddressGroupWatcher(watcher watch.Interface) *AddressGroupWatcher {
+	w := &AddressGroupWatcher{result: make(chan AddressGroupEvent)}
+	w.TypedWatcher = storage.NewTypedWatcher(watcher, (*addressGroupSink)(w), &networking.AddressGroup{}, &networking.AddressGroupPatch{})
+	return w
+}
+
+// ResultChan returns the channel of AddressGroupEvents. It's closed when the underlying watcher or the
+// AddressGroupWatcher is stopped.
+func (w *AddressGroupWatcher) ResultChan() <-chan AddressGroupEvent {
+	return w.result
+}
+
+// addressGroupSink implements storage.TypedSink for AddressGroupWatcher, without exposing its methods.
+type addressGroupSink AddressGroupWatcher
+
+func (s *addressGroupSink) Send(event storage.DecodedEvent, done <-chan struct{}) bool {
+	typed := AddressGroupEvent{Type: event.Type}
+	switch obj := event.Object.(type) {
+	case *networking.AddressGroup:
+		typed.Object = obj
+	case *networking.AddressGroupPatch:
+		typed.Patch = obj
+	}
+	typed.PrevObject, _ = event.PrevObject.(*networking.AddressGroup)
+	select {
+	case s.result <- typed:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (s *addressGroupSink) Close() {
+	close(s.result)
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package typedwatch
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// AppliedToGroupEvent is a watch event of AppliedToGroups.
+type AppliedToGroupEvent struct {
+	Type watch.EventType
+	// Object is the AppliedToGroup carried by the event. It's nil if the event carries a patch.
+	Object *networking.AppliedToGroup
+	// Patch is the incremental update of the AppliedToGroup carried by a Modified event, for the watchers that
+	// negotiated storage.EventVersionDelta.
+	Patch *networking.AppliedToGroupPatch
+	// PrevObject is the whole AppliedToGroup before the update if the watcher requested IncludePreviousObject.
+	PrevObject *networking.AppliedToGroup
+}
+
+// AppliedToGroupWatcher wraps a watch.Interface of AppliedToGroups and emits AppliedToGroupEvents.
+type AppliedToGroupWatcher struct {
+	*storage.TypedWatcher
+	result chan AppliedToGroupEvent
+}
+
+// NewAppliedToGroupWatcher creates an AppliedToGroupWatcher on top of the provided watcher.
+func NewAppliedToGroupWatcher(watcher watch.Interface) *AppliedToGroupWatcher {
+	w := &AppliedToGroupWatcher{result: make(chan AppliedToGroupEvent)}
+	w.TypedWatcher = storage.NewTypedWatcher(watcher, (*appliedToGroupSink)(w), &networking.AppliedToGroup{}, &networking.AppliedToGroupPatch{})
+	return w
+}
+
+// ResultChan returns the channel of AppliedToGroupEvents. It's closed when the underlying watcher or the
+// AppliedToGroupWatcher is stopped.
+func (w *AppliedToGroupWatcher) ResultChan() <-chan AppliedToGroupEvent {
+	return w.result
+}
+
+// appliedToGroupSink implements storage.TypedSink for AppliedToGroupWatcher, without exposing its methods.
+type appliedToGroupSink AppliedToGroupWatcher
+
+func (s *appliedToGroupSink) Send(event storage.DecodedEvent, done <-chan struct{}) bool {
+	typed := AppliedToGroupEvent{Type: event.Type}
+	switch obj := event.Object.(type) {
+	case *networking.AppliedToGroup:
+		typed.Object = obj
+	case *networking.AppliedToGroupPatch:
+		typed.Patch = obj
+	}
+	typed.PrevObject, _ = event.PrevObject.(*networking.AppliedToGroup)
+	select {
+	case s.result <- typed:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (s *appliedToGroupSink) Close() {
+	close(s.result)
+}
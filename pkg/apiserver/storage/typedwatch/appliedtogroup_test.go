@@ -0,0 +1,73 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package typedwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+func TestAppliedToGroupWatcher(t *testing.T) {
+	pod1 := networking.PodReference{Name: "pod1", Namespace: "default"}
+	pod2 := networking.PodReference{Name: "pod2", Namespace: "default"}
+	group := &networking.AppliedToGroup{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Pods: []networking.PodReference{pod1}}
+	updatedGroup := &networking.AppliedToGroup{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Pods: []networking.PodReference{pod1, pod2}}
+	patch := &networking.AppliedToGroupPatch{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, AddedPods: []networking.PodReference{pod2}}
+
+	fake := watch.NewFake()
+	w := NewAppliedToGroupWatcher(fake)
+	defer w.Stop()
+	go func() {
+		fake.Add(group)
+		fake.Action(storage.Batched, &storage.EventBatch{Events: []watch.Event{
+			{Type: watch.Modified, Object: patch},
+			{Type: watch.Modified, Object: &storage.ObjectUpdate{Object: updatedGroup, PrevObject: group}},
+		}})
+		fake.Add(&networking.AddressGroup{ObjectMeta: metav1.ObjectMeta{Name: "bar"}})
+		fake.Delete(updatedGroup)
+	}()
+
+	expected := []AppliedToGroupEvent{
+		{Type: watch.Added, Object: group},
+		{Type: watch.Modified, Patch: patch},
+		{Type: watch.Modified, Object: updatedGroup, PrevObject: group},
+		{Type: watch.Deleted, Object: updatedGroup},
+	}
+	for _, expectedEvent := range expected {
+		select {
+		case event := <-w.ResultChan():
+			assert.Equal(t, expectedEvent, event)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %v", expectedEvent)
+		}
+	}
+	select {
+	case err := <-w.Errors():
+		assert.Contains(t, err.Error(), "*networking.AddressGroup")
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for error")
+	}
+
+	w.Stop()
+	_, ok := <-w.ResultChan()
+	assert.False(t, ok, "Expected ResultChan to be closed")
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package typedwatch
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
+	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
+)
+
+// NetworkPolicyEvent is a watch event of NetworkPolicys.
+type NetworkPolicyEvent struct {
+	Type watch.EventType
+	// Object is the NetworkPolicy carried by the event. It's nil if the event carries a patch.
+	Object *networking.NetworkPolicy
+	// PrevObject is the whole NetworkPolicy before the update if the watcher requested IncludePreviousObject.
+	PrevObject *networking.NetworkPolicy
+}
+
+// NetworkPolicyWatcher wraps a watch.Interface of NetworkPolicys and emits NetworkPolicyEvents.
+type NetworkPolicyWatcher struct {
+	*storage.TypedWatcher
+	result chan NetworkPolicyEvent
+}
+
+// NewNetworkPolicyWatcher creates a NetworkPolicyWatcher on top of the provided watcher.
+func NewNetworkPolicyWatcher(watcher watch.Interface) *NetworkPolicyWatcher {
+	w := &NetworkPolicyWatcher{result: make(chan NetworkPolicyEvent)}
+	w.TypedWatcher = storage.NewTypedWatcher(watcher, (*networkPolicySink)(w), &networking.NetworkPolicy{})
+	return w
+}
+
+// ResultChan returns the channel of NetworkPolicyEvents. It's closed when the underlying watcher or the
+// NetworkPolicyWatcher is stopped.
+func (w *NetworkPolicyWatcher) ResultChan() <-chan NetworkPolicyEvent {
+	return w.result
+}
+
+// networkPolicySink implements storage.TypedSink for NetworkPolicyWatcher, without exposing its methods.
+type networkPolicySink NetworkPolicyWatcher
+
+func (s *networkPolicySink) Send(event storage.DecodedEvent, done <-chan struct{}) bool {
+	typed := NetworkPolicyEvent{Type: event.Type}
+	typed.Object = event.Object.(*networking.NetworkPolicy)
+	typed.PrevObject, _ = event.PrevObject.(*networking.NetworkPolicy)
+	select {
+	case s.result <- typed:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (s *networkPolicySink) Close() {
+	close(s.result)
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// chanSink is a TypedSink delivering the events on itself.
+type chanSink chan DecodedEvent
+
+func (s chanSink) Send(event DecodedEvent, done <-chan struct{}) bool {
+	select {
+	case s <- event:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (s chanSink) Close() {
+	close(s)
+}
+
+func receiveDecoded(t *testing.T, sink chanSink) DecodedEvent {
+	select {
+	case event, ok := <-sink:
+		require.True(t, ok, "Sink was closed")
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for event")
+	}
+	return DecodedEvent{}
+}
+
+func receiveError(t *testing.T, w *TypedWatcher) error {
+	select {
+	case err, ok := <-w.Errors():
+		require.True(t, ok, "Errors was closed")
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for error")
+	}
+	return nil
+}
+
+func TestTypedWatcher(t *testing.T) {
+	pod := func(name string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	fake := watch.NewFake()
+	sink := make(chanSink)
+	w := NewTypedWatcher(fake, sink, &v1.Pod{}, &v1.Node{})
+
+	go func() {
+		fake.Add(pod("pod1"))
+		fake.Add(&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc1"}})
+		fake.Action(Batched, &EventBatch{Events: []watch.Event{
+			{Type: watch.Modified, Object: &ObjectUpdate{Object: pod("pod1"), PrevObject: pod("pod0")}},
+			{Type: watch.Deleted, Object: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}},
+		}})
+		fake.Add(&KindedObject{Kind: "Pod", Object: pod("pod2")})
+		fake.Action(Batched, &KindedObject{Kind: "Pod", Object: &EventBatch{Events: []watch.Event{
+			{Type: watch.Added, Object: pod("pod3")},
+		}}})
+		fake.Error(&metav1.Status{Status: metav1.StatusFailure, Code: 410, Reason: metav1.StatusReasonExpired})
+		fake.Stop()
+	}()
+
+	assert.Equal(t, DecodedEvent{Type: watch.Added, Object: pod("pod1")}, receiveDecoded(t, sink))
+	assert.Contains(t, receiveError(t, w).Error(), "*v1.Service")
+	assert.Equal(t, DecodedEvent{Type: watch.Modified, Object: pod("pod1"), PrevObject: pod("pod0")}, receiveDecoded(t, sink))
+	assert.Equal(t, DecodedEvent{Type: watch.Deleted, Object: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}}, receiveDecoded(t, sink))
+	assert.Equal(t, DecodedEvent{Type: watch.Added, Kind: "Pod", Object: pod("pod2")}, receiveDecoded(t, sink))
+	assert.Equal(t, DecodedEvent{Type: watch.Added, Kind: "Pod", Object: pod("pod3")}, receiveDecoded(t, sink))
+	err := receiveError(t, w)
+	assert.True(t, errors.IsResourceExpired(err), "Expected ResourceExpired error, got %v", err)
+
+	_, ok := <-sink
+	assert.False(t, ok, "Expected sink to be closed")
+	_, ok = <-w.Errors()
+	assert.False(t, ok, "Expected Errors to be closed")
+}
+
+func TestTypedWatcherErrorsDontBlockEvents(t *testing.T) {
+	fake := watch.NewFake()
+	sink := make(chanSink)
+	w := NewTypedWatcher(fake, sink, &v1.Pod{})
+	defer w.Stop()
+
+	go func() {
+		for i := 1; i <= 3; i++ {
+			fake.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node%d", i)}})
+		}
+		fake.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+	}()
+
+	// The errors nobody received don't prevent the following event from being delivered, only the latest is kept.
+	assert.Equal(t, "pod1", receiveDecoded(t, sink).Object.(*v1.Pod).Name)
+	assert.Contains(t, receiveError(t, w).Error(), "*v1.Node")
+	select {
+	case err := <-w.Errors():
+		t.Fatalf("Unexpected error %v", err)
+	default:
+	}
+}
+
+func TestTypedWatcherStop(t *testing.T) {
+	fake := watch.NewFake()
+	sink := make(chanSink)
+	w := NewTypedWatcher(fake, sink, &v1.Pod{})
+	w.Stop()
+	w.Stop()
+
+	assert.True(t, fake.IsStopped(), "Underlying watcher was not stopped")
+	select {
+	case _, ok := <-sink:
+		assert.False(t, ok, "Expected sink to be closed")
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for sink to be closed")
+	}
+}
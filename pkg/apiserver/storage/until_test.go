@@ -0,0 +1,72 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestWatchUntilError(t *testing.T) {
+	status := &metav1.Status{Status: metav1.StatusFailure, Code: 410, Reason: metav1.StatusReasonExpired}
+	tests := []struct {
+		name          string
+		actions       func(fake *watch.RaceFreeFakeWatcher, cancel context.CancelFunc)
+		expectedEvent *watch.Event
+		expectedErr   error
+	}{
+		{
+			name: "error-first",
+			actions: func(fake *watch.RaceFreeFakeWatcher, cancel context.CancelFunc) {
+				fake.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+				fake.Error(status)
+				fake.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2"}})
+			},
+			expectedEvent: &watch.Event{Type: watch.Error, Object: status},
+		},
+		{
+			name: "close-first",
+			actions: func(fake *watch.RaceFreeFakeWatcher, cancel context.CancelFunc) {
+				fake.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}})
+				fake.Stop()
+			},
+		},
+		{
+			name: "cancel-first",
+			actions: func(fake *watch.RaceFreeFakeWatcher, cancel context.CancelFunc) {
+				cancel()
+			},
+			expectedErr: context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := watch.NewRaceFreeFake()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tt.actions(fake, cancel)
+
+			event, err := WatchUntilError(ctx, fake)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.expectedEvent, event)
+			assert.True(t, fake.IsStopped(), "The watcher should be stopped")
+		})
+	}
+}
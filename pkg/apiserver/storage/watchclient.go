@@ -0,0 +1,195 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+)
+
+// DefaultWatchClientBackoff is the backoff a WatchClient waits for between reconnections by default.
+var DefaultWatchClientBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    10,
+	Cap:      30 * time.Second,
+}
+
+// WatchFunc starts a watch with the specified resourceVersion and selectors, e.g. Interface.Watch.
+type WatchFunc func(ctx context.Context, resourceVersion string, selectors *Selectors) (watch.Interface, error)
+
+// WatchHandler handles the events received by a WatchClient.
+type WatchHandler interface {
+	// OnRelist is called when the watch restarts from the current state, which happens the first time and
+	// whenever the events following the last observed resourceVersion can no longer be served. ADDED events of
+	// all the existing objects follow, until OnSynced is called.
+	OnRelist()
+	// OnSynced is called once all the existing objects have been added after OnRelist. The objects the handler
+	// knew before OnRelist that haven't been added again since then no longer exist.
+	OnSynced()
+	// OnEvent handles an ADDED, MODIFIED, DELETED or PATCHED event. Bookmark and Error events are handled by the
+	// WatchClient itself, and Batched events are unbatched.
+	OnEvent(event watch.Event)
+}
+
+// WatchClient watches a store continuously, reconnecting with backoff whenever the watch is terminated. It tracks
+// the last observed resourceVersion to resume from it, and relists when it's no longer available, so that the
+// handler doesn't miss any change.
+type WatchClient struct {
+	watchFunc WatchFunc
+	selectors Selectors
+	backoff   wait.Backoff
+	// resourceVersion is the last observed resourceVersion. It's empty if the client must relist.
+	resourceVersion string
+}
+
+// NewWatchClient creates a WatchClient that watches with the provided function and selectors. The watches that
+// relist always request SendInitialEvents and AllowWatchBookmarks, to tell when the existing objects have all been
+// added. The other watches should allow Bookmark events too, so that the client can resume from a recent
+// resourceVersion.
+func NewWatchClient(watchFunc WatchFunc, selectors *Selectors) *WatchClient {
+	c := &WatchClient{watchFunc: watchFunc, backoff: DefaultWatchClientBackoff}
+	if selectors != nil {
+		c.selectors = *selectors
+	}
+	return c
+}
+
+// SetBackoff sets the backoff the client waits for between reconnections. It's reset whenever a watch receives
+// an event. It must be called before Run.
+func (c *WatchClient) SetBackoff(backoff wait.Backoff) {
+	c.backoff = backoff
+}
+
+// ResourceVersion returns the last resourceVersion observed by the client, or an empty string if it must relist.
+// It must not be called concurrently with Run.
+func (c *WatchClient) ResourceVersion() string {
+	return c.resourceVersion
+}
+
+// Run watches and calls the handler with the received events until the context is done, in which case it returns
+// the context's error, or until the store rejects a relist, in which case it returns the rejection.
+func (c *WatchClient) Run(ctx context.Context, handler WatchHandler) error {
+	backoff := c.backoff
+	for {
+		relist := c.resourceVersion == ""
+		progressed, err := c.watchOnce(ctx, handler, relist)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if progressed {
+			backoff = c.backoff
+		}
+		switch {
+		case errors.IsResourceExpired(err) || errors.IsGone(err) || err == ErrWatcherResyncRequired:
+			klog.V(2).Infof("Watch from resourceVersion %s can't be resumed, relisting: %v", c.resourceVersion, err)
+			c.resourceVersion = ""
+			if !relist {
+				// The relist doesn't depend on the store's history, there is no need to wait.
+				continue
+			}
+		case errors.IsBadRequest(err) && relist:
+			return err
+		case errors.IsBadRequest(err):
+			// The resourceVersion may be newer than the store's, e.g. after the store restarted.
+			klog.V(2).Infof("Watch from resourceVersion %s was rejected, relisting: %v", c.resourceVersion, err)
+			c.resourceVersion = ""
+		case err != nil:
+			klog.V(2).Infof("Watch from resourceVersion %q was terminated, reconnecting: %v", c.resourceVersion, err)
+		}
+		select {
+		case <-time.After(backoff.Step()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// watchOnce starts a watch and consumes it until it's terminated. It returns whether it received any event, and
+// the cause of the termination.
+func (c *WatchClient) watchOnce(ctx context.Context, handler WatchHandler, relist bool) (bool, error) {
+	selectors := c.selectors
+	selectors.SendInitialEvents = relist
+	if relist {
+		selectors.AllowWatchBookmarks = true
+	}
+	watcher, err := c.watchFunc(ctx, c.resourceVersion, &selectors)
+	if err != nil {
+		return false, err
+	}
+	defer watcher.Stop()
+
+	if relist {
+		handler.OnRelist()
+	}
+	progressed := false
+	for {
+		select {
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				if errWatcher, ok := watcher.(ErrWatcher); ok {
+					return progressed, errWatcher.Err()
+				}
+				return progressed, nil
+			}
+			progressed = true
+			switch event.Type {
+			case watch.Error:
+				if status, ok := event.Object.(*metav1.Status); ok {
+					return progressed, errors.FromObject(status)
+				}
+				return progressed, fmt.Errorf("received Error event carrying unexpected object %#v", event.Object)
+			case watch.Bookmark:
+				accessor, err := meta.Accessor(event.Object)
+				if err != nil {
+					continue
+				}
+				if relist && accessor.GetAnnotations()[InitialEventsAnnotationKey] == "true" {
+					relist = false
+					handler.OnSynced()
+				}
+				// The resourceVersion can't be resumed from until the existing objects have all been added.
+				if !relist {
+					c.observe(accessor.GetResourceVersion())
+				}
+			default:
+				for _, event := range Unbatch(event) {
+					handler.OnEvent(event)
+					if accessor, err := meta.Accessor(event.Object); err == nil && !relist {
+						c.observe(accessor.GetResourceVersion())
+					}
+				}
+			}
+		case <-ctx.Done():
+			return progressed, ctx.Err()
+		}
+	}
+}
+
+// observe records the resourceVersion of a received event, if it carries one.
+func (c *WatchClient) observe(resourceVersion string) {
+	if resourceVersion != "" {
+		c.resourceVersion = resourceVersion
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2019 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// watchCall records the arguments of a call to fakeWatchFunc.
+type watchCall struct {
+	resourceVersion   string
+	sendInitialEvents bool
+}
+
+// fakeWatchFunc serves the scripted responses in order, then cancels the context.
+type fakeWatchFunc struct {
+	responses []func() (watch.Interface, error)
+	calls     []watchCall
+	cancel    context.CancelFunc
+}
+
+func (f *fakeWatchFunc) watch(ctx context.Context, resourceVersion string, selectors *Selectors) (watch.Interface, error) {
+	f.calls = append(f.calls, watchCall{resourceVersion, selectors.SendInitialEvents})
+	if len(f.calls) > len(f.responses) {
+		f.cancel()
+		return nil, ctx.Err()
+	}
+	return f.responses[len(f.calls)-1]()
+}
+
+// recordingHandler records the calls to it as strings.
+type recordingHandler struct {
+	records []string
+}
+
+func (h *recordingHandler) OnRelist() {
+	h.records = append(h.records, "relist")
+}
+
+func (h *recordingHandler) OnSynced() {
+	h.records = append(h.records, "synced")
+}
+
+func (h *recordingHandler) OnEvent(event watch.Event) {
+	h.records = append(h.records, fmt.Sprintf("%s %s", event.Type, event.Object.(*v1.Pod).Name))
+}
+
+func newPod(name string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func newBookmark(resourceVersion string, initialEventsEnd bool) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: resourceVersion}}
+	if initialEventsEnd {
+		pod.Annotations = map[string]string{InitialEventsAnnotationKey: "true"}
+	}
+	return pod
+}
+
+// scripted returns a response that sends the provided events and closes the watcher.
+func scripted(events ...watch.Event) func() (watch.Interface, error) {
+	return func() (watch.Interface, error) {
+		fake := watch.NewRaceFreeFake()
+		for _, event := range events {
+			fake.Action(event.Type, event.Object)
+		}
+		fake.Stop()
+		return fake, nil
+	}
+}
+
+func failed(err error) func() (watch.Interface, error) {
+	return func() (watch.Interface, error) {
+		return nil, err
+	}
+}
+
+func TestWatchClient(t *testing.T) {
+	expired := errors.NewResourceExpired("too old resource version")
+	expiredStatus := expired.Status()
+	initialState := []watch.Event{
+		{Type: watch.Added, Object: newPod("pod1")},
+		{Type: watch.Added, Object: newPod("pod2")},
+		{Type: watch.Bookmark, Object: newBookmark("5", true)},
+	}
+	tests := []struct {
+		name            string
+		responses       []func() (watch.Interface, error)
+		expectedCalls   []watchCall
+		expectedRecords []string
+		expectedErr     error
+	}{
+		{
+			name: "disconnect",
+			responses: []func() (watch.Interface, error){
+				scripted(append(initialState,
+					watch.Event{Type: watch.Modified, Object: newPod("pod1")},
+					watch.Event{Type: watch.Bookmark, Object: newBookmark("6", false)})...),
+				scripted(watch.Event{Type: watch.Deleted, Object: newPod("pod2")}),
+			},
+			expectedCalls: []watchCall{{"", true}, {"6", false}, {"6", false}},
+			expectedRecords: []string{"relist", "ADDED pod1", "ADDED pod2", "synced", "MODIFIED pod1",
+				"DELETED pod2"},
+			expectedErr: context.Canceled,
+		},
+		{
+			name: "batched",
+			responses: []func() (watch.Interface, error){
+				scripted(watch.Event{Type: Batched, Object: &EventBatch{Events: initialState[:2]}}, initialState[2],
+					watch.Event{Type: Batched, Object: &EventBatch{Events: []watch.Event{
+						{Type: watch.Modified, Object: newPod("pod1")},
+						{Type: watch.Deleted, Object: newPod("pod2")},
+					}}}),
+			},
+			expectedCalls:   []watchCall{{"", true}, {"5", false}},
+			expectedRecords: []string{"relist", "ADDED pod1", "ADDED pod2", "synced", "MODIFIED pod1", "DELETED pod2"},
+			expectedErr:     context.Canceled,
+		},
+		{
+			name: "gone",
+			responses: []func() (watch.Interface, error){
+				scripted(initialState...),
+				scripted(watch.Event{Type: watch.Error, Object: &expiredStatus}),
+				scripted(initialState...),
+			},
+			expectedCalls: []watchCall{{"", true}, {"5", false}, {"", true}, {"5", false}},
+			expectedRecords: []string{"relist", "ADDED pod1", "ADDED pod2", "synced",
+				"relist", "ADDED pod1", "ADDED pod2", "synced"},
+			expectedErr: context.Canceled,
+		},
+		{
+			name: "disconnect-before-synced",
+			responses: []func() (watch.Interface, error){
+				scripted(initialState[0]),
+				scripted(initialState...),
+			},
+			expectedCalls:   []watchCall{{"", true}, {"", true}, {"5", false}},
+			expectedRecords: []string{"relist", "ADDED pod1", "relist", "ADDED pod1", "ADDED pod2", "synced"},
+			expectedErr:     context.Canceled,
+		},
+		{
+			name: "transient-error",
+			responses: []func() (watch.Interface, error){
+				failed(errors.NewTooManyRequests("too many watches", 1)),
+				scripted(initialState...),
+				failed(errors.NewServiceUnavailable("unavailable")),
+			},
+			expectedCalls:   []watchCall{{"", true}, {"", true}, {"5", false}, {"5", false}},
+			expectedRecords: []string{"relist", "ADDED pod1", "ADDED pod2", "synced"},
+			expectedErr:     context.Canceled,
+		},
+		{
+			name: "rejected-resume",
+			responses: []func() (watch.Interface, error){
+				scripted(initialState...),
+				failed(errors.NewBadRequest("resourceVersion 5 is newer than the current resourceVersion 0")),
+			},
+			expectedCalls:   []watchCall{{"", true}, {"5", false}, {"", true}},
+			expectedRecords: []string{"relist", "ADDED pod1", "ADDED pod2", "synced"},
+			expectedErr:     context.Canceled,
+		},
+		{
+			name: "rejected-relist",
+			responses: []func() (watch.Interface, error){
+				failed(errors.NewBadRequest("invalid selectors")),
+			},
+			expectedCalls: []watchCall{{"", true}},
+			expectedErr:   errors.NewBadRequest("invalid selectors"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fake := &fakeWatchFunc{responses: tt.responses, cancel: cancel}
+			handler := &recordingHandler{}
+			client := NewWatchClient(fake.watch, &Selectors{AllowWatchBookmarks: true})
+			client.SetBackoff(wait.Backoff{Duration: time.Millisecond})
+
+			err := client.Run(ctx, handler)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.expectedCalls, fake.calls)
+			assert.Equal(t, tt.expectedRecords, handler.records)
+		})
+	}
+}
+
+// errWatcher is a watcher that tells why it has been terminated.
+type errWatcher struct {
+	*watch.RaceFreeFakeWatcher
+	err error
+}
+
+func (w *errWatcher) Err() error {
+	return w.err
+}
+
+func TestWatchClientResyncRequired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := &fakeWatchFunc{cancel: cancel}
+	fake.responses = []func() (watch.Interface, error){
+		scripted(watch.Event{Type: watch.Bookmark, Object: newBookmark("3", true)}),
+		func() (watch.Interface, error) {
+			w := &errWatcher{RaceFreeFakeWatcher: watch.NewRaceFreeFake(), err: ErrWatcherResyncRequired}
+			w.Stop()
+			return w, nil
+		},
+	}
+	handler := &recordingHandler{}
+	client := NewWatchClient(fake.watch, nil)
+	client.SetBackoff(wait.Backoff{Duration: time.Millisecond})
+
+	require.Equal(t, context.Canceled, client.Run(ctx, handler))
+	assert.Equal(t, []watchCall{{"", true}, {"3", false}, {"", true}}, fake.calls)
+	assert.Equal(t, []string{"relist", "synced"}, handler.records)
+	assert.Equal(t, "", client.ResourceVersion())
+}
+
+func TestWatchClientCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fake := watch.NewRaceFreeFake()
+	client := NewWatchClient(func(ctx context.Context, resourceVersion string, selectors *Selectors) (watch.Interface, error) {
+		return fake, nil
+	}, nil)
+
+	done := make(chan error)
+	go func() {
+		done <- client.Run(ctx, &recordingHandler{})
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was canceled")
+	}
+	assert.True(t, fake.IsStopped(), "The watcher should be stopped")
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"reflect"
 
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 
@@ -50,39 +51,63 @@ type addressGroupEvent struct {
 // 2. Modified event will be generated if the Selectors was and is interested in the object.
 // 3. Deleted event will be generated if the Selectors was interested in the object but is not now.
 func (event *addressGroupEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	eventType, ok := event.GetEventType(selectors)
+	if !ok {
+		return nil
+	}
+	switch eventType {
+	case watch.Added:
+		return &watch.Event{Type: watch.Added, Object: event.CurrObject}
+	case watch.Modified:
+		return &watch.Event{Type: watch.Modified, Object: event.PatchObject}
+	default:
+		return &watch.Event{Type: watch.Deleted, Object: event.PrevObject}
+	}
+}
+
+var _ storage.TypedInternalEvent = &addressGroupEvent{}
+
+// GetEventType returns the type of the event ToWatchEvent converts the addressGroupEvent to, without converting it.
+func (event *addressGroupEvent) GetEventType(selectors *storage.Selectors) (watch.EventType, bool) {
 	prevObjSelected, currObjSelected := false, false
 	if event.CurrGroup != nil {
-		currObjSelected = filter(selectors, event.Key, event.CurrGroup.NodeNames)
+		currObjSelected = filter(selectors, event.Key, groupFields(event.CurrGroup.Name), event.CurrGroup.NodeNames)
 	}
 	if event.PrevGroup != nil {
-		prevObjSelected = filter(selectors, event.Key, event.PrevGroup.NodeNames)
-	}
-	if !currObjSelected && !prevObjSelected {
-		// Watcher is not interested in that object.
-		return nil
+		prevObjSelected = filter(selectors, event.Key, groupFields(event.PrevGroup.Name), event.PrevGroup.NodeNames)
 	}
 
 	switch {
 	case currObjSelected && !prevObjSelected:
 		// Watcher was not interested in that object but is now, an added event will be generated.
-		return &watch.Event{Type: watch.Added, Object: event.CurrObject}
+		return watch.Added, true
 	case currObjSelected && prevObjSelected:
 		// Watcher was and is interested in that object, a modified event will be generated, unless there's no address change.
-		if event.PatchObject == nil {
-			return nil
-		}
-		return &watch.Event{Type: watch.Modified, Object: event.PatchObject}
+		return watch.Modified, event.PatchObject != nil
 	case !currObjSelected && prevObjSelected:
 		// Watcher was interested in that object but is not interested now, a deleted event will be generated.
-		return &watch.Event{Type: watch.Deleted, Object: event.PrevObject}
+		return watch.Deleted, true
 	}
-	return nil
+	// Watcher is not interested in that object.
+	return "", false
 }
 
 func (event *addressGroupEvent) GetResourceVersion() uint64 {
 	return event.ResourceVersion
 }
 
+var _ storage.PreviousObjectEvent = &addressGroupEvent{}
+
+// ToPreviousObject returns the whole previous version of the transferred AddressGroup, or nil if the event created it.
+func (event *addressGroupEvent) ToPreviousObject(selectors *storage.Selectors) runtime.Object {
+	if event.PrevGroup == nil {
+		return nil
+	}
+	obj := new(networking.AddressGroup)
+	ToAddressGroupMsg(event.PrevGroup, obj, true)
+	return obj
+}
+
 // ToAddressGroupMsg converts the stored AddressGroup to its message form.
 // If includeBody is true, IPAddresses will be copied.
 func ToAddressGroupMsg(in *types.AddressGroup, out *networking.AddressGroup, includeBody bool) {
@@ -159,5 +184,5 @@ func AddressGroupKeyFunc(obj interface{}) (string, error) {
 
 // NewAddressGroupStore creates a store of AddressGroup.
 func NewAddressGroupStore() storage.Interface {
-	return ram.NewStore(AddressGroupKeyFunc, cache.Indexers{}, genAddressGroupEvent)
+	return ram.NewStore("AddressGroup", AddressGroupKeyFunc, cache.Indexers{}, genAddressGroupEvent, func() runtime.Object { return new(networking.AddressGroup) })
 }
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"reflect"
 
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 
@@ -27,12 +28,17 @@ import (
 	"github.com/vmware-tanzu/antrea/pkg/controller/types"
 )
 
-// appliedToGroupEvent implements storage.InternalEvent.
+// appliedToGroupEvent implements storage.VersionedInternalEvent.
 type appliedToGroupEvent struct {
 	// The current version of the stored AppliedToGroup.
 	CurrGroup *types.AppliedToGroup
 	// The previous version of the stored AppliedToGroup.
 	PrevGroup *types.AppliedToGroup
+	// The patch of the AppliedToGroup for watchers of all Nodes, nil if no Pod is added or removed.
+	PatchObject *networking.AppliedToGroupPatch
+	// The patches of the AppliedToGroup for watchers of a single Node, keyed by the Node name. Nodes whose Pods are
+	// not changed are absent.
+	PatchObjectsByNode map[string]*networking.AppliedToGroupPatch
 	// The key of this AppliedToGroup.
 	Key             string
 	ResourceVersion uint64
@@ -43,25 +49,19 @@ type appliedToGroupEvent struct {
 // 2. Modified event will be generated if the Selectors was and is interested in the object.
 // 3. Deleted event will be generated if the Selectors was interested in the object but is not now.
 // 4. If nodeName is specified, only Pods that hosted by the Node will be in the event.
+// 5. Modified event will carry an AppliedToGroupPatch if the Selectors negotiated EventVersionDelta, the whole
+// AppliedToGroup otherwise.
 func (event *appliedToGroupEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
-	prevObjSelected, currObjSelected := false, false
-	if event.CurrGroup != nil {
-		currObjSelected = filter(selectors, event.Key, event.CurrGroup.NodeNames)
-	}
-	if event.PrevGroup != nil {
-		prevObjSelected = filter(selectors, event.Key, event.PrevGroup.NodeNames)
-	}
-	if !currObjSelected && !prevObjSelected {
-		// Watcher is not interested in that object.
+	eventType, ok := event.GetEventType(selectors)
+	if !ok {
 		return nil
 	}
 
 	// If nodeName is specified in selectors, only Pods that hosted by the Node should be in the event.
 	nodeName, nodeSpecified := selectors.Field.RequiresExactMatch("nodeName")
 
-	switch {
-	case currObjSelected && !prevObjSelected:
-		// Watcher was not interested in that object but is now, an added event will be generated.
+	switch eventType {
+	case watch.Added:
 		obj := new(networking.AppliedToGroup)
 		if nodeSpecified {
 			ToAppliedToGroupMsg(event.CurrGroup, obj, true, &nodeName)
@@ -69,39 +69,19 @@ func (event *appliedToGroupEvent) ToWatchEvent(selectors *storage.Selectors) *wa
 			ToAppliedToGroupMsg(event.CurrGroup, obj, true, nil)
 		}
 		return &watch.Event{Type: watch.Added, Object: obj}
-	case currObjSelected && prevObjSelected:
-		// Watcher was and is interested in that object, a modified event will be generated.
-		obj := new(networking.AppliedToGroupPatch)
-		obj.UID = event.CurrGroup.UID
-		obj.Name = event.CurrGroup.Name
-
-		var currPods, prevPods types.PodSet
-		if nodeSpecified {
-			currPods = event.CurrGroup.PodsByNode[nodeName]
-			prevPods = event.PrevGroup.PodsByNode[nodeName]
-		} else {
-			currPods = types.PodSet{}
-			for _, pods := range event.CurrGroup.PodsByNode {
-				currPods = currPods.Union(pods)
+	case watch.Modified:
+		if selectors.NegotiatedEventVersion() < storage.EventVersionDelta {
+			// Watcher can't handle the patch, send the whole object instead.
+			fullObj := new(networking.AppliedToGroup)
+			if nodeSpecified {
+				ToAppliedToGroupMsg(event.CurrGroup, fullObj, true, &nodeName)
+			} else {
+				ToAppliedToGroupMsg(event.CurrGroup, fullObj, true, nil)
 			}
-			prevPods = types.PodSet{}
-			for _, pods := range event.PrevGroup.PodsByNode {
-				prevPods = prevPods.Union(pods)
-			}
-		}
-		for pod := range currPods.Difference(prevPods) {
-			obj.AddedPods = append(obj.AddedPods, pod)
-		}
-		for pod := range prevPods.Difference(currPods) {
-			obj.RemovedPods = append(obj.RemovedPods, pod)
-		}
-		if len(obj.AddedPods)+len(obj.RemovedPods) == 0 {
-			// No change for the watcher.
-			return nil
+			return &watch.Event{Type: watch.Modified, Object: fullObj}
 		}
-		return &watch.Event{Type: watch.Modified, Object: obj}
-	case !currObjSelected && prevObjSelected:
-		// Watcher was interested in that object but is not interested now, a deleted event will be generated.
+		return &watch.Event{Type: watch.Modified, Object: event.patchObject(selectors)}
+	default:
 		obj := new(networking.AppliedToGroup)
 		if nodeSpecified {
 			ToAppliedToGroupMsg(event.PrevGroup, obj, false, &nodeName)
@@ -110,13 +90,73 @@ func (event *appliedToGroupEvent) ToWatchEvent(selectors *storage.Selectors) *wa
 		}
 		return &watch.Event{Type: watch.Deleted, Object: obj}
 	}
-	return nil
+}
+
+var _ storage.TypedInternalEvent = &appliedToGroupEvent{}
+
+// GetEventType returns the type of the event ToWatchEvent converts the appliedToGroupEvent to, without converting it.
+func (event *appliedToGroupEvent) GetEventType(selectors *storage.Selectors) (watch.EventType, bool) {
+	prevObjSelected, currObjSelected := false, false
+	if event.CurrGroup != nil {
+		currObjSelected = filter(selectors, event.Key, groupFields(event.CurrGroup.Name), event.CurrGroup.NodeNames)
+	}
+	if event.PrevGroup != nil {
+		prevObjSelected = filter(selectors, event.Key, groupFields(event.PrevGroup.Name), event.PrevGroup.NodeNames)
+	}
+
+	switch {
+	case currObjSelected && !prevObjSelected:
+		// Watcher was not interested in that object but is now, an added event will be generated.
+		return watch.Added, true
+	case currObjSelected && prevObjSelected:
+		// Watcher was and is interested in that object, a modified event will be generated, unless there's no
+		// Pod change for the watcher.
+		return watch.Modified, event.patchObject(selectors) != nil
+	case !currObjSelected && prevObjSelected:
+		// Watcher was interested in that object but is not interested now, a deleted event will be generated.
+		return watch.Deleted, true
+	}
+	// Watcher is not interested in that object.
+	return "", false
+}
+
+// patchObject returns the patch of the AppliedToGroup for the Selectors, nil if no Pod is added or removed for them.
+func (event *appliedToGroupEvent) patchObject(selectors *storage.Selectors) *networking.AppliedToGroupPatch {
+	if nodeName, nodeSpecified := selectors.Field.RequiresExactMatch("nodeName"); nodeSpecified {
+		return event.PatchObjectsByNode[nodeName]
+	}
+	return event.PatchObject
 }
 
 func (event *appliedToGroupEvent) GetResourceVersion() uint64 {
 	return event.ResourceVersion
 }
 
+var _ storage.PreviousObjectEvent = &appliedToGroupEvent{}
+
+// ToPreviousObject returns the whole previous version of the transferred AppliedToGroup, or nil if the event created
+// it. If nodeName is specified in selectors, only Pods that hosted by the Node will be in it.
+func (event *appliedToGroupEvent) ToPreviousObject(selectors *storage.Selectors) runtime.Object {
+	if event.PrevGroup == nil {
+		return nil
+	}
+	obj := new(networking.AppliedToGroup)
+	if nodeName, nodeSpecified := selectors.Field.RequiresExactMatch("nodeName"); nodeSpecified {
+		ToAppliedToGroupMsg(event.PrevGroup, obj, true, &nodeName)
+	} else {
+		ToAppliedToGroupMsg(event.PrevGroup, obj, true, nil)
+	}
+	return obj
+}
+
+// GetEventVersion returns EventVersionDelta if the event carries patches, EventVersionFull otherwise.
+func (event *appliedToGroupEvent) GetEventVersion() storage.EventVersion {
+	if event.PatchObject != nil || len(event.PatchObjectsByNode) > 0 {
+		return storage.EventVersionDelta
+	}
+	return storage.EventVersionFull
+}
+
 var _ storage.GenEventFunc = genAppliedToGroupEvent
 
 // genAppliedToGroupEvent generates InternalEvent from the given versions of an AppliedToGroup.
@@ -133,10 +173,57 @@ func genAppliedToGroupEvent(key string, prevObj, currObj interface{}, rv uint64)
 	if currObj != nil {
 		event.CurrGroup = currObj.(*types.AppliedToGroup)
 	}
+	if event.PrevGroup != nil && event.CurrGroup != nil {
+		// Calculate the incremental messages once for all watchers.
+		currPods, prevPods := types.PodSet{}, types.PodSet{}
+		for _, pods := range event.CurrGroup.PodsByNode {
+			for pod := range pods {
+				currPods.Insert(pod)
+			}
+		}
+		for _, pods := range event.PrevGroup.PodsByNode {
+			for pod := range pods {
+				prevPods.Insert(pod)
+			}
+		}
+		event.PatchObject = genAppliedToGroupPatch(event.CurrGroup, currPods, prevPods)
+		event.PatchObjectsByNode = map[string]*networking.AppliedToGroupPatch{}
+		for nodeName, pods := range event.CurrGroup.PodsByNode {
+			if patch := genAppliedToGroupPatch(event.CurrGroup, pods, event.PrevGroup.PodsByNode[nodeName]); patch != nil {
+				event.PatchObjectsByNode[nodeName] = patch
+			}
+		}
+		for nodeName, pods := range event.PrevGroup.PodsByNode {
+			if _, exists := event.CurrGroup.PodsByNode[nodeName]; exists {
+				continue
+			}
+			if patch := genAppliedToGroupPatch(event.CurrGroup, nil, pods); patch != nil {
+				event.PatchObjectsByNode[nodeName] = patch
+			}
+		}
+	}
 
 	return event, nil
 }
 
+// genAppliedToGroupPatch returns the AppliedToGroupPatch carrying the Pods added to and removed from prevPods to
+// get currPods, or nil if there's no difference.
+func genAppliedToGroupPatch(group *types.AppliedToGroup, currPods, prevPods types.PodSet) *networking.AppliedToGroupPatch {
+	patch := new(networking.AppliedToGroupPatch)
+	patch.UID = group.UID
+	patch.Name = group.Name
+	for pod := range currPods.Difference(prevPods) {
+		patch.AddedPods = append(patch.AddedPods, pod)
+	}
+	for pod := range prevPods.Difference(currPods) {
+		patch.RemovedPods = append(patch.RemovedPods, pod)
+	}
+	if len(patch.AddedPods)+len(patch.RemovedPods) == 0 {
+		return nil
+	}
+	return patch
+}
+
 // ToAppliedToGroupMsg converts the stored AppliedToGroup to its message form.
 // If includeBody is true, Pods will be copied.
 // If nodeName is provided, only Pods that hosted by the Node will be copied.
@@ -172,5 +259,5 @@ func AppliedToGroupKeyFunc(obj interface{}) (string, error) {
 
 // NewAppliedToGroupStore creates a store of AppliedToGroup.
 func NewAppliedToGroupStore() storage.Interface {
-	return ram.NewStore(AppliedToGroupKeyFunc, cache.Indexers{}, genAppliedToGroupEvent)
+	return ram.NewStore("AppliedToGroup", AppliedToGroupKeyFunc, cache.Indexers{}, genAppliedToGroupEvent, func() runtime.Object { return new(networking.AppliedToGroup) })
 }
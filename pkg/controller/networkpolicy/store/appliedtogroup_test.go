@@ -16,6 +16,8 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,6 +40,7 @@ func TestWatchAppliedToGroupEvent(t *testing.T) {
 
 	testCases := map[string]struct {
 		fieldSelector fields.Selector
+		supportsDelta bool
 		// The operations that will be executed on the store.
 		operations func(p storage.Interface)
 		// The events expected to see.
@@ -46,6 +49,7 @@ func TestWatchAppliedToGroupEvent(t *testing.T) {
 		"non-node-scoped-watcher": {
 			// All events should be watched.
 			fieldSelector: fields.Everything(),
+			supportsDelta: true,
 			operations: func(store storage.Interface) {
 				store.Create(&types.AppliedToGroup{
 					Name:       "foo",
@@ -70,9 +74,36 @@ func TestWatchAppliedToGroupEvent(t *testing.T) {
 				}},
 			},
 		},
+		"non-delta-watcher": {
+			// Modified events should carry the whole object.
+			fieldSelector: fields.Everything(),
+			operations: func(store storage.Interface) {
+				store.Create(&types.AppliedToGroup{
+					Name:       "foo",
+					SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1", "node2")},
+					PodsByNode: map[string]types.PodSet{"node1": {pod1: sets.Empty{}}, "node2": {pod2: sets.Empty{}}},
+				})
+				store.Update(&types.AppliedToGroup{
+					Name:       "foo",
+					SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1", "node2")},
+					PodsByNode: map[string]types.PodSet{"node1": {pod1: sets.Empty{}}, "node2": {pod3: sets.Empty{}}},
+				})
+			},
+			expected: []watch.Event{
+				{Type: watch.Added, Object: &networking.AppliedToGroup{
+					ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+					Pods:       []networking.PodReference{pod1, pod2},
+				}},
+				{Type: watch.Modified, Object: &networking.AppliedToGroup{
+					ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+					Pods:       []networking.PodReference{pod1, pod3},
+				}},
+			},
+		},
 		"node-scoped-watcher": {
 			// Only events that span node3 should be watched.
 			fieldSelector: fields.SelectorFromSet(fields.Set{"nodeName": "node3"}),
+			supportsDelta: true,
 			operations: func(store storage.Interface) {
 				// This should not be seen as it doesn't span node3.
 				store.Create(&types.AppliedToGroup{
@@ -124,7 +155,7 @@ func TestWatchAppliedToGroupEvent(t *testing.T) {
 	for name, testCase := range testCases {
 		t.Run(name, func(t *testing.T) {
 			store := NewAppliedToGroupStore()
-			w, err := store.Watch(context.Background(), "", labels.Everything(), testCase.fieldSelector)
+			w, err := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: testCase.fieldSelector, SupportsDelta: testCase.supportsDelta})
 			if err != nil {
 				t.Fatalf("Failed to watch object: %v", err)
 			}
@@ -135,19 +166,23 @@ func TestWatchAppliedToGroupEvent(t *testing.T) {
 				if actualEvent.Type != expectedEvent.Type {
 					t.Fatalf("Expected event type %v, got %v", expectedEvent.Type, actualEvent.Type)
 				}
-				switch actualEvent.Type {
-				case watch.Added, watch.Deleted:
-					actualObj := actualEvent.Object.(*networking.AppliedToGroup)
-					expectedObj := expectedEvent.Object.(*networking.AppliedToGroup)
+				switch expectedObj := expectedEvent.Object.(type) {
+				case *networking.AppliedToGroup:
+					actualObj, ok := actualEvent.Object.(*networking.AppliedToGroup)
+					if !ok {
+						t.Fatalf("Expected *networking.AppliedToGroup, got %T", actualEvent.Object)
+					}
 					if !assert.Equal(t, expectedObj.ObjectMeta, actualObj.ObjectMeta) {
 						t.Errorf("Expected ObjectMeta %v, got %v", expectedObj.ObjectMeta, actualObj.ObjectMeta)
 					}
 					if !assert.ElementsMatch(t, expectedObj.Pods, actualObj.Pods) {
 						t.Errorf("Expected Pods %v, got %v", expectedObj.Pods, actualObj.Pods)
 					}
-				case watch.Modified:
-					actualObj := actualEvent.Object.(*networking.AppliedToGroupPatch)
-					expectedObj := expectedEvent.Object.(*networking.AppliedToGroupPatch)
+				case *networking.AppliedToGroupPatch:
+					actualObj, ok := actualEvent.Object.(*networking.AppliedToGroupPatch)
+					if !ok {
+						t.Fatalf("Expected *networking.AppliedToGroupPatch, got %T", actualEvent.Object)
+					}
 					if !assert.Equal(t, expectedObj.ObjectMeta, actualObj.ObjectMeta) {
 						t.Errorf("Expected ObjectMeta %v, got %v", expectedObj.ObjectMeta, actualObj.ObjectMeta)
 					}
@@ -167,3 +202,199 @@ func TestWatchAppliedToGroupEvent(t *testing.T) {
 		})
 	}
 }
+
+func TestAppliedToGroupPatchSize(t *testing.T) {
+	newGroup := func(numPods int) *types.AppliedToGroup {
+		pods := types.PodSet{}
+		for i := 0; i < numPods; i++ {
+			pods.Insert(networking.PodReference{Name: fmt.Sprintf("pod%d", i), Namespace: "default"})
+		}
+		return &types.AppliedToGroup{
+			Name:       "foo",
+			SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1")},
+			PodsByNode: map[string]types.PodSet{"node1": pods},
+		}
+	}
+	store := NewAppliedToGroupStore()
+	store.Create(newGroup(1000))
+
+	fullWatcher, err := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything()})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer fullWatcher.Stop()
+	deltaWatcher, err := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), SupportsDelta: true})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer deltaWatcher.Stop()
+	assert.Equal(t, watch.Added, (<-fullWatcher.ResultChan()).Type)
+	assert.Equal(t, watch.Added, (<-deltaWatcher.ResultChan()).Type)
+
+	// A Pod churns within the group.
+	store.Update(newGroup(1001))
+	fullEvent := <-fullWatcher.ResultChan()
+	deltaEvent := <-deltaWatcher.ResultChan()
+	assert.Equal(t, watch.Modified, fullEvent.Type)
+	assert.Equal(t, watch.Modified, deltaEvent.Type)
+	assert.Len(t, fullEvent.Object.(*networking.AppliedToGroup).Pods, 1001)
+	assert.Equal(t, &networking.AppliedToGroupPatch{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+		AddedPods:  []networking.PodReference{{Name: "pod1000", Namespace: "default"}},
+	}, deltaEvent.Object)
+
+	fullPayload, err := json.Marshal(fullEvent.Object)
+	assert.NoError(t, err)
+	deltaPayload, err := json.Marshal(deltaEvent.Object)
+	assert.NoError(t, err)
+	t.Logf("Full payload: %d bytes, delta payload: %d bytes", len(fullPayload), len(deltaPayload))
+	assert.True(t, len(deltaPayload)*100 < len(fullPayload), "Expected the delta payload to be less than 1%% of the full payload, got %d and %d bytes", len(deltaPayload), len(fullPayload))
+}
+
+func TestAppliedToGroupEventVersions(t *testing.T) {
+	pod1 := networking.PodReference{Name: "pod1", Namespace: "ns1"}
+	pod2 := networking.PodReference{Name: "pod2", Namespace: "ns1"}
+	store := NewAppliedToGroupStore()
+	newWatcher := func(version storage.EventVersion) watch.Interface {
+		w, err := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), EventVersion: version})
+		if err != nil {
+			t.Fatalf("Failed to watch object: %v", err)
+		}
+		return w
+	}
+	// A client which only interprets full objects, as agents did before patches were introduced, watching along with
+	// a client of the latest version.
+	v1Watcher := newWatcher(storage.EventVersionFull)
+	defer v1Watcher.Stop()
+	v2Watcher := newWatcher(storage.LatestEventVersion)
+	defer v2Watcher.Stop()
+
+	store.Create(&types.AppliedToGroup{
+		Name:       "foo",
+		SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1")},
+		PodsByNode: map[string]types.PodSet{"node1": {pod1: sets.Empty{}}},
+	})
+	store.Update(&types.AppliedToGroup{
+		Name:       "foo",
+		SpanMeta:   types.SpanMeta{NodeNames: sets.NewString("node1")},
+		PodsByNode: map[string]types.PodSet{"node1": {pod1: sets.Empty{}, pod2: sets.Empty{}}},
+	})
+
+	assert.Equal(t, watch.Added, (<-v1Watcher.ResultChan()).Type)
+	assert.Equal(t, watch.Added, (<-v2Watcher.ResultChan()).Type)
+	v1Event := <-v1Watcher.ResultChan()
+	assert.Equal(t, watch.Modified, v1Event.Type)
+	v1Obj, ok := v1Event.Object.(*networking.AppliedToGroup)
+	if assert.True(t, ok, "Expected *networking.AppliedToGroup for the v1 client, got %T", v1Event.Object) {
+		assert.ElementsMatch(t, []networking.PodReference{pod1, pod2}, v1Obj.Pods)
+	}
+	v2Event := <-v2Watcher.ResultChan()
+	assert.Equal(t, watch.Modified, v2Event.Type)
+	assert.Equal(t, &networking.AppliedToGroupPatch{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+		AddedPods:  []networking.PodReference{pod2},
+	}, v2Event.Object)
+}
+
+func TestAppliedToGroupEventPreviousObject(t *testing.T) {
+	pod1 := networking.PodReference{Name: "pod1", Namespace: "ns1"}
+	pod2 := networking.PodReference{Name: "pod2", Namespace: "ns1"}
+	pod3 := networking.PodReference{Name: "pod3", Namespace: "ns1"}
+	store := NewAppliedToGroupStore()
+	w, err := store.Watch(context.Background(), "", &storage.Selectors{
+		Label:                 labels.Everything(),
+		Field:                 fields.OneTermEqualSelector("nodeName", "node1"),
+		EventVersion:          storage.LatestEventVersion,
+		IncludePreviousObject: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to watch object: %v", err)
+	}
+	defer w.Stop()
+
+	versions := []map[string]types.PodSet{
+		{"node1": {pod1: sets.Empty{}}},
+		{"node1": {pod1: sets.Empty{}, pod2: sets.Empty{}}},
+		{"node1": {pod2: sets.Empty{}}, "node2": {pod3: sets.Empty{}}},
+	}
+	store.Create(&types.AppliedToGroup{Name: "foo", SpanMeta: types.SpanMeta{NodeNames: sets.NewString("node1")}, PodsByNode: versions[0]})
+	for _, podsByNode := range versions[1:] {
+		store.Update(&types.AppliedToGroup{Name: "foo", SpanMeta: types.SpanMeta{NodeNames: sets.NewString("node1", "node2")}, PodsByNode: podsByNode})
+	}
+
+	event := <-w.ResultChan()
+	assert.Equal(t, watch.Added, event.Type)
+	assert.IsType(t, &networking.AppliedToGroup{}, event.Object, "Only Modified events carry the previous object")
+	// Each Modified event carries the patch along with the whole previous version, filtered by the Node.
+	expected := []*storage.ObjectUpdate{
+		{
+			Object:     &networking.AppliedToGroupPatch{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, AddedPods: []networking.PodReference{pod2}},
+			PrevObject: &networking.AppliedToGroup{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Pods: []networking.PodReference{pod1}},
+		},
+		{
+			Object:     &networking.AppliedToGroupPatch{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, RemovedPods: []networking.PodReference{pod1}},
+			PrevObject: &networking.AppliedToGroup{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Pods: []networking.PodReference{pod1, pod2}},
+		},
+	}
+	for i, expectedObj := range expected {
+		event := <-w.ResultChan()
+		assert.Equal(t, watch.Modified, event.Type)
+		obj, ok := event.Object.(*storage.ObjectUpdate)
+		if !assert.True(t, ok, "Expected *storage.ObjectUpdate for update %d, got %T", i, event.Object) {
+			continue
+		}
+		assert.Equal(t, expectedObj.Object, obj.Object)
+		prevObj := obj.PrevObject.(*networking.AppliedToGroup)
+		assert.Equal(t, expectedObj.PrevObject.(*networking.AppliedToGroup).Name, prevObj.Name)
+		assert.ElementsMatch(t, expectedObj.PrevObject.(*networking.AppliedToGroup).Pods, prevObj.Pods)
+	}
+}
+
+func TestAppliedToGroupEventType(t *testing.T) {
+	pod1 := networking.PodReference{Name: "pod1", Namespace: "ns1"}
+	pod2 := networking.PodReference{Name: "pod2", Namespace: "ns1"}
+	group := func(podsByNode map[string]types.PodSet) *types.AppliedToGroup {
+		g := &types.AppliedToGroup{Name: "foo", SpanMeta: types.SpanMeta{NodeNames: sets.NewString()}, PodsByNode: podsByNode}
+		for node := range podsByNode {
+			g.NodeNames.Insert(node)
+		}
+		return g
+	}
+	versions := []*types.AppliedToGroup{
+		nil,
+		group(map[string]types.PodSet{"node1": {pod1: sets.Empty{}}}),
+		group(map[string]types.PodSet{"node1": {pod1: sets.Empty{}}, "node2": {pod2: sets.Empty{}}}),
+		group(map[string]types.PodSet{"node2": {pod1: sets.Empty{}}}),
+		nil,
+	}
+	var selectorsList []*storage.Selectors
+	for _, version := range []storage.EventVersion{storage.EventVersionFull, storage.LatestEventVersion} {
+		selectorsList = append(selectorsList, &storage.Selectors{Label: labels.Everything(), Field: fields.Everything(), EventVersion: version})
+		for _, node := range []string{"node1", "node2", "node3"} {
+			selectorsList = append(selectorsList, &storage.Selectors{Label: labels.Everything(), Field: fields.OneTermEqualSelector("nodeName", node), EventVersion: version})
+		}
+	}
+	// The type told without converting the event must be the one of the converted event, including when the
+	// event is not converted for a Node whose Pods are not changed.
+	for i := 1; i < len(versions); i++ {
+		var prevObj, currObj interface{}
+		if versions[i-1] != nil {
+			prevObj = versions[i-1]
+		}
+		if versions[i] != nil {
+			currObj = versions[i]
+		}
+		event, err := genAppliedToGroupEvent("foo", prevObj, currObj, uint64(i))
+		if err != nil {
+			t.Fatalf("Failed to generate event: %v", err)
+		}
+		typed := event.(storage.TypedInternalEvent)
+		for _, selectors := range selectorsList {
+			eventType, ok := typed.GetEventType(selectors)
+			watchEvent := event.ToWatchEvent(selectors)
+			if assert.Equal(t, watchEvent != nil, ok, "Unexpected result for event %d and selectors %v", i, selectors) && ok {
+				assert.Equal(t, watchEvent.Type, eventType, "Unexpected type for event %d and selectors %v", i, selectors)
+			}
+		}
+	}
+}
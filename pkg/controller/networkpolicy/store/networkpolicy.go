@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"reflect"
 
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 
@@ -54,33 +56,69 @@ type networkPolicyEvent struct {
 // 2. Modified event will be generated if the Selectors was and is interested in the object.
 // 3. Deleted event will be generated if the Selectors was interested in the object but is not now.
 func (event *networkPolicyEvent) ToWatchEvent(selectors *storage.Selectors) *watch.Event {
+	eventType, ok := event.GetEventType(selectors)
+	if !ok {
+		return nil
+	}
+	switch eventType {
+	case watch.Added:
+		return &watch.Event{Type: watch.Added, Object: event.CurrObject}
+	case watch.Modified:
+		return &watch.Event{Type: watch.Modified, Object: event.CurrObject}
+	default:
+		return &watch.Event{Type: watch.Deleted, Object: event.PrevObject}
+	}
+}
+
+var _ storage.TypedInternalEvent = &networkPolicyEvent{}
+
+// GetEventType returns the type of the event ToWatchEvent converts the networkPolicyEvent to, without converting it.
+func (event *networkPolicyEvent) GetEventType(selectors *storage.Selectors) (watch.EventType, bool) {
 	prevObjSelected, currObjSelected := false, false
 	if event.CurrPolicy != nil {
-		currObjSelected = filter(selectors, event.Key, event.CurrPolicy.NodeNames)
+		currObjSelected = filter(selectors, event.Key, networkPolicyFields(event.CurrPolicy), event.CurrPolicy.NodeNames)
 	}
 	if event.PrevPolicy != nil {
-		prevObjSelected = filter(selectors, event.Key, event.PrevPolicy.NodeNames)
-	}
-	if !currObjSelected && !prevObjSelected {
-		// Watcher is not interested in that object.
-		return nil
+		prevObjSelected = filter(selectors, event.Key, networkPolicyFields(event.PrevPolicy), event.PrevPolicy.NodeNames)
 	}
 
 	switch {
 	case currObjSelected && !prevObjSelected:
-		return &watch.Event{Type: watch.Added, Object: event.CurrObject}
+		return watch.Added, true
 	case currObjSelected && prevObjSelected:
-		return &watch.Event{Type: watch.Modified, Object: event.CurrObject}
+		return watch.Modified, true
 	case !currObjSelected && prevObjSelected:
-		return &watch.Event{Type: watch.Deleted, Object: event.PrevObject}
+		return watch.Deleted, true
 	}
-	return nil
+	// Watcher is not interested in that object.
+	return "", false
 }
 
 func (event *networkPolicyEvent) GetResourceVersion() uint64 {
 	return event.ResourceVersion
 }
 
+var _ storage.PreviousObjectEvent = &networkPolicyEvent{}
+
+// ToPreviousObject returns the whole previous version of the transferred NetworkPolicy, or nil if the event created
+// it.
+func (event *networkPolicyEvent) ToPreviousObject(selectors *storage.Selectors) runtime.Object {
+	if event.PrevPolicy == nil {
+		return nil
+	}
+	obj := new(networking.NetworkPolicy)
+	ToNetworkPolicyMsg(event.PrevPolicy, obj, true)
+	return obj
+}
+
+// networkPolicyFields returns the fields of a NetworkPolicy that can be used in field selectors.
+func networkPolicyFields(policy *types.NetworkPolicy) fields.Set {
+	return fields.Set{
+		"metadata.name":      policy.Name,
+		"metadata.namespace": policy.Namespace,
+	}
+}
+
 var _ storage.GenEventFunc = genNetworkPolicyEvent
 
 // genNetworkPolicyEvent generates InternalEvent from the given versions of a NetworkPolicy.
@@ -165,5 +203,5 @@ func NewNetworkPolicyStore() storage.Interface {
 			return groupNames, nil
 		},
 	}
-	return ram.NewStore(NetworkPolicyKeyFunc, indexers, genNetworkPolicyEvent)
+	return ram.NewStore("NetworkPolicy", NetworkPolicyKeyFunc, indexers, genNetworkPolicyEvent, func() runtime.Object { return new(networking.NetworkPolicy) })
 }
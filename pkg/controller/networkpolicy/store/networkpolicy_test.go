@@ -69,6 +69,14 @@ func TestWatchNetworkPolicyEvent(t *testing.T) {
 		AppliedToGroups: []string{"appliedToGroup1"},
 	}
 
+	policyInOtherNamespace := &types.NetworkPolicy{
+		Namespace:       "baz",
+		Name:            "bar",
+		SpanMeta:        types.SpanMeta{NodeNames: sets.NewString("node1")},
+		Rules:           policyV1.Rules,
+		AppliedToGroups: policyV1.AppliedToGroups,
+	}
+
 	testCases := map[string]struct {
 		fieldSelector fields.Selector
 		// The operations that will be executed on the store.
@@ -125,11 +133,46 @@ func TestWatchNetworkPolicyEvent(t *testing.T) {
 				}},
 			},
 		},
+		"namespace-scoped-watcher": {
+			// Only events of NetworkPolicies in namespace baz should be watched.
+			fieldSelector: fields.SelectorFromSet(fields.Set{"metadata.namespace": "baz"}),
+			operations: func(store storage.Interface) {
+				store.Create(policyV1)
+				store.Create(policyInOtherNamespace)
+				store.Delete("baz/bar")
+			},
+			expected: []watch.Event{
+				{Type: watch.Added, Object: &networking.NetworkPolicy{
+					ObjectMeta:      metav1.ObjectMeta{Namespace: "baz", Name: "bar"},
+					Rules:           policyInOtherNamespace.Rules,
+					AppliedToGroups: policyInOtherNamespace.AppliedToGroups,
+				}},
+				{Type: watch.Deleted, Object: &networking.NetworkPolicy{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "baz", Name: "bar"},
+				}},
+			},
+		},
+		"node-and-namespace-scoped-watcher": {
+			// Only events of NetworkPolicies in namespace foo that span node3 should be watched.
+			fieldSelector: fields.SelectorFromSet(fields.Set{"metadata.namespace": "foo", "nodeName": "node3"}),
+			operations: func(store storage.Interface) {
+				store.Create(policyInOtherNamespace)
+				store.Create(policyV1)
+				store.Update(policyV2)
+			},
+			expected: []watch.Event{
+				{Type: watch.Added, Object: &networking.NetworkPolicy{
+					ObjectMeta:      metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+					Rules:           policyV2.Rules,
+					AppliedToGroups: policyV2.AppliedToGroups,
+				}},
+			},
+		},
 	}
 	for name, testCase := range testCases {
 		t.Run(name, func(t *testing.T) {
 			store := NewNetworkPolicyStore()
-			w, err := store.Watch(context.Background(), "", labels.Everything(), testCase.fieldSelector)
+			w, err := store.Watch(context.Background(), "", &storage.Selectors{Label: labels.Everything(), Field: testCase.fieldSelector})
 			if err != nil {
 				t.Fatalf("Failed to watch object: %v", err)
 			}
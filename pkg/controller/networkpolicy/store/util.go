@@ -20,14 +20,16 @@ import (
 	"strconv"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	"github.com/vmware-tanzu/antrea/pkg/apis/networking"
 	"github.com/vmware-tanzu/antrea/pkg/apiserver/storage"
 )
 
-// filter returns whether the provided selectors matches the key and/or the nodeNames.
-func filter(selectors *storage.Selectors, key string, nodeNames sets.String) bool {
+// filter returns whether an object is selected by the provided selectors, given the object's key,
+// its fields, and the Nodes it spans.
+func filter(selectors *storage.Selectors, key string, objFields fields.Set, nodeNames sets.String) bool {
 	// If Key is present in selectors, the provided key must match it.
 	if selectors.Key != "" && key != selectors.Key {
 		return false
@@ -38,7 +40,14 @@ func filter(selectors *storage.Selectors, key string, nodeNames sets.String) boo
 			return false
 		}
 	}
-	return true
+	// nodeName is not a field of the object, the remaining requirements must match the provided fields.
+	fieldSelector, _ := selectors.Field.Transform(func(field, value string) (string, string, error) {
+		if field == "nodeName" {
+			return "", "", nil
+		}
+		return field, value, nil
+	})
+	return fieldSelector.Matches(objFields)
 }
 
 // IPStrToIPAddress converts an IP string to networkpolicy.IPAddress.
@@ -47,6 +56,11 @@ func IPStrToIPAddress(ip string) networking.IPAddress {
 	return networking.IPAddress(net.ParseIP(ip))
 }
 
+// groupFields returns the fields of an AddressGroup or AppliedToGroup that can be used in field selectors.
+func groupFields(name string) fields.Set {
+	return fields.Set{"metadata.name": name}
+}
+
 // CIDRStrToIPNet converts a CIDR (eg. 10.0.0.0/16) to a *networkpolicy.IPNet.
 func CIDRStrToIPNet(cidr string) (*networking.IPNet, error) {
 	// Split the cidr to retrieve the IP and prefix.
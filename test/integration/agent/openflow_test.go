@@ -37,6 +37,8 @@ var (
 )
 
 const (
+	// ctZone is distinct from the default zone to verify flows use the configured zone.
+	ctZone              = uint16(0xfff1)
 	ingressRuleTable    = uint8(90)
 	ingressDefaultTable = uint8(100)
 	contrackCommitTable = uint8(105)
@@ -77,7 +79,7 @@ type testConfig struct {
 }
 
 func TestConnectivityFlows(t *testing.T) {
-	c = ofClient.NewClient(br)
+	c = ofClient.NewClient(br, ctZone)
 	err := ofTestUtils.PrepareOVSBridge(br)
 	require.Nil(t, err, fmt.Sprintf("Failed to prepare OVS bridge: %v", err))
 	defer func() {
@@ -103,7 +105,7 @@ func TestConnectivityFlows(t *testing.T) {
 }
 
 func TestReplayFlowsConnectivityFlows(t *testing.T) {
-	c = ofClient.NewClient(br)
+	c = ofClient.NewClient(br, ctZone)
 	err := ofTestUtils.PrepareOVSBridge(br)
 	require.Nil(t, err, fmt.Sprintf("Failed to prepare OVS bridge: %v", err))
 
@@ -130,7 +132,7 @@ func TestReplayFlowsConnectivityFlows(t *testing.T) {
 }
 
 func TestReplayFlowsNetworkPolicyFlows(t *testing.T) {
-	c = ofClient.NewClient(br)
+	c = ofClient.NewClient(br, ctZone)
 	err := ofTestUtils.PrepareOVSBridge(br)
 	require.Nil(t, err, fmt.Sprintf("Failed to prepare OVS bridge: %v", err))
 
@@ -273,7 +275,7 @@ func testUninstallPodFlows(t *testing.T, config *testConfig) {
 }
 
 func TestNetworkPolicyFlows(t *testing.T) {
-	c = ofClient.NewClient(br)
+	c = ofClient.NewClient(br, ctZone)
 	err := ofTestUtils.PrepareOVSBridge(br)
 	require.Nil(t, err, fmt.Sprintf("Failed to prepare OVS bridge %s", br))
 
@@ -698,7 +700,7 @@ func prepareDefaultFlows() []expectTableFlows {
 		{
 			uint8(30),
 			[]*ofTestUtils.ExpectFlow{
-				{"priority=200,ip", "ct(table=31,zone=65520)"},
+				{"priority=200,ip", fmt.Sprintf("ct(table=31,zone=%d)", ctZone)},
 			},
 		},
 		{
@@ -740,8 +742,8 @@ func prepareDefaultFlows() []expectTableFlows {
 		{
 			uint8(105),
 			[]*ofTestUtils.ExpectFlow{
-				{"priority=200,ct_state=+new+trk,ip,reg0=0x1/0xffff", "ct(commit,table=110,zone=65520,exec(load:0x20->NXM_NX_CT_MARK[])"},
-				{"priority=190,ct_state=+new+trk,ip", "ct(commit,table=110,zone=65520)"},
+				{"priority=200,ct_state=+new+trk,ip,reg0=0x1/0xffff", fmt.Sprintf("ct(commit,table=110,zone=%d,exec(load:0x20->NXM_NX_CT_MARK[])", ctZone)},
+				{"priority=190,ct_state=+new+trk,ip", fmt.Sprintf("ct(commit,table=110,zone=%d)", ctZone)},
 				{"priority=0", "resubmit(,110)"}},
 		},
 		{